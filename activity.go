@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// StatefulSet annotations holding the autoscaler's last persisted activity.
+const (
+	lastActivityAnnotation      = "buildkitd-proxy/last-activity"
+	activeConnectionsAnnotation = "buildkitd-proxy/active-connections"
+	keepAliveLeasesAnnotation   = "buildkitd-proxy/keepalive-leases"
+)
+
+// activityPollInterval is how often the leader checks whether its activity needs persisting.
+const activityPollInterval = 15 * time.Second
+
+// activityRecord is the connection activity persisted across autoscaler restarts.
+type activityRecord struct {
+	// lastActivity is the last time a connection was open or a keep-alive lease held.
+	lastActivity time.Time
+	// connections is the number of connections open at lastActivity.
+	connections int64
+	// leases is the number of keep-alive leases held at lastActivity.
+	leases int
+}
+
+// active reports whether buildkitd was in use when the record was taken.
+func (r activityRecord) active() bool {
+	return r.connections > 0 || r.leases > 0
+}
+
+// activityStore persists an activityRecord, so a restarted autoscaler resumes the idle timer
+// rather than scaling buildkitd down in the middle of a build.
+type activityStore interface {
+	// LoadActivity returns the persisted record; ok is false if none was persisted.
+	LoadActivity() (record activityRecord, ok bool, err error)
+	// SaveActivity persists the record.
+	SaveActivity(ctx context.Context, record activityRecord) error
+}
+
+// LoadActivity reads the activity annotations from the cached StatefulSet.
+func (t kubeScaleTarget) LoadActivity() (activityRecord, bool, error) {
+	sts, err := t.cache.statefulSet()
+	if err != nil {
+		return activityRecord{}, false, err
+	}
+	return activityRecordOf(sts.Annotations)
+}
+
+// activityRecordOf parses the activity annotations. Missing annotations are not an error.
+func activityRecordOf(annotations map[string]string) (activityRecord, bool, error) {
+	last, ok := annotations[lastActivityAnnotation]
+	if !ok {
+		return activityRecord{}, false, nil
+	}
+	var record activityRecord
+	var err error
+	record.lastActivity, err = time.Parse(time.RFC3339, last)
+	if err != nil {
+		return activityRecord{}, false, fmt.Errorf("invalid %s annotation %q: %w", lastActivityAnnotation, last, err)
+	}
+	if n, ok := annotations[activeConnectionsAnnotation]; ok {
+		record.connections, err = strconv.ParseInt(n, 10, 64)
+		if err != nil {
+			return activityRecord{}, false, fmt.Errorf("invalid %s annotation %q: %w", activeConnectionsAnnotation, n, err)
+		}
+	}
+	if n, ok := annotations[keepAliveLeasesAnnotation]; ok {
+		record.leases, err = strconv.Atoi(n)
+		if err != nil {
+			return activityRecord{}, false, fmt.Errorf("invalid %s annotation %q: %w", keepAliveLeasesAnnotation, n, err)
+		}
+	}
+	return record, true, nil
+}
+
+// SaveActivity writes the activity annotations with a merge patch, leaving other annotations untouched.
+func (t kubeScaleTarget) SaveActivity(ctx context.Context, record activityRecord) error {
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]string{
+				lastActivityAnnotation:      record.lastActivity.UTC().Format(time.RFC3339),
+				activeConnectionsAnnotation: strconv.FormatInt(record.connections, 10),
+				keepAliveLeasesAnnotation:   strconv.Itoa(record.leases),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = t.clientset.AppsV1().StatefulSets(t.namespace).Patch(ctx, t.name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return fmt.Errorf("error saving activity on StatefulSet %s in namespace %s: %w", t.name, t.namespace, err)
+	}
+	return nil
+}
+
+// finalActivitySaveTimeout bounds the save persistActivity makes after its context is cancelled.
+const finalActivitySaveTimeout = 5 * time.Second
+
+// persistActivity saves the lifecycle's activity to store while this replica is the leader. It checks the
+// activity every interval but saves only when it differs by activityChanged, so the StatefulSet is not
+// patched throughout a long build. When ctx is cancelled it saves a final record, bounded by
+// finalActivitySaveTimeout, and returns.
+func persistActivity(ctx context.Context, lc *lifecycle, store activityStore, interval time.Duration) {
+	var saved activityRecord
+	save := func(ctx context.Context) {
+		if !lc.isLeading() {
+			// Another leader may overwrite the record in the meantime.
+			saved = activityRecord{}
+			return
+		}
+		record := lc.activity()
+		if record.lastActivity.IsZero() || !activityChanged(saved, record) {
+			return
+		}
+		if err := store.SaveActivity(ctx, record); err != nil {
+			logger.Warn("Failed to persist connection activity", "error", err)
+			return
+		}
+		saved = record
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			finalCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), finalActivitySaveTimeout)
+			save(finalCtx)
+			cancel()
+			return
+		case <-ticker.C:
+			save(ctx)
+		}
+	}
+}
+
+// activityChanged reports whether record needs persisting over saved: when buildkitd turned active or idle,
+// or its last activity moved while idle (e.g. a connection opened and closed between two checks). An active
+// record reads as active until the current time, so it is not re-saved while buildkitd stays in use.
+func activityChanged(saved, record activityRecord) bool {
+	if saved.active() || record.active() {
+		return saved.active() != record.active()
+	}
+	return !record.lastActivity.Equal(saved.lastActivity)
+}
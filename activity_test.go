@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// TestActivityRecordOf verifies parsing of the activity annotations.
+func TestActivityRecordOf(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        activityRecord
+		wantOK      bool
+		wantErr     bool
+	}{
+		{"none", nil, activityRecord{}, false, false},
+		{"both", map[string]string{lastActivityAnnotation: "2024-01-01T00:00:00Z", activeConnectionsAnnotation: "3"},
+			activityRecord{lastActivity: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), connections: 3}, true, false},
+		{"invalid time", map[string]string{lastActivityAnnotation: "yesterday"}, activityRecord{}, false, true},
+		{"leases", map[string]string{lastActivityAnnotation: "2024-01-01T00:00:00Z", activeConnectionsAnnotation: "0", keepAliveLeasesAnnotation: "2"},
+			activityRecord{lastActivity: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), leases: 2}, true, false},
+		{"invalid count", map[string]string{lastActivityAnnotation: "2024-01-01T00:00:00Z", activeConnectionsAnnotation: "many"}, activityRecord{}, false, true},
+		{"invalid leases", map[string]string{lastActivityAnnotation: "2024-01-01T00:00:00Z", keepAliveLeasesAnnotation: "some"}, activityRecord{}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok, err := activityRecordOf(tt.annotations)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("activityRecordOf() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if ok != tt.wantOK || got.connections != tt.want.connections || got.leases != tt.want.leases || !got.lastActivity.Equal(tt.want.lastActivity) {
+				t.Errorf("activityRecordOf() = %+v, %v, want %+v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+// TestKubeScaleTarget_Activity verifies that activity saved on the StatefulSet is read back from the cache.
+func TestKubeScaleTarget_Activity(t *testing.T) {
+	sts := newTestStatefulSet(testStsName, testNamespace, 1)
+	sts.Annotations = map[string]string{"unrelated": "kept"}
+	clientset := fake.NewSimpleClientset(sts)
+	c := startTestCache(t, clientset)
+	target := kubeScaleTarget{clientset: clientset, cache: c, namespace: testNamespace, name: testStsName, timeout: time.Second}
+
+	want := activityRecord{lastActivity: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC), connections: 4}
+	if err := target.SaveActivity(context.Background(), want); err != nil {
+		t.Fatalf("SaveActivity() error = %v", err)
+	}
+	waitFor(t, "the saved activity in the cache", func() bool {
+		got, ok, err := target.LoadActivity()
+		return err == nil && ok && got.connections == want.connections && got.lastActivity.Equal(want.lastActivity)
+	})
+
+	cached, err := c.statefulSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached.Annotations["unrelated"] != "kept" {
+		t.Errorf("SaveActivity() dropped other annotations: %v", cached.Annotations)
+	}
+}
+
+// TestPersistActivity verifies that the leader saves its activity, and saves a final record on shutdown.
+func TestPersistActivity(t *testing.T) {
+	lt := newLifecycleTest(t, testLifecyclePolicy, time.Minute)
+	store := &fakeActivityStore{}
+	lt.open(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		persistActivity(ctx, lt.lc, store, time.Hour)
+		close(done)
+	}()
+	cancel()
+	<-done
+
+	if !store.ok || store.record.connections != 1 || !store.record.lastActivity.Equal(lt.clock.Now()) {
+		t.Errorf("persisted record = %+v, %v, want 1 connection active now", store.record, store.ok)
+	}
+}
+
+// TestPersistActivity_OnStateChange verifies that activity is only saved when buildkitd turns active or idle,
+// not on every check while a build runs.
+func TestPersistActivity_OnStateChange(t *testing.T) {
+	lt := newLifecycleTest(t, testLifecyclePolicy, time.Minute)
+	store := &fakeActivityStore{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go persistActivity(ctx, lt.lc, store, time.Millisecond)
+
+	lt.open(1)
+	waitFor(t, "the active record", func() bool { record, _ := store.saved(); return record.active() })
+	lt.open(1)
+	lt.clock.Advance(time.Minute)
+	time.Sleep(20 * time.Millisecond)
+	if _, saves := store.saved(); saves != 1 {
+		t.Errorf("saves while buildkitd stays active = %d, want 1", saves)
+	}
+
+	lt.close(2)
+	closedAt := lt.clock.Now()
+	waitFor(t, "the idle record", func() bool { record, _ := store.saved(); return !record.active() })
+	if record, saves := store.saved(); saves != 2 || !record.lastActivity.Equal(closedAt) {
+		t.Errorf("idle record = %+v after %d saves, want last activity at %v after 2 saves", record, saves, closedAt)
+	}
+}
+
+// TestActivityChanged verifies which activity changes are persisted.
+func TestActivityChanged(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name          string
+		saved, record activityRecord
+		want          bool
+	}{
+		{"turned active", activityRecord{lastActivity: now}, activityRecord{lastActivity: now.Add(time.Minute), connections: 1}, true},
+		{"leased", activityRecord{lastActivity: now}, activityRecord{lastActivity: now.Add(time.Minute), leases: 1}, true},
+		{"still active", activityRecord{lastActivity: now, connections: 1}, activityRecord{lastActivity: now.Add(time.Hour), connections: 3}, false},
+		{"turned idle", activityRecord{lastActivity: now, connections: 1}, activityRecord{lastActivity: now.Add(time.Hour)}, true},
+		{"idle activity moved", activityRecord{lastActivity: now}, activityRecord{lastActivity: now.Add(time.Minute)}, true},
+		{"still idle", activityRecord{lastActivity: now}, activityRecord{lastActivity: now}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := activityChanged(tt.saved, tt.record); got != tt.want {
+				t.Errorf("activityChanged() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Paths of the admin endpoints, served on the admin listener, and of the peer endpoints through which the
+// admin API of one replica reaches the connections of the others, served on the health listener.
+const (
+	adminConnectionsPath = "/admin/connections"
+	peerConnectionsPath  = "/peer/connections"
+	// adminTargetsPath is followed by "/<namespace>/<name>/" and the override: wake, sleep or pin.
+	adminTargetsPath = "/admin/targets"
+)
+
+// peerRequestTimeout bounds each request the admin API makes to another replica.
+const peerRequestTimeout = 5 * time.Second
+
+// errUnknownConnection is returned when a connection to close does not exist, for example because it ended.
+var errUnknownConnection = errors.New("unknown connection")
+
+// connectionInfo is a live connection as listed by the admin API.
+type connectionInfo struct {
+	// Replica is the autoscaler pod the connection goes through. IDs are only unique within one replica.
+	Replica  string `json:"replica"`
+	ID       uint64 `json:"id"`
+	Listener string `json:"listener"`
+	// Target is the StatefulSet the connection is routed to, as "<namespace>/<name>".
+	Target     string `json:"target"`
+	ClientAddr string `json:"clientAddr"`
+	// BackendPod is empty while the connection is held for buildkitd to start.
+	BackendPod           string    `json:"backendPod,omitempty"`
+	StartTime            time.Time `json:"startTime"`
+	BytesClientToBackend int64     `json:"bytesClientToBackend"`
+	BytesBackendToClient int64     `json:"bytesBackendToClient"`
+	LastActivity         time.Time `json:"lastActivity"`
+}
+
+// connectionList is the response to listing connections.
+type connectionList struct {
+	Connections []connectionInfo `json:"connections"`
+	// Unreachable names the replicas whose connections could not be listed, for example while they restart.
+	Unreachable []string `json:"unreachable,omitempty"`
+}
+
+// pinRequest is the body of a PUT to a target's pin.
+type pinRequest struct {
+	// Duration is how long the pin lasts, e.g. "2h"; empty pins until the pin is removed.
+	Duration string `json:"duration"`
+	// Replicas fixes the replica count; zero keeps load-based scaling without scaling to zero.
+	Replicas int32 `json:"replicas"`
+}
+
+// connectionRef identifies a connection across replicas.
+type connectionRef struct {
+	Replica string `json:"replica"`
+	ID      uint64 `json:"id"`
+}
+
+// closedConnections is the response to closing connections.
+type closedConnections struct {
+	Closed []connectionRef `json:"closed"`
+	// Unreachable names the replicas whose connections could not be closed.
+	Unreachable []string `json:"unreachable,omitempty"`
+}
+
+// adminAPI serves the admin endpoints, which require a bearer token. With leader election it also covers the
+// connections of the other replicas, which it reaches through their peer endpoints.
+type adminAPI struct {
+	token       string
+	connections *connectionRegistry
+	// replica names this autoscaler pod in connection listings.
+	replica string
+	// peers, if set, returns the identities ("<pod>@<advertise address>") of the other replicas.
+	peers func() []string
+	// peerToken authenticates the requests to the other replicas' peer endpoints.
+	peerToken string
+	client    *http.Client
+	// targets are the StatefulSets that can be overridden, by key.
+	targets map[string]*buildkitdTarget
+}
+
+// newAdminAPI creates the admin API of the replica in the named pod over its live connections and the targets.
+func newAdminAPI(token string, connections *connectionRegistry, replica string, targets []*buildkitdTarget) *adminAPI {
+	a := &adminAPI{
+		token:       token,
+		connections: connections,
+		replica:     replica,
+		client:      &http.Client{},
+		targets:     make(map[string]*buildkitdTarget, len(targets)),
+	}
+	for _, t := range targets {
+		a.targets[t.key()] = t
+	}
+	return a
+}
+
+// handler returns the admin endpoints, each requiring the bearer token.
+func (a *adminAPI) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+adminConnectionsPath, a.serveListConnections)
+	mux.HandleFunc("DELETE "+adminConnectionsPath, a.serveCloseClientConnections)
+	mux.HandleFunc("DELETE "+adminConnectionsPath+"/{id}", a.serveCloseConnection)
+	mux.HandleFunc("POST "+adminTargetsPath+"/{namespace}/{name}/wake", a.serveWake)
+	mux.HandleFunc("POST "+adminTargetsPath+"/{namespace}/{name}/sleep", a.serveSleep)
+	mux.HandleFunc("PUT "+adminTargetsPath+"/{namespace}/{name}/pin", a.servePin)
+	mux.HandleFunc("DELETE "+adminTargetsPath+"/{namespace}/{name}/pin", a.serveUnpin)
+	return requireBearerToken(a.token, "buildkitd-proxy admin", mux)
+}
+
+// registerPeer adds the peer endpoints, which act on this replica's connections only, to mux. They require
+// the token shared by the replicas.
+func (a *adminAPI) registerPeer(mux *http.ServeMux) {
+	const realm = "buildkitd-proxy peers"
+	mux.Handle("GET "+peerConnectionsPath, requireBearerToken(a.peerToken, realm, http.HandlerFunc(a.servePeerListConnections)))
+	mux.Handle("DELETE "+peerConnectionsPath, requireBearerToken(a.peerToken, realm, http.HandlerFunc(a.servePeerCloseClientConnections)))
+	mux.Handle("DELETE "+peerConnectionsPath+"/{id}", requireBearerToken(a.peerToken, realm, http.HandlerFunc(a.servePeerCloseConnection)))
+}
+
+// serveListConnections lists the live connections of every replica, oldest first. The "client" query
+// parameter limits the list to the connections from one client IP address.
+func (a *adminAPI) serveListConnections(w http.ResponseWriter, r *http.Request) {
+	client := r.URL.Query().Get("client")
+	list := connectionList{Connections: a.localConnections(client)}
+	for _, identity := range a.otherReplicas() {
+		var infos []connectionInfo
+		if err := a.callPeer(r.Context(), http.MethodGet, identity, peerConnectionsPath+clientQuery(client), &infos); err != nil {
+			logger.Warn("Failed to list the connections of another autoscaler replica", "replica", identity, "error", err)
+			list.Unreachable = append(list.Unreachable, podNameOf(identity))
+			continue
+		}
+		list.Connections = append(list.Connections, infos...)
+	}
+	slices.SortStableFunc(list.Connections, func(a, b connectionInfo) int { return a.StartTime.Compare(b.StartTime) })
+	writeJSON(w, list)
+}
+
+// serveCloseConnection closes the connection with the ID in the path on the replica named by the "replica"
+// query parameter, this one if it is empty.
+func (a *adminAPI) serveCloseConnection(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid connection ID", http.StatusBadRequest)
+		return
+	}
+	replica := r.URL.Query().Get("replica")
+	if replica == "" || replica == a.replica {
+		a.writeLocalClose(w, id)
+		return
+	}
+	identity, ok := a.replicaIdentity(replica)
+	if !ok {
+		http.Error(w, "unknown replica", http.StatusNotFound)
+		return
+	}
+	var closed closedConnections
+	err = a.callPeer(r.Context(), http.MethodDelete, identity, peerConnectionsPath+"/"+strconv.FormatUint(id, 10), &closed)
+	switch {
+	case errors.Is(err, errUnknownConnection):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err != nil:
+		http.Error(w, "closing the connection on replica "+replica+": "+err.Error(), http.StatusBadGateway)
+	default:
+		writeJSON(w, closed)
+	}
+}
+
+// serveCloseClientConnections closes every connection from the client IP address in the "client" query
+// parameter, on every replica.
+func (a *adminAPI) serveCloseClientConnections(w http.ResponseWriter, r *http.Request) {
+	client := r.URL.Query().Get("client")
+	if client == "" {
+		http.Error(w, "the client query parameter is required", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, a.closeOnAllReplicas(r.Context(), url.Values{"client": {client}}))
+}
+
+// servePeerListConnections lists this replica's live connections for another replica's admin API.
+func (a *adminAPI) servePeerListConnections(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.localConnections(r.URL.Query().Get("client")))
+}
+
+// servePeerCloseConnection closes one of this replica's connections for another replica's admin API.
+func (a *adminAPI) servePeerCloseConnection(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid connection ID", http.StatusBadRequest)
+		return
+	}
+	a.writeLocalClose(w, id)
+}
+
+// servePeerCloseClientConnections closes this replica's connections from the client in the "client" query
+// parameter, or to the target in the "target" one, for another replica's admin API.
+func (a *adminAPI) servePeerCloseClientConnections(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("client") == "" && query.Get("target") == "" {
+		http.Error(w, "the client or target query parameter is required", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, closedConnections{Closed: a.closeLocal(query)})
+}
+
+// localConnections returns this replica's live connections, oldest first, limited to those from the client
+// IP address if it is not empty.
+func (a *adminAPI) localConnections(client string) []connectionInfo {
+	conns := a.connections.list()
+	if client != "" {
+		conns = a.connections.fromClient(client)
+	}
+	infos := make([]connectionInfo, 0, len(conns))
+	for _, c := range conns {
+		infos = append(infos, connectionInfo{
+			Replica:              a.replica,
+			ID:                   c.id,
+			Listener:             c.listener,
+			Target:               c.target,
+			ClientAddr:           c.client.String(),
+			BackendPod:           c.pod(),
+			StartTime:            c.started,
+			BytesClientToBackend: c.bytesToBackend.Load(),
+			BytesBackendToClient: c.bytesToClient.Load(),
+			LastActivity:         time.Unix(0, c.lastActivity.Load()),
+		})
+	}
+	return infos
+}
+
+// writeLocalClose closes this replica's connection with the given ID and responds with it.
+func (a *adminAPI) writeLocalClose(w http.ResponseWriter, id uint64) {
+	c := a.connections.get(id)
+	if c == nil {
+		http.Error(w, errUnknownConnection.Error(), http.StatusNotFound)
+		return
+	}
+	a.close(c)
+	writeJSON(w, closedConnections{Closed: []connectionRef{{Replica: a.replica, ID: c.id}}})
+}
+
+// closeOnAllReplicas closes the connections selected by query, from a "client" IP address or to a
+// "target", on this replica and every other one.
+func (a *adminAPI) closeOnAllReplicas(ctx context.Context, query url.Values) closedConnections {
+	closed := closedConnections{Closed: a.closeLocal(query)}
+	for _, identity := range a.otherReplicas() {
+		var peerClosed closedConnections
+		if err := a.callPeer(ctx, http.MethodDelete, identity, peerConnectionsPath+"?"+query.Encode(), &peerClosed); err != nil {
+			logger.Warn("Failed to close the connections of another autoscaler replica", "replica", identity, "selector", query.Encode(), "error", err)
+			closed.Unreachable = append(closed.Unreachable, podNameOf(identity))
+			continue
+		}
+		closed.Closed = append(closed.Closed, peerClosed.Closed...)
+	}
+	return closed
+}
+
+// closeLocal closes this replica's connections to the "target" in query, or else from its "client" IP
+// address.
+func (a *adminAPI) closeLocal(query url.Values) []connectionRef {
+	conns := a.connections.fromClient(query.Get("client"))
+	if target := query.Get("target"); target != "" {
+		conns = a.connections.forTarget(target)
+	}
+	closed := []connectionRef{}
+	for _, c := range conns {
+		a.close(c)
+		closed = append(closed, connectionRef{Replica: a.replica, ID: c.id})
+	}
+	return closed
+}
+
+// close ends c on an admin's request.
+func (a *adminAPI) close(c *trackedConnection) {
+	logger.Info("Closing connection on admin request.", "connectionID", c.id, "remoteAddr", c.client.String(), "target", c.target, "backendPod", c.pod())
+	c.close()
+}
+
+// otherReplicas returns the identities of the other replicas, none without leader election.
+func (a *adminAPI) otherReplicas() []string {
+	if a.peers == nil {
+		return nil
+	}
+	return a.peers()
+}
+
+// replicaIdentity returns the identity of the other replica running in the named pod.
+func (a *adminAPI) replicaIdentity(pod string) (string, bool) {
+	for _, identity := range a.otherReplicas() {
+		if podNameOf(identity) == pod {
+			return identity, true
+		}
+	}
+	return "", false
+}
+
+// callPeer sends a request to path on the peer endpoints of the replica with the given identity and decodes
+// its JSON response into out. A 404 response is returned as errUnknownConnection.
+func (a *adminAPI) callPeer(ctx context.Context, method, identity, path string, out any) error {
+	ctx, cancel := context.WithTimeout(ctx, peerRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, "http://"+advertiseAddrOf(identity)+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.peerToken)
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return json.NewDecoder(resp.Body).Decode(out)
+	case http.StatusNotFound:
+		return errUnknownConnection
+	default:
+		var msg bytes.Buffer
+		msg.ReadFrom(resp.Body)
+		return fmt.Errorf("replica responded %s: %s", resp.Status, strings.TrimSpace(msg.String()))
+	}
+}
+
+// clientQuery returns the query string limiting a request to the connections from client, if it is not empty.
+func clientQuery(client string) string {
+	if client == "" {
+		return ""
+	}
+	return "?client=" + url.QueryEscape(client)
+}
+
+// podNameOf returns the pod name part of a replica identity.
+func podNameOf(identity string) string {
+	pod, _, _ := strings.Cut(identity, "@")
+	return pod
+}
+
+// target returns the target named in the request path, or responds 404 and returns nil.
+func (a *adminAPI) target(w http.ResponseWriter, r *http.Request) *buildkitdTarget {
+	t, ok := a.targets[r.PathValue("namespace")+"/"+r.PathValue("name")]
+	if !ok {
+		http.Error(w, "unknown target", http.StatusNotFound)
+		return nil
+	}
+	return t
+}
+
+// serveWake scales the target up like a connection arriving at zero replicas would, and responds once it
+// is ready. The request fails with the scale-up's error if buildkitd does not become ready.
+func (a *adminAPI) serveWake(w http.ResponseWriter, r *http.Request) {
+	t := a.target(w, r)
+	if t == nil {
+		return
+	}
+	logger.Info("Waking StatefulSet on admin request.", "target", t.key())
+	if err := t.coldStarts.do(r.Context(), t.readyWaitTimeout, t.scaler.wake); err != nil {
+		logger.Error("Scale-up requested by an admin failed", "error", err, "cause", failureCause(err), "target", t.key())
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveSleep scales the target to zero now, removing any pin. With "force=true" it does so even with
+// connections active, closes the connections to the target on every replica and responds with them.
+func (a *adminAPI) serveSleep(w http.ResponseWriter, r *http.Request) {
+	t := a.target(w, r)
+	if t == nil {
+		return
+	}
+	force, err := strconv.ParseBool(cmp.Or(r.URL.Query().Get("force"), "false"))
+	if err != nil {
+		http.Error(w, "invalid force parameter", http.StatusBadRequest)
+		return
+	}
+	logger.Info("Putting StatefulSet to sleep on admin request.", "target", t.key(), "force", force)
+	if err := t.scaler.sleep(r.Context(), force); err != nil {
+		writeOverrideError(w, err)
+		return
+	}
+	closed := closedConnections{Closed: []connectionRef{}}
+	if force {
+		closed = a.closeOnAllReplicas(r.Context(), url.Values{"target": {t.key()}})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(closed); err != nil {
+		logger.Warn("Failed to write admin response", "error", err)
+	}
+}
+
+// servePin pins the target awake, for the duration in the body or until unpinned, optionally to a fixed
+// replica count. It replaces any previous pin and responds with the pin in effect.
+func (a *adminAPI) servePin(w http.ResponseWriter, r *http.Request) {
+	t := a.target(w, r)
+	if t == nil {
+		return
+	}
+	var req pinRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "invalid pin request", http.StatusBadRequest)
+		return
+	}
+	pin := pinState{replicas: req.Replicas}
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid pin duration", http.StatusBadRequest)
+			return
+		}
+		pin.until = time.Now().Add(d)
+	}
+	if err := t.scaler.setPin(r.Context(), pin); err != nil {
+		writeOverrideError(w, err)
+		return
+	}
+	writeJSON(w, pin.record())
+}
+
+// serveUnpin removes the target's pin and resumes load-based scaling.
+func (a *adminAPI) serveUnpin(w http.ResponseWriter, r *http.Request) {
+	t := a.target(w, r)
+	if t == nil {
+		return
+	}
+	if err := t.scaler.clearPin(r.Context()); err != nil {
+		writeOverrideError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeOverrideError responds with the error of a manual override.
+func writeOverrideError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, errInvalidPin):
+		code = http.StatusBadRequest
+	case errors.Is(err, errNotLeader), errors.Is(err, errActiveConnections), errors.Is(err, errTransitionInProgress):
+		code = http.StatusConflict
+	}
+	http.Error(w, err.Error(), code)
+}
+
+// writeJSON responds with v as JSON.
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Warn("Failed to write admin response", "error", err)
+	}
+}
+
+// startAdminServer serves the admin endpoints in handler on addr in the background.
+func startAdminServer(addr string, handler http.Handler) *http.Server {
+	srv := &http.Server{Addr: addr, Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		logger.Info("Admin server listening", "address", addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Admin server failed", "address", addr, "error", err)
+		}
+	}()
+	return srv
+}
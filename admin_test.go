@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const testAdminToken = "s3cret"
+
+// addTestConnection registers a connection from host:port and returns the client's end of it.
+func addTestConnection(t *testing.T, r *connectionRegistry, host string, port int) (*trackedConnection, net.Conn) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	conn := fakeAddrConn{Conn: server, remote: &net.TCPAddr{IP: net.ParseIP(host), Port: port}}
+	return r.add("default", testNamespace+"/"+testStsName, conn), client
+}
+
+// requireClosed fails the test unless the proxy closed its end of the connection whose client end is client.
+func requireClosed(t *testing.T, client net.Conn) {
+	t.Helper()
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read from client end = %v, want EOF after the connection was closed", err)
+	}
+}
+
+// callAdmin performs a request against the admin API with the given bearer token.
+func callAdmin(t *testing.T, a *adminAPI, method, path, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	return callAdminWithBody(t, a, method, path, token, "")
+}
+
+// callAdminWithBody performs a request with a body against the admin API with the given bearer token.
+func callAdminWithBody(t *testing.T, a *adminAPI, method, path, token, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequestWithContext(context.Background(), method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	a.handler().ServeHTTP(rec, req)
+	return rec
+}
+
+// newTestAdminAPI creates an admin API for the replica in the named pod, without other replicas.
+func newTestAdminAPI(replica string) *adminAPI {
+	return &adminAPI{token: testAdminToken, connections: newConnectionRegistry(), replica: replica, peerToken: testPeerToken, client: &http.Client{}}
+}
+
+// listConnections lists the connections through the admin API.
+func listConnections(t *testing.T, a *adminAPI, path string) connectionList {
+	t.Helper()
+	rec := callAdmin(t, a, http.MethodGet, path, testAdminToken)
+	var list connectionList
+	if err := json.NewDecoder(rec.Body).Decode(&list); err != nil {
+		t.Fatalf("decoding the connection list: %v", err)
+	}
+	return list
+}
+
+// closeConnections closes connections through the admin API and returns the status code and response.
+func closeConnections(t *testing.T, a *adminAPI, path string) (int, closedConnections) {
+	t.Helper()
+	rec := callAdmin(t, a, http.MethodDelete, path, testAdminToken)
+	var closed closedConnections
+	if rec.Code == http.StatusOK {
+		if err := json.NewDecoder(rec.Body).Decode(&closed); err != nil {
+			t.Fatalf("decoding the closed connections: %v", err)
+		}
+	}
+	return rec.Code, closed
+}
+
+// TestAdminAPI_Authentication verifies that every admin endpoint requires the bearer token.
+func TestAdminAPI_Authentication(t *testing.T) {
+	a := newTestAdminAPI("autoscaler-0")
+	for _, token := range []string{"", "wrong"} {
+		for _, req := range []struct{ method, path string }{
+			{http.MethodGet, adminConnectionsPath},
+			{http.MethodDelete, adminConnectionsPath + "/1"},
+			{http.MethodDelete, adminConnectionsPath + "?client=192.0.2.1"},
+		} {
+			if rec := callAdmin(t, a, req.method, req.path, token); rec.Code != http.StatusUnauthorized {
+				t.Errorf("%s %s with token %q = %d, want %d", req.method, req.path, token, rec.Code, http.StatusUnauthorized)
+			}
+		}
+	}
+	if rec := callAdmin(t, a, http.MethodGet, adminConnectionsPath, testAdminToken); rec.Code != http.StatusOK {
+		t.Errorf("GET %s with the token = %d, want %d", adminConnectionsPath, rec.Code, http.StatusOK)
+	}
+}
+
+// TestAdminAPI_ListConnections verifies that live connections are listed with their backend and byte counts.
+func TestAdminAPI_ListConnections(t *testing.T) {
+	a := newTestAdminAPI("autoscaler-0")
+	r := a.connections
+	held, _ := addTestConnection(t, r, "192.0.2.1", 40000)
+	proxied, _ := addTestConnection(t, r, "192.0.2.2", 40001)
+	backend, _ := net.Pipe()
+	defer backend.Close()
+	proxied.proxying(testStsName+"-1", backend)
+	io.Copy(io.Discard, proxied.reader(strings.NewReader("hello"), &proxied.bytesToBackend, proxiedBytes.WithLabelValues(directionClientToBackend)))
+
+	infos := listConnections(t, a, adminConnectionsPath).Connections
+	if len(infos) != 2 || infos[0].ID != held.id || infos[1].ID != proxied.id {
+		t.Fatalf("listed connections = %+v, want the held and proxied connections, oldest first", infos)
+	}
+	if infos[0].Replica != "autoscaler-0" || infos[0].BackendPod != "" || infos[0].ClientAddr != "192.0.2.1:40000" {
+		t.Errorf("held connection = %+v, want replica autoscaler-0, client 192.0.2.1:40000 and no backend pod", infos[0])
+	}
+	got := infos[1]
+	if got.BackendPod != testStsName+"-1" || got.BytesClientToBackend != 5 || got.BytesBackendToClient != 0 || got.Target != testNamespace+"/"+testStsName {
+		t.Errorf("proxied connection = %+v, want backend pod %s-1 and 5 bytes to the backend", got, testStsName)
+	}
+	if got.LastActivity.Before(got.StartTime) {
+		t.Errorf("last activity %v is before the start time %v", got.LastActivity, got.StartTime)
+	}
+
+	infos = listConnections(t, a, adminConnectionsPath+"?client=192.0.2.2").Connections
+	if len(infos) != 1 || infos[0].ID != proxied.id {
+		t.Errorf("connections from 192.0.2.2 = %+v, want only the proxied connection", infos)
+	}
+}
+
+// TestAdminAPI_CloseConnections verifies that a single connection or every connection of a client is closed.
+func TestAdminAPI_CloseConnections(t *testing.T) {
+	a := newTestAdminAPI("autoscaler-0")
+	r := a.connections
+	first, firstClient := addTestConnection(t, r, "192.0.2.1", 40000)
+	second, secondClient := addTestConnection(t, r, "192.0.2.1", 40001)
+	_, otherClient := addTestConnection(t, r, "192.0.2.2", 40000)
+
+	if code, _ := closeConnections(t, a, adminConnectionsPath+"/999"); code != http.StatusNotFound {
+		t.Errorf("DELETE of an unknown connection = %d, want %d", code, http.StatusNotFound)
+	}
+	if code, _ := closeConnections(t, a, adminConnectionsPath+"/1?replica=autoscaler-9"); code != http.StatusNotFound {
+		t.Errorf("DELETE on an unknown replica = %d, want %d", code, http.StatusNotFound)
+	}
+	if rec := callAdmin(t, a, http.MethodDelete, adminConnectionsPath, testAdminToken); rec.Code != http.StatusBadRequest {
+		t.Errorf("DELETE without a client = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	closeConnections(t, a, adminConnectionsPath+"/"+strconv.FormatUint(first.id, 10))
+	requireClosed(t, firstClient)
+
+	// The admin's close ends the connection; handleConnection unregisters it once it returns.
+	r.remove(first)
+	_, closed := closeConnections(t, a, adminConnectionsPath+"?client=192.0.2.1")
+	requireClosed(t, secondClient)
+	if want := []connectionRef{{Replica: "autoscaler-0", ID: second.id}}; !slices.Equal(closed.Closed, want) {
+		t.Errorf("closed connections = %v, want %v", closed.Closed, want)
+	}
+
+	otherClient.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := otherClient.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("read from another client's connection = %v, want it to stay open", err)
+	}
+}
+
+// TestAdminAPI_Overrides verifies waking, pinning, unpinning and sleeping a target, and the errors of each.
+func TestAdminAPI_Overrides(t *testing.T) {
+	lt := newPinTest(t, scalePolicy{targetConnectionsPerReplica: 1, minReplicas: 1, maxReplicas: 3}, &fakePinStore{}, 0)
+	target := &buildkitdTarget{
+		targetSpec: targetSpec{namespace: testNamespace, name: testStsName, readyWaitTimeout: time.Second},
+		coldStarts: newScaleUpGroup(defaultMaxPendingConnections),
+		scaler:     lt.lc,
+	}
+	r := newConnectionRegistry()
+	a := newAdminAPI(testAdminToken, r, "autoscaler-0", []*buildkitdTarget{target})
+	a.peerToken = testPeerToken
+	other := newTestAdminAPI("autoscaler-1")
+	mux := http.NewServeMux()
+	other.registerPeer(mux)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	a.peers = func() []string { return []string{"autoscaler-1@" + strings.TrimPrefix(srv.URL, "http://")} }
+	path := adminTargetsPath + "/" + testNamespace + "/" + testStsName
+
+	if rec := callAdmin(t, a, http.MethodPost, adminTargetsPath+"/"+testNamespace+"/unknown/wake", testAdminToken); rec.Code != http.StatusNotFound {
+		t.Errorf("wake of an unknown target = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if rec := callAdmin(t, a, http.MethodPost, path+"/wake", testAdminToken); rec.Code != http.StatusNoContent {
+		t.Fatalf("wake = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	lt.assertState(t, stateReady)
+	lt.assertScales(t, 1)
+
+	for _, body := range []string{`{"replicas":4}`, `{"duration":"-1h"}`, `pin`} {
+		if rec := callAdminWithBody(t, a, http.MethodPut, path+"/pin", testAdminToken, body); rec.Code != http.StatusBadRequest {
+			t.Errorf("pin with %s = %d, want %d", body, rec.Code, http.StatusBadRequest)
+		}
+	}
+	rec := callAdminWithBody(t, a, http.MethodPut, path+"/pin", testAdminToken, `{"duration":"2h","replicas":2}`)
+	var pin pinRecord
+	if err := json.NewDecoder(rec.Body).Decode(&pin); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("pin = %d, %v, want %d with the pin", rec.Code, err, http.StatusOK)
+	}
+	if pin.Replicas != 2 || pin.Until == nil {
+		t.Errorf("pin = %+v, want 2 replicas with an expiry", pin)
+	}
+	lt.assertScales(t, 1, 2)
+	if rec := callAdmin(t, a, http.MethodDelete, path+"/pin", testAdminToken); rec.Code != http.StatusNoContent {
+		t.Errorf("unpin = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+
+	tracked, client := addTestConnection(t, r, "192.0.2.1", 40000)
+	otherTracked, otherClient := addTestConnection(t, other.connections, "192.0.2.2", 40001)
+	lt.open(1)
+	if rec := callAdmin(t, a, http.MethodPost, path+"/sleep", testAdminToken); rec.Code != http.StatusConflict {
+		t.Errorf("sleep with an active connection = %d, want %d", rec.Code, http.StatusConflict)
+	}
+	rec = callAdmin(t, a, http.MethodPost, path+"/sleep?force=true", testAdminToken)
+	var closed closedConnections
+	if err := json.NewDecoder(rec.Body).Decode(&closed); err != nil || rec.Code != http.StatusAccepted {
+		t.Fatalf("forced sleep = %d, %v, want %d with the closed connections", rec.Code, err, http.StatusAccepted)
+	}
+	requireClosed(t, client)
+	requireClosed(t, otherClient)
+	if want := []connectionRef{{Replica: "autoscaler-0", ID: tracked.id}, {Replica: "autoscaler-1", ID: otherTracked.id}}; !slices.Equal(closed.Closed, want) {
+		t.Errorf("closed connections = %+v, want %v", closed.Closed, want)
+	}
+	r.remove(tracked)
+	lt.close(1)
+	lt.assertState(t, stateIdle)
+
+	lt.lc.stopLeading()
+	if rec := callAdmin(t, a, http.MethodPut, path+"/pin", testAdminToken); rec.Code != http.StatusConflict {
+		t.Errorf("pin on a follower without a leader = %d, want %d", rec.Code, http.StatusConflict)
+	}
+}
+
+// TestTrackedConnection_CloseBeforeDial verifies that a buildkitd connection dialed after an admin closed the
+// client connection is closed right away.
+func TestTrackedConnection_CloseBeforeDial(t *testing.T) {
+	c, _ := addTestConnection(t, newConnectionRegistry(), "192.0.2.1", 40000)
+	c.close()
+	backend, backendPeer := net.Pipe()
+	defer backendPeer.Close()
+	c.proxying(testStsName+"-0", backend)
+	requireClosed(t, backendPeer)
+}
+
+// TestAdminAPI_Replicas verifies that the admin API of one replica lists and closes the connections of the
+// others through their peer endpoints, and names the replicas it cannot reach.
+func TestAdminAPI_Replicas(t *testing.T) {
+	local, other := newTestAdminAPI("autoscaler-0"), newTestAdminAPI("autoscaler-1")
+	mux := http.NewServeMux()
+	other.registerPeer(mux)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	local.peers = func() []string {
+		return []string{"autoscaler-1@" + strings.TrimPrefix(srv.URL, "http://"), "autoscaler-2@" + strings.TrimPrefix(down.URL, "http://")}
+	}
+
+	localConn, localClient := addTestConnection(t, local.connections, "192.0.2.1", 40000)
+	otherConn, otherClient := addTestConnection(t, other.connections, "192.0.2.1", 40001)
+	_, otherClient2 := addTestConnection(t, other.connections, "192.0.2.2", 40002)
+
+	list := listConnections(t, local, adminConnectionsPath)
+	if len(list.Connections) != 3 || list.Connections[0].Replica != "autoscaler-0" || list.Connections[1].Replica != "autoscaler-1" {
+		t.Errorf("listed connections = %+v, want the local one and the two of autoscaler-1, oldest first", list.Connections)
+	}
+	if !slices.Equal(list.Unreachable, []string{"autoscaler-2"}) {
+		t.Errorf("unreachable replicas = %v, want [autoscaler-2]", list.Unreachable)
+	}
+
+	// IDs are per replica, so the same ID names different connections on each.
+	path := adminConnectionsPath + "/" + strconv.FormatUint(otherConn.id, 10)
+	if code, closed := closeConnections(t, local, path+"?replica=autoscaler-1"); code != http.StatusOK || len(closed.Closed) != 1 || closed.Closed[0].Replica != "autoscaler-1" {
+		t.Errorf("DELETE %s?replica=autoscaler-1 = %d, %+v, want the connection closed on autoscaler-1", path, code, closed)
+	}
+	requireClosed(t, otherClient)
+	other.connections.remove(otherConn)
+	if code, _ := closeConnections(t, local, path+"?replica=autoscaler-1"); code != http.StatusNotFound {
+		t.Errorf("DELETE of a connection that ended on autoscaler-1 = %d, want %d", code, http.StatusNotFound)
+	}
+
+	_, closed := closeConnections(t, local, adminConnectionsPath+"?client=192.0.2.1")
+	requireClosed(t, localClient)
+	if want := []connectionRef{{Replica: "autoscaler-0", ID: localConn.id}}; !slices.Equal(closed.Closed, want) || !slices.Equal(closed.Unreachable, []string{"autoscaler-2"}) {
+		t.Errorf("closed connections = %+v, want %v and autoscaler-2 unreachable", closed, want)
+	}
+	_, closed = closeConnections(t, local, adminConnectionsPath+"?client=192.0.2.2")
+	requireClosed(t, otherClient2)
+	if len(closed.Closed) != 1 || closed.Closed[0].Replica != "autoscaler-1" {
+		t.Errorf("closed connections = %+v, want the one of 192.0.2.2 on autoscaler-1", closed)
+	}
+}
+
+// TestAdminAPI_PeerAuthentication verifies that the peer endpoints require the token shared by the replicas,
+// not the admin token.
+func TestAdminAPI_PeerAuthentication(t *testing.T) {
+	mux := http.NewServeMux()
+	newTestAdminAPI("autoscaler-0").registerPeer(mux)
+	for _, token := range []string{"", testAdminToken, testPeerToken} {
+		req := httptest.NewRequestWithContext(context.Background(), http.MethodGet, peerConnectionsPath, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		want := http.StatusUnauthorized
+		if token == testPeerToken {
+			want = http.StatusOK
+		}
+		if rec.Code != want {
+			t.Errorf("GET %s with token %q = %d, want %d", peerConnectionsPath, token, rec.Code, want)
+		}
+	}
+}
+
+// TestCountingReader verifies that proxied bytes are counted on every read, before the stream ends.
+func TestCountingReader(t *testing.T) {
+	c, _ := addTestConnection(t, newConnectionRegistry(), "192.0.2.1", 40000)
+	counter := proxiedBytes.WithLabelValues(directionClientToBackend)
+	before := testutil.ToFloat64(counter)
+	r := c.reader(strings.NewReader("hello, buildkit"), &c.bytesToBackend, counter)
+
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(counter) - before; got != 5 || c.bytesToBackend.Load() != 5 {
+		t.Errorf("proxied bytes after the first read = %v and %d, want 5", got, c.bytesToBackend.Load())
+	}
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(counter) - before; got != 15 || c.bytesToBackend.Load() != 15 {
+		t.Errorf("proxied bytes after the whole stream = %v and %d, want 15", got, c.bytesToBackend.Load())
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestReadTokenFile verifies that the token is read without surrounding whitespace and must not be empty.
+func TestReadTokenFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "token")
+	os.WriteFile(path, []byte("s3cret\n"), 0o600)
+	if token, err := readTokenFile(path); err != nil || token != "s3cret" {
+		t.Errorf("readTokenFile() = %q, %v, want %q", token, err, "s3cret")
+	}
+	empty := filepath.Join(dir, "empty")
+	os.WriteFile(empty, []byte("\n"), 0o600)
+	if _, err := readTokenFile(empty); err == nil {
+		t.Error("readTokenFile() of an empty file expected an error, got nil")
+	}
+}
+
+// TestRequireBearerToken verifies that only requests carrying the token reach the wrapped handler.
+func TestRequireBearerToken(t *testing.T) {
+	handler := requireBearerToken("s3cret", "test", http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	tests := []struct {
+		authorization string
+		want          int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Basic s3cret", http.StatusUnauthorized},
+		{"Bearer s3cret", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.authorization != "" {
+			req.Header.Set("Authorization", tt.authorization)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("Authorization %q = %d, want %d", tt.authorization, rec.Code, tt.want)
+		}
+		if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") != `Bearer realm="test"` {
+			t.Errorf("Authorization %q challenge = %q, want the realm", tt.authorization, rec.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// balancingStrategy names the algorithm used to choose a buildkitd backend for a new connection.
+type balancingStrategy string
+
+// Supported load-balancing strategies.
+const (
+	// strategyRoundRobin cycles through the ready backends in ordinal order.
+	strategyRoundRobin balancingStrategy = "round-robin"
+	// strategyLeastConnections picks the backend with the fewest active proxied connections.
+	strategyLeastConnections balancingStrategy = "least-connections"
+	// strategyRandomTwoChoices samples two random backends and picks the less loaded of the two.
+	strategyRandomTwoChoices balancingStrategy = "random-two-choices"
+)
+
+// errNoReadyBackends is returned by backendPool.acquire when no non-draining backend is available for routing.
+var errNoReadyBackends = errors.New("no ready buildkitd backends")
+
+// parseBalancingStrategy validates a strategy name supplied via flag or environment variable.
+func parseBalancingStrategy(s string) (balancingStrategy, error) {
+	switch strategy := balancingStrategy(s); strategy {
+	case strategyRoundRobin, strategyLeastConnections, strategyRandomTwoChoices:
+		return strategy, nil
+	}
+	return "", fmt.Errorf("unknown load-balancing strategy %q (expected %s, %s or %s)",
+		s, strategyRoundRobin, strategyLeastConnections, strategyRandomTwoChoices)
+}
+
+// backend is a single buildkitd pod, identified by its StatefulSet ordinal.
+type backend struct {
+	// ordinal is the pod's StatefulSet ordinal (the N in <sts>-N).
+	ordinal int32
+	// addr is the host:port used to dial the pod.
+	addr string
+	// activeConnections is the number of connections currently proxied to this pod.
+	activeConnections atomic.Int64
+	// draining is set while the pod is about to be removed by a scale-down. Draining backends
+	// keep their existing connections but receive no new ones.
+	draining atomic.Bool
+}
+
+// release marks one connection previously handed out by backendPool.acquire as finished.
+func (b *backend) release() {
+	b.activeConnections.Add(-1)
+}
+
+// backendPool tracks the ready buildkitd pods and balances new connections across them.
+// Backends are kept across updates so their connection counters survive re-discovery.
+type backendPool struct {
+	mu       sync.Mutex
+	strategy balancingStrategy
+	// addrFor builds the dial address for a given ordinal.
+	addrFor func(ordinal int32) string
+	// backends holds the routable backends, sorted by ordinal.
+	backends []*backend
+	// known holds every backend seen so far, keyed by ordinal, so counters are preserved
+	// when a pod briefly drops out of the ready set.
+	known map[int32]*backend
+	// next is the round-robin cursor.
+	next uint64
+	rand *rand.Rand
+}
+
+// newBackendPool creates an empty pool using the given strategy and address builder.
+func newBackendPool(strategy balancingStrategy, addrFor func(ordinal int32) string) *backendPool {
+	return &backendPool{
+		strategy: strategy,
+		addrFor:  addrFor,
+		known:    make(map[int32]*backend),
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// update replaces the set of routable backends with the given ready ordinals.
+// The ordinals are expected in ascending order, as returned by the StatefulSet cache.
+func (p *backendPool) update(readyOrdinals []int32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	backends := make([]*backend, 0, len(readyOrdinals))
+	ready := make(map[int32]bool, len(readyOrdinals))
+	for _, ordinal := range readyOrdinals {
+		b, ok := p.known[ordinal]
+		if !ok {
+			b = &backend{ordinal: ordinal, addr: p.addrFor(ordinal)}
+			p.known[ordinal] = b
+		}
+		backends = append(backends, b)
+		ready[ordinal] = true
+	}
+	// A drained pod that has left the ready set is gone; if the ordinal comes back
+	// after a later scale-up it is a fresh pod that may receive connections again.
+	for ordinal, b := range p.known {
+		if !ready[ordinal] {
+			b.draining.Store(false)
+		}
+	}
+	p.backends = backends
+}
+
+// setDraining marks the backend with the given ordinal as draining (or not). It returns the
+// backend so callers can watch its connection count, creating it if it was not yet known.
+func (p *backendPool) setDraining(ordinal int32, draining bool) *backend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	b, ok := p.known[ordinal]
+	if !ok {
+		b = &backend{ordinal: ordinal, addr: p.addrFor(ordinal)}
+		p.known[ordinal] = b
+	}
+	b.draining.Store(draining)
+	return b
+}
+
+// acquire chooses a backend for a new connection according to the pool's strategy and
+// increments its connection counter. Callers must call release on the returned backend
+// once the connection is closed.
+func (p *backendPool) acquire() (*backend, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	routable := make([]*backend, 0, len(p.backends))
+	for _, b := range p.backends {
+		if !b.draining.Load() {
+			routable = append(routable, b)
+		}
+	}
+	if len(routable) == 0 {
+		return nil, errNoReadyBackends
+	}
+
+	var chosen *backend
+	switch p.strategy {
+	case strategyLeastConnections:
+		for _, b := range routable {
+			if chosen == nil || b.activeConnections.Load() < chosen.activeConnections.Load() {
+				chosen = b
+			}
+		}
+	case strategyRandomTwoChoices:
+		n := len(routable)
+		i := p.rand.Intn(n)
+		chosen = routable[i]
+		if n > 1 {
+			// Sample a second, distinct backend and keep the less loaded of the two.
+			other := routable[(i+1+p.rand.Intn(n-1))%n]
+			if other.activeConnections.Load() < chosen.activeConnections.Load() {
+				chosen = other
+			}
+		}
+	default: // strategyRoundRobin
+		chosen = routable[p.next%uint64(len(routable))]
+		p.next++
+	}
+
+	chosen.activeConnections.Add(1)
+	return chosen, nil
+}
+
+// connectionCounts returns the number of active connections per ordinal, omitting ordinals without any.
+func (p *backendPool) connectionCounts() map[int32]int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	counts := make(map[int32]int64)
+	for ordinal, b := range p.known {
+		if n := b.activeConnections.Load(); n > 0 {
+			counts[ordinal] = n
+		}
+	}
+	return counts
+}
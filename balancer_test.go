@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// testBackendAddr is a simple address builder used by the balancer tests.
+func testBackendAddr(ordinal int32) string {
+	return fmt.Sprintf("pod-%d:1234", ordinal)
+}
+
+// TestParseBalancingStrategy verifies that known strategies are accepted and unknown ones rejected.
+func TestParseBalancingStrategy(t *testing.T) {
+	for _, name := range []string{"round-robin", "least-connections", "random-two-choices"} {
+		if _, err := parseBalancingStrategy(name); err != nil {
+			t.Errorf("parseBalancingStrategy(%q) unexpected error: %v", name, err)
+		}
+	}
+	if _, err := parseBalancingStrategy("weighted"); err == nil {
+		t.Error("parseBalancingStrategy(\"weighted\") expected an error, got nil")
+	}
+}
+
+// TestBackendPool_Empty checks that acquiring from a pool without ready backends fails.
+func TestBackendPool_Empty(t *testing.T) {
+	pool := newBackendPool(strategyRoundRobin, testBackendAddr)
+	if _, err := pool.acquire(); !errors.Is(err, errNoReadyBackends) {
+		t.Errorf("acquire() error = %v, want %v", err, errNoReadyBackends)
+	}
+}
+
+// TestBackendPool_RoundRobin verifies that round-robin cycles through the ready ordinals in order.
+func TestBackendPool_RoundRobin(t *testing.T) {
+	pool := newBackendPool(strategyRoundRobin, testBackendAddr)
+	pool.update([]int32{0, 1, 2})
+
+	var got []int32
+	for i := 0; i < 6; i++ {
+		b, err := pool.acquire()
+		if err != nil {
+			t.Fatalf("acquire() unexpected error: %v", err)
+		}
+		got = append(got, b.ordinal)
+	}
+	want := []int32{0, 1, 2, 0, 1, 2}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("round-robin order = %v, want %v", got, want)
+		}
+	}
+}
+
+// TestBackendPool_LeastConnections verifies that the least loaded backend is chosen.
+func TestBackendPool_LeastConnections(t *testing.T) {
+	pool := newBackendPool(strategyLeastConnections, testBackendAddr)
+	pool.update([]int32{0, 1, 2})
+
+	// Three acquisitions should spread one connection to each backend.
+	seen := map[int32]bool{}
+	for i := 0; i < 3; i++ {
+		b, err := pool.acquire()
+		if err != nil {
+			t.Fatalf("acquire() unexpected error: %v", err)
+		}
+		seen[b.ordinal] = true
+	}
+	if len(seen) != 3 {
+		t.Fatalf("expected connections on 3 distinct backends, got %v", seen)
+	}
+
+	// Releasing a connection on ordinal 1 makes it the least loaded.
+	pool.known[1].release()
+	b, _ := pool.acquire()
+	if b.ordinal != 1 {
+		t.Errorf("acquire() picked ordinal %d, want 1", b.ordinal)
+	}
+}
+
+// TestBackendPool_RandomTwoChoices verifies that, with two backends, the less loaded one always wins.
+func TestBackendPool_RandomTwoChoices(t *testing.T) {
+	pool := newBackendPool(strategyRandomTwoChoices, testBackendAddr)
+	pool.update([]int32{0, 1})
+	pool.known[0].activeConnections.Store(5)
+
+	for i := 0; i < 10; i++ {
+		b, err := pool.acquire()
+		if err != nil {
+			t.Fatalf("acquire() unexpected error: %v", err)
+		}
+		if b.ordinal != 1 {
+			t.Fatalf("acquire() picked ordinal %d, want 1", b.ordinal)
+		}
+		b.release()
+	}
+}
+
+// TestBackendPool_UpdatePreservesCounters checks that connection counters survive re-discovery
+// and that backends no longer ready are not routed to.
+func TestBackendPool_UpdatePreservesCounters(t *testing.T) {
+	pool := newBackendPool(strategyLeastConnections, testBackendAddr)
+	pool.update([]int32{0})
+	b, _ := pool.acquire()
+
+	pool.update([]int32{0, 1})
+	if got := pool.known[0].activeConnections.Load(); got != 1 {
+		t.Errorf("ordinal 0 activeConnections = %d after update, want 1", got)
+	}
+	if next, _ := pool.acquire(); next.ordinal != 1 {
+		t.Errorf("acquire() picked ordinal %d, want 1", next.ordinal)
+	}
+
+	b.release()
+	pool.update([]int32{1})
+	for i := 0; i < 3; i++ {
+		if next, _ := pool.acquire(); next.ordinal != 1 {
+			t.Errorf("acquire() routed to ordinal %d, which is no longer ready", next.ordinal)
+		}
+	}
+	if pool.known[1].addr != "pod-1:1234" {
+		t.Errorf("backend addr = %q, want %q", pool.known[1].addr, "pod-1:1234")
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import "time"
+
+// clock abstracts the passage of time so that timer-driven logic can be unit tested
+// with a fake implementation.
+type clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// AfterFunc calls f in its own goroutine after d has elapsed, like time.AfterFunc.
+	AfterFunc(d time.Duration, f func()) timer
+}
+
+// timer is the subset of *time.Timer used by the autoscaler.
+type timer interface {
+	// Stop prevents the timer from firing. It returns false if the timer already fired or was stopped.
+	Stop() bool
+}
+
+// realClock is the clock backed by the time package.
+type realClock struct{}
+
+// Now returns time.Now().
+func (realClock) Now() time.Time { return time.Now() }
+
+// AfterFunc wraps time.AfterFunc.
+func (realClock) AfterFunc(d time.Duration, f func()) timer { return time.AfterFunc(d, f) }
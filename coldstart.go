@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Errors returned by scaleUpGroup.do when a connection cannot be held for a cold start.
+var (
+	// errColdStartQueueFull is returned when the maximum number of connections is already waiting.
+	errColdStartQueueFull = errors.New("too many connections waiting for buildkitd to start")
+	// errColdStartTimeout is returned when the shared scale-up does not finish within the caller's timeout.
+	errColdStartTimeout = errors.New("timed out waiting for buildkitd to start")
+	// errClientDisconnected cancels the wait of a held connection whose client went away.
+	errClientDisconnected = errors.New("client disconnected while waiting for buildkitd to start")
+)
+
+// maxHeldClientData bounds how much a client may send while its connection is held. Once it is reached the
+// connection is no longer watched for a disconnect, which only shows when reading.
+const maxHeldClientData = 1 << 20
+
+// scaleUpCall is a single in-flight scale-up shared by all connections waiting on it.
+type scaleUpCall struct {
+	// done is closed once the scale-up has finished.
+	done chan struct{}
+	// err is the result of the scale-up, valid once done is closed.
+	err error
+}
+
+// scaleUpGroup ensures that connections arriving while buildkitd is at zero ready replicas all wait
+// on one shared scale-up operation (singleflight) instead of each triggering or skipping their own.
+// The number of waiting connections is bounded so a burst cannot pile up unbounded goroutines.
+type scaleUpGroup struct {
+	mu sync.Mutex
+	// call is the in-flight scale-up, or nil if none is running.
+	call *scaleUpCall
+	// waiters is the number of connections currently blocked in do.
+	waiters int
+	// maxWaiters bounds waiters. Zero or less means unbounded.
+	maxWaiters int
+}
+
+// newScaleUpGroup creates a scaleUpGroup that holds at most maxWaiters connections at once.
+func newScaleUpGroup(maxWaiters int) *scaleUpGroup {
+	return &scaleUpGroup{maxWaiters: maxWaiters}
+}
+
+// do joins the in-flight scale-up, or starts one running fn if none is in flight, and blocks until
+// it finishes, timeout elapses or ctx is cancelled. The scale-up keeps running in the background if a
+// caller gives up, so the other callers and later ones can still benefit from it.
+//
+// fn runs with the context of the caller that started it, minus its cancellation, so the scale-up is traced
+// as part of that caller's trace.
+func (g *scaleUpGroup) do(ctx context.Context, timeout time.Duration, fn func(context.Context) error) error {
+	g.mu.Lock()
+	if g.maxWaiters > 0 && g.waiters >= g.maxWaiters {
+		g.mu.Unlock()
+		return fmt.Errorf("%w (limit %d)", errColdStartQueueFull, g.maxWaiters)
+	}
+	g.waiters++
+	call := g.call
+	if call == nil {
+		call = &scaleUpCall{done: make(chan struct{})}
+		g.call = call
+		go g.run(context.WithoutCancel(ctx), call, fn)
+	}
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		g.waiters--
+		g.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-call.done:
+		return call.err
+	case <-timer.C:
+		return fmt.Errorf("%w after %s", errColdStartTimeout, timeout)
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+// run executes fn for the given call and publishes its result to every waiter.
+func (g *scaleUpGroup) run(ctx context.Context, call *scaleUpCall, fn func(context.Context) error) {
+	call.err = fn(ctx)
+
+	g.mu.Lock()
+	g.call = nil
+	g.mu.Unlock()
+	close(call.done)
+}
+
+// clientWatch notices a client disconnecting while its connection is held for a cold start. A closed
+// socket only shows when reading, so it reads ahead from the connection and keeps what it read for buildkitd.
+type clientWatch struct {
+	conn   net.Conn
+	cancel context.CancelCauseFunc
+	// buf holds the bytes read ahead, valid once done is closed.
+	buf bytes.Buffer
+	// stopping is set by stop before it interrupts the read.
+	stopping atomic.Bool
+	done     chan struct{}
+}
+
+// watchClient returns a context derived from parent that is cancelled with errClientDisconnected when the
+// client closes conn. Call stop once the wait is over to take the connection back.
+func watchClient(parent context.Context, conn net.Conn) (context.Context, *clientWatch) {
+	ctx, cancel := context.WithCancelCause(parent)
+	w := &clientWatch{conn: conn, cancel: cancel, done: make(chan struct{})}
+	go w.read()
+	return ctx, w
+}
+
+// read reads ahead until the client closes the connection, the limit is reached or stop interrupts it.
+func (w *clientWatch) read() {
+	defer close(w.done)
+	n, err := io.Copy(&w.buf, io.LimitReader(w.conn, maxHeldClientData))
+	switch {
+	case w.stopping.Load():
+	case err == nil && n == maxHeldClientData:
+		// A client still sending is not going anywhere; stop watching and leave the rest in the socket.
+	case err == nil:
+		w.cancel(errClientDisconnected)
+	default:
+		w.cancel(fmt.Errorf("%w: %w", errClientDisconnected, err))
+	}
+}
+
+// stop ends the watch, cancels its context and returns the connection, which replays the bytes read ahead.
+func (w *clientWatch) stop() (net.Conn, error) {
+	w.stopping.Store(true)
+	// Interrupt the pending read. TLS connections stay usable after a read times out.
+	if err := w.conn.SetReadDeadline(time.Now()); err != nil {
+		return nil, err
+	}
+	<-w.done
+	w.cancel(nil)
+	if err := w.conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	return &peekedConn{Conn: w.conn, reader: io.MultiReader(&w.buf, w.conn)}, nil
+}
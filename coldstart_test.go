@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitForWaiters blocks until the group has exactly n callers waiting.
+func waitForWaiters(t *testing.T, g *scaleUpGroup, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		g.mu.Lock()
+		waiters := g.waiters
+		g.mu.Unlock()
+		if waiters == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d waiters", n)
+}
+
+// TestScaleUpGroup_SharesSingleScaleUp verifies that concurrent callers share one execution of fn
+// and all receive its result.
+func TestScaleUpGroup_SharesSingleScaleUp(t *testing.T) {
+	g := newScaleUpGroup(0)
+	var calls atomic.Int32
+	release := make(chan struct{})
+	fn := func(context.Context) error {
+		calls.Add(1)
+		<-release
+		return nil
+	}
+
+	const n = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- g.do(context.Background(), time.Second, fn)
+		}()
+	}
+
+	// Wait until every caller is queued before letting the scale-up finish.
+	waitForWaiters(t, g, n)
+	close(release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("do() unexpected error: %v", err)
+		}
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("fn called %d times, want 1", got)
+	}
+}
+
+// TestScaleUpGroup_PropagatesError verifies that the scale-up error is returned to the waiter and
+// that a new call starts a fresh scale-up afterwards.
+func TestScaleUpGroup_PropagatesError(t *testing.T) {
+	g := newScaleUpGroup(0)
+	wantErr := errors.New("scale failed")
+	if err := g.do(context.Background(), time.Second, func(context.Context) error { return wantErr }); !errors.Is(err, wantErr) {
+		t.Fatalf("do() error = %v, want %v", err, wantErr)
+	}
+	if err := g.do(context.Background(), time.Second, func(context.Context) error { return nil }); err != nil {
+		t.Errorf("do() after failed scale-up error = %v, want nil", err)
+	}
+}
+
+// TestScaleUpGroup_QueueFull verifies that callers beyond maxWaiters are rejected immediately.
+func TestScaleUpGroup_QueueFull(t *testing.T) {
+	g := newScaleUpGroup(1)
+	release := make(chan struct{})
+	defer close(release)
+
+	go g.do(context.Background(), time.Second, func(context.Context) error {
+		<-release
+		return nil
+	})
+	waitForWaiters(t, g, 1)
+
+	if err := g.do(context.Background(), time.Second, func(context.Context) error { return nil }); !errors.Is(err, errColdStartQueueFull) {
+		t.Errorf("do() error = %v, want %v", err, errColdStartQueueFull)
+	}
+}
+
+// TestScaleUpGroup_Timeout verifies that a caller gives up after its timeout while the scale-up
+// keeps running for later callers.
+func TestScaleUpGroup_Timeout(t *testing.T) {
+	g := newScaleUpGroup(0)
+	release := make(chan struct{})
+	var calls atomic.Int32
+	fn := func(context.Context) error {
+		calls.Add(1)
+		<-release
+		return nil
+	}
+
+	if err := g.do(context.Background(), 10*time.Millisecond, fn); !errors.Is(err, errColdStartTimeout) {
+		t.Fatalf("do() error = %v, want %v", err, errColdStartTimeout)
+	}
+
+	done := make(chan error)
+	go func() { done <- g.do(context.Background(), time.Second, fn) }()
+	waitForWaiters(t, g, 1)
+	close(release)
+	if err := <-done; err != nil {
+		t.Errorf("do() joining in-flight scale-up error = %v, want nil", err)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("fn called %d times, want 1", got)
+	}
+}
+
+// TestScaleUpGroup_Cancel verifies that a cancelled caller stops waiting with the cancellation cause while
+// the other callers still get the result of the scale-up.
+func TestScaleUpGroup_Cancel(t *testing.T) {
+	g := newScaleUpGroup(0)
+	release := make(chan struct{})
+	fn := func(context.Context) error {
+		<-release
+		return nil
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancelled := make(chan error)
+	go func() { cancelled <- g.do(ctx, time.Second, fn) }()
+	other := make(chan error)
+	go func() { other <- g.do(context.Background(), time.Second, fn) }()
+	waitForWaiters(t, g, 2)
+
+	cancel(errClientDisconnected)
+	if err := <-cancelled; !errors.Is(err, errClientDisconnected) {
+		t.Errorf("cancelled do() error = %v, want %v", err, errClientDisconnected)
+	}
+	close(release)
+	if err := <-other; err != nil {
+		t.Errorf("do() of the remaining caller error = %v, want nil", err)
+	}
+}
+
+// TestWatchClient verifies that a held client's disconnect cancels the wait, and that bytes read ahead while
+// watching are replayed once the watch stops.
+func TestWatchClient(t *testing.T) {
+	client, server := net.Pipe()
+	ctx, watch := watchClient(context.Background(), server)
+	go func(client net.Conn) {
+		client.Write([]byte("more"))
+		client.Close()
+	}(client)
+	<-ctx.Done()
+	if cause := context.Cause(ctx); !errors.Is(cause, errClientDisconnected) {
+		t.Errorf("context cause = %v, want %v", cause, errClientDisconnected)
+	}
+
+	client, server = net.Pipe()
+	defer client.Close()
+	ctx, watch = watchClient(context.Background(), server)
+	go client.Write([]byte("early"))
+	time.Sleep(20 * time.Millisecond)
+	conn, err := watch.stop()
+	if err != nil {
+		t.Fatalf("stop() error = %v", err)
+	}
+	if cause := context.Cause(ctx); errors.Is(cause, errClientDisconnected) {
+		t.Errorf("context cause = %v after stop, want a plain cancellation", cause)
+	}
+	go client.Write([]byte(" later"))
+	buf := make([]byte, len("early later"))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "early later" {
+		t.Errorf("read %q, %v from resumed connection, want %q", buf, err, "early later")
+	}
+}
@@ -0,0 +1,597 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+// config is the autoscaler's configuration, read from command-line flags and environment variables.
+type config struct {
+	// listenAddr is the address and port the proxy listens on without a config file.
+	listenAddr string
+	// target is the buildkitd StatefulSet configured by the BUILDKITD_* settings and the timeouts. Without a
+	// config file it is the single listener's target; listeners in the file default to its settings.
+	target targetSpec
+	// listeners are the validated listeners: the single one described by the flags, or those of configFile.
+	listeners []listenerSpec
+	// kubeconfigPath is the path to the kubeconfig file, used for out-of-cluster development.
+	kubeconfigPath string
+	// lbStrategy is the algorithm used to choose a buildkitd pod for each new connection.
+	lbStrategy balancingStrategy
+	// scalingPolicy is the load-based scaling policy.
+	scalingPolicy scalePolicy
+	// maxPendingConnections is the maximum number of connections held while waiting for a cold start.
+	maxPendingConnections int
+	// metricsAddr is the address and port of the Prometheus /metrics endpoint. Empty disables it.
+	metricsAddr string
+	// healthAddr is the address and port of the /healthz and /readyz endpoints. Empty disables them.
+	healthAddr string
+	// pipelineAddr is the address and port of the /prewarm and /keepalive endpoints pipelines call. Empty
+	// disables them.
+	pipelineAddr string
+	// pipelineTokenFile holds the bearer token the pipeline endpoints require.
+	pipelineTokenFile string
+	// adminAddr is the address and port of the authenticated admin API. Empty disables it.
+	adminAddr string
+	// adminTokenFile holds the bearer token the admin API requires.
+	adminTokenFile string
+	// tlsCertFile and tlsKeyFile are the certificate and key the proxy listener terminates TLS with. Empty serves plain TCP.
+	tlsCertFile string
+	tlsKeyFile  string
+	// tlsClientCAFile is the CA bundle client certificates must be signed by. Empty disables client authentication.
+	tlsClientCAFile string
+	// backendTLSCertFile, backendTLSKeyFile and backendTLSCAFile are the client certificate, key and CA used to
+	// originate TLS to buildkitd. Setting any of them, or backendTLSSecret, enables TLS to buildkitd.
+	backendTLSCertFile string
+	backendTLSKeyFile  string
+	backendTLSCAFile   string
+	// backendTLSSecret is a Secret in podNamespace holding tls.crt, tls.key and ca.crt for TLS to buildkitd.
+	backendTLSSecret string
+	// backendTLSServerName overrides the server name verified on buildkitd's certificate. Empty uses each pod's FQDN.
+	backendTLSServerName string
+	// leaderElect enables Lease-based leader election, so several autoscaler replicas can run at once.
+	leaderElect bool
+	// leaderElectionLeaseName is the name of the Lease used for leader election. Defaults to "<sts>-autoscaler".
+	leaderElectionLeaseName string
+	// advertiseAddr is the address other replicas use to reach this replica's health listener. Defaults to $POD_IP and the health port.
+	advertiseAddr string
+	// peerTokenFile holds the bearer token replicas authenticate to each other's leader endpoints with.
+	peerTokenFile string
+	// podNamespace is the autoscaler's own namespace, which holds the leader election Lease and the backend TLS
+	// Secret. Read from POD_NAMESPACE; defaults to the StatefulSet's namespace.
+	podNamespace string
+	// sniRoutes maps TLS server names to other buildkitd StatefulSets ("<name>=<ns>/<sts>[/<svc>[:<port>]]", comma-separated).
+	sniRoutes string
+	// configFile declares several listeners and their targets, replacing the single listener of the flags.
+	configFile string
+	// proxyProtocolTrustedCIDRs are the load balancers whose connections start with a PROXY protocol header.
+	// Empty disables the PROXY protocol.
+	proxyProtocolTrustedCIDRs []*net.IPNet
+	// backendProxyProtocol prepends a PROXY protocol v2 header to every connection to buildkitd.
+	backendProxyProtocol bool
+	// tcpKeepAlive configures TCP keep-alive probes on client and buildkitd connections. Disabled when Enable is false.
+	tcpKeepAlive net.KeepAliveConfig
+	// inactivityTimeout closes proxied connections after no bytes have flowed in either direction for this long. Zero disables it.
+	inactivityTimeout time.Duration
+	// maxKeepAliveTTL is the longest TTL a keep-alive lease may be acquired or renewed for, so a pipeline that
+	// dies without releasing its lease does not keep buildkitd awake for long.
+	maxKeepAliveTTL time.Duration
+	// probeCIDRs are the sources of load balancer health probes, whose connections are never proxied.
+	probeCIDRs []*net.IPNet
+	// otlpEndpoint is the OTLP/HTTP endpoint connection traces are exported to. Empty disables tracing.
+	otlpEndpoint string
+}
+
+// backendTLSFiles reports whether TLS to buildkitd uses certificate files rather than a Secret.
+func (c config) backendTLSFiles() bool {
+	return c.backendTLSCertFile != "" || c.backendTLSKeyFile != "" || c.backendTLSCAFile != ""
+}
+
+// loadConfig parses the command-line arguments (without the program name) and validates the result.
+// Environment variables read through getenv override the flags.
+func loadConfig(args []string, getenv func(string) string) (config, error) {
+	var cfg config
+	fs := flag.NewFlagSet("buildkitd-autoscaler", flag.ContinueOnError)
+	fs.StringVar(&cfg.listenAddr, "listen-addr", defaultProxyListenAddr, "Proxy listen address and port (e.g., :8080). Env: PROXY_LISTEN_ADDR")
+	fs.StringVar(&cfg.target.name, "sts-name", defaultBuildkitdStatefulSetName, "Name of the buildkitd StatefulSet. Env: BUILDKITD_STATEFULSET_NAME")
+	fs.StringVar(&cfg.target.namespace, "sts-namespace", defaultBuildkitdNamespace, "Namespace of the buildkitd StatefulSet. Env: BUILDKITD_STATEFULSET_NAMESPACE")
+	fs.StringVar(&cfg.target.headlessService, "headless-service-name", defaultBuildkitdHeadlessSvcName, "Name of the buildkitd Headless Service. Env: BUILDKITD_HEADLESS_SERVICE_NAME")
+	fs.StringVar(&cfg.target.port, "target-port", defaultBuildkitdTargetPort, "Target port on buildkitd pods. Env: BUILDKITD_TARGET_PORT")
+	scaleDownIdleTimeoutStr := fs.String("idle-timeout", defaultScaleDownIdleTimeoutStr, "Duration for scale-down idle timer (e.g., 2m0s). Env: SCALE_DOWN_IDLE_TIMEOUT")
+
+	defaultKubeconfig := ""
+	if home := homeDir(); home != "" {
+		defaultKubeconfig = filepath.Join(home, ".kube", "config")
+	}
+	fs.StringVar(&cfg.kubeconfigPath, "kubeconfig", defaultKubeconfig, "Path to the kubeconfig file (for out-of-cluster development). Env: KUBECONFIG_PATH")
+	lbStrategyStr := fs.String("lb-strategy", defaultBalancingStrategy, "Load-balancing strategy across ready buildkitd pods (round-robin, least-connections, random-two-choices). Env: LB_STRATEGY")
+	targetConnectionsStr := fs.String("target-connections-per-replica", strconv.Itoa(defaultTargetConnectionsPerReplica), "Concurrent connections each buildkitd replica should serve before scaling up. Env: TARGET_CONNECTIONS_PER_REPLICA")
+	minReplicasStr := fs.String("min-replicas", strconv.Itoa(defaultMinReplicas), "Minimum buildkitd replicas while there are active connections. Env: MIN_REPLICAS")
+	maxReplicasStr := fs.String("max-replicas", strconv.Itoa(defaultMaxReplicas), "Maximum buildkitd replicas. Env: MAX_REPLICAS")
+	scaleDownCooldownStr := fs.String("scale-down-cooldown", defaultScaleDownCooldownStr, "Cooldown after any scaling event before scaling down one step under load (e.g., 5m0s). Env: SCALE_DOWN_COOLDOWN")
+	readyWaitTimeoutStr := fs.String("ready-wait-timeout", defaultReadyWaitTimeoutStr, "Maximum time a connection waits for buildkitd to become ready after scaling up (e.g., 5m0s). Env: READY_WAIT_TIMEOUT")
+	maxPendingConnectionsStr := fs.String("max-pending-connections", strconv.Itoa(defaultMaxPendingConnections), "Maximum number of connections held while buildkitd is starting; further connections are closed. Env: MAX_PENDING_CONNECTIONS")
+	fs.StringVar(&cfg.metricsAddr, "metrics-addr", defaultMetricsListenAddr, "Listen address and port for the Prometheus /metrics endpoint; empty disables it. Env: METRICS_LISTEN_ADDR")
+	fs.StringVar(&cfg.healthAddr, "health-addr", defaultHealthListenAddr, "Listen address and port for the /healthz and /readyz endpoints; empty disables them. Env: HEALTH_LISTEN_ADDR")
+	fs.StringVar(&cfg.pipelineAddr, "pipeline-addr", "", "Listen address and port for the /prewarm and /keepalive endpoints pipelines call; empty disables them. Env: PIPELINE_LISTEN_ADDR")
+	fs.StringVar(&cfg.pipelineTokenFile, "pipeline-token-file", "", "File holding the bearer token the pipeline endpoints require. Env: PIPELINE_TOKEN_FILE")
+	fs.StringVar(&cfg.adminAddr, "admin-addr", "", "Listen address and port for the authenticated admin API; empty disables it. Env: ADMIN_LISTEN_ADDR")
+	fs.StringVar(&cfg.adminTokenFile, "admin-token-file", "", "File holding the bearer token the admin API requires. Env: ADMIN_TOKEN_FILE")
+	fs.StringVar(&cfg.tlsCertFile, "tls-cert-file", defaultTLSCertFile, "TLS certificate file for the proxy listener; reloaded when it changes. Empty serves plain TCP. Env: TLS_CERT_FILE")
+	fs.StringVar(&cfg.tlsKeyFile, "tls-key-file", "", "TLS private key file for the proxy listener. Env: TLS_KEY_FILE")
+	fs.StringVar(&cfg.tlsClientCAFile, "tls-client-ca-file", "", "CA bundle that client certificates must be signed by; enables mTLS. Env: TLS_CLIENT_CA_FILE")
+	fs.StringVar(&cfg.backendTLSCertFile, "backend-tls-cert-file", "", "Client certificate file for TLS to buildkitd. Env: BACKEND_TLS_CERT_FILE")
+	fs.StringVar(&cfg.backendTLSKeyFile, "backend-tls-key-file", "", "Client key file for TLS to buildkitd. Env: BACKEND_TLS_KEY_FILE")
+	fs.StringVar(&cfg.backendTLSCAFile, "backend-tls-ca-file", "", "CA bundle buildkitd's certificate must be signed by. Env: BACKEND_TLS_CA_FILE")
+	fs.StringVar(&cfg.backendTLSSecret, "backend-tls-secret", "", "Secret (tls.crt, tls.key, ca.crt) in the autoscaler's namespace for TLS to buildkitd, instead of files. Env: BACKEND_TLS_SECRET")
+	fs.StringVar(&cfg.backendTLSServerName, "backend-tls-server-name", "", "Server name to verify on buildkitd's certificate (default: each pod's FQDN). Env: BACKEND_TLS_SERVER_NAME")
+	leaderElectStr := fs.String("leader-elect", strconv.FormatBool(defaultLeaderElect), "Elect a leader among autoscaler replicas with a Lease; only the leader scales buildkitd. Env: LEADER_ELECT")
+	fs.StringVar(&cfg.leaderElectionLeaseName, "leader-election-lease-name", "", "Name of the leader election Lease (default <sts-name>-autoscaler). Env: LEADER_ELECTION_LEASE_NAME")
+	fs.StringVar(&cfg.advertiseAddr, "advertise-addr", "", "Address and port other autoscaler replicas use to reach this replica's health listener (default $POD_IP with the health port). Env: ADVERTISE_ADDR")
+	fs.StringVar(&cfg.peerTokenFile, "peer-token-file", "", "File holding the bearer token shared by all autoscaler replicas for the leader endpoints; required with leader election. Env: PEER_TOKEN_FILE")
+	fs.StringVar(&cfg.sniRoutes, "sni-routes", "", "Route TLS connections by server name without terminating TLS, as comma-separated <server name>=<namespace>/<statefulset>[/<headless service>[:<port>]] entries. Unmatched connections go to the default StatefulSet. Env: SNI_ROUTES")
+	fs.StringVar(&cfg.configFile, "config", "", "YAML or JSON file declaring several listeners, each with its own target StatefulSet and timeouts; replaces -listen-addr and -sni-routes. Env: CONFIG_FILE")
+	proxyProtocolTrustedCIDRsStr := fs.String("proxy-protocol-trusted-cidrs", "", "Comma-separated CIDRs of load balancers that send a PROXY protocol v1/v2 header; empty disables the PROXY protocol. Env: PROXY_PROTOCOL_TRUSTED_CIDRS")
+	tcpKeepAliveIdleStr := fs.String("tcp-keepalive-idle", defaultTCPKeepAliveIdleStr, "Idle time before TCP keep-alive probes are sent on client and buildkitd connections; 0 disables keep-alive. Env: TCP_KEEPALIVE_IDLE")
+	tcpKeepAliveIntervalStr := fs.String("tcp-keepalive-interval", defaultTCPKeepAliveIntervalStr, "Time between unanswered TCP keep-alive probes. Env: TCP_KEEPALIVE_INTERVAL")
+	tcpKeepAliveCountStr := fs.String("tcp-keepalive-count", strconv.Itoa(defaultTCPKeepAliveCount), "Unanswered TCP keep-alive probes before a connection is dropped. Env: TCP_KEEPALIVE_COUNT")
+	inactivityTimeoutStr := fs.String("inactivity-timeout", defaultInactivityTimeoutStr, "Close proxied connections after no bytes flow in either direction for this long (e.g., 1h0m0s); 0 disables it. Env: INACTIVITY_TIMEOUT")
+	maxKeepAliveTTLStr := fs.String("max-keepalive-ttl", defaultMaxKeepAliveTTLStr, "Longest TTL a keep-alive lease may be acquired or renewed for (e.g., 1h0m0s). Env: MAX_KEEPALIVE_TTL")
+	probeCIDRsStr := fs.String("probe-cidrs", "", "Comma-separated CIDRs of load balancer health probes; their connections are closed without waking buildkitd. Env: PROBE_CIDRS")
+	backendProxyProtocolStr := fs.String("backend-proxy-protocol", "false", "Send a PROXY protocol v2 header with the client address, target and client identity on every connection to buildkitd. Env: BACKEND_PROXY_PROTOCOL")
+	fs.StringVar(&cfg.otlpEndpoint, "otlp-endpoint", "", "OTLP/HTTP endpoint to export a trace of every proxied connection to (e.g., http://otel-collector:4318); empty disables tracing. Env: OTLP_ENDPOINT")
+	drainTimeoutStr := fs.String("drain-timeout", defaultDrainTimeoutStr, "Maximum time to wait for the highest-ordinal pod's connections to finish before scaling down one step (e.g., 10m0s). Env: DRAIN_TIMEOUT")
+
+	if err := fs.Parse(args); err != nil {
+		return config{}, err
+	}
+
+	// Override with environment variables if set
+	if envVal := getenv("PROXY_LISTEN_ADDR"); envVal != "" {
+		cfg.listenAddr = envVal
+	}
+	if envVal := getenv("BUILDKITD_STATEFULSET_NAME"); envVal != "" {
+		cfg.target.name = envVal
+	}
+	if envVal := getenv("BUILDKITD_STATEFULSET_NAMESPACE"); envVal != "" {
+		cfg.target.namespace = envVal
+	}
+	if envVal := getenv("BUILDKITD_HEADLESS_SERVICE_NAME"); envVal != "" {
+		cfg.target.headlessService = envVal
+	}
+	if envVal := getenv("BUILDKITD_TARGET_PORT"); envVal != "" {
+		cfg.target.port = envVal
+	}
+	if envVal := getenv("SCALE_DOWN_IDLE_TIMEOUT"); envVal != "" {
+		*scaleDownIdleTimeoutStr = envVal
+	}
+	if envVal := getenv("KUBECONFIG_PATH"); envVal != "" {
+		cfg.kubeconfigPath = envVal
+	}
+	if envVal := getenv("LB_STRATEGY"); envVal != "" {
+		*lbStrategyStr = envVal
+	}
+	if envVal := getenv("TARGET_CONNECTIONS_PER_REPLICA"); envVal != "" {
+		*targetConnectionsStr = envVal
+	}
+	if envVal := getenv("MIN_REPLICAS"); envVal != "" {
+		*minReplicasStr = envVal
+	}
+	if envVal := getenv("MAX_REPLICAS"); envVal != "" {
+		*maxReplicasStr = envVal
+	}
+	if envVal := getenv("SCALE_DOWN_COOLDOWN"); envVal != "" {
+		*scaleDownCooldownStr = envVal
+	}
+	if envVal := getenv("DRAIN_TIMEOUT"); envVal != "" {
+		*drainTimeoutStr = envVal
+	}
+	if envVal := getenv("READY_WAIT_TIMEOUT"); envVal != "" {
+		*readyWaitTimeoutStr = envVal
+	}
+	if envVal := getenv("MAX_PENDING_CONNECTIONS"); envVal != "" {
+		*maxPendingConnectionsStr = envVal
+	}
+	if envVal := getenv("METRICS_LISTEN_ADDR"); envVal != "" {
+		cfg.metricsAddr = envVal
+	}
+	if envVal := getenv("HEALTH_LISTEN_ADDR"); envVal != "" {
+		cfg.healthAddr = envVal
+	}
+	if envVal := getenv("PIPELINE_LISTEN_ADDR"); envVal != "" {
+		cfg.pipelineAddr = envVal
+	}
+	if envVal := getenv("PIPELINE_TOKEN_FILE"); envVal != "" {
+		cfg.pipelineTokenFile = envVal
+	}
+	if envVal := getenv("ADMIN_LISTEN_ADDR"); envVal != "" {
+		cfg.adminAddr = envVal
+	}
+	if envVal := getenv("ADMIN_TOKEN_FILE"); envVal != "" {
+		cfg.adminTokenFile = envVal
+	}
+	if envVal := getenv("TLS_CERT_FILE"); envVal != "" {
+		cfg.tlsCertFile = envVal
+	}
+	if envVal := getenv("TLS_KEY_FILE"); envVal != "" {
+		cfg.tlsKeyFile = envVal
+	}
+	if envVal := getenv("TLS_CLIENT_CA_FILE"); envVal != "" {
+		cfg.tlsClientCAFile = envVal
+	}
+	if envVal := getenv("BACKEND_TLS_CERT_FILE"); envVal != "" {
+		cfg.backendTLSCertFile = envVal
+	}
+	if envVal := getenv("BACKEND_TLS_KEY_FILE"); envVal != "" {
+		cfg.backendTLSKeyFile = envVal
+	}
+	if envVal := getenv("BACKEND_TLS_CA_FILE"); envVal != "" {
+		cfg.backendTLSCAFile = envVal
+	}
+	if envVal := getenv("BACKEND_TLS_SECRET"); envVal != "" {
+		cfg.backendTLSSecret = envVal
+	}
+	if envVal := getenv("BACKEND_TLS_SERVER_NAME"); envVal != "" {
+		cfg.backendTLSServerName = envVal
+	}
+	if envVal := getenv("LEADER_ELECT"); envVal != "" {
+		*leaderElectStr = envVal
+	}
+	if envVal := getenv("LEADER_ELECTION_LEASE_NAME"); envVal != "" {
+		cfg.leaderElectionLeaseName = envVal
+	}
+	if envVal := getenv("ADVERTISE_ADDR"); envVal != "" {
+		cfg.advertiseAddr = envVal
+	}
+	if envVal := getenv("PEER_TOKEN_FILE"); envVal != "" {
+		cfg.peerTokenFile = envVal
+	}
+	if envVal := getenv("SNI_ROUTES"); envVal != "" {
+		cfg.sniRoutes = envVal
+	}
+	cfg.podNamespace = getenv("POD_NAMESPACE")
+	if cfg.podNamespace == "" {
+		cfg.podNamespace = cfg.target.namespace
+	}
+	if envVal := getenv("CONFIG_FILE"); envVal != "" {
+		cfg.configFile = envVal
+	}
+	if envVal := getenv("PROXY_PROTOCOL_TRUSTED_CIDRS"); envVal != "" {
+		*proxyProtocolTrustedCIDRsStr = envVal
+	}
+	if envVal := getenv("BACKEND_PROXY_PROTOCOL"); envVal != "" {
+		*backendProxyProtocolStr = envVal
+	}
+	if envVal := getenv("PROBE_CIDRS"); envVal != "" {
+		*probeCIDRsStr = envVal
+	}
+	if envVal := getenv("TCP_KEEPALIVE_IDLE"); envVal != "" {
+		*tcpKeepAliveIdleStr = envVal
+	}
+	if envVal := getenv("TCP_KEEPALIVE_INTERVAL"); envVal != "" {
+		*tcpKeepAliveIntervalStr = envVal
+	}
+	if envVal := getenv("TCP_KEEPALIVE_COUNT"); envVal != "" {
+		*tcpKeepAliveCountStr = envVal
+	}
+	if envVal := getenv("INACTIVITY_TIMEOUT"); envVal != "" {
+		*inactivityTimeoutStr = envVal
+	}
+	if envVal := getenv("MAX_KEEPALIVE_TTL"); envVal != "" {
+		*maxKeepAliveTTLStr = envVal
+	}
+	if envVal := getenv("OTLP_ENDPOINT"); envVal != "" {
+		cfg.otlpEndpoint = envVal
+	}
+
+	var err error
+	cfg.target.idleTimeout, err = time.ParseDuration(*scaleDownIdleTimeoutStr)
+	if err != nil {
+		return config{}, fmt.Errorf("invalid SCALE_DOWN_IDLE_TIMEOUT value %q: %w", *scaleDownIdleTimeoutStr, err)
+	}
+	cfg.lbStrategy, err = parseBalancingStrategy(*lbStrategyStr)
+	if err != nil {
+		return config{}, fmt.Errorf("invalid LB_STRATEGY value: %w", err)
+	}
+
+	cfg.scalingPolicy.targetConnectionsPerReplica, err = strconv.ParseInt(*targetConnectionsStr, 10, 64)
+	if err != nil {
+		return config{}, fmt.Errorf("invalid TARGET_CONNECTIONS_PER_REPLICA value %q: %w", *targetConnectionsStr, err)
+	}
+	minReplicas, err := strconv.ParseInt(*minReplicasStr, 10, 32)
+	if err != nil {
+		return config{}, fmt.Errorf("invalid MIN_REPLICAS value %q: %w", *minReplicasStr, err)
+	}
+	maxReplicas, err := strconv.ParseInt(*maxReplicasStr, 10, 32)
+	if err != nil {
+		return config{}, fmt.Errorf("invalid MAX_REPLICAS value %q: %w", *maxReplicasStr, err)
+	}
+	cfg.scalingPolicy.minReplicas, cfg.scalingPolicy.maxReplicas = int32(minReplicas), int32(maxReplicas)
+	cfg.scalingPolicy.scaleDownCooldown, err = time.ParseDuration(*scaleDownCooldownStr)
+	if err != nil {
+		return config{}, fmt.Errorf("invalid SCALE_DOWN_COOLDOWN value %q: %w", *scaleDownCooldownStr, err)
+	}
+	cfg.scalingPolicy.drainTimeout, err = time.ParseDuration(*drainTimeoutStr)
+	if err != nil {
+		return config{}, fmt.Errorf("invalid DRAIN_TIMEOUT value %q: %w", *drainTimeoutStr, err)
+	}
+	if err := cfg.scalingPolicy.validate(); err != nil {
+		return config{}, fmt.Errorf("invalid scaling policy: %w", err)
+	}
+	cfg.target.readyWaitTimeout, err = time.ParseDuration(*readyWaitTimeoutStr)
+	if err != nil {
+		return config{}, fmt.Errorf("invalid READY_WAIT_TIMEOUT value %q: %w", *readyWaitTimeoutStr, err)
+	}
+	cfg.maxPendingConnections, err = strconv.Atoi(*maxPendingConnectionsStr)
+	if err != nil {
+		return config{}, fmt.Errorf("invalid MAX_PENDING_CONNECTIONS value %q: %w", *maxPendingConnectionsStr, err)
+	}
+	if (cfg.tlsCertFile == "") != (cfg.tlsKeyFile == "") || (cfg.tlsClientCAFile != "" && cfg.tlsCertFile == "") {
+		return config{}, errors.New("invalid TLS configuration: TLS_CERT_FILE and TLS_KEY_FILE must be set together, and TLS_CLIENT_CA_FILE requires them")
+	}
+	if (cfg.backendTLSCertFile == "") != (cfg.backendTLSKeyFile == "") || (cfg.backendTLSFiles() && cfg.backendTLSSecret != "") {
+		return config{}, errors.New("invalid backend TLS configuration: BACKEND_TLS_CERT_FILE and BACKEND_TLS_KEY_FILE must be set together, and files cannot be combined with BACKEND_TLS_SECRET")
+	}
+
+	// Without a config file the flags describe a single listener.
+	if cfg.configFile != "" {
+		if cfg.sniRoutes != "" {
+			return config{}, errors.New("SNI_ROUTES cannot be combined with CONFIG_FILE; set sniRoutes on the listeners in the config file")
+		}
+		cfg.listeners, err = loadConfigFile(cfg.configFile, cfg.target)
+		if err != nil {
+			return config{}, fmt.Errorf("invalid CONFIG_FILE: %w", err)
+		}
+	} else {
+		spec := listenerSpec{name: "default", address: cfg.listenAddr, target: cfg.target}
+		if cfg.sniRoutes != "" {
+			routes, err := parseSNIRoutes(cfg.sniRoutes, cfg.target.port)
+			if err != nil {
+				return config{}, fmt.Errorf("invalid SNI_ROUTES value %q: %w", cfg.sniRoutes, err)
+			}
+			spec.sniRoutes = withTimeouts(routes, cfg.target)
+		}
+		cfg.listeners = []listenerSpec{spec}
+	}
+	for _, spec := range cfg.listeners {
+		if spec.sniRoutes != nil && (cfg.tlsCertFile != "" || cfg.backendTLSFiles() || cfg.backendTLSSecret != "") {
+			return config{}, fmt.Errorf("listener %s: SNI routes pass TLS through to buildkitd and cannot be combined with TLS_CERT_FILE or backend TLS", spec.name)
+		}
+	}
+	if cfg.adminAddr != "" && cfg.adminTokenFile == "" {
+		return config{}, errors.New("the admin API requires a bearer token; set ADMIN_TOKEN_FILE")
+	}
+	if cfg.pipelineAddr != "" && cfg.pipelineTokenFile == "" {
+		return config{}, errors.New("the pipeline endpoints require a bearer token; set PIPELINE_TOKEN_FILE")
+	}
+	if *proxyProtocolTrustedCIDRsStr != "" {
+		cfg.proxyProtocolTrustedCIDRs, err = parseCIDRs(*proxyProtocolTrustedCIDRsStr)
+		if err != nil {
+			return config{}, fmt.Errorf("invalid PROXY_PROTOCOL_TRUSTED_CIDRS value: %w", err)
+		}
+	}
+	cfg.backendProxyProtocol, err = strconv.ParseBool(*backendProxyProtocolStr)
+	if err != nil {
+		return config{}, fmt.Errorf("invalid BACKEND_PROXY_PROTOCOL value %q: %w", *backendProxyProtocolStr, err)
+	}
+	if *probeCIDRsStr != "" {
+		cfg.probeCIDRs, err = parseCIDRs(*probeCIDRsStr)
+		if err != nil {
+			return config{}, fmt.Errorf("invalid PROBE_CIDRS value: %w", err)
+		}
+	}
+	cfg.tcpKeepAlive.Idle, err = time.ParseDuration(*tcpKeepAliveIdleStr)
+	if err != nil || cfg.tcpKeepAlive.Idle < 0 {
+		return config{}, fmt.Errorf("invalid TCP_KEEPALIVE_IDLE value %q: must be a non-negative duration", *tcpKeepAliveIdleStr)
+	}
+	cfg.tcpKeepAlive.Enable = cfg.tcpKeepAlive.Idle > 0
+	cfg.tcpKeepAlive.Interval, err = time.ParseDuration(*tcpKeepAliveIntervalStr)
+	if err != nil || cfg.tcpKeepAlive.Interval <= 0 {
+		return config{}, fmt.Errorf("invalid TCP_KEEPALIVE_INTERVAL value %q: must be a positive duration", *tcpKeepAliveIntervalStr)
+	}
+	cfg.tcpKeepAlive.Count, err = strconv.Atoi(*tcpKeepAliveCountStr)
+	if err != nil || cfg.tcpKeepAlive.Count <= 0 {
+		return config{}, fmt.Errorf("invalid TCP_KEEPALIVE_COUNT value %q: must be a positive number", *tcpKeepAliveCountStr)
+	}
+	cfg.inactivityTimeout, err = time.ParseDuration(*inactivityTimeoutStr)
+	if err != nil || cfg.inactivityTimeout < 0 {
+		return config{}, fmt.Errorf("invalid INACTIVITY_TIMEOUT value %q: must be a non-negative duration", *inactivityTimeoutStr)
+	}
+	cfg.maxKeepAliveTTL, err = time.ParseDuration(*maxKeepAliveTTLStr)
+	if err != nil || cfg.maxKeepAliveTTL <= 0 {
+		return config{}, fmt.Errorf("invalid MAX_KEEPALIVE_TTL value %q: must be a positive duration", *maxKeepAliveTTLStr)
+	}
+	if cfg.otlpEndpoint != "" {
+		u, err := url.Parse(cfg.otlpEndpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return config{}, fmt.Errorf("invalid OTLP_ENDPOINT value %q: must be an http or https URL", cfg.otlpEndpoint)
+		}
+	}
+
+	cfg.leaderElect, err = strconv.ParseBool(*leaderElectStr)
+	if err != nil {
+		return config{}, fmt.Errorf("invalid LEADER_ELECT value %q: %w", *leaderElectStr, err)
+	}
+	if cfg.leaderElect {
+		if cfg.healthAddr == "" {
+			return config{}, errors.New("leader election requires the health listener, which serves the leader endpoints; set HEALTH_LISTEN_ADDR")
+		}
+		if cfg.peerTokenFile == "" {
+			return config{}, errors.New("leader election requires a token shared by the replicas for the leader endpoints; set PEER_TOKEN_FILE")
+		}
+		if cfg.leaderElectionLeaseName == "" {
+			cfg.leaderElectionLeaseName = cfg.target.name + "-autoscaler"
+		}
+		if cfg.advertiseAddr == "" {
+			_, port, err := net.SplitHostPort(cfg.healthAddr)
+			if err != nil {
+				return config{}, fmt.Errorf("cannot derive ADVERTISE_ADDR for leader election from HEALTH_LISTEN_ADDR: %w", err)
+			}
+			podIP := getenv("POD_IP")
+			if podIP == "" {
+				return config{}, errors.New("cannot derive ADVERTISE_ADDR for leader election; set it or POD_IP")
+			}
+			cfg.advertiseAddr = net.JoinHostPort(podIP, port)
+		}
+	}
+	return cfg, nil
+}
+
+// fileConfig is the configuration file given with -config. It declares several listeners, each proxying
+// to its own buildkitd StatefulSet with independent scaling state. Settings not covered by the file
+// (scaling policy, TLS, leader election, ...) still come from flags and environment variables.
+type fileConfig struct {
+	Listeners []listenerConfig `json:"listeners"`
+}
+
+// listenerConfig is one listener of the configuration file. Omitted fields default to the corresponding
+// flags: the target's namespace to -sts-namespace, its port to -target-port, and the timeouts to
+// -idle-timeout and -ready-wait-timeout. The headless service defaults to "<statefulSet>-headless".
+type listenerConfig struct {
+	// Name identifies the listener in logs. Defaults to the address.
+	Name string `json:"name"`
+	// Address is a TCP "host:port" (e.g. ":8372" or "[::]:8372") or a Unix socket as "unix:///path".
+	Address          string       `json:"address"`
+	Target           targetConfig `json:"target"`
+	IdleTimeout      duration     `json:"idleTimeout"`
+	ReadyWaitTimeout duration     `json:"readyWaitTimeout"`
+	// SNIRoutes routes this listener's TLS connections by server name, in the -sni-routes format.
+	// Routed StatefulSets use the listener's timeouts.
+	SNIRoutes string `json:"sniRoutes"`
+}
+
+// targetConfig names the buildkitd StatefulSet of a listener.
+type targetConfig struct {
+	Namespace       string `json:"namespace"`
+	StatefulSet     string `json:"statefulSet"`
+	HeadlessService string `json:"headlessService"`
+	Port            int    `json:"port"`
+}
+
+// duration is a time.Duration read from a string such as "2m0s".
+type duration struct {
+	time.Duration
+}
+
+// UnmarshalJSON accepts a Go duration string such as "2m0s"; integer nanoseconds are rejected as ambiguous.
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"2m0s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// listenerSpec is a validated listener with every default filled in.
+type listenerSpec struct {
+	name    string
+	address string
+	target  targetSpec
+	// sniRoutes maps server name patterns to the targets they route to; nil without SNI routing.
+	sniRoutes map[string]targetSpec
+}
+
+// loadConfigFile reads a YAML or JSON configuration file and resolves its listeners against defaults,
+// which holds the target settings from flags. Unknown fields are rejected so typos do not go unnoticed.
+func loadConfigFile(path string, defaults targetSpec) ([]listenerSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %w", err)
+	}
+	var cfg fileConfig
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return nil, fmt.Errorf("error parsing config file %s: %w", path, err)
+	}
+	if len(cfg.Listeners) == 0 {
+		return nil, fmt.Errorf("config file %s declares no listeners", path)
+	}
+
+	specs := make([]listenerSpec, 0, len(cfg.Listeners))
+	addresses := make(map[string]bool)
+	for i, l := range cfg.Listeners {
+		spec, err := l.resolve(defaults)
+		if err != nil {
+			return nil, fmt.Errorf("listener %d in %s: %w", i, path, err)
+		}
+		if addresses[spec.address] {
+			return nil, fmt.Errorf("listener %d in %s: duplicate address %s", i, path, spec.address)
+		}
+		addresses[spec.address] = true
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// resolve validates the listener and fills in its defaults.
+func (l listenerConfig) resolve(defaults targetSpec) (listenerSpec, error) {
+	if l.Address == "" {
+		return listenerSpec{}, errors.New("address is required")
+	}
+	if l.Target.StatefulSet == "" {
+		return listenerSpec{}, errors.New("target.statefulSet is required")
+	}
+	if l.IdleTimeout.Duration < 0 || l.ReadyWaitTimeout.Duration < 0 {
+		return listenerSpec{}, errors.New("timeouts must not be negative")
+	}
+
+	target := targetSpec{
+		namespace:        l.Target.Namespace,
+		name:             l.Target.StatefulSet,
+		headlessService:  l.Target.HeadlessService,
+		port:             defaults.port,
+		idleTimeout:      l.IdleTimeout.Duration,
+		readyWaitTimeout: l.ReadyWaitTimeout.Duration,
+	}
+	if target.namespace == "" {
+		target.namespace = defaults.namespace
+	}
+	if target.headlessService == "" {
+		target.headlessService = target.name + "-headless"
+	}
+	if l.Target.Port != 0 {
+		target.port = strconv.Itoa(l.Target.Port)
+	}
+	if target.idleTimeout == 0 {
+		target.idleTimeout = defaults.idleTimeout
+	}
+	if target.readyWaitTimeout == 0 {
+		target.readyWaitTimeout = defaults.readyWaitTimeout
+	}
+
+	spec := listenerSpec{name: l.Name, address: l.Address, target: target}
+	if spec.name == "" {
+		spec.name = l.Address
+	}
+	if l.SNIRoutes != "" {
+		routes, err := parseSNIRoutes(l.SNIRoutes, defaults.port)
+		if err != nil {
+			return listenerSpec{}, fmt.Errorf("sniRoutes: %w", err)
+		}
+		spec.sniRoutes = withTimeouts(routes, target)
+	}
+	return spec, nil
+}
+
+// withTimeouts gives every routed target the timeouts of from.
+func withTimeouts(routes map[string]targetSpec, from targetSpec) map[string]targetSpec {
+	for pattern, spec := range routes {
+		spec.idleTimeout, spec.readyWaitTimeout = from.idleTimeout, from.readyWaitTimeout
+		routes[pattern] = spec
+	}
+	return routes
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testFlagTarget stands in for the target settings taken from flags.
+var testFlagTarget = targetSpec{
+	namespace: "buildkit", name: "buildkitd", headlessService: "buildkitd-headless", port: "8372",
+	idleTimeout: 2 * time.Minute, readyWaitTimeout: 5 * time.Minute,
+}
+
+// writeConfig writes a config file named name with the given contents and returns its path.
+func writeConfig(t *testing.T, name, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestLoadConfigFile verifies that listeners are read from YAML and JSON and that omitted fields
+// default to the flag settings.
+func TestLoadConfigFile(t *testing.T) {
+	yamlPath := writeConfig(t, "config.yaml", `
+listeners:
+  - name: amd64
+    address: ":8372"
+    target:
+      statefulSet: buildkitd-amd64
+  - address: "[::]:8373"
+    target:
+      namespace: arm
+      statefulSet: buildkitd-arm64
+      headlessService: arm-hl
+      port: 1234
+    idleTimeout: 10m
+    readyWaitTimeout: 1m
+    sniRoutes: gpu.example.com=gpu/buildkitd
+  - name: local
+    address: unix:///run/buildkitd-proxy/amd64.sock
+    target:
+      statefulSet: buildkitd-amd64
+`)
+	jsonPath := writeConfig(t, "config.json", `{"listeners": [{"name": "amd64", "address": ":8372", "target": {"statefulSet": "buildkitd-amd64"}},
+		{"address": "[::]:8373", "target": {"namespace": "arm", "statefulSet": "buildkitd-arm64", "headlessService": "arm-hl", "port": 1234},
+		 "idleTimeout": "10m", "readyWaitTimeout": "1m", "sniRoutes": "gpu.example.com=gpu/buildkitd"},
+		{"name": "local", "address": "unix:///run/buildkitd-proxy/amd64.sock", "target": {"statefulSet": "buildkitd-amd64"}}]}`)
+
+	amd64 := targetSpec{namespace: "buildkit", name: "buildkitd-amd64", headlessService: "buildkitd-amd64-headless", port: "8372", idleTimeout: 2 * time.Minute, readyWaitTimeout: 5 * time.Minute}
+	arm64 := targetSpec{namespace: "arm", name: "buildkitd-arm64", headlessService: "arm-hl", port: "1234", idleTimeout: 10 * time.Minute, readyWaitTimeout: time.Minute}
+	gpu := targetSpec{namespace: "gpu", name: "buildkitd", headlessService: "buildkitd-headless", port: "8372", idleTimeout: 10 * time.Minute, readyWaitTimeout: time.Minute}
+
+	for _, path := range []string{yamlPath, jsonPath} {
+		t.Run(filepath.Ext(path), func(t *testing.T) {
+			specs, err := loadConfigFile(path, testFlagTarget)
+			if err != nil {
+				t.Fatalf("loadConfigFile() error = %v", err)
+			}
+			if len(specs) != 3 {
+				t.Fatalf("loadConfigFile() returned %d listeners, want 3", len(specs))
+			}
+			if specs[0].name != "amd64" || specs[0].address != ":8372" || specs[0].target != amd64 || specs[0].sniRoutes != nil {
+				t.Errorf("listener 0 = %+v, want amd64 on :8372 to %+v", specs[0], amd64)
+			}
+			if specs[1].name != "[::]:8373" || specs[1].target != arm64 || specs[1].sniRoutes["gpu.example.com"] != gpu {
+				t.Errorf("listener 1 = %+v, want [::]:8373 to %+v routing gpu.example.com to %+v", specs[1], arm64, gpu)
+			}
+			if specs[2].address != "unix:///run/buildkitd-proxy/amd64.sock" || specs[2].target != amd64 {
+				t.Errorf("listener 2 = %+v, want the Unix socket to %+v", specs[2], amd64)
+			}
+		})
+	}
+}
+
+// TestLoadConfigFile_Invalid verifies that invalid config files are rejected with a useful error.
+func TestLoadConfigFile_Invalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		wantErr  string
+	}{
+		{"no listeners", "listeners: []", "no listeners"},
+		{"unknown field", "listeners: [{address: ':1', target: {statefulSet: a}, idleTimeot: 1m}]", "idleTimeot"},
+		{"missing address", "listeners: [{target: {statefulSet: a}}]", "address is required"},
+		{"missing statefulSet", "listeners: [{address: ':1'}]", "target.statefulSet is required"},
+		{"bad duration", "listeners: [{address: ':1', target: {statefulSet: a}, idleTimeout: soon}]", "soon"},
+		{"numeric duration", "listeners: [{address: ':1', target: {statefulSet: a}, idleTimeout: 60}]", "duration must be a string"},
+		{"duplicate address", "listeners: [{address: ':1', target: {statefulSet: a}}, {address: ':1', target: {statefulSet: b}}]", "duplicate address"},
+		{"bad routes", "listeners: [{address: ':1', target: {statefulSet: a}, sniRoutes: 'x.example.com'}]", "sniRoutes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadConfigFile(writeConfig(t, "config.yaml", tt.contents), testFlagTarget)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("loadConfigFile() error = %v, want it to mention %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"cmp"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// connectionRegistry tracks the live proxied connections of this replica, so the admin API can show which
+// clients hold buildkitd awake and close them. Connection IDs are only unique within one replica.
+type connectionRegistry struct {
+	mu     sync.Mutex
+	nextID uint64
+	conns  map[uint64]*trackedConnection
+}
+
+// newConnectionRegistry creates an empty registry.
+func newConnectionRegistry() *connectionRegistry {
+	return &connectionRegistry{conns: make(map[uint64]*trackedConnection)}
+}
+
+// trackedConnection is a live connection in a connectionRegistry.
+type trackedConnection struct {
+	id       uint64
+	listener string
+	target   string
+	client   net.Addr
+	started  time.Time
+	// bytesToBackend and bytesToClient count the bytes proxied so far in each direction.
+	bytesToBackend atomic.Int64
+	bytesToClient  atomic.Int64
+	// lastActivity is the time of the last read in either direction, in Unix nanoseconds.
+	lastActivity atomic.Int64
+
+	mu sync.Mutex
+	// backendPod is the buildkitd pod the connection is proxied to, empty until one is chosen.
+	backendPod string
+	// conns are closed by close; the client connection first, then the buildkitd connection once dialed.
+	conns  []net.Conn
+	closed bool
+}
+
+// add registers a connection from client, which close ends.
+func (r *connectionRegistry) add(listener, target string, client net.Conn) *trackedConnection {
+	c := &trackedConnection{listener: listener, target: target, client: client.RemoteAddr(), started: time.Now(), conns: []net.Conn{client}}
+	c.lastActivity.Store(c.started.UnixNano())
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextID++
+	c.id = r.nextID
+	r.conns[c.id] = c
+	return c
+}
+
+// remove unregisters c once the connection has ended.
+func (r *connectionRegistry) remove(c *trackedConnection) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.conns, c.id)
+}
+
+// list returns the live connections, oldest first.
+func (r *connectionRegistry) list() []*trackedConnection {
+	r.mu.Lock()
+	conns := make([]*trackedConnection, 0, len(r.conns))
+	for _, c := range r.conns {
+		conns = append(conns, c)
+	}
+	r.mu.Unlock()
+	slices.SortFunc(conns, func(a, b *trackedConnection) int { return cmp.Compare(a.id, b.id) })
+	return conns
+}
+
+// get returns the connection with the given ID, or nil if there is none.
+func (r *connectionRegistry) get(id uint64) *trackedConnection {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.conns[id]
+}
+
+// fromClient returns the live connections from the client host, an IP address, oldest first.
+func (r *connectionRegistry) fromClient(host string) []*trackedConnection {
+	var conns []*trackedConnection
+	for _, c := range r.list() {
+		if c.clientHost() == host {
+			conns = append(conns, c)
+		}
+	}
+	return conns
+}
+
+// forTarget returns the live connections to the target with the given key, oldest first.
+func (r *connectionRegistry) forTarget(key string) []*trackedConnection {
+	var conns []*trackedConnection
+	for _, c := range r.list() {
+		if c.target == key {
+			conns = append(conns, c)
+		}
+	}
+	return conns
+}
+
+// clientHost returns the client's address without its port.
+func (c *trackedConnection) clientHost() string {
+	host, _, err := net.SplitHostPort(c.client.String())
+	if err != nil {
+		return c.client.String()
+	}
+	return host
+}
+
+// proxying records that the connection is proxied to backendPod over backendConn, which close then also ends.
+// If the connection was closed while the backend was being dialed, backendConn is closed right away.
+func (c *trackedConnection) proxying(backendPod string, backendConn net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.backendPod = backendPod
+	if c.closed {
+		backendConn.Close()
+		return
+	}
+	c.conns = append(c.conns, backendConn)
+}
+
+// pod returns the buildkitd pod the connection is proxied to, empty until one is chosen.
+func (c *trackedConnection) pod() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.backendPod
+}
+
+// close ends the connection. A connection held for a cold start stops waiting, as its client disconnected.
+func (c *trackedConnection) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for _, conn := range c.conns {
+		conn.Close()
+	}
+}
+
+// reader returns a reader that adds the bytes it reads from r to counter and to the proxied metric on every
+// read, so both are current while the stream is still flowing, and records activity.
+func (c *trackedConnection) reader(r io.Reader, counter *atomic.Int64, proxied prometheus.Counter) io.Reader {
+	return &countingReader{reader: r, conn: c, counter: counter, proxied: proxied}
+}
+
+// countingReader counts the bytes read through it for its connection and the proxied bytes metric.
+type countingReader struct {
+	reader  io.Reader
+	conn    *trackedConnection
+	counter *atomic.Int64
+	proxied prometheus.Counter
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.counter.Add(int64(n))
+		r.proxied.Add(float64(n))
+		r.conn.lastActivity.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// readinessCheckTimeout bounds the Kubernetes API calls made by a single /readyz request.
+const readinessCheckTimeout = 5 * time.Second
+
+// RBAC review results are reused by readiness probes for these durations. Permissions rarely change, so
+// granted ones are re-reviewed rarely; denied ones are re-reviewed sooner to pick up a fixed Role.
+const (
+	rbacAllowedCacheTTL = 5 * time.Minute
+	rbacDeniedCacheTTL  = 30 * time.Second
+)
+
+// requiredPermission is an API permission the autoscaler needs in a namespace.
+type requiredPermission struct {
+	group    string
+	resource string
+	verb     string
+}
+
+// requiredPermissions lists the permissions the autoscaler needs in the namespace of every target
+// StatefulSet, matching the chart's Role.
+var requiredPermissions = []requiredPermission{
+	{"apps", "statefulsets", "get"},
+	{"apps", "statefulsets", "list"},
+	{"apps", "statefulsets", "watch"},
+	{"apps", "statefulsets", "patch"},
+	{"", "pods", "list"},
+	{"", "pods", "watch"},
+	{"", "events", "list"},
+}
+
+// ownNamespacePermissions lists the permissions the autoscaler needs in its own namespace. leasePermissions
+// are added when leader election is enabled, and reading the backend TLS Secret when it is configured.
+var ownNamespacePermissions []requiredPermission
+
+// healthChecker serves the autoscaler's own liveness and readiness endpoints.
+type healthChecker struct {
+	clientset kubernetes.Interface
+	// apiClient reaches the API server's /version endpoint.
+	apiClient rest.Interface
+	// namespace is the autoscaler's own namespace, where ownNamespacePermissions are needed.
+	namespace string
+	// statefulSets are the caches of the target StatefulSets, which are checked without an API call per probe.
+	statefulSets []*statefulSetCache
+	// accepting is true while the proxy's accept loop is running.
+	accepting atomic.Bool
+
+	mu sync.Mutex
+	// rbacErr is the result of the last completed RBAC review, reused until rbacExpires.
+	rbacErr     error
+	rbacExpires time.Time
+}
+
+// newHealthChecker creates a healthChecker for an autoscaler running in namespace and managing the
+// StatefulSets behind the given caches.
+func newHealthChecker(clientset kubernetes.Interface, namespace string, statefulSets []*statefulSetCache) *healthChecker {
+	return &healthChecker{clientset: clientset, apiClient: clientset.Discovery().RESTClient(), namespace: namespace, statefulSets: statefulSets}
+}
+
+// handler returns the mux serving /healthz and /readyz. Other endpoints served on the health
+// listener are registered on the same mux.
+func (h *healthChecker) handler() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", h.serveHealthz)
+	mux.HandleFunc("/readyz", h.serveReadyz)
+	return mux
+}
+
+// serveHealthz reports whether the process is alive and the accept loop is running.
+func (h *healthChecker) serveHealthz(w http.ResponseWriter, _ *http.Request) {
+	if !h.accepting.Load() {
+		http.Error(w, "accept loop not running", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// serveReadyz reports whether the Kubernetes API is reachable, the target StatefulSets exist and the
+// autoscaler's RBAC permissions suffice. Each check is listed in the response body.
+func (h *healthChecker) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessCheckTimeout)
+	defer cancel()
+
+	checks := []struct {
+		name  string
+		check func(context.Context) error
+	}{
+		{"api", h.checkAPI},
+		{"statefulset", h.checkStatefulSet},
+		{"rbac", h.checkRBAC},
+	}
+
+	var body strings.Builder
+	ready := true
+	for _, c := range checks {
+		if err := c.check(ctx); err != nil {
+			ready = false
+			fmt.Fprintf(&body, "[-]%s failed: %v\n", c.name, err)
+			continue
+		}
+		fmt.Fprintf(&body, "[+]%s ok\n", c.name)
+	}
+
+	if !ready {
+		logger.Warn("Readiness check failed", "checks", body.String())
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprint(w, body.String())
+}
+
+// checkAPI verifies that the Kubernetes API server is reachable.
+func (h *healthChecker) checkAPI(ctx context.Context) error {
+	if err := h.apiClient.Get().AbsPath("/version").Do(ctx).Error(); err != nil {
+		return fmt.Errorf("kubernetes API unreachable: %w", err)
+	}
+	return nil
+}
+
+// checkStatefulSet verifies that every target StatefulSet exists in its watch cache.
+func (h *healthChecker) checkStatefulSet(context.Context) error {
+	for _, c := range h.statefulSets {
+		if _, err := c.status(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkRBAC verifies the required permissions, reusing the last review's result for rbacAllowedCacheTTL
+// after it passed or rbacDeniedCacheTTL after permissions were denied. Failed reviews are not reused.
+func (h *healthChecker) checkRBAC(ctx context.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if time.Now().Before(h.rbacExpires) {
+		return h.rbacErr
+	}
+	err := h.reviewRBAC(ctx)
+	var denied *permissionsDeniedError
+	switch {
+	case err == nil:
+		h.rbacErr, h.rbacExpires = nil, time.Now().Add(rbacAllowedCacheTTL)
+	case errors.As(err, &denied):
+		h.rbacErr, h.rbacExpires = err, time.Now().Add(rbacDeniedCacheTTL)
+	}
+	return err
+}
+
+// permissionsDeniedError lists the permissions a review found missing.
+type permissionsDeniedError struct {
+	denied []string
+}
+
+func (e *permissionsDeniedError) Error() string {
+	return "not allowed to " + strings.Join(e.denied, ", ")
+}
+
+// reviewRBAC verifies every required permission with a SelfSubjectAccessReview: requiredPermissions in the
+// namespace of each target StatefulSet and ownNamespacePermissions in the autoscaler's own namespace.
+func (h *healthChecker) reviewRBAC(ctx context.Context) error {
+	wanted := make(map[string][]requiredPermission)
+	for _, c := range h.statefulSets {
+		wanted[c.namespace] = requiredPermissions
+	}
+	wanted[h.namespace] = append(slices.Clone(wanted[h.namespace]), ownNamespacePermissions...)
+
+	var denied []string
+	for _, namespace := range slices.Sorted(maps.Keys(wanted)) {
+		for _, p := range wanted[namespace] {
+			review := &authorizationv1.SelfSubjectAccessReview{
+				Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+					ResourceAttributes: &authorizationv1.ResourceAttributes{
+						Namespace: namespace,
+						Group:     p.group,
+						Resource:  p.resource,
+						Verb:      p.verb,
+					},
+				},
+			}
+			result, err := h.clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, review, metav1.CreateOptions{})
+			if err != nil {
+				return fmt.Errorf("error reviewing access: %w", err)
+			}
+			if !result.Status.Allowed {
+				denied = append(denied, p.verb+" "+p.resource+" in "+namespace)
+			}
+		}
+	}
+	if len(denied) > 0 {
+		return &permissionsDeniedError{denied: denied}
+	}
+	return nil
+}
+
+// startHealthServer serves the health endpoints in handler on addr in the background.
+func startHealthServer(addr string, handler http.Handler) *http.Server {
+	srv := &http.Server{Addr: addr, Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		logger.Info("Health server listening", "address", addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Health server failed", "address", addr, "error", err)
+		}
+	}()
+	return srv
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	restfake "k8s.io/client-go/rest/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newTestHealthChecker creates a healthChecker over clientset whose API server answers /version with
+// apiStatus; the fake clientset's discovery client cannot make requests.
+func newTestHealthChecker(t *testing.T, clientset *fake.Clientset, apiStatus int) *healthChecker {
+	t.Helper()
+	h := newHealthChecker(clientset, testNamespace, []*statefulSetCache{startTestCache(t, clientset)})
+	h.apiClient = &restfake.RESTClient{
+		NegotiatedSerializer: scheme.Codecs.WithoutConversion(),
+		Client: restfake.CreateHTTPClient(func(*http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: apiStatus, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("{}"))}, nil
+		}),
+	}
+	return h
+}
+
+// allowAccessReviews makes the fake clientset answer SelfSubjectAccessReviews, denying the given
+// "verb resource" pairs and allowing everything else.
+func allowAccessReviews(clientset *fake.Clientset, denied ...string) {
+	clientset.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview).DeepCopy()
+		attrs := review.Spec.ResourceAttributes
+		review.Status.Allowed = true
+		for _, d := range denied {
+			if d == attrs.Verb+" "+attrs.Resource {
+				review.Status.Allowed = false
+			}
+		}
+		return true, review, nil
+	})
+}
+
+// getHealth performs a GET against the health handler and returns the status code and body.
+func getHealth(t *testing.T, h *healthChecker, path string) (int, string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.handler().ServeHTTP(rec, httptest.NewRequestWithContext(context.Background(), http.MethodGet, path, nil))
+	return rec.Code, rec.Body.String()
+}
+
+// TestHealthz verifies that liveness follows the accept loop.
+func TestHealthz(t *testing.T) {
+	h := newTestHealthChecker(t, fake.NewSimpleClientset(), http.StatusOK)
+
+	if code, _ := getHealth(t, h, "/healthz"); code != http.StatusServiceUnavailable {
+		t.Errorf("/healthz before the accept loop = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	h.accepting.Store(true)
+	if code, _ := getHealth(t, h, "/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz with the accept loop running = %d, want %d", code, http.StatusOK)
+	}
+}
+
+// TestReadyz verifies that readiness requires the StatefulSet and sufficient RBAC permissions.
+func TestReadyz(t *testing.T) {
+	tests := []struct {
+		name     string
+		objects  []runtime.Object
+		denied   []string
+		wantCode int
+		wantBody string
+	}{
+		{"ready", []runtime.Object{newTestStatefulSet(testStsName, testNamespace, 0)}, nil, http.StatusOK, "[+]rbac ok"},
+		{"statefulset missing", nil, nil, http.StatusServiceUnavailable, "[-]statefulset failed"},
+		{"rbac insufficient", []runtime.Object{newTestStatefulSet(testStsName, testNamespace, 0)}, []string{"patch statefulsets"}, http.StatusServiceUnavailable, "[-]rbac failed: not allowed to patch statefulsets in " + testNamespace},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset(tt.objects...)
+			allowAccessReviews(clientset, tt.denied...)
+			h := newTestHealthChecker(t, clientset, http.StatusOK)
+
+			code, body := getHealth(t, h, "/readyz")
+			if code != tt.wantCode {
+				t.Errorf("/readyz = %d, want %d\n%s", code, tt.wantCode, body)
+			}
+			if !strings.Contains(body, tt.wantBody) {
+				t.Errorf("/readyz body = %q, want it to contain %q", body, tt.wantBody)
+			}
+		})
+	}
+}
+
+// TestReadyz_OwnNamespacePermissions verifies that the Lease permissions are reviewed in the autoscaler's own
+// namespace and the StatefulSet permissions in the target's namespace.
+func TestReadyz_OwnNamespacePermissions(t *testing.T) {
+	saved := ownNamespacePermissions
+	defer func() { ownNamespacePermissions = saved }()
+	ownNamespacePermissions = leasePermissions
+
+	clientset := fake.NewSimpleClientset(newTestStatefulSet(testStsName, testNamespace, 0))
+	allowAccessReviews(clientset, "update leases")
+	h := newTestHealthChecker(t, clientset, http.StatusOK)
+	h.namespace = "autoscaler-ns"
+
+	want := "[-]rbac failed: not allowed to update leases in autoscaler-ns"
+	if code, body := getHealth(t, h, "/readyz"); code != http.StatusServiceUnavailable || !strings.Contains(body, want) {
+		t.Errorf("/readyz = %d %q, want it to contain %q", code, body, want)
+	}
+	for _, action := range clientset.Actions() {
+		create, ok := action.(k8stesting.CreateAction)
+		if !ok {
+			continue
+		}
+		attrs := create.GetObject().(*authorizationv1.SelfSubjectAccessReview).Spec.ResourceAttributes
+		wantNamespace := testNamespace
+		if attrs.Resource == "leases" {
+			wantNamespace = "autoscaler-ns"
+		}
+		if attrs.Namespace != wantNamespace {
+			t.Errorf("reviewed %s %s in namespace %q, want %q", attrs.Verb, attrs.Resource, attrs.Namespace, wantNamespace)
+		}
+	}
+}
+
+// TestReadyz_APIUnreachable verifies that readiness fails when the API server does not answer /version.
+func TestReadyz_APIUnreachable(t *testing.T) {
+	clientset := fake.NewSimpleClientset(newTestStatefulSet(testStsName, testNamespace, 0))
+	allowAccessReviews(clientset)
+	h := newTestHealthChecker(t, clientset, http.StatusServiceUnavailable)
+
+	if code, body := getHealth(t, h, "/readyz"); code != http.StatusServiceUnavailable || !strings.Contains(body, "[-]api failed") {
+		t.Errorf("/readyz with the API unreachable = %d %q, want it to fail", code, body)
+	}
+}
+
+// TestReadyz_CachesLookups verifies that probes read the StatefulSet from the watch cache and reuse the last
+// RBAC review, including a denial, instead of calling the API every time.
+func TestReadyz_CachesLookups(t *testing.T) {
+	for _, denied := range [][]string{nil, {"patch statefulsets"}} {
+		clientset := fake.NewSimpleClientset(newTestStatefulSet(testStsName, testNamespace, 0))
+		allowAccessReviews(clientset, denied...)
+		h := newTestHealthChecker(t, clientset, http.StatusOK)
+
+		_, first := getHealth(t, h, "/readyz")
+		calls := len(clientset.Actions())
+		_, second := getHealth(t, h, "/readyz")
+		if got := clientset.Actions()[calls:]; len(got) != 0 {
+			t.Errorf("denied %v: second probe made API calls %v, want none", denied, got)
+		}
+		if first != second {
+			t.Errorf("denied %v: second probe = %q, want the same result as the first %q", denied, second, first)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// keepAlivePeriod is the KeepAlive setting of the net.ListenConfig and net.Dialer used with tcpKeepAlive.
+// Without tcpKeepAlive enabled it is negative, which turns keep-alive probes off instead of leaving them at
+// Go's defaults.
+func keepAlivePeriod() time.Duration {
+	if tcpKeepAlive.Enable {
+		return 0
+	}
+	return -1
+}
+
+// inactivityMonitor reaps a proxied connection once no bytes have flowed in either direction for timeout.
+// TCP keep-alive only detects dead peers; a forgotten buildctl session on a live host answers the probes and
+// would otherwise hold buildkitd awake indefinitely.
+type inactivityMonitor struct {
+	timeout time.Duration
+	// lastActivity is the time of the last read in either direction, in Unix nanoseconds.
+	lastActivity atomic.Int64
+	// onInactive is called once, from the monitor's timer, when the connection is reaped.
+	onInactive func(inactiveFor time.Duration)
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	stopped bool
+}
+
+// newInactivityMonitor starts monitoring a connection that has just become active.
+func newInactivityMonitor(timeout time.Duration, onInactive func(inactiveFor time.Duration)) *inactivityMonitor {
+	m := &inactivityMonitor{timeout: timeout, onInactive: onInactive}
+	m.touch()
+	m.mu.Lock()
+	m.timer = time.AfterFunc(timeout, m.check)
+	m.mu.Unlock()
+	return m
+}
+
+// touch records activity now.
+func (m *inactivityMonitor) touch() {
+	m.lastActivity.Store(time.Now().UnixNano())
+}
+
+// check reaps the connection if it has been inactive for the timeout, and otherwise waits for the rest of it.
+// The timer is re-armed here rather than on every read, so busy connections cost one atomic store per read.
+func (m *inactivityMonitor) check() {
+	m.mu.Lock()
+	if m.stopped {
+		m.mu.Unlock()
+		return
+	}
+	inactiveFor := time.Since(time.Unix(0, m.lastActivity.Load()))
+	if remaining := m.timeout - inactiveFor; remaining > 0 {
+		m.timer.Reset(remaining)
+		m.mu.Unlock()
+		return
+	}
+	m.stopped = true
+	m.mu.Unlock()
+	m.onInactive(inactiveFor)
+}
+
+// stop ends monitoring. It reports whether the connection was reaped.
+func (m *inactivityMonitor) stop() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stopped {
+		return true
+	}
+	m.stopped = true
+	m.timer.Stop()
+	return false
+}
+
+// reader returns a reader that records activity whenever it reads data from r.
+func (m *inactivityMonitor) reader(r io.Reader) io.Reader {
+	return &activityReader{reader: r, monitor: m}
+}
+
+// activityReader records activity on its monitor for every successful read.
+type activityReader struct {
+	reader  io.Reader
+	monitor *inactivityMonitor
+}
+
+func (r *activityReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.monitor.touch()
+	}
+	return n, err
+}
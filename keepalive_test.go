@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestInactivityMonitor verifies that a connection is reaped only after the timeout passes without reads,
+// and that reads postpone it.
+func TestInactivityMonitor(t *testing.T) {
+	reaped := make(chan time.Duration, 1)
+	m := newInactivityMonitor(100*time.Millisecond, func(inactiveFor time.Duration) { reaped <- inactiveFor })
+	r := m.reader(strings.NewReader(strings.Repeat("x", 10)))
+
+	// Keep the connection active for longer than the timeout.
+	buf := make([]byte, 1)
+	for range 5 {
+		time.Sleep(40 * time.Millisecond)
+		r.Read(buf)
+	}
+	select {
+	case <-reaped:
+		t.Fatal("active connection was reaped")
+	default:
+	}
+
+	select {
+	case inactiveFor := <-reaped:
+		if inactiveFor < 100*time.Millisecond {
+			t.Errorf("reaped after %s of inactivity, want at least the 100ms timeout", inactiveFor)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("inactive connection was not reaped")
+	}
+	if !m.stop() {
+		t.Error("stop() = false after the connection was reaped, want true")
+	}
+}
+
+// TestInactivityMonitor_Stop verifies that a stopped monitor never reaps its connection.
+func TestInactivityMonitor_Stop(t *testing.T) {
+	reaped := make(chan time.Duration, 1)
+	m := newInactivityMonitor(10*time.Millisecond, func(inactiveFor time.Duration) { reaped <- inactiveFor })
+	if m.stop() {
+		t.Error("stop() = true before the timeout, want false")
+	}
+	select {
+	case <-reaped:
+		t.Error("stopped monitor reaped its connection")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// keepAlivePath is the pipeline listener endpoint for keep-alive leases, followed by "/<name>".
+const keepAlivePath = "/keepalive"
+
+// defaultKeepAliveTTL is the TTL of a keep-alive lease acquired without one.
+const defaultKeepAliveTTL = 10 * time.Minute
+
+// errInvalidKeepAlive is returned for a keep-alive lease TTL that is not positive or exceeds the maximum.
+var errInvalidKeepAlive = errors.New("invalid keep-alive lease")
+
+// keepAliveLease is a named keep-alive lease held on the leader. While any is held the StatefulSet is not
+// scaled to zero, even with no connections.
+type keepAliveLease struct {
+	expires time.Time
+	// timer releases the lease once it expires.
+	timer timer
+}
+
+// keepAliveInfo is a keep-alive lease as returned by the keep-alive endpoint.
+type keepAliveInfo struct {
+	Name string `json:"name"`
+	// Target is the StatefulSet kept awake, as "<namespace>/<name>".
+	Target  string    `json:"target"`
+	Expires time.Time `json:"expires"`
+}
+
+// acquireKeepAlive acquires the keep-alive lease name for ttl, or renews it if it is held, and returns when it
+// expires. It does not wake buildkitd. A ttl above maxKeepAliveTTL is rejected with errInvalidKeepAlive, on
+// the leader as well as on the replica that received the request. While another replica is the leader, the
+// request is passed on through forwardKeepAlive.
+func (lc *lifecycle) acquireKeepAlive(ctx context.Context, name string, ttl time.Duration) (time.Time, error) {
+	if ttl <= 0 || (lc.maxKeepAliveTTL > 0 && ttl > lc.maxKeepAliveTTL) {
+		return time.Time{}, fmt.Errorf("%w: ttl must be a positive duration of at most %s, got %s", errInvalidKeepAlive, lc.maxKeepAliveTTL, ttl)
+	}
+	expires := lc.clock.Now().Add(ttl)
+	forward := false
+	lc.handle(func() {
+		if !lc.leading {
+			forward = true
+			return
+		}
+		lc.holdKeepAlive(name, expires)
+	})
+	if forward {
+		if lc.forwardKeepAlive == nil {
+			return time.Time{}, errNotLeader
+		}
+		return expires, lc.forwardKeepAlive(ctx, name, ttl)
+	}
+	return expires, nil
+}
+
+// releaseKeepAlive releases the keep-alive lease name, if it is held. Once no lease is held and nothing is
+// connected, the scale-down timer starts. While another replica is the leader, the request is passed on
+// through forwardKeepAlive.
+func (lc *lifecycle) releaseKeepAlive(ctx context.Context, name string) error {
+	forward := false
+	lc.handle(func() {
+		if !lc.leading {
+			forward = true
+			return
+		}
+		if _, ok := lc.keepAlives[name]; ok {
+			lc.dropKeepAlive(name, "released")
+		}
+	})
+	if forward {
+		if lc.forwardKeepAlive == nil {
+			return errNotLeader
+		}
+		return lc.forwardKeepAlive(ctx, name, 0)
+	}
+	return nil
+}
+
+// holdKeepAlive holds the keep-alive lease name until expires, replacing its previous expiry, and cancels a
+// pending idle scale-down. Must be called under mu.
+func (lc *lifecycle) holdKeepAlive(name string, expires time.Time) {
+	lease, renewed := lc.keepAlives[name]
+	if renewed {
+		lease.timer.Stop()
+		lc.log.Debug("Renewed keep-alive lease.", "lease", name, "expires", expires)
+	} else {
+		lease = &keepAliveLease{}
+		lc.keepAlives[name] = lease
+		lc.log.Info("Acquired keep-alive lease.", "lease", name, "expires", expires, "leases", len(lc.keepAlives))
+		if lc.onKeepAlivesChanged != nil {
+			lc.onKeepAlivesChanged(len(lc.keepAlives))
+		}
+	}
+	if lc.idleTimer != nil {
+		lc.log.Info("Keep-alive lease held. Cancelling scale-down timer.", "lease", name)
+		lc.idleTimer.Stop()
+		lc.idleTimer = nil
+	}
+
+	lease.expires = expires
+	var t timer
+	t = lc.clock.AfterFunc(expires.Sub(lc.clock.Now()), func() {
+		lc.handle(func() {
+			if lc.keepAlives[name] != lease || lease.timer != t {
+				return // Renewed or released after it fired.
+			}
+			lc.dropKeepAlive(name, "expired")
+		})
+	})
+	lease.timer = t
+}
+
+// dropKeepAlive releases the held keep-alive lease name. Once no lease is held and nothing is connected, the
+// scale-down timer starts. Must be called under mu.
+func (lc *lifecycle) dropKeepAlive(name, reason string) {
+	lc.keepAlives[name].timer.Stop()
+	delete(lc.keepAlives, name)
+	lc.log.Info("Keep-alive lease ended.", "lease", name, "reason", reason, "leases", len(lc.keepAlives))
+	if lc.onKeepAlivesChanged != nil {
+		lc.onKeepAlivesChanged(len(lc.keepAlives))
+	}
+	if len(lc.keepAlives) == 0 {
+		// The lease held buildkitd in use until now.
+		lc.lastActivity = lc.clock.Now()
+		if lc.totalConnections() == 0 && lc.state != stateIdle {
+			lc.startIdleTimer()
+		}
+	}
+}
+
+// keepAliveAPI serves the keep-alive endpoint, which lets a pipeline keep buildkitd awake across the gaps
+// between its builds.
+type keepAliveAPI struct {
+	targets *targetSet
+}
+
+// newKeepAliveAPI creates the keep-alive endpoint over targets.
+func newKeepAliveAPI(targets *targetSet) *keepAliveAPI {
+	return &keepAliveAPI{targets: targets}
+}
+
+// register adds the keep-alive endpoint to mux.
+func (a *keepAliveAPI) register(mux *http.ServeMux) {
+	mux.HandleFunc("PUT "+keepAlivePath+"/{name}", a.serveAcquire)
+	mux.HandleFunc("DELETE "+keepAlivePath+"/{name}", a.serveRelease)
+}
+
+// serveAcquire acquires or renews the keep-alive lease in the path on the target named by the "target"
+// query parameter, for the TTL in the "ttl" query parameter, and responds with the lease.
+func (a *keepAliveAPI) serveAcquire(w http.ResponseWriter, r *http.Request) {
+	t := a.targets.fromQuery(w, r)
+	if t == nil {
+		return
+	}
+	ttl, err := time.ParseDuration(cmp.Or(r.URL.Query().Get("ttl"), defaultKeepAliveTTL.String()))
+	if err != nil {
+		http.Error(w, "invalid ttl", http.StatusBadRequest)
+		return
+	}
+	name := r.PathValue("name")
+	expires, err := t.scaler.acquireKeepAlive(r.Context(), name, ttl)
+	if errors.Is(err, errInvalidKeepAlive) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to acquire keep-alive lease", "error", err, "lease", name, "target", t.key())
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, keepAliveInfo{Name: name, Target: t.key(), Expires: expires.UTC()})
+}
+
+// serveRelease releases the keep-alive lease in the path on the target named by the "target" query parameter.
+// Releasing a lease that is not held succeeds.
+func (a *keepAliveAPI) serveRelease(w http.ResponseWriter, r *http.Request) {
+	t := a.targets.fromQuery(w, r)
+	if t == nil {
+		return
+	}
+	name := r.PathValue("name")
+	if err := t.scaler.releaseKeepAlive(r.Context(), name); err != nil {
+		logger.Error("Failed to release keep-alive lease", "error", err, "lease", name, "target", t.key())
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+// newKeepAliveTest creates a lifecycle with one ready replica and no connections, its scale-down timer running.
+func newKeepAliveTest(t *testing.T) *lifecycleTest {
+	t.Helper()
+	lt := newLifecycleTest(t, testLifecyclePolicy, time.Minute)
+	lt.open(1)
+	if err := lt.lc.wake(context.Background()); err != nil {
+		t.Fatalf("wake() error = %v", err)
+	}
+	lt.close(1)
+	return lt
+}
+
+// TestLifecycle_KeepAlive verifies that a held keep-alive lease stops the scale to zero without any
+// connections, and that the scale-down timer starts once the last lease is released.
+func TestLifecycle_KeepAlive(t *testing.T) {
+	lt := newKeepAliveTest(t)
+	var leases []int
+	lt.lc.onKeepAlivesChanged = func(n int) { leases = append(leases, n) }
+
+	for _, name := range []string{"pipeline-1", "pipeline-2"} {
+		if _, err := lt.lc.acquireKeepAlive(context.Background(), name, 10*time.Minute); err != nil {
+			t.Fatalf("acquireKeepAlive(%s) error = %v", name, err)
+		}
+	}
+	lt.clock.Advance(5 * time.Minute)
+	if got := lt.lc.activity().lastActivity; !got.Equal(lt.clock.Now()) {
+		t.Errorf("last activity while leases are held = %v, want now", got)
+	}
+	if err := lt.lc.releaseKeepAlive(context.Background(), "pipeline-1"); err != nil {
+		t.Fatalf("releaseKeepAlive() error = %v", err)
+	}
+	lt.clock.Advance(2 * time.Minute)
+	lt.assertState(t, stateReady)
+
+	if err := lt.lc.releaseKeepAlive(context.Background(), "pipeline-2"); err != nil {
+		t.Fatalf("releaseKeepAlive() error = %v", err)
+	}
+	lt.clock.Advance(time.Minute)
+	lt.assertState(t, stateIdle)
+	lt.assertScales(t, 1, 0)
+	if want := []int{1, 2, 1, 0}; !slices.Equal(leases, want) {
+		t.Errorf("lease counts = %v, want %v", leases, want)
+	}
+}
+
+// TestLifecycle_KeepAliveExpires verifies that a renewed lease lasts for its new TTL and that an expired
+// lease no longer holds buildkitd awake.
+func TestLifecycle_KeepAliveExpires(t *testing.T) {
+	lt := newKeepAliveTest(t)
+	lt.lc.acquireKeepAlive(context.Background(), "pipeline", 5*time.Minute)
+	lt.clock.Advance(4 * time.Minute)
+	expires, err := lt.lc.acquireKeepAlive(context.Background(), "pipeline", 5*time.Minute)
+	if err != nil || !expires.Equal(lt.clock.Now().Add(5*time.Minute)) {
+		t.Fatalf("renewing = %v, %v, want an expiry 5m from now", expires, err)
+	}
+	lt.clock.Advance(4 * time.Minute)
+	lt.assertState(t, stateReady)
+
+	lt.clock.Advance(time.Minute)
+	lt.assertState(t, stateReady)
+	lt.clock.Advance(time.Minute)
+	lt.assertState(t, stateIdle)
+	lt.assertScales(t, 1, 0)
+}
+
+// TestLifecycle_KeepAliveFollower verifies that a follower without a leader to forward to refuses leases, that
+// it rejects TTLs above the maximum before forwarding, and that losing leadership drops the leases held.
+func TestLifecycle_KeepAliveFollower(t *testing.T) {
+	lt := newKeepAliveTest(t)
+	lt.lc.acquireKeepAlive(context.Background(), "pipeline", 10*time.Minute)
+	lt.lc.stopLeading()
+	lt.clock.Advance(time.Minute)
+	if got := lt.lc.activity().lastActivity; !got.Before(lt.clock.Now()) {
+		t.Errorf("last activity = %v, want it no longer advanced by the dropped lease", got)
+	}
+	lt.lc.maxKeepAliveTTL = time.Hour
+	if _, err := lt.lc.acquireKeepAlive(context.Background(), "pipeline", 2*time.Hour); !errors.Is(err, errInvalidKeepAlive) {
+		t.Errorf("acquireKeepAlive() above the maximum TTL on a follower error = %v, want %v", err, errInvalidKeepAlive)
+	}
+	if _, err := lt.lc.acquireKeepAlive(context.Background(), "pipeline", 10*time.Minute); !errors.Is(err, errNotLeader) {
+		t.Errorf("acquireKeepAlive() on a follower error = %v, want %v", err, errNotLeader)
+	}
+	if err := lt.lc.releaseKeepAlive(context.Background(), "pipeline"); !errors.Is(err, errNotLeader) {
+		t.Errorf("releaseKeepAlive() on a follower error = %v, want %v", err, errNotLeader)
+	}
+}
+
+// callKeepAlive performs a request against the keep-alive endpoint.
+func callKeepAlive(t *testing.T, a *keepAliveAPI, method, path string) *httptest.ResponseRecorder {
+	t.Helper()
+	mux := http.NewServeMux()
+	a.register(mux)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequestWithContext(context.Background(), method, path, nil))
+	return rec
+}
+
+// TestKeepAliveAPI verifies acquiring and releasing a lease over HTTP, and that invalid TTLs and unknown
+// targets are rejected.
+func TestKeepAliveAPI(t *testing.T) {
+	lt := newKeepAliveTest(t)
+	target := &buildkitdTarget{targetSpec: targetSpec{namespace: testNamespace, name: testStsName}, scaler: lt.lc}
+	lt.lc.maxKeepAliveTTL = time.Hour
+	a := newKeepAliveAPI(newTargetSet([]*buildkitdTarget{target}))
+
+	for _, query := range []string{"?ttl=2h", "?ttl=0s", "?ttl=soon"} {
+		if rec := callKeepAlive(t, a, http.MethodPut, keepAlivePath+"/pipeline"+query); rec.Code != http.StatusBadRequest {
+			t.Errorf("PUT with %s = %d, want %d", query, rec.Code, http.StatusBadRequest)
+		}
+	}
+	if rec := callKeepAlive(t, a, http.MethodPut, keepAlivePath+"/pipeline?target="+testNamespace+"/unknown"); rec.Code != http.StatusNotFound {
+		t.Errorf("PUT for an unknown target = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	rec := callKeepAlive(t, a, http.MethodPut, keepAlivePath+"/pipeline?target="+testNamespace+"/"+testStsName+"&ttl=30m")
+	var info keepAliveInfo
+	if err := json.NewDecoder(rec.Body).Decode(&info); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("PUT = %d, %v, want %d with the lease", rec.Code, err, http.StatusOK)
+	}
+	if info.Name != "pipeline" || info.Target != testNamespace+"/"+testStsName || !info.Expires.Equal(lt.clock.Now().Add(30*time.Minute)) {
+		t.Errorf("lease = %+v, want pipeline on %s/%s expiring in 30m", info, testNamespace, testStsName)
+	}
+	lt.clock.Advance(10 * time.Minute)
+	lt.assertState(t, stateReady)
+
+	if rec := callKeepAlive(t, a, http.MethodDelete, keepAlivePath+"/pipeline"); rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	lt.clock.Advance(time.Minute)
+	lt.assertState(t, stateIdle)
+}
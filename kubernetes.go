@@ -6,13 +6,16 @@ import (
 	"fmt"
 	// "os" // No longer needed here
 	// "path/filepath" // No longer needed here
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
+	"go.opentelemetry.io/otel/trace"
 	appsv1 "k8s.io/api/apps/v1"
-	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes" // Interface definition
 
 	// "k8s.io/client-go/kubernetes" // Concrete type if needed elsewhere, but interface is preferred for params
@@ -56,73 +59,134 @@ type StatefulSetStatus struct {
 	ReadyReplicas   int32
 }
 
-// GetStatefulSetStatus fetches the specified StatefulSet from the Kubernetes API
-// and returns a StatefulSetStatus struct containing its desired, current, and ready replica counts.
-func GetStatefulSetStatus(clientset kubernetes.Interface, namespace, statefulSetName string) (*StatefulSetStatus, error) {
-	sts, err := clientset.AppsV1().StatefulSets(namespace).Get(context.TODO(), statefulSetName, metav1.GetOptions{})
-	if err != nil {
-		if apierrors.IsNotFound(err) {
-			return nil, fmt.Errorf("StatefulSet %s in namespace %s not found: %w", statefulSetName, namespace, err)
-		}
-		return nil, fmt.Errorf("error getting StatefulSet %s in namespace %s: %w", statefulSetName, namespace, err)
-	}
-
-	status := &StatefulSetStatus{
+// statefulSetStatusOf extracts the replica counts from a StatefulSet object.
+func statefulSetStatusOf(sts *appsv1.StatefulSet) *StatefulSetStatus {
+	return &StatefulSetStatus{
 		DesiredReplicas: *sts.Spec.Replicas,
 		CurrentReplicas: sts.Status.Replicas,
 		ReadyReplicas:   sts.Status.ReadyReplicas,
 	}
-	return status, nil
 }
 
 // ScaleStatefulSet scales the specified StatefulSet to the targetReplicas count.
 // It uses a strategic merge patch to update the .spec.replicas field.
-// It returns the updated StatefulSet object or an error if the patch fails.
-func ScaleStatefulSet(clientset kubernetes.Interface, namespace, statefulSetName string, targetReplicas int32) (*appsv1.StatefulSet, error) {
+// It returns the updated StatefulSet object or an error if the patch fails or ctx is cancelled.
+func ScaleStatefulSet(ctx context.Context, clientset kubernetes.Interface, namespace, statefulSetName string, targetReplicas int32) (*appsv1.StatefulSet, error) {
 	patchPayload := []byte(fmt.Sprintf(`{"spec":{"replicas":%d}}`, targetReplicas))
 
-	sts, err := clientset.AppsV1().StatefulSets(namespace).Patch(context.TODO(), statefulSetName, types.StrategicMergePatchType, patchPayload, metav1.PatchOptions{})
+	sts, err := clientset.AppsV1().StatefulSets(namespace).Patch(ctx, statefulSetName, types.StrategicMergePatchType, patchPayload, metav1.PatchOptions{})
 	if err != nil {
 		return nil, fmt.Errorf("error patching StatefulSet %s in namespace %s: %w", statefulSetName, namespace, err)
 	}
 	return sts, nil
 }
 
-// WaitForStatefulSetReady polls the status of the specified StatefulSet until its
-// readyReplicas count meets or exceeds expectedReadyReplicas, or until the timeout is reached.
-// It also checks for stability by ensuring currentReplicas and desiredReplicas match readyReplicas.
-func WaitForStatefulSetReady(clientset kubernetes.Interface, namespace, statefulSetName string, expectedReadyReplicas int32, timeout time.Duration) error {
-	return wait.PollImmediate(time.Second*5, timeout, func() (bool, error) {
-		status, err := GetStatefulSetStatus(clientset, namespace, statefulSetName)
-		if err != nil {
-			// If the StatefulSet is not found, we might be in a scale-down-to-zero scenario or creation is delayed.
-			// For scale-to-zero, if expected is 0 and it's not found, it could be considered ready.
-			// However, the current logic expects GetStatefulSetStatus to return an error if not found.
-			// We might need to refine this if IsNotFound should be treated as "0 replicas ready".
-			// For now, log the error and continue polling or return error if it's persistent.
-			logger.Debug("Polling: Error getting StatefulSet status. Retrying...", "statefulSet", statefulSetName, "namespace", namespace, "error", err)
-			// Do not return the error immediately, let PollImmediate retry.
-			// If the error is persistent (e.g. auth issues), PollImmediate will eventually time out.
-			// If it's a transient "NotFound" during creation, it might resolve.
-			return false, nil // Continue polling
+// readyOrdinalsOf returns the ordinals of the given StatefulSet pods that are Ready and not terminating,
+// in ascending order. Pods that do not belong to the StatefulSet are ignored.
+func readyOrdinalsOf(statefulSetName string, pods []*corev1.Pod) []int32 {
+	var ordinals []int32
+	for _, pod := range pods {
+		ordinal, ok := podOrdinal(statefulSetName, pod.Name)
+		if !ok || pod.DeletionTimestamp != nil || !isPodReady(pod) {
+			continue
 		}
+		ordinals = append(ordinals, ordinal)
+	}
+	slices.Sort(ordinals)
+	return ordinals
+}
+
+// podOrdinal extracts the ordinal from a StatefulSet pod name of the form <sts>-<ordinal>.
+// It returns false if the name does not belong to the StatefulSet.
+func podOrdinal(statefulSetName, podName string) (int32, bool) {
+	suffix, found := strings.CutPrefix(podName, statefulSetName+"-")
+	if !found {
+		return 0, false
+	}
+	ordinal, err := strconv.ParseInt(suffix, 10, 32)
+	if err != nil || ordinal < 0 {
+		return 0, false
+	}
+	return int32(ordinal), true
+}
 
-		logger.Debug("Polling StatefulSet status",
-			"statefulSet", statefulSetName, "namespace", namespace,
-			"desiredReplicas", status.DesiredReplicas, "currentReplicas", status.CurrentReplicas, "readyReplicas", status.ReadyReplicas,
-			"expectedReadyReplicas", expectedReadyReplicas)
-
-		if status.ReadyReplicas >= expectedReadyReplicas {
-			// Additionally, ensure current replicas also match desired, indicating stability post-scaling
-			// And that desired replicas match the expected ready replicas (or more, if scaling up beyond 1)
-			if status.CurrentReplicas == status.DesiredReplicas && status.ReadyReplicas == status.DesiredReplicas && status.DesiredReplicas >= expectedReadyReplicas {
-				logger.Info("StatefulSet is ready.", "statefulSet", statefulSetName, "namespace", namespace, "readyReplicas", status.ReadyReplicas)
-				return true, nil // Condition met
-			}
-			logger.Debug("Polling: StatefulSet ready replicas met, but current or desired not yet stable or matching expected.",
-				"statefulSet", statefulSetName, "namespace", namespace,
-				"readyReplicas", status.ReadyReplicas, "currentReplicas", status.CurrentReplicas, "desiredReplicas", status.DesiredReplicas)
+// isPodReady reports whether the pod's Ready condition is True.
+func isPodReady(pod *corev1.Pod) bool {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodReady {
+			return cond.Status == corev1.ConditionTrue
 		}
-		return false, nil // Condition not met, continue polling
-	})
+	}
+	return false
+}
+
+// isStatefulSetReady reports whether at least expectedReadyReplicas are ready and the StatefulSet is stable,
+// i.e. current replicas also match desired, and desired replicas match the expected ready replicas
+// (or more, if scaling up beyond 1).
+func isStatefulSetReady(status *StatefulSetStatus, expectedReadyReplicas int32) bool {
+	return status.ReadyReplicas >= expectedReadyReplicas &&
+		status.CurrentReplicas == status.DesiredReplicas &&
+		status.ReadyReplicas == status.DesiredReplicas &&
+		status.DesiredReplicas >= expectedReadyReplicas
+}
+
+// isStatefulSetScaledDown reports whether the StatefulSet is scaled to zero with no pods left, including terminating ones.
+func isStatefulSetScaledDown(status *StatefulSetStatus) bool {
+	return status.DesiredReplicas == 0 && status.CurrentReplicas == 0
+}
+
+// kubeScaleTarget implements scaleTarget against a StatefulSet in the Kubernetes API.
+// Reads and waits are served from the StatefulSet cache; only scaling calls the API server.
+type kubeScaleTarget struct {
+	clientset kubernetes.Interface
+	cache     *statefulSetCache
+	namespace string
+	name      string
+	// timeout bounds WaitReady and WaitTerminated.
+	timeout time.Duration
+}
+
+// Status returns the StatefulSet's cached replica counts.
+func (t kubeScaleTarget) Status() (*StatefulSetStatus, error) {
+	return t.cache.status()
+}
+
+// Scale patches the StatefulSet's desired replica count and records the scale event or failure.
+func (t kubeScaleTarget) Scale(ctx context.Context, replicas int32) error {
+	direction := scaleDirectionUp
+	if status, err := t.cache.status(); err == nil && replicas < status.DesiredReplicas {
+		direction = scaleDirectionDown
+	}
+	ctx, span := tracer.Start(ctx, "ScaleStatefulSet", targetAttributes(t.namespace, t.name), trace.WithAttributes(attrReplicas.Int64(int64(replicas))))
+	_, err := ScaleStatefulSet(ctx, t.clientset, t.namespace, t.name, replicas)
+	endSpan(span, err)
+	if err != nil {
+		recordScaleFailure(t.namespace, t.name, direction, err, false)
+		return err
+	}
+	scaleEvents.WithLabelValues(t.name, t.namespace, direction).Inc()
+	return nil
+}
+
+// WaitReady waits for the given number of replicas to become ready. A wait cancelled through ctx is not
+// counted as a scaling failure.
+func (t kubeScaleTarget) WaitReady(ctx context.Context, replicas int32) error {
+	ctx, span := tracer.Start(ctx, "WaitForStatefulSetReady", targetAttributes(t.namespace, t.name), trace.WithAttributes(attrReplicas.Int64(int64(replicas))))
+	err := t.cache.waitReady(ctx, replicas, t.timeout)
+	endSpan(span, err)
+	if err != nil && ctx.Err() == nil {
+		recordScaleFailure(t.namespace, t.name, scaleDirectionUp, err, true)
+	}
+	return err
+}
+
+// WaitTerminated waits for the StatefulSet's pods to be gone after a scale to zero.
+func (t kubeScaleTarget) WaitTerminated(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "WaitForStatefulSetScaledDown", targetAttributes(t.namespace, t.name))
+	err := t.cache.waitScaledDown(ctx, t.timeout)
+	endSpan(span, err)
+	if err != nil && ctx.Err() == nil {
+		recordScaleFailure(t.namespace, t.name, scaleDirectionDown, err, true)
+	}
+	return err
 }
@@ -8,13 +8,11 @@ import (
 	"os"
 	"strings"
 	"testing"
-	"time"
 
 	appsv1 "k8s.io/api/apps/v1"
-	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/kubernetes/fake"
 	k8stesting "k8s.io/client-go/testing"
 )
@@ -46,51 +44,6 @@ func newTestStatefulSet(name, namespace string, replicas int32) *appsv1.Stateful
 	}
 }
 
-// TestGetStatefulSetStatus_Found tests the GetStatefulSetStatus function
-// when the StatefulSet exists and is found by the client.
-// It verifies that the returned status matches the mock StatefulSet's data.
-func TestGetStatefulSetStatus_Found(t *testing.T) {
-	clientset := fake.NewSimpleClientset(newTestStatefulSet(testStsName, testNamespace, 3))
-	status, err := GetStatefulSetStatus(clientset, testNamespace, testStsName)
-
-	if err != nil {
-		t.Fatalf("GetStatefulSetStatus() error = %v, wantErr %v", err, false)
-	}
-	if status == nil {
-		t.Fatal("GetStatefulSetStatus() status is nil")
-	}
-	if status.DesiredReplicas != 3 {
-		t.Errorf("GetStatefulSetStatus() DesiredReplicas = %d, want %d", status.DesiredReplicas, 3)
-	}
-	if status.ReadyReplicas != 3 {
-		t.Errorf("GetStatefulSetStatus() ReadyReplicas = %d, want %d", status.ReadyReplicas, 3)
-	}
-}
-
-// TestGetStatefulSetStatus_NotFound tests the GetStatefulSetStatus function
-// when the specified StatefulSet does not exist.
-// It checks that an error is returned and that the error indicates a "not found" condition.
-func TestGetStatefulSetStatus_NotFound(t *testing.T) {
-	clientset := fake.NewSimpleClientset() // No objects
-	_, err := GetStatefulSetStatus(clientset, testNamespace, testStsName)
-
-	if err == nil {
-		t.Fatal("GetStatefulSetStatus() expected an error for not found, got nil")
-	}
-	if !apierrors.IsNotFound(err) { // Check the original error wrapped
-		// The function wraps the error, so we need to check the cause or type.
-		// For this test, we'll check if the error message contains "not found"
-		// as a simpler check, assuming the function correctly wraps apierrors.IsNotFound.
-		// A more robust check would involve errors.Is(err, someSpecificErrorType) if GetStatefulSetStatus returned a custom error type.
-		// Or, check the wrapped error directly if possible.
-		// For now, let's check the error message.
-		expectedMsg := fmt.Sprintf("StatefulSet %s in namespace %s not found", testStsName, testNamespace)
-		if err.Error() != expectedMsg+": "+apierrors.NewNotFound(schema.GroupResource{Group: "apps", Resource: "statefulsets"}, testStsName).Error() {
-			t.Errorf("GetStatefulSetStatus() error = %v, want error containing '%s'", err, expectedMsg)
-		}
-	}
-}
-
 // TestScaleStatefulSet_Success tests the ScaleStatefulSet function for a successful scaling operation.
 // It uses a fake client with a reactor to simulate a successful patch operation
 // and verifies that the returned StatefulSet reflects the updated replica count.
@@ -114,7 +67,7 @@ func TestScaleStatefulSet_Success(t *testing.T) {
 		return false, nil, fmt.Errorf("unexpected patch action: %+v", action)
 	})
 
-	updatedSts, err := ScaleStatefulSet(clientset, testNamespace, testStsName, targetReplicas)
+	updatedSts, err := ScaleStatefulSet(context.Background(), clientset, testNamespace, testStsName, targetReplicas)
 	if err != nil {
 		t.Fatalf("ScaleStatefulSet() error = %v, wantErr %v", err, false)
 	}
@@ -137,7 +90,7 @@ func TestScaleStatefulSet_Error(t *testing.T) {
 		return true, nil, fmt.Errorf("simulated API error on patch")
 	})
 
-	_, err := ScaleStatefulSet(clientset, testNamespace, testStsName, 3)
+	_, err := ScaleStatefulSet(context.Background(), clientset, testNamespace, testStsName, 3)
 	if err == nil {
 		t.Fatal("ScaleStatefulSet() expected an error, got nil")
 	}
@@ -147,100 +100,43 @@ func TestScaleStatefulSet_Error(t *testing.T) {
 	}
 }
 
-// TestWaitForStatefulSetReady_BecomesReady tests the WaitForStatefulSetReady function
-// when the StatefulSet eventually reaches the desired ready replica count.
-// It uses a reactor to simulate the StatefulSet's status changing over multiple polls.
-func TestWaitForStatefulSetReady_BecomesReady(t *testing.T) {
-	sts := newTestStatefulSet(testStsName, testNamespace, 0) // Start with 0 ready
-	clientset := fake.NewSimpleClientset(sts)
-	expectedReadyReplicas := int32(1)
-
-	// Simulate the StatefulSet becoming ready after a few polls
-	pollCount := 0
-	clientset.PrependReactor("get", "statefulsets", func(action k8stesting.Action) (handled bool, ret runtime.Object, err error) {
-		pollCount++
-		currentSts := sts.DeepCopy()
-		if pollCount >= 2 { // Becomes ready on the second GET
-			currentSts.Spec.Replicas = &expectedReadyReplicas
-			currentSts.Status.Replicas = expectedReadyReplicas
-			currentSts.Status.ReadyReplicas = expectedReadyReplicas
-		} else { // Still at 0
-			currentSts.Spec.Replicas = &expectedReadyReplicas // Controller has updated spec
-			currentSts.Status.Replicas = 0
-			currentSts.Status.ReadyReplicas = 0
-		}
-		return true, currentSts, nil
-	})
-
-	// Initialize logger for WaitForStatefulSetReady
-	// In a real test setup, you might pass a test-specific logger or mock slog.Default()
-	logger = slog.New(slog.NewTextHandler(io.Discard, nil)) // Discard logs for this test
-
-	err := WaitForStatefulSetReady(clientset, testNamespace, testStsName, expectedReadyReplicas, 100*time.Millisecond)
-	if err != nil {
-		t.Fatalf("WaitForStatefulSetReady() error = %v, wantErr %v", err, false)
-	}
-	if pollCount < 2 {
-		t.Errorf("Expected at least 2 polls for readiness, got %d", pollCount)
-	}
-}
-
-// TestWaitForStatefulSetReady_Timeout tests the WaitForStatefulSetReady function
-// when the StatefulSet does not become ready within the specified timeout.
-// It verifies that a timeout error (context.DeadlineExceeded or similar) is returned.
-func TestWaitForStatefulSetReady_Timeout(t *testing.T) {
-	sts := newTestStatefulSet(testStsName, testNamespace, 0) // Start with 0, never becomes ready
-	sts.Spec.Replicas = int32Ptr(1)                          // Controller desires 1
-	clientset := fake.NewSimpleClientset(sts)
-
-	// Reactor to always return 0 ready replicas
-	clientset.PrependReactor("get", "statefulsets", func(action k8stesting.Action) (handled bool, ret runtime.Object, err error) {
-		currentSts := sts.DeepCopy()
-		// Spec might be 1, but status never reaches ready
-		currentSts.Status.Replicas = 0
-		currentSts.Status.ReadyReplicas = 0
-		return true, currentSts, nil
-	})
-
-	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
-
-	err := WaitForStatefulSetReady(clientset, testNamespace, testStsName, 1, 50*time.Millisecond) // Short timeout
-	if err == nil {
-		t.Fatal("WaitForStatefulSetReady() expected a timeout error, got nil")
+// newTestPod is a helper function to create a pod belonging to the test StatefulSet
+// with the given name and readiness.
+func newTestPod(name string, ready bool) *corev1.Pod {
+	status := corev1.ConditionFalse
+	if ready {
+		status = corev1.ConditionTrue
 	}
-	if err != context.DeadlineExceeded && !strings.Contains(err.Error(), "timed out waiting for the condition") {
-		// wait.PollImmediate wraps the context.DeadlineExceeded error.
-		t.Errorf("WaitForStatefulSetReady() error = %v, want context.DeadlineExceeded or similar timeout error", err)
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: testNamespace,
+			Labels:    map[string]string{"app": testStsName},
+		},
+		Status: corev1.PodStatus{
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: status}},
+		},
 	}
 }
 
-// TestWaitForStatefulSetReady_NotFoundInitiallyThenAppears tests the scenario where
-// the StatefulSet is initially not found, but then appears and becomes ready.
-// This simulates cases where the StatefulSet is being created during the polling period.
-func TestWaitForStatefulSetReady_NotFoundInitiallyThenAppears(t *testing.T) {
-	clientset := fake.NewSimpleClientset() // STS doesn't exist initially
-	expectedReadyReplicas := int32(1)
-	notFoundError := apierrors.NewNotFound(schema.GroupResource{Group: "apps", Resource: "statefulsets"}, testStsName)
-
-	pollCount := 0
-	clientset.PrependReactor("get", "statefulsets", func(action k8stesting.Action) (handled bool, ret runtime.Object, err error) {
-		pollCount++
-		if pollCount == 1 { // First call, not found
-			return true, nil, notFoundError
+// TestPodOrdinal tests ordinal extraction from StatefulSet pod names.
+func TestPodOrdinal(t *testing.T) {
+	tests := []struct {
+		podName string
+		want    int32
+		wantOK  bool
+	}{
+		{"buildkitd-0", 0, true},
+		{"buildkitd-12", 12, true},
+		{"buildkitd-extra-0", 0, false},
+		{"other-1", 0, false},
+		{"buildkitd-", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := podOrdinal("buildkitd", tt.podName)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("podOrdinal(%q) = (%d, %v), want (%d, %v)", tt.podName, got, ok, tt.want, tt.wantOK)
 		}
-		// Subsequent calls, STS exists and is ready
-		stsReady := newTestStatefulSet(testStsName, testNamespace, expectedReadyReplicas)
-		return true, stsReady, nil
-	})
-
-	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
-
-	err := WaitForStatefulSetReady(clientset, testNamespace, testStsName, expectedReadyReplicas, 100*time.Millisecond)
-	if err != nil {
-		t.Fatalf("WaitForStatefulSetReady() error = %v; want nil. Poll count: %d", err, pollCount)
-	}
-	if pollCount < 2 {
-		t.Errorf("Expected at least 2 polls (1 not found, 1 found & ready), got %d", pollCount)
 	}
 }
 
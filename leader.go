@@ -0,0 +1,778 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// Leader election timings. The leader renews its Lease every leaderRetryPeriod; a new leader takes over
+// at most leaderLeaseDuration after the old one stopped renewing.
+const (
+	leaderLeaseDuration = 15 * time.Second
+	leaderRenewDeadline = 10 * time.Second
+	leaderRetryPeriod   = 2 * time.Second
+)
+
+// activityReportInterval is how often followers report their connection counts to the leader, in addition
+// to reporting every change. A follower that has not reported for peerActivityTTL is forgotten.
+const (
+	activityReportInterval = 5 * time.Second
+	peerActivityTTL        = 3 * activityReportInterval
+)
+
+// Paths of the leader endpoints, served on the health listener of every replica.
+const (
+	leaderActivityPath  = "/leader/activity"
+	leaderWakePath      = "/leader/wake"
+	leaderPinPath       = "/leader/pin"
+	leaderUnpinPath     = "/leader/unpin"
+	leaderSleepPath     = "/leader/sleep"
+	leaderKeepAlivePath = "/leader/keepalive"
+)
+
+// keepAliveForwardTimeout bounds a keep-alive lease request forwarded to the leader.
+const keepAliveForwardTimeout = 10 * time.Second
+
+// leaderOverrideTimeout bounds a pin, unpin or sleep request forwarded to the leader.
+const leaderOverrideTimeout = 10 * time.Second
+
+// leaderOverrideStatus is the status code the leader answers a forwarded override with for each of its
+// errors. The follower turns it back into the error, so its admin API responds as the leader's would.
+var leaderOverrideStatus = map[error]int{
+	errInvalidPin:           http.StatusBadRequest,
+	errActiveConnections:    http.StatusPreconditionFailed,
+	errTransitionInProgress: http.StatusServiceUnavailable,
+	errNotLeader:            http.StatusConflict,
+}
+
+// leasePermissions are the permissions needed on the leader election Lease.
+var leasePermissions = []requiredPermission{
+	{"coordination.k8s.io", "leases", "get"},
+	{"coordination.k8s.io", "leases", "create"},
+	{"coordination.k8s.io", "leases", "update"},
+}
+
+// activityReport is the body of a follower's POST to leaderActivityPath.
+type activityReport struct {
+	Identity string `json:"identity"`
+	// Connections is the follower's number of active connections, by target key.
+	Connections map[string]int64 `json:"connections"`
+	// Backends is the follower's number of connections per buildkitd ordinal, by target key. Ordinals
+	// without connections are omitted.
+	Backends map[string]map[int32]int64 `json:"backends,omitempty"`
+	// Draining is the ordinal the follower has stopped routing new connections to, by target key.
+	Draining map[string]int32 `json:"draining,omitempty"`
+}
+
+// activityResponse is the leader's answer to an activity report.
+type activityResponse struct {
+	// Draining is the ordinal the leader is draining, by target key. Followers must stop routing new
+	// connections to it.
+	Draining map[string]int32 `json:"draining,omitempty"`
+	// Replicas are the identities of every replica the leader hears from, itself included, so the admin API
+	// of any replica can reach the connections of the others.
+	Replicas []string `json:"replicas,omitempty"`
+}
+
+// remoteActivity is the activity reported by all followers together for one target.
+type remoteActivity struct {
+	// connections is the total number of connections.
+	connections int64
+	// backends is the total number of connections per buildkitd ordinal.
+	backends map[int32]int64
+	// peers is the number of followers reporting.
+	peers int
+	// drainAcks is the number of followers that have stopped routing new connections to each ordinal.
+	drainAcks map[int32]int
+}
+
+// peerActivity tracks the connection counts reported by followers. Reports older than peerActivityTTL are
+// dropped, so a follower that went away without reporting zero does not keep buildkitd awake.
+type peerActivity struct {
+	mu    sync.Mutex
+	clock clock
+	peers map[string]peerReport
+	// onChange, if set, is called with the followers' activity outside mu after every update.
+	onChange func(remoteActivity)
+}
+
+// peerReport is the last report received from a follower for one target.
+type peerReport struct {
+	connections int64
+	// backends is the number of connections per buildkitd ordinal.
+	backends map[int32]int64
+	// draining is the ordinal the follower has stopped routing new connections to, or nil.
+	draining *int32
+	seen     time.Time
+}
+
+// newPeerActivity creates an empty peerActivity.
+func newPeerActivity(clk clock, onChange func(remoteActivity)) *peerActivity {
+	return &peerActivity{clock: clk, peers: make(map[string]peerReport), onChange: onChange}
+}
+
+// report records a follower's activity.
+func (p *peerActivity) report(identity string, r peerReport) {
+	p.update(func() {
+		r.seen = p.clock.Now()
+		p.peers[identity] = r
+	})
+}
+
+// expire forgets followers that have not reported within peerActivityTTL.
+func (p *peerActivity) expire() {
+	p.update(func() {
+		now := p.clock.Now()
+		for identity, r := range p.peers {
+			if now.Sub(r.seen) > peerActivityTTL {
+				logger.Info("Dropping connection count of silent autoscaler replica", "identity", identity, "activeConnections", r.connections)
+				delete(p.peers, identity)
+			}
+		}
+	})
+}
+
+// reset forgets every follower, for when this replica stops leading.
+func (p *peerActivity) reset() {
+	p.update(func() {
+		clear(p.peers)
+	})
+}
+
+// update applies fn under mu and calls onChange with the resulting activity.
+func (p *peerActivity) update(fn func()) {
+	p.mu.Lock()
+	fn()
+	activity := p.activityLocked()
+	p.mu.Unlock()
+
+	if p.onChange != nil {
+		p.onChange(activity)
+	}
+}
+
+// identities returns the identities of the followers that reported.
+func (p *peerActivity) identities() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Collect(maps.Keys(p.peers))
+}
+
+// activity returns the sum of the activity reported by followers.
+func (p *peerActivity) activity() remoteActivity {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.activityLocked()
+}
+
+// activityLocked returns the sum of the reported activity. Must be called under mu.
+func (p *peerActivity) activityLocked() remoteActivity {
+	a := remoteActivity{backends: make(map[int32]int64), peers: len(p.peers), drainAcks: make(map[int32]int)}
+	for _, r := range p.peers {
+		a.connections += r.connections
+		for ordinal, n := range r.backends {
+			a.backends[ordinal] += n
+		}
+		if r.draining != nil {
+			a.drainAcks[*r.draining]++
+		}
+	}
+	return a
+}
+
+// leaderElector lets several autoscaler replicas share the buildkitd StatefulSets. Every replica proxies
+// traffic, but only the holder of the Lease runs the lifecycles' scaling and idle timers. Followers report
+// their connection counts to the leader and forward cold-start wake-ups to it over the health listener. In
+// return the leader tells them which ordinals it is draining, so they stop routing new connections to them.
+type leaderElector struct {
+	clientset kubernetes.Interface
+	namespace string
+	leaseName string
+	// identity names this replica in the Lease as "<pod>@<advertise address>", so followers can
+	// find the leader's endpoints from the Lease holder.
+	identity string
+	// targets are the StatefulSets scaled by the leader, by key.
+	targets map[string]*buildkitdTarget
+	// peers tracks the connection counts reported by followers, by target key.
+	peers  map[string]*peerActivity
+	client *http.Client
+	// waitLocal blocks until this replica's own view of a target has ready replicas.
+	waitLocal func(ctx context.Context, t *buildkitdTarget) error
+	// leading is true while this replica holds the Lease and its lifecycles are started.
+	leading atomic.Bool
+
+	mu sync.Mutex
+	// leaderAddr is the advertise address of the current leader, empty while unknown.
+	leaderAddr string
+	// activityChanged asks the reporter to send the connection counts now.
+	activityChanged chan struct{}
+	// draining is the ordinal this follower stopped routing to because the leader is draining it, by target key.
+	draining map[string]int32
+	// replicaIdentities are the identities of all replicas as last reported by the leader.
+	replicaIdentities []string
+	// peerToken is the bearer token shared by all replicas, which the leader endpoints require and requests to
+	// the leader carry, so other pods cannot report connections or trigger scaling.
+	peerToken string
+}
+
+// newLeaderElector creates a leaderElector for the targets and hooks it into their lifecycles. Replicas
+// authenticate to each other with peerToken.
+func newLeaderElector(clientset kubernetes.Interface, namespace, leaseName, podName, advertiseAddr, peerToken string, targets []*buildkitdTarget) *leaderElector {
+	le := &leaderElector{
+		clientset:       clientset,
+		namespace:       namespace,
+		leaseName:       leaseName,
+		identity:        podName + "@" + advertiseAddr,
+		targets:         make(map[string]*buildkitdTarget, len(targets)),
+		peers:           make(map[string]*peerActivity, len(targets)),
+		client:          &http.Client{},
+		waitLocal:       func(ctx context.Context, t *buildkitdTarget) error { return t.waitLocalReady(ctx) },
+		activityChanged: make(chan struct{}, 1),
+		peerToken:       peerToken,
+	}
+	for _, t := range targets {
+		le.targets[t.key()] = t
+		le.peers[t.key()] = newPeerActivity(realClock{}, t.scaler.setRemoteActivity)
+		t.scaler.forwardWake = func(ctx context.Context) error { return le.forwardWake(ctx, t) }
+		t.scaler.forwardPin = func(ctx context.Context, pin *pinState) error { return le.forwardPin(ctx, t, pin) }
+		t.scaler.forwardSleep = func(ctx context.Context, force bool) error { return le.forwardSleep(ctx, t, force) }
+		t.scaler.forwardKeepAlive = func(ctx context.Context, name string, ttl time.Duration) error {
+			return le.forwardKeepAlive(ctx, t, name, ttl)
+		}
+		t.scaler.onConnectionsChanged = le.notifyActivity
+	}
+	return le
+}
+
+// advertiseAddrOf returns the address part of a Lease holder identity.
+func advertiseAddrOf(identity string) string {
+	if i := strings.LastIndex(identity, "@"); i >= 0 {
+		return identity[i+1:]
+	}
+	return ""
+}
+
+// run takes part in leader election until ctx is cancelled. It campaigns again whenever leadership is lost.
+func (le *leaderElector) run(ctx context.Context) {
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Name: le.leaseName, Namespace: le.namespace},
+		Client:     le.clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: le.identity},
+	}
+	go le.reportActivity(ctx)
+
+	for ctx.Err() == nil {
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			LeaseDuration:   leaderLeaseDuration,
+			RenewDeadline:   leaderRenewDeadline,
+			RetryPeriod:     leaderRetryPeriod,
+			ReleaseOnCancel: true,
+			Name:            le.leaseName,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(context.Context) {
+					logger.Info("Became leader. Taking over scaling.", "identity", le.identity, "lease", le.leaseName)
+					leaderGauge.Set(1)
+					le.setDraining(nil)
+					for _, t := range le.targets {
+						t.scaler.start()
+					}
+					le.leading.Store(true)
+				},
+				OnStoppedLeading: func() {
+					leaderGauge.Set(0)
+					le.leading.Store(false)
+					for key, t := range le.targets {
+						le.peers[key].reset()
+						t.scaler.stopLeading()
+					}
+				},
+				OnNewLeader: func(identity string) {
+					logger.Info("Autoscaler leader changed", "leader", identity, "self", identity == le.identity)
+					le.setLeader(advertiseAddrOf(identity))
+				},
+			},
+		})
+	}
+}
+
+// setLeader records the current leader's address and reports this replica's activity to it.
+func (le *leaderElector) setLeader(addr string) {
+	le.mu.Lock()
+	le.leaderAddr = addr
+	le.mu.Unlock()
+	le.notifyActivity()
+}
+
+// leader returns the current leader's address, or "" while it is unknown or this replica is the leader.
+func (le *leaderElector) leader() string {
+	if le.leading.Load() {
+		return ""
+	}
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	return le.leaderAddr
+}
+
+// notifyActivity asks the reporter to send the connection counts to the leader without waiting for the next tick.
+func (le *leaderElector) notifyActivity() {
+	select {
+	case le.activityChanged <- struct{}{}:
+	default:
+	}
+}
+
+// reportActivity sends this replica's connection counts to the leader on every change and every
+// activityReportInterval. The leader uses the interval to expire followers that went away.
+func (le *leaderElector) reportActivity(ctx context.Context) {
+	ticker := time.NewTicker(activityReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, p := range le.peers {
+				p.expire()
+			}
+		case <-le.activityChanged:
+		}
+
+		addr := le.leader()
+		if addr == "" {
+			continue
+		}
+		if err := le.sendActivity(ctx, addr); err != nil {
+			logger.Warn("Failed to report connection activity to the leader", "leader", addr, "error", err)
+		}
+	}
+}
+
+// sendActivity reports this replica's connection counts, per backend, and the ordinals it stopped routing
+// to, to the leader at addr. It then follows the leader's drains.
+func (le *leaderElector) sendActivity(ctx context.Context, addr string) error {
+	le.mu.Lock()
+	draining := maps.Clone(le.draining)
+	le.mu.Unlock()
+	report := activityReport{
+		Identity:    le.identity,
+		Connections: make(map[string]int64, len(le.targets)),
+		Backends:    make(map[string]map[int32]int64, len(le.targets)),
+		Draining:    draining,
+	}
+	for key, t := range le.targets {
+		report.Connections[key] = t.scaler.activeConnectionCount()
+		if counts := t.backends.connectionCounts(); len(counts) > 0 {
+			report.Backends[key] = counts
+		}
+	}
+	var resp activityResponse
+	if err := le.post(ctx, addr, leaderActivityPath, report, &resp, activityReportInterval); err != nil {
+		return err
+	}
+	le.mu.Lock()
+	le.replicaIdentities = resp.Replicas
+	le.mu.Unlock()
+	if le.setDraining(resp.Draining) {
+		// Acknowledge the drain straight away, so the leader does not wait for the next tick.
+		le.notifyActivity()
+	}
+	return nil
+}
+
+// replicas returns the identities of the other replicas, sorted: the followers that report to this replica
+// while it leads, or the replicas the leader last reported otherwise.
+func (le *leaderElector) replicas() []string {
+	var identities []string
+	if le.leading.Load() {
+		identities = le.knownReplicas()
+	} else {
+		le.mu.Lock()
+		identities = slices.Clone(le.replicaIdentities)
+		le.mu.Unlock()
+	}
+	identities = slices.DeleteFunc(identities, func(identity string) bool { return identity == le.identity })
+	slices.Sort(identities)
+	return identities
+}
+
+// knownReplicas returns this replica's identity and those of the followers reporting to it, sorted.
+func (le *leaderElector) knownReplicas() []string {
+	seen := map[string]bool{le.identity: true}
+	for _, p := range le.peers {
+		for _, identity := range p.identities() {
+			seen[identity] = true
+		}
+	}
+	return slices.Sorted(maps.Keys(seen))
+}
+
+// setDraining stops routing new connections to the ordinals the leader is draining, by target key, and
+// routes to previously drained ordinals again. It reports whether any drained ordinal changed.
+func (le *leaderElector) setDraining(draining map[string]int32) bool {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	changed := false
+	for key, t := range le.targets {
+		prev, had := le.draining[key]
+		ordinal, has := draining[key]
+		if had && (!has || ordinal != prev) {
+			t.backends.setDraining(prev, false)
+		}
+		if has {
+			// Marked on every report, as the pool forgets the mark once the pod left the ready set.
+			t.backends.setDraining(ordinal, true)
+		}
+		if had != has || ordinal != prev {
+			changed = true
+			if has {
+				t.scaler.log.Info("The leader is draining a buildkitd pod. No longer routing new connections to it.", "ordinal", ordinal)
+			}
+		}
+	}
+	le.draining = maps.Clone(draining)
+	return changed
+}
+
+// forwardWake asks the leader to scale target up and waits until this replica sees ready replicas.
+// While the leader is unknown or changing it retries until the target's ready-wait timeout or until ctx is
+// cancelled.
+func (le *leaderElector) forwardWake(ctx context.Context, target *buildkitdTarget) error {
+	ctx, cancel := context.WithTimeout(ctx, target.readyWaitTimeout)
+	defer cancel()
+
+	for {
+		if le.leading.Load() {
+			// Became the leader while waiting; wake through the lifecycle directly.
+			return target.scaler.wake(ctx)
+		}
+		addr := le.leader()
+		var err error
+		if addr == "" {
+			err = errNotLeader
+		} else {
+			logger.Info("Forwarding scale-up request to the leader", "leader", addr, "target", target.key())
+			err = le.post(ctx, addr, leaderWakePath+"?target="+url.QueryEscape(target.key()), nil, nil, target.readyWaitTimeout)
+		}
+		switch {
+		case err == nil:
+			return le.waitLocal(ctx, target)
+		case !errors.Is(err, errNotLeader):
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("no autoscaler leader available to scale up buildkitd: %w", ctx.Err())
+		case <-time.After(leaderRetryPeriod):
+		}
+	}
+}
+
+// forwardKeepAlive acquires or renews the keep-alive lease name on target for ttl on the leader, or releases
+// it if ttl is zero. Unlike a wake it is not retried: while the leader is unknown or changing it fails with
+// errNotLeader, and the lease's holder retries with its next renewal.
+func (le *leaderElector) forwardKeepAlive(ctx context.Context, target *buildkitdTarget, name string, ttl time.Duration) error {
+	addr := le.leader()
+	if addr == "" {
+		return errNotLeader
+	}
+	query := url.Values{"target": {target.key()}, "name": {name}, "ttl": {ttl.String()}}
+	return le.post(ctx, addr, leaderKeepAlivePath+"?"+query.Encode(), nil, nil, keepAliveForwardTimeout)
+}
+
+// forwardPin asks the leader to pin target, or to remove its pin if pin is nil.
+func (le *leaderElector) forwardPin(ctx context.Context, target *buildkitdTarget, pin *pinState) error {
+	if pin == nil {
+		return le.forwardOverride(ctx, leaderUnpinPath, target, nil, nil)
+	}
+	return le.forwardOverride(ctx, leaderPinPath, target, nil, pin.record())
+}
+
+// forwardSleep asks the leader to scale target to zero.
+func (le *leaderElector) forwardSleep(ctx context.Context, target *buildkitdTarget, force bool) error {
+	return le.forwardOverride(ctx, leaderSleepPath, target, url.Values{"force": {strconv.FormatBool(force)}}, nil)
+}
+
+// forwardOverride posts a manual override of target to path on the leader. A failure the leader reports
+// with one of the leaderOverrideStatus codes is returned as the matching error, and errNotLeader if no
+// leader is known.
+func (le *leaderElector) forwardOverride(ctx context.Context, path string, target *buildkitdTarget, query url.Values, body any) error {
+	addr := le.leader()
+	if addr == "" {
+		return errNotLeader
+	}
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("target", target.key())
+	logger.Info("Forwarding override to the leader", "leader", addr, "path", path, "target", target.key())
+	err := le.post(ctx, addr, path+"?"+query.Encode(), body, nil, leaderOverrideTimeout)
+	var respErr *leaderResponseError
+	if errors.As(err, &respErr) {
+		for cause, code := range leaderOverrideStatus {
+			if respErr.code == code {
+				respErr.cause = cause
+			}
+		}
+	}
+	return err
+}
+
+// leaderResponseError is an unexpected response from the leader. It wraps cause, if one was identified
+// from the status code.
+type leaderResponseError struct {
+	addr   string
+	status string
+	code   int
+	msg    string
+	cause  error
+}
+
+func (e *leaderResponseError) Error() string {
+	return fmt.Sprintf("leader %s responded %s: %s", e.addr, e.status, e.msg)
+}
+
+func (e *leaderResponseError) Unwrap() error {
+	return e.cause
+}
+
+// post sends body as JSON to path on the replica at addr and decodes a JSON response into out, if set.
+// A 409 response is returned as errNotLeader.
+func (le *leaderElector) post(ctx context.Context, addr, path string, body, out any, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+addr+path, &payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+le.peerToken)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	resp, err := le.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if out != nil {
+			return json.NewDecoder(resp.Body).Decode(out)
+		}
+		return nil
+	case http.StatusNoContent:
+		return nil
+	case http.StatusConflict:
+		return errNotLeader
+	default:
+		var msg bytes.Buffer
+		msg.ReadFrom(resp.Body)
+		return &leaderResponseError{addr: addr, status: resp.Status, code: resp.StatusCode, msg: strings.TrimSpace(msg.String())}
+	}
+}
+
+// register adds the leader endpoints to mux, each requiring the peer token.
+func (le *leaderElector) register(mux *http.ServeMux) {
+	const realm = "buildkitd-proxy peers"
+	mux.Handle("POST "+leaderActivityPath, requireBearerToken(le.peerToken, realm, http.HandlerFunc(le.serveActivity)))
+	mux.Handle("POST "+leaderWakePath, requireBearerToken(le.peerToken, realm, http.HandlerFunc(le.serveWake)))
+	mux.Handle("POST "+leaderPinPath, requireBearerToken(le.peerToken, realm, http.HandlerFunc(le.servePin)))
+	mux.Handle("POST "+leaderUnpinPath, requireBearerToken(le.peerToken, realm, http.HandlerFunc(le.serveUnpin)))
+	mux.Handle("POST "+leaderSleepPath, requireBearerToken(le.peerToken, realm, http.HandlerFunc(le.serveSleep)))
+	mux.Handle("POST "+leaderKeepAlivePath, requireBearerToken(le.peerToken, realm, http.HandlerFunc(le.serveKeepAlive)))
+}
+
+// serveActivity records a follower's connection counts and answers with the ordinals being drained.
+// Counts for unknown targets are ignored.
+func (le *leaderElector) serveActivity(w http.ResponseWriter, r *http.Request) {
+	if !le.leading.Load() {
+		http.Error(w, errNotLeader.Error(), http.StatusConflict)
+		return
+	}
+	var report activityReport
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil || report.Identity == "" {
+		http.Error(w, "invalid activity report", http.StatusBadRequest)
+		return
+	}
+	for key, connections := range report.Connections {
+		p, ok := le.peers[key]
+		if !ok {
+			continue
+		}
+		r := peerReport{connections: connections, backends: report.Backends[key]}
+		if ordinal, ok := report.Draining[key]; ok {
+			r.draining = &ordinal
+		}
+		p.report(report.Identity, r)
+	}
+
+	resp := activityResponse{Draining: make(map[string]int32), Replicas: le.knownReplicas()}
+	for key, t := range le.targets {
+		if ordinal, ok := t.scaler.drainingOrdinal(); ok {
+			resp.Draining[key] = ordinal
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// serveWake scales the target named by the "target" query parameter up on behalf of a follower,
+// sharing the scale-up with local connections.
+func (le *leaderElector) serveWake(w http.ResponseWriter, r *http.Request) {
+	if !le.leading.Load() {
+		http.Error(w, errNotLeader.Error(), http.StatusConflict)
+		return
+	}
+	target, ok := le.targets[r.URL.Query().Get("target")]
+	if !ok {
+		http.Error(w, "unknown target", http.StatusNotFound)
+		return
+	}
+	// The follower's request is cancelled when its client gives up; the shared scale-up carries on regardless.
+	// It is traced as part of the follower's connection.
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	if err := target.coldStarts.do(ctx, target.readyWaitTimeout, target.scaler.wake); err != nil {
+		logger.Error("Scale-up requested by a follower failed", "error", err, "cause", failureCause(err), "target", target.key())
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// servePin pins the target named by the "target" query parameter to the pin in the body on behalf of a
+// follower's admin API.
+func (le *leaderElector) servePin(w http.ResponseWriter, r *http.Request) {
+	target := le.overrideTarget(w, r)
+	if target == nil {
+		return
+	}
+	var record pinRecord
+	if err := json.NewDecoder(r.Body).Decode(&record); err != nil {
+		http.Error(w, "invalid pin", http.StatusBadRequest)
+		return
+	}
+	pin := pinState{replicas: record.Replicas}
+	if record.Until != nil {
+		pin.until = *record.Until
+	}
+	le.writeOverrideResult(w, target.scaler.setPin(r.Context(), pin))
+}
+
+// serveUnpin removes the pin of the target named by the "target" query parameter on behalf of a follower's
+// admin API.
+func (le *leaderElector) serveUnpin(w http.ResponseWriter, r *http.Request) {
+	target := le.overrideTarget(w, r)
+	if target == nil {
+		return
+	}
+	le.writeOverrideResult(w, target.scaler.clearPin(r.Context()))
+}
+
+// serveSleep scales the target named by the "target" query parameter to zero on behalf of a follower's
+// admin API, even with connections active if "force" is true. The follower closes the connections.
+func (le *leaderElector) serveSleep(w http.ResponseWriter, r *http.Request) {
+	target := le.overrideTarget(w, r)
+	if target == nil {
+		return
+	}
+	force, err := strconv.ParseBool(r.URL.Query().Get("force"))
+	if err != nil {
+		http.Error(w, "invalid force parameter", http.StatusBadRequest)
+		return
+	}
+	le.writeOverrideResult(w, target.scaler.sleep(r.Context(), force))
+}
+
+// overrideTarget returns the target named by the "target" query parameter of a forwarded override, or
+// responds with an error and returns nil, also if this replica is not the leader.
+func (le *leaderElector) overrideTarget(w http.ResponseWriter, r *http.Request) *buildkitdTarget {
+	if !le.leading.Load() {
+		http.Error(w, errNotLeader.Error(), http.StatusConflict)
+		return nil
+	}
+	target, ok := le.targets[r.URL.Query().Get("target")]
+	if !ok {
+		http.Error(w, "unknown target", http.StatusNotFound)
+		return nil
+	}
+	return target
+}
+
+// writeOverrideResult responds to a forwarded override with its error, using the leaderOverrideStatus code
+// the follower recognizes.
+func (le *leaderElector) writeOverrideResult(w http.ResponseWriter, err error) {
+	if err == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	code := http.StatusInternalServerError
+	for cause, c := range leaderOverrideStatus {
+		if errors.Is(err, cause) {
+			code = c
+		}
+	}
+	http.Error(w, err.Error(), code)
+}
+
+// serveKeepAlive acquires, renews or, with a zero "ttl", releases the keep-alive lease "name" on the target
+// named by the "target" query parameter on behalf of a follower.
+func (le *leaderElector) serveKeepAlive(w http.ResponseWriter, r *http.Request) {
+	if !le.leading.Load() {
+		http.Error(w, errNotLeader.Error(), http.StatusConflict)
+		return
+	}
+	query := r.URL.Query()
+	target, ok := le.targets[query.Get("target")]
+	if !ok {
+		http.Error(w, "unknown target", http.StatusNotFound)
+		return
+	}
+	name := query.Get("name")
+	ttl, err := time.ParseDuration(query.Get("ttl"))
+	if name == "" || err != nil || ttl < 0 {
+		http.Error(w, "invalid keep-alive lease request", http.StatusBadRequest)
+		return
+	}
+	if ttl == 0 {
+		err = target.scaler.releaseKeepAlive(r.Context(), name)
+	} else {
+		_, err = target.scaler.acquireKeepAlive(r.Context(), name, ttl)
+	}
+	if errors.Is(err, errInvalidKeepAlive) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		// Leadership is changing; the follower reports it and the lease's holder retries.
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
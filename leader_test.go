@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// TestPeerActivity verifies that follower reports are summed and that silent followers expire.
+func TestPeerActivity(t *testing.T) {
+	clk := newFakeClock()
+	var totals []int64
+	p := newPeerActivity(clk, func(a remoteActivity) { totals = append(totals, a.connections) })
+	one := int32(1)
+
+	p.report("a", peerReport{connections: 2, backends: map[int32]int64{0: 1, 1: 1}, draining: &one})
+	p.report("b", peerReport{connections: 3, backends: map[int32]int64{1: 3}})
+	p.report("b", peerReport{connections: 3, backends: map[int32]int64{1: 3}})
+	a := p.activity()
+	if a.connections != 5 || a.peers != 2 {
+		t.Fatalf("activity() = %d connections from %d peers, want 5 from 2", a.connections, a.peers)
+	}
+	if a.backends[0] != 1 || a.backends[1] != 4 {
+		t.Errorf("activity().backends = %v, want map[0:1 1:4]", a.backends)
+	}
+	if a.drainAcks[1] != 1 {
+		t.Errorf("activity().drainAcks = %v, want map[1:1]", a.drainAcks)
+	}
+
+	clk.Advance(peerActivityTTL / 2)
+	p.report("a", peerReport{connections: 1})
+	clk.Advance(peerActivityTTL/2 + time.Second)
+	p.expire()
+	if a := p.activity(); a.connections != 1 || a.peers != 1 {
+		t.Errorf("activity() after b went silent = %d connections from %d peers, want 1 from 1", a.connections, a.peers)
+	}
+	if want := []int64{2, 5, 5, 4, 1}; !slices.Equal(totals, want) {
+		t.Errorf("onChange totals = %v, want %v", totals, want)
+	}
+}
+
+// testPeerToken is the peer token of the electors created by newTestElector.
+const testPeerToken = "p33r"
+
+// newTestElector creates a leading leaderElector over a target with a started lifecycle.
+func newTestElector(t *testing.T, waitLocal func(context.Context, *buildkitdTarget) error) (*leaderElector, *lifecycleTest) {
+	t.Helper()
+	lt := newLifecycleTest(t, scalePolicy{targetConnectionsPerReplica: 1, minReplicas: 1, maxReplicas: 3}, time.Minute)
+	target := &buildkitdTarget{
+		targetSpec: targetSpec{namespace: testNamespace, name: testStsName, readyWaitTimeout: time.Second},
+		backends:   lt.lc.pool,
+		coldStarts: newScaleUpGroup(defaultMaxPendingConnections),
+		scaler:     lt.lc,
+	}
+	le := newLeaderElector(fake.NewSimpleClientset(), testNamespace, testStsName+"-autoscaler", "autoscaler-0", "127.0.0.1:8081", testPeerToken, []*buildkitdTarget{target})
+	if waitLocal != nil {
+		le.waitLocal = waitLocal
+	}
+	le.leading.Store(true)
+	return le, lt
+}
+
+// stopLeading turns the elector and its lifecycle into a follower, as losing the Lease does.
+func stopLeading(le *leaderElector, lt *lifecycleTest) {
+	le.leading.Store(false)
+	lt.lc.stopLeading()
+}
+
+// postLeader performs a POST with the peer token against the leader endpoints and returns the status code.
+func postLeader(t *testing.T, le *leaderElector, path, body string) int {
+	t.Helper()
+	return postLeaderWithToken(t, le, path, body, testPeerToken)
+}
+
+// postLeaderWithToken performs a POST against the leader endpoints with the given bearer token, if any, and
+// returns the status code.
+func postLeaderWithToken(t *testing.T, le *leaderElector, path, body, token string) int {
+	t.Helper()
+	mux := http.NewServeMux()
+	le.register(mux)
+	req := httptest.NewRequestWithContext(context.Background(), http.MethodPost, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+// TestLeaderElector_RequiresPeerToken verifies that the leader endpoints reject requests without the peer
+// token, and that a follower with another token cannot forward to the leader.
+func TestLeaderElector_RequiresPeerToken(t *testing.T) {
+	le, lt := newTestElector(t, nil)
+	report := `{"identity":"intruder@10.0.0.9:8081","connections":{"` + testNamespace + "/" + testStsName + `":3}}`
+	for _, path := range []string{leaderActivityPath, leaderWakePath, leaderPinPath, leaderUnpinPath, leaderSleepPath} {
+		for _, token := range []string{"", "wrong"} {
+			if code := postLeaderWithToken(t, le, path, report, token); code != http.StatusUnauthorized {
+				t.Errorf("POST %s with token %q = %d, want %d", path, token, code, http.StatusUnauthorized)
+			}
+		}
+	}
+	lt.assertScales(t)
+
+	mux := http.NewServeMux()
+	le.register(mux)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	follower, followerTest := newTestElector(t, nil)
+	follower.peerToken = "wrong"
+	stopLeading(follower, followerTest)
+	follower.setLeader(strings.TrimPrefix(srv.URL, "http://"))
+	if err := followerTest.lc.wake(context.Background()); err == nil || errors.Is(err, errNotLeader) {
+		t.Errorf("wake() forwarded with the wrong token error = %v, want the leader's refusal", err)
+	}
+	lt.assertScales(t)
+}
+
+// TestLeaderElector_ServeActivity verifies that the leader scales for connections reported by followers
+// and that followers refuse reports.
+func TestLeaderElector_ServeActivity(t *testing.T) {
+	le, lt := newTestElector(t, nil)
+
+	report := `{"identity":"autoscaler-1@10.0.0.2:8081","connections":{"` + testNamespace + "/" + testStsName + `":2,"other/sts":5}}`
+	if code := postLeader(t, le, leaderActivityPath, report); code != http.StatusOK {
+		t.Fatalf("POST %s = %d, want %d", leaderActivityPath, code, http.StatusOK)
+	}
+	if err := lt.lc.wake(context.Background()); err != nil {
+		t.Fatalf("wake() error = %v", err)
+	}
+	lt.assertScales(t, 2)
+
+	if code := postLeader(t, le, leaderActivityPath, `{}`); code != http.StatusBadRequest {
+		t.Errorf("POST %s without identity = %d, want %d", leaderActivityPath, code, http.StatusBadRequest)
+	}
+
+	stopLeading(le, lt)
+	if code := postLeader(t, le, leaderActivityPath, report); code != http.StatusConflict {
+		t.Errorf("POST %s on a follower = %d, want %d", leaderActivityPath, code, http.StatusConflict)
+	}
+}
+
+// TestLeaderElector_DrainCoordination verifies that followers stop routing to the ordinal the leader drains
+// and that the leader only scales it away once the followers acknowledged the drain and closed their
+// connections to it.
+func TestLeaderElector_DrainCoordination(t *testing.T) {
+	leader, leaderTest := newTestElector(t, nil)
+	leaderTest.lc.handle(func() {
+		leaderTest.lc.leading = true
+		leaderTest.lc.replicas = 2
+		leaderTest.lc.draining = leaderTest.lc.pool.setDraining(1, true)
+		leaderTest.lc.setState(stateDraining, "test")
+	})
+	mux := http.NewServeMux()
+	leader.register(mux)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	follower, followerTest := newTestElector(t, nil)
+	stopLeading(follower, followerTest)
+	pool := followerTest.lc.pool
+	pool.update([]int32{0, 1})
+	b0, _ := pool.acquire()
+	b1, _ := pool.acquire()
+	defer b0.release()
+	if b1.ordinal != 1 {
+		t.Fatalf("acquired ordinal %d, want 1", b1.ordinal)
+	}
+
+	ctx := context.Background()
+	report := func() {
+		t.Helper()
+		if err := follower.sendActivity(ctx, addr); err != nil {
+			t.Fatalf("sendActivity() error = %v", err)
+		}
+	}
+
+	// The first report learns about the drain; the acknowledgement still has a connection on ordinal 1.
+	report()
+	for range 3 {
+		b, err := pool.acquire()
+		if err != nil || b.ordinal != 0 {
+			t.Fatalf("acquire() on the follower during drain = (%v, %v), want ordinal 0", b, err)
+		}
+		b.release()
+	}
+	report()
+	leaderTest.assertState(t, stateDraining)
+	leaderTest.assertScales(t)
+
+	b1.release()
+	report()
+	leaderTest.assertState(t, stateReady)
+	leaderTest.assertScales(t, 1)
+
+	// Once the leader is done draining, the follower routes to the ordinal again should it come back.
+	report()
+	if b1.draining.Load() {
+		t.Error("ordinal 1 still draining on the follower after the leader finished the drain")
+	}
+}
+
+// TestLeaderElector_Replicas verifies that the leader tells followers about every replica, so each one
+// knows the others.
+func TestLeaderElector_Replicas(t *testing.T) {
+	leader, _ := newTestElector(t, nil)
+	mux := http.NewServeMux()
+	leader.register(mux)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	follower, followerTest := newTestElector(t, nil)
+	stopLeading(follower, followerTest)
+	follower.identity = "autoscaler-1@10.0.0.2:8081"
+	if got := follower.replicas(); len(got) != 0 {
+		t.Errorf("replicas() on the follower before reporting = %v, want none", got)
+	}
+	if err := follower.sendActivity(context.Background(), strings.TrimPrefix(srv.URL, "http://")); err != nil {
+		t.Fatalf("sendActivity() error = %v", err)
+	}
+	if got, want := follower.replicas(), []string{leader.identity}; !slices.Equal(got, want) {
+		t.Errorf("replicas() on the follower = %v, want %v", got, want)
+	}
+	if got, want := leader.replicas(), []string{follower.identity}; !slices.Equal(got, want) {
+		t.Errorf("replicas() on the leader = %v, want %v", got, want)
+	}
+}
+
+// TestLeaderElector_ForwardWake verifies that a follower's wake-up scales through the leader's endpoint
+// and then waits for its own view of the StatefulSet.
+func TestLeaderElector_ForwardWake(t *testing.T) {
+	leader, leaderTest := newTestElector(t, nil)
+	mux := http.NewServeMux()
+	leader.register(mux)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	waited := false
+	follower, followerTest := newTestElector(t, func(context.Context, *buildkitdTarget) error { waited = true; return nil })
+	stopLeading(follower, followerTest)
+	follower.setLeader(strings.TrimPrefix(srv.URL, "http://"))
+
+	if err := followerTest.lc.wake(context.Background()); err != nil {
+		t.Fatalf("wake() on the follower error = %v", err)
+	}
+	leaderTest.assertState(t, stateReady)
+	leaderTest.assertScales(t, 1)
+	followerTest.assertScales(t)
+	if !waited {
+		t.Error("forwarded wake did not wait for the follower's own cache")
+	}
+
+	if code := postLeader(t, leader, leaderWakePath+"?target=other/sts", ""); code != http.StatusNotFound {
+		t.Errorf("POST %s for an unknown target = %d, want %d", leaderWakePath, code, http.StatusNotFound)
+	}
+}
+
+// TestLeaderElector_ForwardOverrides verifies that a follower's pin, unpin and sleep are applied by the
+// leader, and that the leader's refusals come back as the errors it reported.
+func TestLeaderElector_ForwardOverrides(t *testing.T) {
+	leader, leaderTest := newTestElector(t, nil)
+	mux := http.NewServeMux()
+	leader.register(mux)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	follower, followerTest := newTestElector(t, nil)
+	stopLeading(follower, followerTest)
+	follower.setLeader(strings.TrimPrefix(srv.URL, "http://"))
+
+	until := time.Now().Add(time.Hour)
+	if err := followerTest.lc.setPin(context.Background(), pinState{replicas: 2, until: until}); err != nil {
+		t.Fatalf("setPin() on the follower error = %v", err)
+	}
+	if pin, ok := leaderTest.lc.currentPin(); !ok || pin.replicas != 2 || !pin.until.Equal(until) {
+		t.Errorf("leader's pin = %+v, %v, want the forwarded pin", pin, ok)
+	}
+	leaderTest.assertScales(t, 2)
+
+	leaderTest.open(1)
+	if err := followerTest.lc.sleep(context.Background(), false); !errors.Is(err, errActiveConnections) {
+		t.Errorf("sleep() on the follower with connections on the leader error = %v, want %v", err, errActiveConnections)
+	}
+	if err := followerTest.lc.sleep(context.Background(), true); err != nil {
+		t.Fatalf("forced sleep() on the follower error = %v", err)
+	}
+	if _, ok := leaderTest.lc.currentPin(); ok {
+		t.Error("leader still pinned after a forwarded sleep")
+	}
+	leaderTest.assertScales(t, 2, 0)
+	if err := followerTest.lc.clearPin(context.Background()); err != nil {
+		t.Errorf("clearPin() on the follower error = %v", err)
+	}
+	followerTest.assertScales(t)
+
+	stopLeading(leader, leaderTest)
+	if err := followerTest.lc.clearPin(context.Background()); !errors.Is(err, errNotLeader) {
+		t.Errorf("clearPin() forwarded to a replica that lost the Lease error = %v, want %v", err, errNotLeader)
+	}
+	if code := postLeader(t, leader, leaderSleepPath+"?target=other/sts&force=false", ""); code != http.StatusConflict {
+		t.Errorf("POST %s to a follower = %d, want %d", leaderSleepPath, code, http.StatusConflict)
+	}
+}
+
+// TestLeaderElector_ForwardKeepAlive verifies that a follower acquires and releases keep-alive leases on the
+// leader, and fails without a known leader.
+func TestLeaderElector_ForwardKeepAlive(t *testing.T) {
+	leader, leaderTest := newTestElector(t, nil)
+	mux := http.NewServeMux()
+	leader.register(mux)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	if err := leaderTest.lc.wake(context.Background()); err != nil {
+		t.Fatalf("wake() error = %v", err)
+	}
+
+	follower, followerTest := newTestElector(t, nil)
+	stopLeading(follower, followerTest)
+	if _, err := followerTest.lc.acquireKeepAlive(context.Background(), "pipeline", time.Hour); !errors.Is(err, errNotLeader) {
+		t.Errorf("acquireKeepAlive() without a leader error = %v, want %v", err, errNotLeader)
+	}
+	follower.setLeader(strings.TrimPrefix(srv.URL, "http://"))
+
+	if _, err := followerTest.lc.acquireKeepAlive(context.Background(), "pipeline", time.Hour); err != nil {
+		t.Fatalf("acquireKeepAlive() on the follower error = %v", err)
+	}
+	leaderTest.clock.Advance(30 * time.Minute)
+	leaderTest.assertState(t, stateReady)
+
+	if err := followerTest.lc.releaseKeepAlive(context.Background(), "pipeline"); err != nil {
+		t.Fatalf("releaseKeepAlive() on the follower error = %v", err)
+	}
+	leaderTest.clock.Advance(time.Minute)
+	leaderTest.assertState(t, stateIdle)
+
+	leaderTest.lc.maxKeepAliveTTL = time.Hour
+	for _, ttl := range []string{"soon", "2h"} {
+		if code := postLeader(t, leader, leaderKeepAlivePath+"?target="+testNamespace+"/"+testStsName+"&name=pipeline&ttl="+ttl, ""); code != http.StatusBadRequest {
+			t.Errorf("POST %s with a TTL of %s = %d, want %d", leaderKeepAlivePath, ttl, code, http.StatusBadRequest)
+		}
+	}
+}
+
+// TestLeaderElector_Run verifies that a single candidate acquires the Lease and starts scaling.
+func TestLeaderElector_Run(t *testing.T) {
+	le, lt := newTestElector(t, nil)
+	stopLeading(le, lt)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		le.run(ctx)
+		close(done)
+	}()
+	waitFor(t, "leadership", le.leading.Load)
+	if got := le.leader(); got != "" {
+		t.Errorf("leader() on the leader = %q, want empty", got)
+	}
+
+	cancel()
+	<-done
+	if le.leading.Load() || lt.lc.isLeading() {
+		t.Error("still leading after the election stopped")
+	}
+}
@@ -0,0 +1,753 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// errNotLeader is returned by wake when another replica scales the StatefulSet and there is no way to reach it.
+var errNotLeader = errors.New("this autoscaler replica is not the leader")
+
+// lifecycleState is a stage in the lifecycle of the buildkitd StatefulSet as managed by the autoscaler.
+type lifecycleState int
+
+// Lifecycle states. All scale transitions move between these states under lifecycle.mu.
+const (
+	// stateIdle means the StatefulSet is scaled to zero.
+	stateIdle lifecycleState = iota
+	// stateScalingUp means replicas were requested and the autoscaler is waiting for them to become ready.
+	stateScalingUp
+	// stateReady means the requested replicas are running and no transition is in progress.
+	stateReady
+	// stateDraining means the highest ordinal receives no new connections ahead of a one-step scale-down.
+	stateDraining
+	// stateScalingDown means replicas are being lowered; for a scale to zero this lasts until the pods terminated.
+	stateScalingDown
+)
+
+// String returns the state name used in logs.
+func (s lifecycleState) String() string {
+	switch s {
+	case stateIdle:
+		return "Idle"
+	case stateScalingUp:
+		return "ScalingUp"
+	case stateReady:
+		return "Ready"
+	case stateDraining:
+		return "Draining"
+	case stateScalingDown:
+		return "ScalingDown"
+	}
+	return fmt.Sprintf("lifecycleState(%d)", int(s))
+}
+
+// scaleTarget is the set of StatefulSet operations the lifecycle performs. It is an interface so the
+// state machine can be tested without a Kubernetes API server; kubeScaleTarget is the real implementation.
+type scaleTarget interface {
+	// Status returns the current replica counts.
+	Status() (*StatefulSetStatus, error)
+	// Scale sets the desired replica count.
+	Scale(ctx context.Context, replicas int32) error
+	// WaitReady blocks until the given number of replicas is ready or ctx is cancelled.
+	WaitReady(ctx context.Context, replicas int32) error
+	// WaitTerminated blocks until all pods of a StatefulSet scaled to zero are gone or ctx is cancelled.
+	WaitTerminated(ctx context.Context) error
+}
+
+// lifecycle is the single serialized state machine that owns every scale transition of the buildkitd
+// StatefulSet: cold starts, load-based scale-up, draining, one-step scale-down and the idle scale to zero.
+//
+// Events (connections opening and closing, wake requests, timers and completed Kubernetes calls) are
+// handled under mu. Kubernetes calls are queued as actions while handling an event and run once mu is
+// released, reporting back through another event, so no slow call ever blocks the state machine.
+type lifecycle struct {
+	mu sync.Mutex
+
+	target      scaleTarget
+	pool        *backendPool
+	policy      scalePolicy
+	idleTimeout time.Duration
+	clock       clock
+	// log is the logger for this lifecycle's messages, usually labelled with its StatefulSet.
+	log *slog.Logger
+	// ctx bounds the Kubernetes calls of every transition. It is not tied to any one connection, so a scale-up
+	// carries on when the connection that started it goes away; it is cancelled only when the process shuts down.
+	ctx context.Context
+	// spawn runs queued actions. It defaults to starting a goroutine; tests may run actions inline.
+	spawn func(func())
+	// onTransition, if set, is called under mu for every state change.
+	onTransition func(from, to lifecycleState, reason string)
+	// onConnectionsChanged, if set, is called after the local connection count changed.
+	onConnectionsChanged func()
+	// forwardWake, if set, is used by wake while another replica is the leader.
+	forwardWake func(ctx context.Context) error
+	// forwardPin and forwardSleep, if set, are used by setPin, clearPin and sleep while another replica is the
+	// leader. A nil pin removes the pin.
+	forwardPin   func(ctx context.Context, pin *pinState) error
+	forwardSleep func(ctx context.Context, force bool) error
+	// forwardKeepAlive, if set, acquires or renews a keep-alive lease for ttl on the leader while another
+	// replica is the leader. A zero ttl releases the lease.
+	forwardKeepAlive func(ctx context.Context, name string, ttl time.Duration) error
+	// maxKeepAliveTTL, if positive, is the longest TTL a keep-alive lease may be acquired or renewed for.
+	maxKeepAliveTTL time.Duration
+	// onKeepAlivesChanged, if set, is called under mu with the number of keep-alive leases held whenever it
+	// changes.
+	onKeepAlivesChanged func(leases int)
+	// store, if set, holds the activity persisted by a previous leader, which start resumes from.
+	store activityStore
+	// pins, if set, persists the pin, which start restores.
+	pins pinStore
+	// onPinChanged, if set, is called under mu whenever the pin is set or removed.
+	onPinChanged func(pin *pinState)
+	// pinSaveMu serializes saving the pin to pins.
+	pinSaveMu sync.Mutex
+
+	// leading is true while this replica may scale the StatefulSet. A lifecycle that is not leading
+	// only counts its connections; see start and stopLeading.
+	leading bool
+	state   lifecycleState
+	// replicas is the replica count last requested by (or observed at startup by) the lifecycle.
+	replicas int32
+	// scalingTo is the target replica count of the transition in progress.
+	scalingTo int32
+	// activeConnections is the number of connections currently being handled by this replica.
+	activeConnections int64
+	// remote is the activity reported by the other autoscaler replicas.
+	remote remoteActivity
+	// lastActivity is the last time any replica had a connection open, a keep-alive lease was held or buildkitd
+	// was woken.
+	lastActivity time.Time
+	// lastScaleEvent is when replicas last changed; it starts the scale-down cooldown.
+	lastScaleEvent time.Time
+	// readyWaiters are woken with the result of the next scale-up.
+	readyWaiters []chan error
+	// checkTimer is the next periodic scale-down check.
+	checkTimer timer
+	// idleTimer scales to zero once no connections have been active for idleTimeout.
+	idleTimer timer
+	// drainTimer bounds how long a draining backend may keep its connections.
+	drainTimer timer
+	// draining is the backend being drained in stateDraining.
+	draining *backend
+	// pin is the manual override in effect, or nil for load-based scaling. Only the leader holds it.
+	pin *pinState
+	// pinTimer removes the pin when it expires.
+	pinTimer timer
+	// keepAlives are the keep-alive leases held, by name. Only the leader holds them.
+	keepAlives map[string]*keepAliveLease
+	// pending holds actions queued while handling the current event.
+	pending []func()
+}
+
+// newLifecycle creates a lifecycle in stateIdle. Call start to pick up the StatefulSet's current state.
+func newLifecycle(target scaleTarget, pool *backendPool, policy scalePolicy, idleTimeout time.Duration, clk clock) *lifecycle {
+	return &lifecycle{
+		target:      target,
+		pool:        pool,
+		policy:      policy,
+		idleTimeout: idleTimeout,
+		clock:       clk,
+		log:         logger,
+		ctx:         context.Background(),
+		spawn:       func(f func()) { go f() },
+		state:       stateIdle,
+		keepAlives:  make(map[string]*keepAliveLease),
+	}
+}
+
+// handle runs fn as one serialized event and then starts any actions it queued.
+func (lc *lifecycle) handle(fn func()) {
+	lc.mu.Lock()
+	fn()
+	actions := lc.pending
+	lc.pending = nil
+	lc.mu.Unlock()
+
+	for _, action := range actions {
+		lc.spawn(action)
+	}
+}
+
+// setState moves the state machine to a new state and logs the transition. Must be called under mu.
+func (lc *lifecycle) setState(to lifecycleState, reason string) {
+	from := lc.state
+	lc.state = to
+	lc.log.Info("Lifecycle transition",
+		"from", from.String(), "to", to.String(), "reason", reason,
+		"replicas", lc.replicas, "activeConnections", lc.totalConnections())
+	if lc.onTransition != nil {
+		lc.onTransition(from, to, reason)
+	}
+}
+
+// totalConnections returns the number of connections across all autoscaler replicas. Must be called under mu.
+func (lc *lifecycle) totalConnections() int64 {
+	return lc.activeConnections + lc.remote.connections
+}
+
+// start makes this replica the one that scales the StatefulSet. It reads the current replica count and
+// enters the matching state. A persisted pin is restored and scaled for; otherwise, with replicas running
+// and no connections yet, it scales down to zero straight away. It also starts the periodic scale-down
+// check when the policy allows more than one replica.
+func (lc *lifecycle) start() {
+	status, err := lc.target.Status()
+	var record activityRecord
+	var persisted bool
+	if err == nil && status.DesiredReplicas > 0 && lc.store != nil {
+		var loadErr error
+		record, persisted, loadErr = lc.store.LoadActivity()
+		if loadErr != nil {
+			lc.log.Warn("Could not read persisted connection activity. Treating the StatefulSet as idle.", "error", loadErr)
+		}
+	}
+	var pin pinState
+	var pinned bool
+	if err == nil && lc.pins != nil {
+		var loadErr error
+		pin, pinned, loadErr = lc.pins.LoadPin()
+		if loadErr != nil {
+			lc.log.Warn("Could not read the persisted pin. Scaling for load.", "error", loadErr)
+		}
+	}
+
+	lc.handle(func() {
+		lc.leading = true
+		lc.state = stateIdle
+		lc.replicas = 0
+		if lc.policy.maxReplicas > 1 {
+			lc.scheduleScaleDownCheck()
+		}
+		if err != nil {
+			lc.log.Warn("Could not get initial status for StatefulSet. Assuming 0 replicas.", "error", err)
+			return
+		}
+		if status.DesiredReplicas > 0 {
+			lc.replicas = status.DesiredReplicas
+			lc.setState(stateReady, "replicas running at startup")
+		}
+		if pinned && pin.expired(lc.clock.Now()) {
+			lc.log.Info("Persisted pin has expired.", "until", pin.until)
+			lc.queuePinSave()
+		} else if pinned {
+			lc.applyPin(&pin, "restored at startup")
+			lc.reconcilePin()
+			return
+		}
+		if lc.replicas == 0 || lc.totalConnections() > 0 {
+			return
+		}
+		if persisted {
+			last := record.lastActivity
+			if record.active() {
+				// Only the switch to active is persisted, so builds may have run until the previous autoscaler stopped.
+				last = lc.clock.Now()
+			}
+			if last.After(lc.lastActivity) {
+				lc.lastActivity = last
+			}
+		}
+		if idle := lc.clock.Now().Sub(lc.lastActivity); idle < lc.idleTimeout {
+			// A previous autoscaler saw activity recently, so builds may still be reconnecting.
+			lc.log.Info("Resuming scale-down timer from persisted activity.",
+				"lastActivity", lc.lastActivity, "connections", record.connections, "leases", record.leases, "remaining", lc.idleTimeout-idle)
+			lc.armIdleTimer(lc.idleTimeout - idle)
+			return
+		}
+		lc.startScaleDown(0, "no active connections at startup")
+	})
+}
+
+// stopLeading hands scaling over to another replica. Timers are stopped and a drain in progress is
+// abandoned; a Kubernetes call already in flight still completes and wakes its waiters.
+func (lc *lifecycle) stopLeading() {
+	lc.handle(func() {
+		if !lc.leading {
+			return
+		}
+		lc.leading = false
+		for _, t := range []timer{lc.checkTimer, lc.idleTimer, lc.drainTimer, lc.pinTimer} {
+			if t != nil {
+				t.Stop()
+			}
+		}
+		lc.checkTimer, lc.idleTimer, lc.drainTimer, lc.pinTimer = nil, nil, nil, nil
+		// The pin stays persisted for the next leader.
+		lc.pin = nil
+		if lc.onPinChanged != nil {
+			lc.onPinChanged(nil)
+		}
+		// Keep-alive leases are held again on the next leader when their holders renew them.
+		for _, lease := range lc.keepAlives {
+			lease.timer.Stop()
+		}
+		clear(lc.keepAlives)
+		if lc.onKeepAlivesChanged != nil {
+			lc.onKeepAlivesChanged(0)
+		}
+		if lc.draining != nil {
+			lc.pool.setDraining(lc.draining.ordinal, false)
+			lc.draining = nil
+		}
+		lc.setState(stateIdle, "lost leadership")
+	})
+}
+
+// activity returns the connection activity to persist. While connections are open or keep-alive leases held
+// the last activity is now.
+func (lc *lifecycle) activity() activityRecord {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	record := activityRecord{lastActivity: lc.lastActivity, connections: lc.totalConnections(), leases: len(lc.keepAlives)}
+	if record.active() {
+		record.lastActivity = lc.clock.Now()
+	}
+	return record
+}
+
+// isLeading reports whether this replica currently scales the StatefulSet.
+func (lc *lifecycle) isLeading() bool {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	return lc.leading
+}
+
+// connectionOpened records a new local connection and returns the number of local active connections.
+func (lc *lifecycle) connectionOpened() int64 {
+	var active int64
+	lc.handle(func() {
+		prevTotal := lc.totalConnections()
+		lc.activeConnections++
+		active = lc.activeConnections
+		lc.loadChanged(prevTotal)
+	})
+	if lc.onConnectionsChanged != nil {
+		lc.onConnectionsChanged()
+	}
+	return active
+}
+
+// connectionClosed records a finished local connection and returns the number of local active connections.
+// Callers must release the connection's backend first so a drain can complete on its last connection.
+func (lc *lifecycle) connectionClosed() int64 {
+	var active int64
+	lc.handle(func() {
+		prevTotal := lc.totalConnections()
+		lc.activeConnections--
+		active = lc.activeConnections
+
+		if lc.leading && lc.state == stateDraining && lc.drained() {
+			lc.finishDrain("draining backend has no more connections")
+		}
+		lc.loadChanged(prevTotal)
+	})
+	if lc.onConnectionsChanged != nil {
+		lc.onConnectionsChanged()
+	}
+	return active
+}
+
+// setRemoteActivity records the connections handled by the other autoscaler replicas, so the leader
+// scales for cluster-wide activity and only finishes a drain once no replica uses the drained pod.
+func (lc *lifecycle) setRemoteActivity(a remoteActivity) {
+	lc.handle(func() {
+		prevTotal := lc.totalConnections()
+		lc.remote = a
+		if lc.leading && lc.state == stateDraining && lc.drained() {
+			lc.finishDrain("draining backend has no more connections")
+		}
+		lc.loadChanged(prevTotal)
+	})
+}
+
+// drained reports whether every autoscaler replica has stopped routing to the draining backend and
+// none has connections left on it. Must be called under mu in stateDraining.
+func (lc *lifecycle) drained() bool {
+	ordinal := lc.draining.ordinal
+	return lc.drainingConnections() == 0 && lc.remote.drainAcks[ordinal] == lc.remote.peers
+}
+
+// drainingConnections returns the number of connections all autoscaler replicas have open to the
+// draining backend. Must be called under mu in stateDraining.
+func (lc *lifecycle) drainingConnections() int64 {
+	return lc.draining.activeConnections.Load() + lc.remote.backends[lc.draining.ordinal]
+}
+
+// drainingOrdinal returns the ordinal being drained or scaled away, if any.
+func (lc *lifecycle) drainingOrdinal() (int32, bool) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if lc.draining == nil {
+		return 0, false
+	}
+	return lc.draining.ordinal, true
+}
+
+// loadChanged reacts to a change of the total connection count. With connections active it cancels a
+// pending idle scale-down and scales up if the load now exceeds the target; once the last connection
+// is gone it starts the idle timer. Must be called under mu.
+func (lc *lifecycle) loadChanged(prevTotal int64) {
+	total := lc.totalConnections()
+	if total > 0 || prevTotal > 0 {
+		lc.lastActivity = lc.clock.Now()
+	}
+	if !lc.leading {
+		return
+	}
+	if total == 0 {
+		if prevTotal > 0 {
+			lc.startIdleTimer()
+		}
+		return
+	}
+
+	if lc.idleTimer != nil {
+		lc.log.Info("Active connection. Cancelling scale-down timer.")
+		lc.idleTimer.Stop()
+		lc.idleTimer = nil
+	}
+
+	desired := lc.desiredReplicas(total)
+	switch lc.state {
+	case stateReady:
+		if desired > lc.replicas {
+			lc.startScaleUp(lc.ctx, desired, "connection load exceeds target")
+		}
+	case stateDraining:
+		if desired >= lc.replicas {
+			lc.abortDrain("connection load increased while draining")
+		}
+	}
+}
+
+// wake asks for ready replicas and blocks until the next scale-up finishes. It is called when a
+// connection finds no ready replicas; a connection arriving mid-scale-down waits for the pods to
+// terminate and then triggers a fresh scale-up. While another replica is the leader, the request
+// is passed on through forwardWake. ctx carries the trace of the connection asking, which a scale-up it
+// starts is recorded in; the scale-up itself is bound to lc.ctx, not to ctx. A wake counts as activity, and
+// the scale-up it joins restarts the scale-down timer once it finishes.
+func (lc *lifecycle) wake(ctx context.Context) error {
+	result := make(chan error, 1)
+	forward := false
+	lc.handle(func() {
+		if !lc.leading {
+			forward = true
+			return
+		}
+		lc.lastActivity = lc.clock.Now()
+		lc.readyWaiters = append(lc.readyWaiters, result)
+		switch lc.state {
+		case stateIdle, stateReady:
+			lc.startScaleUp(ctx, lc.desiredReplicas(lc.totalConnections()), "connection waiting for ready replicas")
+		case stateDraining:
+			lc.abortDrain("connection waiting for ready replicas")
+			lc.startScaleUp(ctx, lc.desiredReplicas(lc.totalConnections()), "connection waiting for ready replicas")
+		case stateScalingUp:
+			// Joins the in-flight scale-up.
+		case stateScalingDown:
+			lc.log.Info("Connection arrived during scale down. Waiting for it to finish before scaling up again.")
+		}
+	})
+	if forward {
+		if lc.forwardWake == nil {
+			return errNotLeader
+		}
+		return lc.forwardWake(withTraceOf(lc.ctx, ctx))
+	}
+	return <-result
+}
+
+// activeConnectionCount returns the number of connections currently being handled by this replica.
+func (lc *lifecycle) activeConnectionCount() int64 {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	return lc.activeConnections
+}
+
+// currentState returns the current lifecycle state.
+func (lc *lifecycle) currentState() lifecycleState {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	return lc.state
+}
+
+// routable reports whether connections may be routed to the currently ready pods. It is false while
+// scaled to zero, during a cold start and during a scale to zero, when any ready pod is about to go away.
+func (lc *lifecycle) routable() bool {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if !lc.leading {
+		// Only the leader knows about scale transitions; followers go by the ready replicas in the cache.
+		return true
+	}
+	switch lc.state {
+	case stateIdle:
+		return false
+	case stateScalingUp:
+		return lc.replicas > 0
+	case stateScalingDown:
+		return lc.scalingTo > 0
+	}
+	return true
+}
+
+// desiredReplicas returns the replica count for total connections: the pinned count if the pin fixes one,
+// and otherwise the policy's. Must be called under mu.
+func (lc *lifecycle) desiredReplicas(total int64) int32 {
+	if lc.pin != nil && lc.pin.replicas > 0 {
+		return lc.pin.replicas
+	}
+	return lc.policy.desiredReplicas(total)
+}
+
+// startScaleUp enters stateScalingUp and queues the scale-up action, which is traced as part of trigger's
+// trace. Must be called under mu.
+func (lc *lifecycle) startScaleUp(trigger context.Context, want int32, reason string) {
+	lc.scalingTo = want
+	lc.setState(stateScalingUp, reason)
+	ctx := withTraceOf(lc.ctx, trigger)
+	lc.pending = append(lc.pending, func() {
+		replicas, err := lc.scaleUp(ctx, want)
+		lc.handle(func() { lc.onScaleUpDone(replicas, err) })
+	})
+}
+
+// scaleUp raises the StatefulSet to at least want replicas and waits for them to become ready.
+// It never lowers the replica count, e.g. if pods are restarting with replicas already set.
+func (lc *lifecycle) scaleUp(ctx context.Context, want int32) (int32, error) {
+	status, err := lc.target.Status()
+	if err != nil {
+		return 0, err
+	}
+	replicas := max(want, status.DesiredReplicas)
+	if status.DesiredReplicas < replicas {
+		lc.log.Info("Scaling up.", "fromReplicas", status.DesiredReplicas, "toReplicas", replicas)
+		if err := lc.target.Scale(ctx, replicas); err != nil {
+			return status.DesiredReplicas, err
+		}
+	}
+	lc.log.Info("Waiting for ready replicas...", "replicas", replicas)
+	return replicas, lc.target.WaitReady(ctx, replicas)
+}
+
+// onScaleUpDone handles the result of a scale-up action. Must be called under mu.
+func (lc *lifecycle) onScaleUpDone(replicas int32, err error) {
+	if replicas > lc.replicas {
+		lc.replicas = replicas
+		lc.lastScaleEvent = lc.clock.Now()
+	}
+	for _, waiter := range lc.readyWaiters {
+		waiter <- err
+	}
+	lc.readyWaiters = nil
+
+	if err != nil {
+		lc.log.Error("Scale up failed.", "error", err, "cause", failureCause(err), "replicas", replicas)
+		if lc.replicas == 0 {
+			lc.setState(stateIdle, "scale up failed")
+		} else {
+			lc.setState(stateReady, "scale up failed")
+		}
+	} else {
+		lc.setState(stateReady, "replicas ready")
+	}
+
+	if !lc.leading {
+		return
+	}
+	if lc.pin != nil && err == nil {
+		lc.reconcilePin()
+	} else if lc.totalConnections() == 0 {
+		lc.startIdleTimer()
+	} else if desired := lc.desiredReplicas(lc.totalConnections()); err == nil && desired > lc.replicas {
+		lc.startScaleUp(lc.ctx, desired, "connection load increased during scale up")
+	}
+}
+
+// startIdleTimer (re)starts the timer that scales to zero after idleTimeout. A pinned StatefulSet, or one
+// with keep-alive leases held, has no idle timer. Must be called under mu.
+func (lc *lifecycle) startIdleTimer() {
+	if lc.pin != nil {
+		lc.log.Debug("Pinned, so not starting the scale-down timer.")
+		return
+	}
+	if len(lc.keepAlives) > 0 {
+		lc.log.Debug("Keep-alive leases held, so not starting the scale-down timer.", "leases", len(lc.keepAlives))
+		return
+	}
+	if lc.idleTimer != nil {
+		lc.log.Debug("Stopping existing scale-down timer as a new one will be started.")
+		lc.idleTimer.Stop()
+	}
+	lc.log.Info("Last connection closed. Starting scale-down timer.", "duration", lc.idleTimeout)
+	lc.armIdleTimer(lc.idleTimeout)
+}
+
+// armIdleTimer schedules onIdleTimeout after d. Must be called under mu.
+func (lc *lifecycle) armIdleTimer(d time.Duration) {
+	var t timer
+	t = lc.clock.AfterFunc(d, func() {
+		lc.handle(func() {
+			if lc.idleTimer != t {
+				return // Stopped or replaced after it fired.
+			}
+			lc.idleTimer = nil
+			lc.onIdleTimeout()
+		})
+	})
+	lc.idleTimer = t
+}
+
+// onIdleTimeout scales to zero if there are still no active connections. Must be called under mu.
+func (lc *lifecycle) onIdleTimeout() {
+	if lc.totalConnections() > 0 {
+		lc.log.Info("Scale-down timer fired, but active connections exist. Scale down aborted.", "activeConnections", lc.totalConnections())
+		return
+	}
+	switch lc.state {
+	case stateDraining:
+		lc.abortDrain("idle timeout")
+		lc.startScaleDown(0, "idle timeout")
+	case stateReady:
+		lc.startScaleDown(0, "idle timeout")
+	default:
+		// Idle has nothing to scale down; ScalingUp and ScalingDown restart the timer when they finish.
+		lc.log.Debug("Scale-down timer fired with no transition to make.", "state", lc.state.String())
+	}
+}
+
+// startScaleDown enters stateScalingDown and queues the scale-down action. Must be called under mu.
+func (lc *lifecycle) startScaleDown(to int32, reason string) {
+	if lc.drainTimer != nil {
+		lc.drainTimer.Stop()
+		lc.drainTimer = nil
+	}
+	lc.scalingTo = to
+	lc.setState(stateScalingDown, reason)
+	lc.pending = append(lc.pending, func() {
+		scaled, err := lc.scaleDown(to)
+		lc.handle(func() { lc.onScaleDownDone(to, scaled, err) })
+	})
+}
+
+// scaleDown lowers the StatefulSet to the given replica count. For a scale to zero it waits for the pods
+// to terminate, so a connection arriving meanwhile scales up a fresh pod rather than a dying one.
+// scaled reports whether the replica count was changed, even if waiting for termination failed.
+func (lc *lifecycle) scaleDown(to int32) (scaled bool, err error) {
+	lc.log.Info("Scaling down.", "toReplicas", to)
+	if err := lc.target.Scale(lc.ctx, to); err != nil {
+		return false, err
+	}
+	if to == 0 {
+		return true, lc.target.WaitTerminated(lc.ctx)
+	}
+	return true, nil
+}
+
+// onScaleDownDone handles the result of a scale-down action. Must be called under mu.
+func (lc *lifecycle) onScaleDownDone(to int32, scaled bool, err error) {
+	if scaled {
+		lc.replicas = to
+		lc.lastScaleEvent = lc.clock.Now()
+	}
+	if lc.draining != nil {
+		if !scaled {
+			lc.pool.setDraining(lc.draining.ordinal, false)
+		}
+		lc.draining = nil
+	}
+
+	if err != nil {
+		lc.log.Error("Scale down failed.", "error", err, "toReplicas", to)
+	} else {
+		lc.log.Info("Successfully scaled down StatefulSet.", "replicas", lc.replicas)
+	}
+	if lc.replicas == 0 {
+		lc.setState(stateIdle, "scaled down")
+	} else {
+		lc.setState(stateReady, "scaled down")
+	}
+
+	switch {
+	case !lc.leading:
+	case len(lc.readyWaiters) > 0:
+		lc.startScaleUp(lc.ctx, lc.desiredReplicas(lc.totalConnections()), "connection arrived during scale down")
+	case lc.pin != nil && err == nil:
+		lc.reconcilePin()
+	case lc.totalConnections() == 0 && lc.replicas > 0:
+		lc.startIdleTimer()
+	}
+}
+
+// scheduleScaleDownCheck arms the periodic one-step scale-down check. Must be called under mu.
+func (lc *lifecycle) scheduleScaleDownCheck() {
+	var t timer
+	t = lc.clock.AfterFunc(scaleDownCheckInterval, func() {
+		lc.handle(func() {
+			if lc.checkTimer != t {
+				return // Stopped or replaced after it fired.
+			}
+			lc.scheduleScaleDownCheck()
+			lc.onScaleDownCheck()
+		})
+	})
+	lc.checkTimer = t
+}
+
+// onScaleDownCheck starts draining the highest ordinal if the load no longer needs all replicas and the
+// cooldown since the last scaling event has elapsed. The idle timer owns the scale to zero. Must be called under mu.
+func (lc *lifecycle) onScaleDownCheck() {
+	if lc.state != stateReady || lc.totalConnections() == 0 || (lc.pin != nil && lc.pin.replicas > 0) {
+		return
+	}
+	if lc.clock.Now().Sub(lc.lastScaleEvent) < lc.policy.scaleDownCooldown {
+		return
+	}
+	if lc.policy.nextScaleDown(lc.replicas, lc.totalConnections()) == lc.replicas {
+		return
+	}
+
+	// A StatefulSet scale-down always removes the highest ordinal.
+	lc.draining = lc.pool.setDraining(lc.replicas-1, true)
+	lc.setState(stateDraining, "connection load below target after cooldown")
+	lc.log.Info("Draining highest ordinal before scaling down one step.",
+		"ordinal", lc.draining.ordinal, "remainingConnections", lc.drainingConnections(), "drainTimeout", lc.policy.drainTimeout)
+
+	if lc.drained() {
+		lc.finishDrain("draining backend has no connections")
+		return
+	}
+	var t timer
+	t = lc.clock.AfterFunc(lc.policy.drainTimeout, func() {
+		lc.handle(func() {
+			if lc.state != stateDraining || lc.drainTimer != t {
+				return
+			}
+			lc.log.Warn("Drain timeout reached. Scaling down with connections still open on the draining backend.",
+				"ordinal", lc.draining.ordinal, "remainingConnections", lc.drainingConnections())
+			lc.finishDrain("drain timeout")
+		})
+	})
+	lc.drainTimer = t
+}
+
+// finishDrain scales down the drained ordinal. Must be called under mu in stateDraining.
+func (lc *lifecycle) finishDrain(reason string) {
+	lc.startScaleDown(lc.replicas-1, reason)
+}
+
+// abortDrain returns the draining backend to the routing pool. Must be called under mu in stateDraining.
+func (lc *lifecycle) abortDrain(reason string) {
+	if lc.drainTimer != nil {
+		lc.drainTimer.Stop()
+		lc.drainTimer = nil
+	}
+	lc.pool.setDraining(lc.draining.ordinal, false)
+	lc.draining = nil
+	lc.setState(stateReady, reason)
+}
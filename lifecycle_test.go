@@ -0,0 +1,556 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a manually advanced clock. Timers fire synchronously from Advance, in deadline order.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// fakeTimer is a timer created by fakeClock.
+type fakeTimer struct {
+	clock    *fakeClock
+	deadline time.Time
+	f        func()
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, deadline: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	i := slices.Index(t.clock.timers, t)
+	if i < 0 {
+		return false
+	}
+	t.clock.timers = slices.Delete(t.clock.timers, i, i+1)
+	return true
+}
+
+// Advance moves the clock forward by d, firing every timer that falls due on the way,
+// including timers scheduled by other timers.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	for {
+		var next *fakeTimer
+		for _, t := range c.timers {
+			if !t.deadline.After(end) && (next == nil || t.deadline.Before(next.deadline)) {
+				next = t
+			}
+		}
+		if next == nil {
+			break
+		}
+		c.now = next.deadline
+		c.timers = slices.DeleteFunc(c.timers, func(t *fakeTimer) bool { return t == next })
+		c.mu.Unlock()
+		next.f()
+		c.mu.Lock()
+	}
+	c.now = end
+	c.mu.Unlock()
+}
+
+// fakeScaleTarget is an in-memory scaleTarget that records every Scale call.
+type fakeScaleTarget struct {
+	mu       sync.Mutex
+	replicas int32
+	scales   []int32
+	// terminated, if set, blocks WaitTerminated until it is closed.
+	terminated chan struct{}
+}
+
+func (f *fakeScaleTarget) Status() (*StatefulSetStatus, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &StatefulSetStatus{DesiredReplicas: f.replicas, CurrentReplicas: f.replicas, ReadyReplicas: f.replicas}, nil
+}
+
+func (f *fakeScaleTarget) Scale(_ context.Context, replicas int32) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.replicas = replicas
+	f.scales = append(f.scales, replicas)
+	return nil
+}
+
+func (f *fakeScaleTarget) WaitReady(context.Context, int32) error { return nil }
+
+func (f *fakeScaleTarget) WaitTerminated(context.Context) error {
+	f.mu.Lock()
+	terminated := f.terminated
+	f.mu.Unlock()
+	if terminated != nil {
+		<-terminated
+	}
+	return nil
+}
+
+// scaleCalls returns the replica counts passed to Scale so far.
+func (f *fakeScaleTarget) scaleCalls() []int32 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.scales)
+}
+
+// lifecycleTest bundles a lifecycle with its fakes and the transitions it made.
+type lifecycleTest struct {
+	lc          *lifecycle
+	target      *fakeScaleTarget
+	clock       *fakeClock
+	transitions []string
+}
+
+// newLifecycleTest creates a started lifecycle over a StatefulSet scaled to zero. Actions run inline,
+// so every event has finished its Kubernetes calls by the time it returns.
+func newLifecycleTest(t *testing.T, policy scalePolicy, idleTimeout time.Duration) *lifecycleTest {
+	t.Helper()
+	lt := &lifecycleTest{target: &fakeScaleTarget{}, clock: newFakeClock()}
+	lt.lc = newLifecycle(lt.target, newBackendPool(strategyRoundRobin, testBackendAddr), policy, idleTimeout, lt.clock)
+	lt.lc.spawn = func(f func()) { f() }
+	lt.lc.onTransition = func(from, to lifecycleState, reason string) {
+		lt.transitions = append(lt.transitions, from.String()+"->"+to.String())
+	}
+	lt.lc.start()
+	return lt
+}
+
+// open opens n connections.
+func (lt *lifecycleTest) open(n int) {
+	for range n {
+		lt.lc.connectionOpened()
+	}
+}
+
+// close closes n connections.
+func (lt *lifecycleTest) close(n int) {
+	for range n {
+		lt.lc.connectionClosed()
+	}
+}
+
+// assertState fails the test if the lifecycle is not in the wanted state.
+func (lt *lifecycleTest) assertState(t *testing.T, want lifecycleState) {
+	t.Helper()
+	if got := lt.lc.currentState(); got != want {
+		t.Fatalf("state = %s, want %s", got, want)
+	}
+}
+
+// assertScales fails the test if the Scale calls made so far differ from want.
+func (lt *lifecycleTest) assertScales(t *testing.T, want ...int32) {
+	t.Helper()
+	if got := lt.target.scaleCalls(); !slices.Equal(got, want) {
+		t.Fatalf("Scale calls = %v, want %v", got, want)
+	}
+}
+
+// waitFor polls cond until it holds or a second has passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+var testLifecyclePolicy = scalePolicy{targetConnectionsPerReplica: 1, minReplicas: 1, maxReplicas: 1}
+
+// TestLifecycle_ColdStart verifies that waking an idle StatefulSet scales it up for the current load.
+func TestLifecycle_ColdStart(t *testing.T) {
+	lt := newLifecycleTest(t, scalePolicy{targetConnectionsPerReplica: 1, minReplicas: 1, maxReplicas: 3}, time.Minute)
+	lt.assertState(t, stateIdle)
+	if lt.lc.routable() {
+		t.Error("routable() = true while idle, want false")
+	}
+
+	lt.open(2)
+	if err := lt.lc.wake(context.Background()); err != nil {
+		t.Fatalf("wake() error = %v", err)
+	}
+	lt.assertState(t, stateReady)
+	lt.assertScales(t, 2)
+	if !lt.lc.routable() {
+		t.Error("routable() = false when ready, want true")
+	}
+	if want := []string{"Idle->ScalingUp", "ScalingUp->Ready"}; !slices.Equal(lt.transitions, want) {
+		t.Errorf("transitions = %v, want %v", lt.transitions, want)
+	}
+}
+
+// TestLifecycle_StartScalesDownRunningReplicas verifies that replicas found running at startup with no
+// connections are scaled to zero.
+func TestLifecycle_StartScalesDownRunningReplicas(t *testing.T) {
+	lt := &lifecycleTest{target: &fakeScaleTarget{replicas: 2}, clock: newFakeClock()}
+	lt.lc = newLifecycle(lt.target, newBackendPool(strategyRoundRobin, testBackendAddr), testLifecyclePolicy, time.Minute, lt.clock)
+	lt.lc.spawn = func(f func()) { f() }
+	lt.lc.start()
+
+	lt.assertState(t, stateIdle)
+	lt.assertScales(t, 0)
+}
+
+// fakeActivityStore is an in-memory activityStore.
+type fakeActivityStore struct {
+	mu     sync.Mutex
+	record activityRecord
+	ok     bool
+	// saves counts the calls to SaveActivity.
+	saves int
+}
+
+func (f *fakeActivityStore) LoadActivity() (activityRecord, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.record, f.ok, nil
+}
+
+func (f *fakeActivityStore) SaveActivity(_ context.Context, record activityRecord) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record, f.ok = record, true
+	f.saves++
+	return nil
+}
+
+// saved returns the persisted record and the number of saves.
+func (f *fakeActivityStore) saved() (activityRecord, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.record, f.saves
+}
+
+// TestLifecycle_StartResumesIdleTimer verifies that a restarted autoscaler keeps running replicas up for
+// the rest of the idle timeout measured from the persisted last activity, or for the whole idle timeout if
+// buildkitd was in use when the activity was persisted.
+func TestLifecycle_StartResumesIdleTimer(t *testing.T) {
+	tests := []struct {
+		name        string
+		idleFor     time.Duration
+		connections int64
+		wantState   lifecycleState
+		remaining   time.Duration
+	}{
+		{"recent activity", 20 * time.Second, 0, stateReady, 40 * time.Second},
+		{"expired activity", 2 * time.Minute, 0, stateIdle, 0},
+		{"active when persisted", time.Hour, 2, stateReady, time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lt := &lifecycleTest{target: &fakeScaleTarget{replicas: 1}, clock: newFakeClock()}
+			lt.lc = newLifecycle(lt.target, newBackendPool(strategyRoundRobin, testBackendAddr), testLifecyclePolicy, time.Minute, lt.clock)
+			lt.lc.spawn = func(f func()) { f() }
+			lt.lc.store = &fakeActivityStore{record: activityRecord{lastActivity: lt.clock.Now().Add(-tt.idleFor), connections: tt.connections}, ok: true}
+			lt.lc.start()
+			lt.assertState(t, tt.wantState)
+			if tt.wantState == stateIdle {
+				return
+			}
+
+			lt.clock.Advance(tt.remaining - time.Second)
+			lt.assertScales(t)
+			lt.clock.Advance(time.Second)
+			lt.assertState(t, stateIdle)
+			lt.assertScales(t, 0)
+		})
+	}
+}
+
+// TestLifecycle_Activity verifies the activity record persisted for a restart.
+func TestLifecycle_Activity(t *testing.T) {
+	lt := newLifecycleTest(t, testLifecyclePolicy, time.Minute)
+	if got := lt.lc.activity(); !got.lastActivity.IsZero() {
+		t.Errorf("activity() before any connection = %+v, want no last activity", got)
+	}
+
+	lt.open(2)
+	lt.clock.Advance(time.Minute)
+	if got := lt.lc.activity(); got.connections != 2 || !got.lastActivity.Equal(lt.clock.Now()) {
+		t.Errorf("activity() with open connections = %+v, want 2 connections active now", got)
+	}
+
+	lt.close(2)
+	closedAt := lt.clock.Now()
+	lt.clock.Advance(time.Second)
+	if got := lt.lc.activity(); got.connections != 0 || !got.lastActivity.Equal(closedAt) {
+		t.Errorf("activity() after closing = %+v, want last activity at %v", got, closedAt)
+	}
+}
+
+// TestLifecycle_IdleScaleDown verifies that the StatefulSet scales to zero once no connection has
+// been active for the idle timeout.
+func TestLifecycle_IdleScaleDown(t *testing.T) {
+	lt := newLifecycleTest(t, testLifecyclePolicy, time.Minute)
+	lt.open(1)
+	if err := lt.lc.wake(context.Background()); err != nil {
+		t.Fatalf("wake() error = %v", err)
+	}
+	lt.close(1)
+
+	lt.clock.Advance(59 * time.Second)
+	lt.assertState(t, stateReady)
+	lt.assertScales(t, 1)
+
+	lt.clock.Advance(time.Second)
+	lt.assertState(t, stateIdle)
+	lt.assertScales(t, 1, 0)
+	want := []string{"Idle->ScalingUp", "ScalingUp->Ready", "Ready->ScalingDown", "ScalingDown->Idle"}
+	if !slices.Equal(lt.transitions, want) {
+		t.Errorf("transitions = %v, want %v", lt.transitions, want)
+	}
+}
+
+// TestLifecycle_IdleTimerCancelledByConnection verifies that a new connection cancels a pending idle scale-down.
+func TestLifecycle_IdleTimerCancelledByConnection(t *testing.T) {
+	lt := newLifecycleTest(t, testLifecyclePolicy, time.Minute)
+	lt.open(1)
+	if err := lt.lc.wake(context.Background()); err != nil {
+		t.Fatalf("wake() error = %v", err)
+	}
+	lt.close(1)
+	lt.clock.Advance(30 * time.Second)
+	lt.open(1)
+	lt.clock.Advance(time.Hour)
+
+	lt.assertState(t, stateReady)
+	lt.assertScales(t, 1)
+}
+
+// TestLifecycle_ConnectionDuringScaleDown verifies that a connection arriving while the StatefulSet is
+// scaling to zero waits for the pods to terminate and then triggers a fresh scale-up.
+func TestLifecycle_ConnectionDuringScaleDown(t *testing.T) {
+	lt := newLifecycleTest(t, testLifecyclePolicy, time.Minute)
+	lt.open(1)
+	if err := lt.lc.wake(context.Background()); err != nil {
+		t.Fatalf("wake() error = %v", err)
+	}
+	lt.close(1)
+
+	// From here on, Kubernetes calls run in the background so the scale-down can be held open.
+	terminated := make(chan struct{})
+	lt.target.terminated = terminated
+	lt.lc.spawn = func(f func()) { go f() }
+
+	lt.clock.Advance(time.Minute)
+	waitFor(t, "scale to zero", func() bool { return len(lt.target.scaleCalls()) == 2 })
+	lt.assertState(t, stateScalingDown)
+
+	lt.open(1)
+	if lt.lc.routable() {
+		t.Error("routable() = true while scaling to zero, want false")
+	}
+	woken := make(chan error, 1)
+	go func() { woken <- lt.lc.wake(context.Background()) }()
+	waitFor(t, "wake to register", func() bool {
+		lt.lc.mu.Lock()
+		defer lt.lc.mu.Unlock()
+		return len(lt.lc.readyWaiters) == 1
+	})
+	lt.assertScales(t, 1, 0)
+
+	close(terminated)
+	if err := <-woken; err != nil {
+		t.Fatalf("wake() error = %v", err)
+	}
+	lt.assertState(t, stateReady)
+	lt.assertScales(t, 1, 0, 1)
+}
+
+// TestLifecycle_ScaleUpForLoad verifies that opening connections beyond the target scales up while ready.
+func TestLifecycle_ScaleUpForLoad(t *testing.T) {
+	lt := newLifecycleTest(t, scalePolicy{targetConnectionsPerReplica: 2, minReplicas: 1, maxReplicas: 5}, time.Minute)
+	lt.open(1)
+	if err := lt.lc.wake(context.Background()); err != nil {
+		t.Fatalf("wake() error = %v", err)
+	}
+	lt.assertScales(t, 1)
+
+	lt.open(1)
+	lt.assertScales(t, 1)
+
+	lt.open(5)
+	lt.assertState(t, stateReady)
+	lt.assertScales(t, 1, 2, 3, 4)
+}
+
+// setupDrainTest brings a lifecycle to two ready replicas with one connection on each backend, then
+// drops the load so the next scale-down check after the cooldown drains ordinal 1.
+func setupDrainTest(t *testing.T, drainTimeout time.Duration) (*lifecycleTest, *backend, *backend) {
+	t.Helper()
+	policy := scalePolicy{targetConnectionsPerReplica: 10, minReplicas: 1, maxReplicas: 5, scaleDownCooldown: time.Minute, drainTimeout: drainTimeout}
+	lt := newLifecycleTest(t, policy, time.Minute)
+	lt.open(11)
+	if err := lt.lc.wake(context.Background()); err != nil {
+		t.Fatalf("wake() error = %v", err)
+	}
+	lt.assertScales(t, 2)
+	lt.close(9)
+
+	lt.lc.pool.update([]int32{0, 1})
+	b0, _ := lt.lc.pool.acquire()
+	b1, _ := lt.lc.pool.acquire()
+	if b0.ordinal != 0 || b1.ordinal != 1 {
+		t.Fatalf("acquired ordinals %d and %d, want 0 and 1", b0.ordinal, b1.ordinal)
+	}
+
+	lt.clock.Advance(45 * time.Second)
+	lt.assertState(t, stateReady)
+	lt.clock.Advance(15 * time.Second)
+	lt.assertState(t, stateDraining)
+	return lt, b0, b1
+}
+
+// TestLifecycle_DrainsHighestOrdinal verifies that the highest ordinal stops receiving new connections
+// and that replicas are only lowered once its connections have finished.
+func TestLifecycle_DrainsHighestOrdinal(t *testing.T) {
+	lt, b0, b1 := setupDrainTest(t, time.Hour)
+	defer b0.release()
+
+	for range 3 {
+		b, err := lt.lc.pool.acquire()
+		if err != nil || b.ordinal != 0 {
+			t.Fatalf("acquire() during drain = (%v, %v), want ordinal 0", b, err)
+		}
+		b.release()
+	}
+	lt.assertScales(t, 2)
+
+	b1.release()
+	lt.close(1)
+	lt.assertState(t, stateReady)
+	lt.assertScales(t, 2, 1)
+}
+
+// TestLifecycle_DrainTimeout verifies that replicas are lowered once the drain timeout passes,
+// even if connections remain on the draining backend.
+func TestLifecycle_DrainTimeout(t *testing.T) {
+	lt, b0, b1 := setupDrainTest(t, 10*time.Second)
+	defer b0.release()
+	defer b1.release()
+
+	lt.clock.Advance(9 * time.Second)
+	lt.assertState(t, stateDraining)
+	lt.clock.Advance(time.Second)
+	lt.assertState(t, stateReady)
+	lt.assertScales(t, 2, 1)
+}
+
+// TestLifecycle_DrainAbortedOnLoad verifies that rising load during a drain returns the backend to the pool.
+func TestLifecycle_DrainAbortedOnLoad(t *testing.T) {
+	lt, b0, b1 := setupDrainTest(t, time.Hour)
+	defer b0.release()
+	defer b1.release()
+
+	lt.open(9)
+	lt.assertState(t, stateReady)
+	if b1.draining.Load() {
+		t.Error("ordinal 1 still draining after the drain was aborted")
+	}
+	lt.clock.Advance(2 * time.Hour)
+	lt.assertScales(t, 2)
+}
+
+// TestLifecycle_DrainWaitsForFollowers verifies that the drain only finishes once every follower
+// acknowledged it and no follower has connections left on the draining backend.
+func TestLifecycle_DrainWaitsForFollowers(t *testing.T) {
+	lt, b0, b1 := setupDrainTest(t, time.Hour)
+	defer b0.release()
+
+	lt.lc.setRemoteActivity(remoteActivity{connections: 1, backends: map[int32]int64{1: 1}, peers: 2, drainAcks: map[int32]int{1: 2}})
+	b1.release()
+	lt.close(1)
+	lt.assertState(t, stateDraining)
+
+	lt.lc.setRemoteActivity(remoteActivity{peers: 2, drainAcks: map[int32]int{1: 1}})
+	lt.assertState(t, stateDraining)
+	lt.assertScales(t, 2)
+
+	lt.lc.setRemoteActivity(remoteActivity{peers: 2, drainAcks: map[int32]int{1: 2}})
+	lt.assertState(t, stateReady)
+	lt.assertScales(t, 2, 1)
+}
+
+// TestLifecycle_RemoteConnections verifies that connections reported by other replicas keep buildkitd
+// awake and count towards the desired replicas.
+func TestLifecycle_RemoteConnections(t *testing.T) {
+	lt := newLifecycleTest(t, scalePolicy{targetConnectionsPerReplica: 1, minReplicas: 1, maxReplicas: 3}, time.Minute)
+	lt.open(1)
+	if err := lt.lc.wake(context.Background()); err != nil {
+		t.Fatalf("wake() error = %v", err)
+	}
+
+	lt.lc.setRemoteActivity(remoteActivity{connections: 2})
+	lt.assertScales(t, 1, 3)
+
+	// The remote connections alone keep two replicas up.
+	lt.close(1)
+	lt.clock.Advance(time.Hour)
+	lt.assertState(t, stateReady)
+	lt.assertScales(t, 1, 3, 2)
+
+	lt.lc.setRemoteActivity(remoteActivity{})
+	lt.clock.Advance(time.Minute)
+	lt.assertState(t, stateIdle)
+	lt.assertScales(t, 1, 3, 2, 0)
+}
+
+// TestLifecycle_StopLeading verifies that a replica that lost leadership stops scaling, still counts its
+// connections and forwards wake-ups.
+func TestLifecycle_StopLeading(t *testing.T) {
+	lt := newLifecycleTest(t, testLifecyclePolicy, time.Minute)
+	lt.open(1)
+	if err := lt.lc.wake(context.Background()); err != nil {
+		t.Fatalf("wake() error = %v", err)
+	}
+	lt.close(1)
+
+	lt.lc.stopLeading()
+	lt.clock.Advance(time.Hour)
+	lt.assertScales(t, 1)
+	if !lt.lc.routable() {
+		t.Error("routable() = false on a follower, want true")
+	}
+
+	lt.open(2)
+	if got := lt.lc.activeConnectionCount(); got != 2 {
+		t.Errorf("activeConnectionCount() = %d, want 2", got)
+	}
+	if err := lt.lc.wake(context.Background()); !errors.Is(err, errNotLeader) {
+		t.Errorf("wake() without forwardWake error = %v, want %v", err, errNotLeader)
+	}
+	forwarded := 0
+	lt.lc.forwardWake = func(context.Context) error { forwarded++; return nil }
+	if err := lt.lc.wake(context.Background()); err != nil || forwarded != 1 {
+		t.Errorf("wake() = %v with %d forwarded calls, want nil and 1", err, forwarded)
+	}
+	lt.assertScales(t, 1)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// unixAddressPrefix marks a listener address as a Unix socket path.
+const unixAddressPrefix = "unix://"
+
+// proxyListener accepts client connections on one address and proxies them to its targets.
+type proxyListener struct {
+	name    string
+	address string
+	// target receives every connection not routed elsewhere by router.
+	target *buildkitdTarget
+	// router picks a target by TLS server name; nil without SNI routes.
+	router *sniRouter
+	// listener is set by listen.
+	listener net.Listener
+}
+
+// buildListeners creates the listeners for specs and the targets they route to. Listeners and routes naming
+// the same StatefulSet share one target, so its connections are counted and scaled together; they must then
+// agree on how the StatefulSet is reached and on its timeouts.
+func buildListeners(clientset kubernetes.Interface, specs []listenerSpec) ([]*proxyListener, []*buildkitdTarget, error) {
+	var targets []*buildkitdTarget
+	byKey := make(map[string]*buildkitdTarget)
+	targetFor := func(spec targetSpec) (*buildkitdTarget, error) {
+		if t, ok := byKey[spec.key()]; ok {
+			if t.targetSpec != spec {
+				return nil, fmt.Errorf("StatefulSet %s is configured more than once with different settings", spec.key())
+			}
+			return t, nil
+		}
+		t := newBuildkitdTarget(clientset, spec)
+		byKey[spec.key()] = t
+		targets = append(targets, t)
+		return t, nil
+	}
+
+	listeners := make([]*proxyListener, 0, len(specs))
+	for _, spec := range specs {
+		l := &proxyListener{name: spec.name, address: spec.address}
+		var err error
+		if l.target, err = targetFor(spec.target); err != nil {
+			return nil, nil, err
+		}
+		if spec.sniRoutes != nil {
+			l.router = &sniRouter{fallback: l.target}
+			for pattern, routeSpec := range spec.sniRoutes {
+				t, err := targetFor(routeSpec)
+				if err != nil {
+					return nil, nil, err
+				}
+				l.router.routes = append(l.router.routes, sniRoute{pattern: pattern, target: t})
+			}
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, targets, nil
+}
+
+// listenAddress splits a listener address into the network and address for net.Listen.
+func listenAddress(address string) (network, addr string) {
+	if path, ok := strings.CutPrefix(address, unixAddressPrefix); ok {
+		return "unix", path
+	}
+	return "tcp", address
+}
+
+// listen opens the listener's socket, with TCP keep-alive set up on accepted connections. A Unix socket left behind by a previous run is removed first.
+func (l *proxyListener) listen() error {
+	network, addr := listenAddress(l.address)
+	if network == "unix" {
+		if info, err := os.Stat(addr); err == nil && info.Mode().Type() == fs.ModeSocket {
+			if err := os.Remove(addr); err != nil {
+				return fmt.Errorf("removing stale socket %s: %w", addr, err)
+			}
+		}
+	}
+	lc := net.ListenConfig{KeepAlive: keepAlivePeriod(), KeepAliveConfig: tcpKeepAlive}
+	listener, err := lc.Listen(context.Background(), network, addr)
+	if err != nil {
+		return err
+	}
+	l.listener = listener
+	return nil
+}
+
+// serve accepts connections until the listener is closed, handling each in its own goroutine.
+func (l *proxyListener) serve() {
+	for {
+		clientConn, err := l.listener.Accept()
+		if err != nil {
+			// Check if the error is due to the listener being closed during shutdown
+			if errors.Is(err, net.ErrClosed) {
+				logger.Info("Listener closed, shutting down accept loop.", "listener", l.name)
+				return
+			}
+			logger.Warn("Failed to accept connection", "listener", l.name, "error", err)
+			continue
+		}
+		shutdownWg.Add(1) // Increment for the new connection
+		go handleConnection(clientConn, l)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// TestBuildListeners verifies that listeners and routes naming the same StatefulSet share one target.
+func TestBuildListeners(t *testing.T) {
+	amd64 := testFlagTarget
+	amd64.name = "buildkitd-amd64"
+	arm64 := testFlagTarget
+	arm64.name = "buildkitd-arm64"
+
+	listeners, targets, err := buildListeners(fake.NewSimpleClientset(), []listenerSpec{
+		{name: "amd64", address: ":8372", target: amd64},
+		{name: "local", address: "unix:///tmp/amd64.sock", target: amd64},
+		{name: "sni", address: ":8373", target: arm64, sniRoutes: map[string]targetSpec{"amd64.example.com": amd64}},
+	})
+	if err != nil {
+		t.Fatalf("buildListeners() error = %v", err)
+	}
+	if len(listeners) != 3 || len(targets) != 2 {
+		t.Fatalf("buildListeners() = %d listeners and %d targets, want 3 and 2", len(listeners), len(targets))
+	}
+	if listeners[0].target != listeners[1].target || listeners[0].router != nil {
+		t.Error("listeners for the same StatefulSet do not share a target")
+	}
+	if got := listeners[2].router.route("amd64.example.com"); got != listeners[0].target {
+		t.Errorf("SNI route target = %s, want the shared %s", got.key(), listeners[0].target.key())
+	}
+	if got := listeners[2].router.route("other.example.com"); got != listeners[2].target {
+		t.Errorf("unrouted server name went to %s, want the listener's own target", got.key())
+	}
+	if targets[0].scaler.idleTimeout != amd64.idleTimeout {
+		t.Errorf("target idle timeout = %s, want %s", targets[0].scaler.idleTimeout, amd64.idleTimeout)
+	}
+
+	conflicting := amd64
+	conflicting.idleTimeout *= 2
+	_, _, err = buildListeners(fake.NewSimpleClientset(), []listenerSpec{
+		{name: "a", address: ":1", target: amd64},
+		{name: "b", address: ":2", target: conflicting},
+	})
+	if err == nil || !strings.Contains(err.Error(), "different settings") {
+		t.Errorf("buildListeners() with conflicting settings error = %v, want a conflict", err)
+	}
+}
+
+// TestProxyListener_ListenUnix verifies that a stale Unix socket is replaced.
+func TestProxyListener_ListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Leave the socket file behind, as a crashed process would.
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l := &proxyListener{name: "local", address: unixAddressPrefix + path}
+	if err := l.listen(); err != nil {
+		t.Fatalf("listen() error = %v", err)
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	conn.Close()
+	l.listener.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file still exists after close: %v", err)
+	}
+}
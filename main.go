@@ -1,20 +1,27 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log/slog" // New import
 	"net"
+	"net/http"
 	"os"
 	"os/signal" // New import
-	"path/filepath"
 	"sync"
 	"sync/atomic"
 	"syscall" // New import
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/client-go/kubernetes"
 )
 
@@ -41,42 +48,86 @@ const (
 	defaultBuildkitdHeadlessSvcName = "buildkitd-headless"
 	// defaultScaleDownIdleTimeoutStr is the default string representation of the idle timeout before scaling down.
 	defaultScaleDownIdleTimeoutStr = "2m0s"
-	// waitForReadyTimeout is the duration to wait for the StatefulSet to become ready after scaling.
-	waitForReadyTimeout = 5 * time.Minute
+	// defaultBalancingStrategy is the default algorithm for spreading connections across ready buildkitd pods.
+	defaultBalancingStrategy = string(strategyRoundRobin)
+	// defaultTargetConnectionsPerReplica is the default number of concurrent connections each buildkitd replica should serve.
+	defaultTargetConnectionsPerReplica = 10
+	// defaultMinReplicas is the default lowest replica count while buildkitd is awake.
+	defaultMinReplicas = 1
+	// defaultMaxReplicas is the default upper bound on buildkitd replicas. 1 preserves single-replica behaviour.
+	defaultMaxReplicas = 1
+	// defaultScaleDownCooldownStr is the default string representation of the cooldown between scale-down steps.
+	defaultScaleDownCooldownStr = "5m0s"
+	// defaultDrainTimeoutStr is the default string representation of how long to wait for the highest ordinal to drain before a scale-down step.
+	defaultDrainTimeoutStr = "10m0s"
+	// defaultReadyWaitTimeoutStr is the default string representation of how long a connection waits for buildkitd to become ready after scaling up.
+	defaultReadyWaitTimeoutStr = "5m0s"
+	// defaultMaxPendingConnections is the default number of connections that may wait for a cold start at once.
+	defaultMaxPendingConnections = 256
+	// defaultMetricsListenAddr is the default address and port for the Prometheus /metrics endpoint.
+	defaultMetricsListenAddr = ":9090"
+	// defaultHealthListenAddr is the default address and port for the /healthz and /readyz endpoints.
+	defaultHealthListenAddr = ":8081"
+	// defaultTLSCertFile is the default TLS certificate file for the proxy listener. Empty serves plain TCP.
+	defaultTLSCertFile = ""
+	// defaultLeaderElect is the default for running Lease-based leader election between autoscaler replicas.
+	defaultLeaderElect = false
+	// defaultTCPKeepAliveIdleStr is the default idle time before TCP keep-alive probes are sent on both legs of
+	// a proxied connection. With the default interval and count a dead peer is detected after 90 seconds.
+	defaultTCPKeepAliveIdleStr = "30s"
+	// defaultTCPKeepAliveIntervalStr is the default time between unanswered TCP keep-alive probes.
+	defaultTCPKeepAliveIntervalStr = "15s"
+	// defaultTCPKeepAliveCount is the default number of unanswered TCP keep-alive probes before a connection is dropped.
+	defaultTCPKeepAliveCount = 4
+	// defaultInactivityTimeoutStr is the default time without traffic after which a proxied connection is
+	// closed. Zero disables the inactivity timeout.
+	defaultInactivityTimeoutStr = "0s"
+	// defaultMaxKeepAliveTTLStr is the default longest TTL a keep-alive lease may be acquired or renewed for.
+	defaultMaxKeepAliveTTLStr = "1h"
 )
 
-// Global configuration variables, populated from command-line flags or environment variables.
+// Global configuration variables used while proxying, set from the loaded config.
 var (
-	// proxyListenAddr is the address and port the proxy listens on.
-	proxyListenAddr string
-	// buildkitdStatefulSetName is the name of the BuildKitd StatefulSet to manage.
-	buildkitdStatefulSetName string
-	// buildkitdNamespace is the Kubernetes namespace of the BuildKitd StatefulSet.
-	buildkitdNamespace string
-	// buildkitdHeadlessSvcName is the name of the BuildKitd headless service used for DNS discovery.
-	buildkitdHeadlessSvcName string
-	// buildkitdTargetPort is the target port on the BuildKitd pods to proxy connections to.
-	buildkitdTargetPort string
-	// scaleDownIdleTimeout is the duration of inactivity before scaling down BuildKitd to zero replicas.
-	scaleDownIdleTimeout time.Duration
-	// kubeconfigPath is the path to the kubeconfig file, used for out-of-cluster development.
-	kubeconfigPath string
+	// lbStrategy is the algorithm used to choose a buildkitd pod for each new connection.
+	lbStrategy balancingStrategy
+	// maxPendingConnections is the maximum number of connections held while waiting for a cold start.
+	maxPendingConnections int
+	// backendTLSServerName overrides the server name verified on buildkitd's certificate. Empty uses each pod's FQDN.
+	backendTLSServerName string
+	// backendProxyProtocol prepends a PROXY protocol v2 header to every connection to buildkitd.
+	backendProxyProtocol bool
+	// tcpKeepAlive configures TCP keep-alive probes on client and buildkitd connections, so half-open
+	// connections from crashed clients or expired NAT mappings are dropped. Disabled when Enable is false.
+	tcpKeepAlive net.KeepAliveConfig
+	// inactivityTimeout closes proxied connections after no bytes have flowed in either direction for this
+	// long, so forgotten sessions do not hold buildkitd awake. Zero disables it.
+	inactivityTimeout time.Duration
+	// maxKeepAliveTTL is the longest TTL a keep-alive lease may be acquired or renewed for.
+	maxKeepAliveTTL time.Duration
+	// probeCIDRs are the sources of load balancer health probes. Their connections are closed without being
+	// proxied, so they never wake buildkitd or reset its idle timer.
+	probeCIDRs []*net.IPNet
 )
 
 // Global runtime variables used by the application.
 var (
 	// kubeClientset is the Kubernetes API client.
-	kubeClientset *kubernetes.Clientset
-	// activeConnectionCount tracks the number of currently active proxied connections.
-	activeConnectionCount atomic.Int64
-	// scaleDownTimer is a timer that triggers scaling down to zero replicas when no connections are active for scaleDownIdleTimeout.
-	scaleDownTimer *time.Timer
-	// scaleDownTimerMutex protects access to scaleDownTimer.
-	scaleDownTimerMutex sync.Mutex
+	kubeClientset kubernetes.Interface
+	// listeners accept client connections, each for its own target StatefulSet.
+	listeners []*proxyListener
+	// targets are all StatefulSets connections may be routed to.
+	targets []*buildkitdTarget
+	// connections tracks the live proxied connections for the admin API.
+	connections = newConnectionRegistry()
+	// backendCerts holds the TLS material for connections to buildkitd; nil dials plain TCP.
+	backendCerts *certReloader
 	// logger is the structured logger for the application.
 	logger *slog.Logger // New global logger
 	// shutdownWg is a WaitGroup to ensure graceful shutdown of active connections.
 	shutdownWg sync.WaitGroup // WaitGroup for graceful shutdown
+	// processCtx is cancelled by stopProcess when shutdown begins. It ends connections still waiting for a cold
+	// start and the Kubernetes calls of scale transitions in flight.
+	processCtx, stopProcess = context.WithCancel(context.Background())
 )
 
 // main is the entry point of the buildkitd-autoscaler application.
@@ -87,95 +138,240 @@ func main() {
 	logger = slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug})) // Using Debug level for more verbose output during dev
 	slog.SetDefault(logger)
 
-	// Define flags
-	flag.StringVar(&proxyListenAddr, "listen-addr", defaultProxyListenAddr, "Proxy listen address and port (e.g., :8080). Env: PROXY_LISTEN_ADDR")
-	flag.StringVar(&buildkitdStatefulSetName, "sts-name", defaultBuildkitdStatefulSetName, "Name of the buildkitd StatefulSet. Env: BUILDKITD_STATEFULSET_NAME")
-	flag.StringVar(&buildkitdNamespace, "sts-namespace", defaultBuildkitdNamespace, "Namespace of the buildkitd StatefulSet. Env: BUILDKITD_STATEFULSET_NAMESPACE")
-	flag.StringVar(&buildkitdHeadlessSvcName, "headless-service-name", defaultBuildkitdHeadlessSvcName, "Name of the buildkitd Headless Service. Env: BUILDKITD_HEADLESS_SERVICE_NAME")
-	flag.StringVar(&buildkitdTargetPort, "target-port", defaultBuildkitdTargetPort, "Target port on buildkitd pods. Env: BUILDKITD_TARGET_PORT")
-	scaleDownIdleTimeoutStr := flag.String("idle-timeout", defaultScaleDownIdleTimeoutStr, "Duration for scale-down idle timer (e.g., 2m0s). Env: SCALE_DOWN_IDLE_TIMEOUT")
-
-	defaultKubeconfig := ""
-	if home := homeDir(); home != "" {
-		defaultKubeconfig = filepath.Join(home, ".kube", "config")
-	}
-	flag.StringVar(&kubeconfigPath, "kubeconfig", defaultKubeconfig, "Path to the kubeconfig file (for out-of-cluster development). Env: KUBECONFIG_PATH")
-
-	flag.Parse()
-
-	// Override with environment variables if set
-	if envVal := os.Getenv("PROXY_LISTEN_ADDR"); envVal != "" {
-		proxyListenAddr = envVal
-	}
-	if envVal := os.Getenv("BUILDKITD_STATEFULSET_NAME"); envVal != "" {
-		buildkitdStatefulSetName = envVal
-	}
-	if envVal := os.Getenv("BUILDKITD_STATEFULSET_NAMESPACE"); envVal != "" {
-		buildkitdNamespace = envVal
+	cfg, err := loadConfig(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
 	}
-	if envVal := os.Getenv("BUILDKITD_HEADLESS_SERVICE_NAME"); envVal != "" {
-		buildkitdHeadlessSvcName = envVal
+	if err != nil {
+		logger.Error("Invalid configuration", "error", err)
+		os.Exit(1)
 	}
-	if envVal := os.Getenv("BUILDKITD_TARGET_PORT"); envVal != "" {
-		buildkitdTargetPort = envVal
+	lbStrategy, maxPendingConnections, scalingPolicy = cfg.lbStrategy, cfg.maxPendingConnections, cfg.scalingPolicy
+	backendTLSServerName, backendProxyProtocol, probeCIDRs = cfg.backendTLSServerName, cfg.backendProxyProtocol, cfg.probeCIDRs
+	tcpKeepAlive, inactivityTimeout, maxKeepAliveTTL = cfg.tcpKeepAlive, cfg.inactivityTimeout, cfg.maxKeepAliveTTL
+	if cfg.backendTLSSecret != "" {
+		ownNamespacePermissions = append(ownNamespacePermissions, requiredPermission{"", "secrets", "get"})
 	}
-	if envVal := os.Getenv("SCALE_DOWN_IDLE_TIMEOUT"); envVal != "" {
-		*scaleDownIdleTimeoutStr = envVal
+	var peerToken string
+	if cfg.leaderElect {
+		peerToken, err = readTokenFile(cfg.peerTokenFile)
+		if err != nil {
+			logger.Error("Invalid PEER_TOKEN_FILE value", "value", cfg.peerTokenFile, "error", err)
+			os.Exit(1)
+		}
+		ownNamespacePermissions = append(ownNamespacePermissions, leasePermissions...)
 	}
-	if envVal := os.Getenv("KUBECONFIG_PATH"); envVal != "" {
-		kubeconfigPath = envVal
+	var adminToken string
+	if cfg.adminAddr != "" {
+		adminToken, err = readTokenFile(cfg.adminTokenFile)
+		if err != nil {
+			logger.Error("Invalid ADMIN_TOKEN_FILE value", "value", cfg.adminTokenFile, "error", err)
+			os.Exit(1)
+		}
 	}
-
-	var err error
-	scaleDownIdleTimeout, err = time.ParseDuration(*scaleDownIdleTimeoutStr)
-	if err != nil {
-		logger.Error("Invalid SCALE_DOWN_IDLE_TIMEOUT value", "value", *scaleDownIdleTimeoutStr, "error", err)
-		os.Exit(1)
+	var pipelineToken string
+	if cfg.pipelineAddr != "" {
+		pipelineToken, err = readTokenFile(cfg.pipelineTokenFile)
+		if err != nil {
+			logger.Error("Invalid PIPELINE_TOKEN_FILE value", "value", cfg.pipelineTokenFile, "error", err)
+			os.Exit(1)
+		}
 	}
 
 	logger.Info("Configuration loaded",
-		"listenAddr", proxyListenAddr,
-		"stsName", buildkitdStatefulSetName,
-		"stsNamespace", buildkitdNamespace,
-		"headlessSvc", buildkitdHeadlessSvcName,
-		"targetPort", buildkitdTargetPort,
-		"idleTimeout", scaleDownIdleTimeout,
-		"kubeconfig", kubeconfigPath,
+		"listenAddr", cfg.listenAddr,
+		"stsName", cfg.target.name,
+		"stsNamespace", cfg.target.namespace,
+		"podNamespace", cfg.podNamespace,
+		"headlessSvc", cfg.target.headlessService,
+		"targetPort", cfg.target.port,
+		"idleTimeout", cfg.target.idleTimeout,
+		"kubeconfig", cfg.kubeconfigPath,
+		"lbStrategy", lbStrategy,
+		"targetConnectionsPerReplica", scalingPolicy.targetConnectionsPerReplica,
+		"minReplicas", scalingPolicy.minReplicas,
+		"maxReplicas", scalingPolicy.maxReplicas,
+		"scaleDownCooldown", scalingPolicy.scaleDownCooldown,
+		"drainTimeout", scalingPolicy.drainTimeout,
+		"readyWaitTimeout", cfg.target.readyWaitTimeout,
+		"maxPendingConnections", maxPendingConnections,
+		"metricsAddr", cfg.metricsAddr,
+		"healthAddr", cfg.healthAddr,
+		"pipelineAddr", cfg.pipelineAddr,
+		"adminAddr", cfg.adminAddr,
+		"tlsCertFile", cfg.tlsCertFile,
+		"tlsClientCAFile", cfg.tlsClientCAFile,
+		"backendTLS", cfg.backendTLSFiles() || cfg.backendTLSSecret != "",
+		"backendTLSSecret", cfg.backendTLSSecret,
+		"backendTLSServerName", backendTLSServerName,
+		"leaderElect", cfg.leaderElect,
+		"leaderElectionLease", cfg.leaderElectionLeaseName,
+		"peerTokenFile", cfg.peerTokenFile,
+		"advertiseAddr", cfg.advertiseAddr,
+		"sniRoutes", cfg.sniRoutes,
+		"configFile", cfg.configFile,
+		"proxyProtocolTrustedCIDRs", cfg.proxyProtocolTrustedCIDRs,
+		"backendProxyProtocol", backendProxyProtocol,
+		"probeCIDRs", cfg.probeCIDRs,
+		"tcpKeepAlive", cfg.tcpKeepAlive.Enable,
+		"tcpKeepAliveIdle", cfg.tcpKeepAlive.Idle,
+		"tcpKeepAliveInterval", cfg.tcpKeepAlive.Interval,
+		"tcpKeepAliveCount", cfg.tcpKeepAlive.Count,
+		"inactivityTimeout", cfg.inactivityTimeout,
+		"maxKeepAliveTTL", cfg.maxKeepAliveTTL,
+		"otlpEndpoint", cfg.otlpEndpoint,
 	)
 
-	kubeClientset, err = InitKubeClient(kubeconfigPath)
+	shutdownTracing := func(context.Context) error { return nil }
+	if cfg.otlpEndpoint != "" {
+		shutdownTracing, err = initTracing(context.Background(), cfg.otlpEndpoint)
+		if err != nil {
+			logger.Error("Failed to set up tracing", "otlpEndpoint", cfg.otlpEndpoint, "error", err)
+			os.Exit(1)
+		}
+	}
+
+	kubeClientset, err = InitKubeClient(cfg.kubeconfigPath)
 	if err != nil {
 		logger.Error("Failed to initialize Kubernetes client. This service requires K8s.", "error", err)
 		os.Exit(1)
 	}
 	logger.Info("Successfully initialized Kubernetes client.")
 
-	// Initial check: if buildkitd is scaled to 0, ensure it is.
-	currentStatus, err := GetStatefulSetStatus(kubeClientset, buildkitdNamespace, buildkitdStatefulSetName)
-	if err == nil && currentStatus.ReadyReplicas > 0 && activeConnectionCount.Load() == 0 {
-		logger.Info("Initial state: ready replicas found with 0 active connections. Initiating scale down to 0.",
-			"readyReplicas", currentStatus.ReadyReplicas,
-			"statefulSet", buildkitdStatefulSetName,
-			"namespace", buildkitdNamespace,
-		)
-		_, scaleErr := ScaleStatefulSet(kubeClientset, buildkitdNamespace, buildkitdStatefulSetName, 0)
-		if scaleErr != nil {
-			logger.Error("Error during initial scale down", "error", scaleErr, "statefulSet", buildkitdStatefulSetName, "namespace", buildkitdNamespace)
-		} else {
-			logger.Info("Successfully scaled down StatefulSet to 0 replicas on startup.", "statefulSet", buildkitdStatefulSetName, "namespace", buildkitdNamespace)
+	// Every target has its own cache, backends and lifecycle. Listeners and routes naming the same StatefulSet
+	// share one target.
+	listeners, targets, err = buildListeners(kubeClientset, cfg.listeners)
+	if err != nil {
+		logger.Error("Invalid listener configuration", "error", err)
+		os.Exit(1)
+	}
+
+	// Serve StatefulSet and pod lookups from a watch-based cache rather than an API call per connection.
+	for _, t := range targets {
+		if err := t.startCache(context.Background()); err != nil {
+			logger.Error("Failed to start StatefulSet cache", "error", err, "statefulSet", t.name, "namespace", t.namespace)
+			os.Exit(1)
 		}
-	} else if err != nil {
-		logger.Warn("Could not get initial status for StatefulSet. Assuming 0 replicas.", "error", err, "statefulSet", buildkitdStatefulSetName, "namespace", buildkitdNamespace)
+		logger.Info("StatefulSet cache synced.", "statefulSet", t.name, "namespace", t.namespace)
 	}
 
-	listener, err := net.Listen("tcp", proxyListenAddr)
-	if err != nil {
-		logger.Error("Failed to listen on address", "address", proxyListenAddr, "error", err)
-		os.Exit(1)
+	// Load the client certificate for TLS to buildkitd, from files or a Secret, and keep it up to date.
+	var backendCertSource certSource
+	switch {
+	case cfg.backendTLSSecret != "":
+		backendCertSource = secretCertSource{clientset: kubeClientset, namespace: cfg.podNamespace, name: cfg.backendTLSSecret}
+	case cfg.backendTLSFiles():
+		backendCertSource = fileCertSource{certFile: cfg.backendTLSCertFile, keyFile: cfg.backendTLSKeyFile, caFile: cfg.backendTLSCAFile}
+	}
+	if backendCertSource != nil {
+		backendCerts, err = newCertReloader(processCtx, backendCertSource)
+		if err != nil {
+			logger.Error("Failed to load TLS material for buildkitd", "source", backendCertSource, "error", err)
+			os.Exit(1)
+		}
+		go backendCerts.watch(processCtx, certReloadInterval)
 	}
-	// defer listener.Close() // Moved to shutdown logic
 
-	logger.Info("TCP proxy listening", "address", proxyListenAddr, "for_statefulset", buildkitdStatefulSetName, "namespace", buildkitdNamespace)
+	// Serve probes from here on, so a misconfigured autoscaler reports itself unready while starting.
+	caches := make([]*statefulSetCache, 0, len(targets))
+	for _, t := range targets {
+		caches = append(caches, t.cache)
+	}
+	health := newHealthChecker(kubeClientset, cfg.podNamespace, caches)
+	healthMux := health.handler()
+	var healthServer *http.Server
+	if cfg.healthAddr != "" {
+		healthServer = startHealthServer(cfg.healthAddr, healthMux)
+	}
+
+	// The lifecycle picks up the StatefulSet's current state. If nothing is connected yet, it resumes the idle
+	// timer from the activity persisted on the StatefulSet, or scales to zero if that has already expired.
+	// With leader election it does so only once this replica becomes the leader.
+	persistCtx, cancelPersist := context.WithCancel(context.Background())
+	var persistWg sync.WaitGroup
+	for _, t := range targets {
+		persistWg.Add(1)
+		go func() {
+			defer persistWg.Done()
+			persistActivity(persistCtx, t.scaler, t.store, activityPollInterval)
+		}()
+	}
+	podName := os.Getenv("POD_NAME")
+	if podName == "" {
+		podName, _ = os.Hostname()
+	}
+	var admin *adminAPI
+	if cfg.adminAddr != "" {
+		admin = newAdminAPI(adminToken, connections, podName, targets)
+	}
+	stopElection := func() {}
+	if cfg.leaderElect {
+		elector := newLeaderElector(kubeClientset, cfg.podNamespace, cfg.leaderElectionLeaseName, podName, cfg.advertiseAddr, peerToken, targets)
+		elector.register(healthMux)
+		// The admin API of every replica covers the connections of all of them through the peer endpoints.
+		if admin != nil {
+			admin.peers, admin.peerToken = elector.replicas, peerToken
+			admin.registerPeer(healthMux)
+		}
+		electionCtx, cancelElection := context.WithCancel(context.Background())
+		electionDone := make(chan struct{})
+		go func() {
+			elector.run(electionCtx)
+			close(electionDone)
+		}()
+		// Release the Lease on shutdown so another replica takes over without waiting for it to expire.
+		stopElection = func() {
+			cancelElection()
+			<-electionDone
+		}
+	} else {
+		for _, t := range targets {
+			t.scaler.start()
+		}
+	}
+
+	// Terminate TLS on every listener if configured, with one certificate for all of them.
+	var listenerCerts *certReloader
+	if cfg.tlsCertFile != "" {
+		listenerCerts, err = newCertReloader(processCtx, fileCertSource{certFile: cfg.tlsCertFile, keyFile: cfg.tlsKeyFile, caFile: cfg.tlsClientCAFile})
+		if err != nil {
+			logger.Error("Failed to load TLS certificate", "error", err)
+			os.Exit(1)
+		}
+		go listenerCerts.watch(processCtx, certReloadInterval)
+	}
+	for _, l := range listeners {
+		if err := l.listen(); err != nil {
+			logger.Error("Failed to listen on address", "listener", l.name, "address", l.address, "error", err)
+			os.Exit(1)
+		}
+		// Read the PROXY protocol header below TLS, since load balancers send it before the TLS handshake.
+		if cfg.proxyProtocolTrustedCIDRs != nil {
+			l.listener = &proxyProtocolListener{Listener: l.listener, trusted: cfg.proxyProtocolTrustedCIDRs}
+		}
+		if listenerCerts != nil {
+			l.listener = tls.NewListener(l.listener, listenerCerts.serverConfig())
+		}
+		sniRouteCount := 0
+		if l.router != nil {
+			sniRouteCount = len(l.router.routes)
+		}
+		logger.Info("TCP proxy listening", "listener", l.name, "address", l.address, "tls", cfg.tlsCertFile != "", "mtls", cfg.tlsClientCAFile != "", "sniRoutes", sniRouteCount, "proxyProtocol", cfg.proxyProtocolTrustedCIDRs != nil,
+			"for_statefulset", l.target.name, "namespace", l.target.namespace, "idleTimeout", l.target.idleTimeout, "readyWaitTimeout", l.target.readyWaitTimeout)
+	}
+
+	var metricsServer *http.Server
+	if cfg.metricsAddr != "" {
+		metricsServer = startMetricsServer(cfg.metricsAddr)
+	}
+	var pipelineServer *http.Server
+	if cfg.pipelineAddr != "" {
+		pipelineServer = startPipelineServer(cfg.pipelineAddr, pipelineHandler(processCtx, pipelineToken, targets))
+	}
+	var adminServer *http.Server
+	if admin != nil {
+		adminServer = startAdminServer(cfg.adminAddr, admin.handler())
+	}
 
 	// Graceful shutdown handling
 	sigChan := make(chan os.Signal, 1)
@@ -185,10 +381,13 @@ func main() {
 		sig := <-sigChan
 		logger.Info("Shutdown signal received, initiating graceful shutdown...", "signal", sig.String())
 
-		// 1. Close the listener
-		if err := listener.Close(); err != nil {
-			logger.Error("Error closing network listener", "error", err)
+		// 1. Close the listeners and release connections still waiting for buildkitd to start
+		for _, l := range listeners {
+			if err := l.listener.Close(); err != nil {
+				logger.Error("Error closing network listener", "listener", l.name, "error", err)
+			}
 		}
+		stopProcess()
 
 		// 2. Wait for active connections to finish with a timeout
 		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 25*time.Second)
@@ -196,7 +395,7 @@ func main() {
 
 		done := make(chan struct{})
 		go func() {
-			logger.Info("Waiting for active connections to close...", "count", activeConnectionCount.Load())
+			logger.Info("Waiting for active connections to close...", "count", activeConnectionCount())
 			shutdownWg.Wait() // shutdownWg is incremented for each handleConnection
 			close(done)
 		}()
@@ -205,147 +404,258 @@ func main() {
 		case <-done:
 			logger.Info("All active connections closed gracefully.")
 		case <-shutdownCtx.Done():
-			logger.Warn("Shutdown timeout reached, some connections may have been cut short.", "remaining_connections", activeConnectionCount.Load())
+			logger.Warn("Shutdown timeout reached, some connections may have been cut short.", "remaining_connections", activeConnectionCount())
+		}
+
+		// 3. Persist the final activity and hand over leadership, then stop serving metrics and probes
+		cancelPersist()
+		persistWg.Wait()
+		stopElection()
+		if err := shutdownTracing(shutdownCtx); err != nil {
+			logger.Error("Error flushing traces", "error", err)
+		}
+		if metricsServer != nil {
+			if err := metricsServer.Close(); err != nil {
+				logger.Error("Error closing metrics server", "error", err)
+			}
+		}
+		if healthServer != nil {
+			if err := healthServer.Close(); err != nil {
+				logger.Error("Error closing health server", "error", err)
+			}
+		}
+		if pipelineServer != nil {
+			if err := pipelineServer.Close(); err != nil {
+				logger.Error("Error closing pipeline server", "error", err)
+			}
+		}
+		if adminServer != nil {
+			if err := adminServer.Close(); err != nil {
+				logger.Error("Error closing admin server", "error", err)
+			}
 		}
 
 		logger.Info("Graceful shutdown complete.")
 		os.Exit(0)
 	}()
 
-	for {
-		clientConn, err := listener.Accept()
-		if err != nil {
-			// Check if the error is due to the listener being closed during shutdown
-			if opErr, ok := err.(*net.OpError); ok && opErr.Err.Error() == "use of closed network connection" {
-				logger.Info("Listener closed, shutting down accept loop.")
-				break // Exit loop if listener is closed
-			}
-			logger.Warn("Failed to accept connection", "error", err)
-			continue
-		}
-		shutdownWg.Add(1) // Increment for the new connection
-		go handleConnection(clientConn)
+	health.accepting.Store(true)
+	var acceptWg sync.WaitGroup
+	for _, l := range listeners {
+		acceptWg.Add(1)
+		go func() {
+			defer acceptWg.Done()
+			l.serve()
+		}()
 	}
+	acceptWg.Wait()
+	health.accepting.Store(false)
 	logger.Info("Exited connection accept loop.")
 }
 
+// activeConnectionCount returns the number of active connections across all targets.
+func activeConnectionCount() int64 {
+	var n int64
+	for _, t := range targets {
+		n += t.scaler.activeConnectionCount()
+	}
+	return n
+}
+
 // handleConnection manages an incoming client connection.
-// It increments the active connection count, potentially scales up buildkitd if it's the first connection
-// and buildkitd is at zero replicas, proxies data between the client and the target buildkitd pod,
-// and decrements the active connection count upon completion. It also manages the scale-down timer.
-func handleConnection(clientConn net.Conn) {
+// It reports the connection to the lifecycle state machine, which scales buildkitd for the load and
+// starts the idle scale-down once the last connection closes. While there are no routable replicas the
+// connection is held until buildkitd is ready (sharing one scale-up with any other connections arriving
+// meanwhile), then data is proxied between the client and a ready buildkitd pod chosen by the configured
+// load-balancing strategy. With SNI routes the target StatefulSet is picked from the server name in the
+// client's TLS ClientHello, and the encrypted stream is passed through unchanged.
+func handleConnection(clientConn net.Conn, l *proxyListener) {
 	defer shutdownWg.Done() // Decrement for graceful shutdown when connection handling finishes
+	acceptStart := time.Now()
 
+	// Behind a load balancer the PROXY protocol header carries the client's address, which RemoteAddr
+	// returns from here on.
+	proxyHeader, err := acceptProxyHeader(clientConn)
+	if err != nil {
+		logger.Warn("Rejecting client connection.", "error", err)
+		clientConn.Close()
+		return
+	}
 	remoteAddrStr := clientConn.RemoteAddr().String()
-	currentActive := activeConnectionCount.Add(1)
-	isFirstConnection := currentActive == 1
-
-	logger.Debug("Accepted connection", "remoteAddr", remoteAddrStr, "activeConnections", currentActive)
+	if isProbe(clientConn, proxyHeader, probeCIDRs) {
+		logger.Debug("Closing load balancer health probe.", "listener", l.name, "remoteAddr", remoteAddrStr)
+		ignoredConnections.WithLabelValues("probe").Inc()
+		clientConn.Close()
+		return
+	}
+	clientIdentity, err := handshakeClient(processCtx, clientConn)
+	if err != nil {
+		logger.Warn("Rejecting client connection.", "error", err, "remoteAddr", remoteAddrStr)
+		clientConn.Close()
+		return
+	}
+	// A connection only counts as demand for buildkitd once the client sends data, so load balancers
+	// that connect and hang up do not wake it.
+	awaited, err := awaitClientData(clientConn, clientDataTimeout)
+	if err != nil {
+		logger.Debug("Closing connection that sent no data.", "listener", l.name, "remoteAddr", remoteAddrStr, "error", err)
+		ignoredConnections.WithLabelValues("no_data").Inc()
+		clientConn.Close()
+		return
+	}
+	clientConn = awaited
+	target, serverName := l.target, ""
+	if l.router != nil {
+		peeked, name, err := peekServerName(clientConn)
+		if err != nil {
+			logger.Warn("Rejecting client connection.", "error", err, "remoteAddr", remoteAddrStr)
+			clientConn.Close()
+			return
+		}
+		clientConn, serverName, target = peeked, name, l.router.route(name)
+	}
+	scaler, stsName, stsNamespace := target.scaler, target.name, target.namespace
+	// Only connections that count as demand are traced, backdated to the accept, so probes leave no traces.
+	ctx, span := tracer.Start(processCtx, "proxy.connection", trace.WithTimestamp(acceptStart), trace.WithSpanKind(trace.SpanKindServer),
+		targetAttributes(stsNamespace, stsName), trace.WithAttributes(clientAttributes(clientConn.RemoteAddr())...), trace.WithAttributes(attrListener.String(l.name)))
+	_, acceptSpan := tracer.Start(ctx, "proxy.accept", trace.WithTimestamp(acceptStart))
+	acceptSpan.End()
+	acceptedAt := time.Now()
+	currentActive := scaler.connectionOpened()
+	tracked := connections.add(l.name, target.key(), clientConn)
+	connectionsTotal.Inc()
+	activeConnectionsGauge.Inc()
+
+	acceptAttrs := []any{"listener", l.name, "remoteAddr", remoteAddrStr, "clientIdentity", clientIdentity, "serverName", serverName, "target", target.key(), "activeConnections", currentActive}
+	if proxyHeader != nil {
+		acceptAttrs = append(acceptAttrs, proxyHeader.logAttrs()...)
+	}
+	logger.Debug("Accepted connection", acceptAttrs...)
 
 	// Defer closing client connection and decrementing active connections
 	defer func() {
 		clientConn.Close()
-		newActiveCount := activeConnectionCount.Add(-1)
+		connections.remove(tracked)
+		newActiveCount := scaler.connectionClosed()
+		activeConnectionsGauge.Dec()
+		connectionDuration.Observe(time.Since(acceptedAt).Seconds())
+		span.End()
 		logger.Debug("Closed connection", "remoteAddr", remoteAddrStr, "activeConnections", newActiveCount)
-
-		if newActiveCount == 0 {
-			// Last connection closed, start scale-down timer
-			scaleDownTimerMutex.Lock()
-			if scaleDownTimer != nil {
-				logger.Debug("Stopping existing scale-down timer as a new one will be started or not needed.")
-				scaleDownTimer.Stop() // Stop any existing timer
-			}
-			logger.Info("Last connection closed. Starting scale-down timer.", "duration", scaleDownIdleTimeout)
-			scaleDownTimer = time.AfterFunc(scaleDownIdleTimeout, func() {
-				scaleDownTimerMutex.Lock()
-				scaleDownTimer = nil // Timer has fired
-				scaleDownTimerMutex.Unlock()
-
-				if activeConnectionCount.Load() == 0 {
-					logger.Info("Scale-down timer fired. Initiating scale down to 0.", "statefulSet", buildkitdStatefulSetName, "namespace", buildkitdNamespace)
-					_, err := ScaleStatefulSet(kubeClientset, buildkitdNamespace, buildkitdStatefulSetName, 0)
-					if err != nil {
-						logger.Error("Failed to scale down StatefulSet to 0.", "error", err, "statefulSet", buildkitdStatefulSetName, "namespace", buildkitdNamespace)
-					} else {
-						logger.Info("Successfully scaled down StatefulSet to 0 replicas.", "statefulSet", buildkitdStatefulSetName, "namespace", buildkitdNamespace)
-					}
-				} else {
-					logger.Info("Scale-down timer fired, but active connections exist. Scale down aborted.", "activeConnections", activeConnectionCount.Load())
-				}
-			})
-			scaleDownTimerMutex.Unlock()
-		}
 	}()
 
-	// If this is the first connection, cancel any pending scale-down timer
-	if isFirstConnection {
-		scaleDownTimerMutex.Lock()
-		if scaleDownTimer != nil {
-			logger.Info("First active connection. Cancelling scale-down timer.")
-			scaleDownTimer.Stop()
-			scaleDownTimer = nil
-		}
-		scaleDownTimerMutex.Unlock()
-	}
-
 	// Determine target address and manage scale-up if needed
 	var targetAddr string
-	status, err := GetStatefulSetStatus(kubeClientset, buildkitdNamespace, buildkitdStatefulSetName)
+	_, statusSpan := tracer.Start(ctx, "GetStatefulSetStatus", targetAttributes(stsNamespace, stsName))
+	status, err := target.cache.status()
+	if err == nil {
+		statusSpan.SetAttributes(attrReadyReplicas.Int64(int64(status.ReadyReplicas)))
+	}
+	endSpan(statusSpan, err)
 	if err != nil {
-		logger.Error("Failed to get status for StatefulSet. Closing connection.", "error", err, "statefulSet", buildkitdStatefulSetName, "namespace", buildkitdNamespace, "remoteAddr", remoteAddrStr)
+		logger.Error("Failed to get status for StatefulSet. Closing connection.", "error", err, "statefulSet", stsName, "namespace", stsNamespace, "remoteAddr", remoteAddrStr)
 		return // Defer will close clientConn and decrement WaitGroup
 	}
 
 	logger.Debug("StatefulSet status",
-		"statefulSet", buildkitdStatefulSetName, "namespace", buildkitdNamespace,
+		"statefulSet", stsName, "namespace", stsNamespace,
 		"desiredReplicas", status.DesiredReplicas, "currentReplicas", status.CurrentReplicas, "readyReplicas", status.ReadyReplicas)
 
-	if isFirstConnection && status.ReadyReplicas == 0 {
-		logger.Info("First connection and 0 ready replicas. Initiating scale up to 1 replica.", "statefulSet", buildkitdStatefulSetName, "namespace", buildkitdNamespace)
-		_, err = ScaleStatefulSet(kubeClientset, buildkitdNamespace, buildkitdStatefulSetName, 1)
-		if err != nil {
-			logger.Error("Failed to scale StatefulSet to 1. Closing connection.", "error", err, "statefulSet", buildkitdStatefulSetName, "namespace", buildkitdNamespace, "remoteAddr", remoteAddrStr)
+	if status.ReadyReplicas == 0 || !scaler.routable() {
+		// Every connection arriving during a cold start or a scale to zero waits on the same scale-up.
+		logger.Info("0 ready replicas. Holding connection until buildkitd is ready.", "statefulSet", stsName, "namespace", stsNamespace, "remoteAddr", remoteAddrStr, "activeConnections", currentActive)
+		heldAt := time.Now()
+		span.SetAttributes(attrColdStart.Bool(true))
+		// Only this connection's wait ends if its client disconnects or the process shuts down; the shared
+		// scale-up carries on for the other connections. A scale-up started here is traced under coldStartSpan.
+		waitCtx, coldStartSpan := tracer.Start(ctx, "proxy.cold_start")
+		waitCtx, watch := watchClient(waitCtx, clientConn)
+		err := target.coldStarts.do(waitCtx, target.readyWaitTimeout, scaler.wake)
+		released := context.Cause(waitCtx)
+		resumed, resumeErr := watch.stop()
+		endSpan(coldStartSpan, cmp.Or(released, err))
+		switch {
+		case released != nil:
+			logger.Info("Stopped holding connection for buildkitd. Closing connection.", "reason", released, "heldFor", time.Since(heldAt), "statefulSet", stsName, "namespace", stsNamespace, "remoteAddr", remoteAddrStr)
+			return
+		case err != nil:
+			logger.Error("buildkitd did not become ready for held connection. Closing connection.", "error", err, "cause", failureCause(err), "statefulSet", stsName, "namespace", stsNamespace, "remoteAddr", remoteAddrStr)
+			return
+		case resumeErr != nil:
+			logger.Error("Failed to resume held connection. Closing connection.", "error", resumeErr, "remoteAddr", remoteAddrStr)
 			return
 		}
-		logger.Info("Successfully initiated scaling. Waiting for 1 ready replica...", "statefulSet", buildkitdStatefulSetName, "namespace", buildkitdNamespace)
-		err = WaitForStatefulSetReady(kubeClientset, buildkitdNamespace, buildkitdStatefulSetName, 1, waitForReadyTimeout)
+		clientConn = resumed
+		coldStartDuration.Observe(time.Since(heldAt).Seconds())
+	}
+
+	// Discover the ready pods and pick one according to the configured strategy
+	readyOrdinals, err := target.cache.readyOrdinals()
+	if err != nil {
+		logger.Error("Failed to discover ready buildkitd pods. Closing connection.", "error", err, "statefulSet", stsName, "namespace", stsNamespace, "remoteAddr", remoteAddrStr)
+		return
+	}
+	target.backends.update(readyOrdinals)
+	selected, err := target.backends.acquire()
+	if err != nil {
+		logger.Error("No buildkitd pod available for routing. Closing connection.", "error", err, "statefulSet", stsName, "namespace", stsNamespace, "remoteAddr", remoteAddrStr)
+		return
+	}
+	defer selected.release()
+	targetAddr = selected.addr
+	backendPod := fmt.Sprintf("%s-%d", stsName, selected.ordinal)
+	span.SetAttributes(semconv.K8SPodName(backendPod))
+
+	logger.Debug("Attempting to proxy connection", "remoteAddr", remoteAddrStr, "targetAddr", targetAddr,
+		"backendOrdinal", selected.ordinal, "backendConnections", selected.activeConnections.Load(), "lbStrategy", lbStrategy)
+	var preamble []byte
+	if backendProxyProtocol {
+		preamble, err = backendProxyHeader(clientConn, proxyHeader, target.key(), serverName, clientIdentity)
 		if err != nil {
-			logger.Error("Error waiting for StatefulSet to become ready (1 replica). Closing connection.", "error", err, "statefulSet", buildkitdStatefulSetName, "namespace", buildkitdNamespace, "remoteAddr", remoteAddrStr)
+			logger.Error("Failed to build PROXY protocol header for buildkitd. Closing connection.", "error", err, "remoteAddr", remoteAddrStr)
 			return
 		}
-		logger.Info("StatefulSet is ready with 1 replica.", "statefulSet", buildkitdStatefulSetName, "namespace", buildkitdNamespace)
-	} else if status.ReadyReplicas == 0 {
-		logger.Error("Non-first connection but 0 ready replicas. Waiting for scale-up or manual intervention. Closing connection.", "statefulSet", buildkitdStatefulSetName, "namespace", buildkitdNamespace, "remoteAddr", remoteAddrStr, "activeConnections", currentActive)
-		return
 	}
-
-	// Construct target FQDN for buildkitd-0
-	targetAddr = fmt.Sprintf("%s-0.%s.%s.svc.cluster.local:%s",
-		buildkitdStatefulSetName,
-		buildkitdHeadlessSvcName,
-		buildkitdNamespace,
-		buildkitdTargetPort)
-
-	logger.Debug("Attempting to proxy connection", "remoteAddr", remoteAddrStr, "targetAddr", targetAddr)
-	targetConn, err := net.DialTimeout("tcp", targetAddr, 10*time.Second)
+	_, dialSpan := tracer.Start(ctx, "proxy.dial", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.K8SPodName(backendPod), semconv.ServerAddress(targetAddr)))
+	targetConn, err := dialBackend(ctx, targetAddr, backendCerts, backendTLSServerName, preamble)
+	endSpan(dialSpan, err)
 	if err != nil {
 		logger.Error("Failed to connect to target. Closing connection.", "targetAddr", targetAddr, "error", err, "remoteAddr", remoteAddrStr)
 		return
 	}
 	logger.Debug("Successfully connected to target", "targetAddr", targetAddr, "remoteAddr", remoteAddrStr)
 	defer targetConn.Close()
+	tracked.proxying(backendPod, targetConn)
+
+	// Reap the connection once nothing has flowed in either direction for the inactivity timeout. Closing both
+	// sides ends the copies below.
+	var monitor *inactivityMonitor
+	if inactivityTimeout > 0 {
+		monitor = newInactivityMonitor(inactivityTimeout, func(inactiveFor time.Duration) {
+			logger.Info("Closing inactive connection.", "remoteAddr", remoteAddrStr, "targetAddr", targetAddr,
+				"statefulSet", stsName, "namespace", stsNamespace, "inactiveFor", inactiveFor, "inactivityTimeout", inactivityTimeout)
+			reapedConnections.WithLabelValues(stsName, stsNamespace).Inc()
+			clientConn.Close()
+			targetConn.Close()
+		})
+	}
 
 	var copyWg sync.WaitGroup
 	copyWg.Add(2)
 
-	copyData := func(dst net.Conn, src net.Conn, direction string) {
+	_, copySpan := tracer.Start(ctx, "proxy.copy")
+	copyData := func(dst net.Conn, src net.Conn, direction string, proxied prometheus.Counter, copied *atomic.Int64) {
 		defer copyWg.Done()
 		// It's important NOT to close dst here if src is clientConn, as clientConn.Close is handled by the main defer.
 		// Similarly, targetConn.Close is handled by its own defer.
 		// Closing here can lead to "use of closed network connection" if the other copy operation is still running.
 		// The primary responsibility for closing connections lies with their respective defer statements in handleConnection.
 
-		bytesCopied, copyErr := io.Copy(dst, src)
+		reader := tracked.reader(src, copied, proxied)
+		if monitor != nil {
+			reader = monitor.reader(reader)
+		}
+		bytesCopied, copyErr := io.Copy(dst, reader)
 		logger.Debug("Data copy operation finished.", "direction", direction, "bytesCopied", bytesCopied, "remoteAddr", remoteAddrStr, "targetAddr", targetAddr)
 		if copyErr != nil && copyErr != io.EOF {
 			// Check if the error is "use of closed network connection", which might be expected if the other side closed.
@@ -355,18 +665,23 @@ func handleConnection(clientConn net.Conn) {
 				logger.Warn("Error copying data.", "direction", direction, "error", copyErr, "remoteAddr", remoteAddrStr, "targetAddr", targetAddr)
 			}
 		}
-		// Attempt to close the write side of the connection to signal the other end if it's a TCPConn
-		if tcpDst, ok := dst.(*net.TCPConn); ok {
-			tcpDst.CloseWrite()
+		// Attempt to close the write side of the connection to signal the other end (TCP, or TLS close_notify)
+		if halfCloser, ok := dst.(interface{ CloseWrite() error }); ok {
+			halfCloser.CloseWrite()
 		}
 		if tcpSrc, ok := src.(*net.TCPConn); ok {
 			tcpSrc.CloseRead()
 		}
 	}
 
-	go copyData(targetConn, clientConn, fmt.Sprintf("client_to_target (client: %s, target: %s)", remoteAddrStr, targetAddr))
-	go copyData(clientConn, targetConn, fmt.Sprintf("target_to_client (target: %s, client: %s)", targetAddr, remoteAddrStr))
+	go copyData(targetConn, clientConn, fmt.Sprintf("client_to_target (client: %s, target: %s)", remoteAddrStr, targetAddr), proxiedBytes.WithLabelValues(directionClientToBackend), &tracked.bytesToBackend)
+	go copyData(clientConn, targetConn, fmt.Sprintf("target_to_client (target: %s, client: %s)", targetAddr, remoteAddrStr), proxiedBytes.WithLabelValues(directionBackendToClient), &tracked.bytesToClient)
 
 	copyWg.Wait()
+	reaped := monitor != nil && monitor.stop()
+	transferred := []attribute.KeyValue{attrBytesToBackend.Int64(tracked.bytesToBackend.Load()), attrBytesToClient.Int64(tracked.bytesToClient.Load())}
+	copySpan.SetAttributes(transferred...)
+	copySpan.End()
+	span.SetAttributes(append(transferred, attrInactivityReaped.Bool(reaped))...)
 	logger.Debug("Data transfer complete.", "remoteAddr", remoteAddrStr, "targetAddr", targetAddr)
 }
@@ -1,158 +1,73 @@
 package main
 
 import (
-	"flag"
+	"context"
+	"io"
+	"net"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
-)
-
-// resetFlagsAndEnv is a test helper function to clean up global state before each test.
-// It resets command-line arguments, clears relevant environment variables,
-// and resets global configuration variables to their zero values.
-// This ensures test isolation for configuration loading tests.
-func resetFlagsAndEnv(t *testing.T) {
-	t.Helper()
-	// Reset standard command-line arguments
-	os.Args = []string{os.Args[0]} // Keep the program name
-
-	// Create a new flag set for the test to avoid conflicts with other tests
-	// or global flag state. Note: This doesn't easily allow testing the global
-	// flag variables directly unless they are re-registered or main's flag registration
-	// is refactored. For this test, we'll assume we are testing the logic of
-	// how os.Getenv and flag defaults interact, rather than flag.Parse() itself on globals.
-
-	// Clear environment variables set by tests
-	os.Unsetenv("PROXY_LISTEN_ADDR")
-	os.Unsetenv("BUILDKITD_STATEFULSET_NAME")
-	os.Unsetenv("BUILDKITD_STATEFULSET_NAMESPACE")
-	os.Unsetenv("BUILDKITD_HEADLESS_SERVICE_NAME")
-	os.Unsetenv("BUILDKITD_TARGET_PORT")
-	os.Unsetenv("SCALE_DOWN_IDLE_TIMEOUT")
-	os.Unsetenv("KUBECONFIG_PATH")
-
-	// Reset global config vars to their zero values or known state before each test run
-	// This is important because flags might have been parsed in previous tests or main()
-	proxyListenAddr = ""
-	buildkitdStatefulSetName = ""
-	buildkitdNamespace = ""
-	buildkitdHeadlessSvcName = ""
-	buildkitdTargetPort = ""
-	scaleDownIdleTimeout = 0
-	kubeconfigPath = "" // Assuming defaultKubeconfig logic will repopulate if necessary
-}
-
-// loadConfigForTest simulates the configuration loading logic from the main() function.
-// It takes a slice of strings representing command-line arguments,
-// sets up a new FlagSet, registers flags, parses arguments,
-// applies environment variable overrides, and parses the idle timeout duration.
-// This allows testing the configuration precedence (defaults, flags, env vars)
-// without the side effects of the full main() function (e.g., starting listeners, K8s client).
-func loadConfigForTest(testArgs []string) error {
-	// Create a new FlagSet for this specific test execution
-	fs := flag.NewFlagSet("testConfig", flag.ContinueOnError)
 
-	// Register flags with the new FlagSet, using the global variables
-	// This means the global variables will be populated by fs.Parse()
-	fs.StringVar(&proxyListenAddr, "listen-addr", defaultProxyListenAddr, "Proxy listen address")
-	fs.StringVar(&buildkitdStatefulSetName, "sts-name", defaultBuildkitdStatefulSetName, "Buildkitd StatefulSet name")
-	fs.StringVar(&buildkitdNamespace, "sts-namespace", defaultBuildkitdNamespace, "Buildkitd StatefulSet namespace")
-	fs.StringVar(&buildkitdHeadlessSvcName, "headless-service-name", defaultBuildkitdHeadlessSvcName, "Buildkitd Headless Service name")
-	fs.StringVar(&buildkitdTargetPort, "target-port", defaultBuildkitdTargetPort, "Buildkitd target port")
-	scaleDownIdleTimeoutStr := fs.String("idle-timeout", defaultScaleDownIdleTimeoutStr, "Scale-down idle timer duration")
-	// kubeconfigPath needs special handling for default as in main.go
-	defaultKubeconfigTest := ""
-	if home := homeDir(); home != "" {
-		// Assuming homeDir() is accessible and works as expected.
-		// For a pure unit test, homeDir might need to be mocked or its behavior controlled.
-		// For simplicity here, we call it directly.
-		defaultKubeconfigTest = home + "/.kube/config" // Simplified, actual uses filepath.Join
-	}
-	fs.StringVar(&kubeconfigPath, "kubeconfig", defaultKubeconfigTest, "Path to kubeconfig")
-
-	// Parse the test arguments
-	if err := fs.Parse(testArgs); err != nil {
-		return err
-	}
-
-	// Environment variable overrides (mirroring main.go logic)
-	if envVal := os.Getenv("PROXY_LISTEN_ADDR"); envVal != "" {
-		proxyListenAddr = envVal
-	}
-	if envVal := os.Getenv("BUILDKITD_STATEFULSET_NAME"); envVal != "" {
-		buildkitdStatefulSetName = envVal
-	}
-	if envVal := os.Getenv("BUILDKITD_STATEFULSET_NAMESPACE"); envVal != "" {
-		buildkitdNamespace = envVal
-	}
-	if envVal := os.Getenv("BUILDKITD_HEADLESS_SERVICE_NAME"); envVal != "" {
-		buildkitdHeadlessSvcName = envVal
-	}
-	if envVal := os.Getenv("BUILDKITD_TARGET_PORT"); envVal != "" {
-		buildkitdTargetPort = envVal
-	}
-	if envVal := os.Getenv("SCALE_DOWN_IDLE_TIMEOUT"); envVal != "" {
-		*scaleDownIdleTimeoutStr = envVal
-	}
-	if envVal := os.Getenv("KUBECONFIG_PATH"); envVal != "" {
-		kubeconfigPath = envVal
-	}
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
 
-	var err error
-	scaleDownIdleTimeout, err = time.ParseDuration(*scaleDownIdleTimeoutStr)
-	return err
+// envFrom returns a getenv function reading from env, so tests do not depend on the process environment.
+func envFrom(env map[string]string) func(string) string {
+	return func(key string) string { return env[key] }
 }
 
 // TestConfigLoading_Defaults verifies that configuration variables are correctly
 // initialized with their default values when no flags or environment variables are provided.
 func TestConfigLoading_Defaults(t *testing.T) {
-	resetFlagsAndEnv(t)
-
-	if err := loadConfigForTest([]string{}); err != nil {
-		t.Fatalf("loadConfigForTest failed: %v", err)
+	cfg, err := loadConfig(nil, envFrom(nil))
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
 	}
 
-	if proxyListenAddr != defaultProxyListenAddr {
-		t.Errorf("Expected proxyListenAddr to be %s, got %s", defaultProxyListenAddr, proxyListenAddr)
+	if cfg.listenAddr != defaultProxyListenAddr {
+		t.Errorf("Expected listenAddr to be %s, got %s", defaultProxyListenAddr, cfg.listenAddr)
 	}
-	if buildkitdStatefulSetName != defaultBuildkitdStatefulSetName {
-		t.Errorf("Expected buildkitdStatefulSetName to be %s, got %s", defaultBuildkitdStatefulSetName, buildkitdStatefulSetName)
+	if cfg.target.name != defaultBuildkitdStatefulSetName {
+		t.Errorf("Expected target name to be %s, got %s", defaultBuildkitdStatefulSetName, cfg.target.name)
 	}
-	if buildkitdNamespace != defaultBuildkitdNamespace {
-		t.Errorf("Expected buildkitdNamespace to be %s, got %s", defaultBuildkitdNamespace, buildkitdNamespace)
+	if cfg.target.namespace != defaultBuildkitdNamespace {
+		t.Errorf("Expected target namespace to be %s, got %s", defaultBuildkitdNamespace, cfg.target.namespace)
 	}
-	if buildkitdHeadlessSvcName != defaultBuildkitdHeadlessSvcName {
-		t.Errorf("Expected buildkitdHeadlessSvcName to be %s, got %s", defaultBuildkitdHeadlessSvcName, buildkitdHeadlessSvcName)
+	if cfg.target.headlessService != defaultBuildkitdHeadlessSvcName {
+		t.Errorf("Expected headless service to be %s, got %s", defaultBuildkitdHeadlessSvcName, cfg.target.headlessService)
 	}
-	if buildkitdTargetPort != defaultBuildkitdTargetPort {
-		t.Errorf("Expected buildkitdTargetPort to be %s, got %s", defaultBuildkitdTargetPort, buildkitdTargetPort)
+	if cfg.target.port != defaultBuildkitdTargetPort {
+		t.Errorf("Expected target port to be %s, got %s", defaultBuildkitdTargetPort, cfg.target.port)
 	}
 	expectedDefaultTimeout, _ := time.ParseDuration(defaultScaleDownIdleTimeoutStr)
-	if scaleDownIdleTimeout != expectedDefaultTimeout {
-		t.Errorf("Expected scaleDownIdleTimeout to be %v, got %v", expectedDefaultTimeout, scaleDownIdleTimeout)
+	if cfg.target.idleTimeout != expectedDefaultTimeout {
+		t.Errorf("Expected idle timeout to be %v, got %v", expectedDefaultTimeout, cfg.target.idleTimeout)
+	}
+	if cfg.podNamespace != defaultBuildkitdNamespace {
+		t.Errorf("Expected podNamespace to default to the StatefulSet's namespace %s, got %s", defaultBuildkitdNamespace, cfg.podNamespace)
+	}
+	if len(cfg.listeners) != 1 || cfg.listeners[0].address != defaultProxyListenAddr || cfg.listeners[0].target != cfg.target {
+		t.Errorf("Expected a single listener on %s for the flag target, got %+v", defaultProxyListenAddr, cfg.listeners)
 	}
 	// Kubeconfig default is environment-dependent, harder to assert precisely without mocking homeDir
 	// We can check it's not empty if a home dir was likely found.
-	if os.Getenv("HOME") != "" || os.Getenv("USERPROFILE") != "" {
-		if kubeconfigPath == "" {
+	if homeDir() != "" {
+		if cfg.kubeconfigPath == "" {
 			t.Error("Expected kubeconfigPath to be set by default, got empty")
 		}
-		// A more specific check could be `strings.Contains(kubeconfigPath, ".kube/config")`
-		// but this depends on homeDir() implementation details.
-	} else {
-		// If no home dir, defaultKubeconfigTest would be "", so kubeconfigPath should be ""
-		if kubeconfigPath != "" {
-			t.Errorf("Expected kubeconfigPath to be empty when no home dir, got %s", kubeconfigPath)
-		}
+	} else if cfg.kubeconfigPath != "" {
+		t.Errorf("Expected kubeconfigPath to be empty when no home dir, got %s", cfg.kubeconfigPath)
 	}
 }
 
 // TestConfigLoading_Flags checks if configuration variables are correctly set
 // using command-line flags.
 func TestConfigLoading_Flags(t *testing.T) {
-	resetFlagsAndEnv(t)
-
 	testArgs := []string{
 		"-listen-addr=:9090",
 		"-sts-name=my-buildkitd",
@@ -163,143 +78,469 @@ func TestConfigLoading_Flags(t *testing.T) {
 		"-kubeconfig=/tmp/test-kubeconfig",
 	}
 
-	if err := loadConfigForTest(testArgs); err != nil {
-		t.Fatalf("loadConfigForTest failed: %v", err)
+	cfg, err := loadConfig(testArgs, envFrom(nil))
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
 	}
 
-	if proxyListenAddr != ":9090" {
-		t.Errorf("Expected proxyListenAddr to be :9090, got %s", proxyListenAddr)
+	if cfg.listenAddr != ":9090" {
+		t.Errorf("Expected listenAddr to be :9090, got %s", cfg.listenAddr)
 	}
-	if buildkitdStatefulSetName != "my-buildkitd" {
-		t.Errorf("Expected buildkitdStatefulSetName to be my-buildkitd, got %s", buildkitdStatefulSetName)
+	if cfg.target.name != "my-buildkitd" {
+		t.Errorf("Expected target name to be my-buildkitd, got %s", cfg.target.name)
 	}
-	if buildkitdNamespace != "test-ns" {
-		t.Errorf("Expected buildkitdNamespace to be test-ns, got %s", buildkitdNamespace)
+	if cfg.target.namespace != "test-ns" {
+		t.Errorf("Expected target namespace to be test-ns, got %s", cfg.target.namespace)
 	}
-	if buildkitdHeadlessSvcName != "my-headless" {
-		t.Errorf("Expected buildkitdHeadlessSvcName to be my-headless, got %s", buildkitdHeadlessSvcName)
+	if cfg.target.headlessService != "my-headless" {
+		t.Errorf("Expected headless service to be my-headless, got %s", cfg.target.headlessService)
 	}
-	if buildkitdTargetPort != "1235" {
-		t.Errorf("Expected buildkitdTargetPort to be 1235, got %s", buildkitdTargetPort)
+	if cfg.target.port != "1235" {
+		t.Errorf("Expected target port to be 1235, got %s", cfg.target.port)
 	}
-	expectedTimeout, _ := time.ParseDuration("5m")
-	if scaleDownIdleTimeout != expectedTimeout {
-		t.Errorf("Expected scaleDownIdleTimeout to be %v, got %v", expectedTimeout, scaleDownIdleTimeout)
+	if cfg.target.idleTimeout != 5*time.Minute {
+		t.Errorf("Expected idle timeout to be %v, got %v", 5*time.Minute, cfg.target.idleTimeout)
 	}
-	if kubeconfigPath != "/tmp/test-kubeconfig" {
-		t.Errorf("Expected kubeconfigPath to be /tmp/test-kubeconfig, got %s", kubeconfigPath)
+	if cfg.kubeconfigPath != "/tmp/test-kubeconfig" {
+		t.Errorf("Expected kubeconfigPath to be /tmp/test-kubeconfig, got %s", cfg.kubeconfigPath)
 	}
 }
 
 // TestConfigLoading_EnvVars ensures that configuration variables are correctly
 // set from environment variables.
 func TestConfigLoading_EnvVars(t *testing.T) {
-	resetFlagsAndEnv(t)
-
-	os.Setenv("PROXY_LISTEN_ADDR", ":9999")
-	os.Setenv("BUILDKITD_STATEFULSET_NAME", "env-buildkitd")
-	os.Setenv("BUILDKITD_STATEFULSET_NAMESPACE", "env-ns")
-	os.Setenv("BUILDKITD_HEADLESS_SERVICE_NAME", "env-headless")
-	os.Setenv("BUILDKITD_TARGET_PORT", "4321")
-	os.Setenv("SCALE_DOWN_IDLE_TIMEOUT", "10m")
-	os.Setenv("KUBECONFIG_PATH", "/env/kubeconfig")
+	env := map[string]string{
+		"PROXY_LISTEN_ADDR":               ":9999",
+		"BUILDKITD_STATEFULSET_NAME":      "env-buildkitd",
+		"BUILDKITD_STATEFULSET_NAMESPACE": "env-ns",
+		"BUILDKITD_HEADLESS_SERVICE_NAME": "env-headless",
+		"BUILDKITD_TARGET_PORT":           "4321",
+		"SCALE_DOWN_IDLE_TIMEOUT":         "10m",
+		"KUBECONFIG_PATH":                 "/env/kubeconfig",
+		"POD_NAMESPACE":                   "autoscaler-ns",
+	}
 
-	if err := loadConfigForTest([]string{}); err != nil {
-		t.Fatalf("loadConfigForTest failed: %v", err)
+	cfg, err := loadConfig(nil, envFrom(env))
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
 	}
 
-	if proxyListenAddr != ":9999" {
-		t.Errorf("Expected proxyListenAddr to be :9999, got %s", proxyListenAddr)
+	if cfg.listenAddr != ":9999" {
+		t.Errorf("Expected listenAddr to be :9999, got %s", cfg.listenAddr)
 	}
-	if buildkitdStatefulSetName != "env-buildkitd" {
-		t.Errorf("Expected buildkitdStatefulSetName to be env-buildkitd, got %s", buildkitdStatefulSetName)
+	if cfg.target.name != "env-buildkitd" {
+		t.Errorf("Expected target name to be env-buildkitd, got %s", cfg.target.name)
 	}
-	if buildkitdNamespace != "env-ns" {
-		t.Errorf("Expected buildkitdNamespace to be env-ns, got %s", buildkitdNamespace)
+	if cfg.target.namespace != "env-ns" {
+		t.Errorf("Expected target namespace to be env-ns, got %s", cfg.target.namespace)
 	}
-	if buildkitdHeadlessSvcName != "env-headless" {
-		t.Errorf("Expected buildkitdHeadlessSvcName to be env-headless, got %s", buildkitdHeadlessSvcName)
+	if cfg.target.headlessService != "env-headless" {
+		t.Errorf("Expected headless service to be env-headless, got %s", cfg.target.headlessService)
 	}
-	if buildkitdTargetPort != "4321" {
-		t.Errorf("Expected buildkitdTargetPort to be 4321, got %s", buildkitdTargetPort)
+	if cfg.target.port != "4321" {
+		t.Errorf("Expected target port to be 4321, got %s", cfg.target.port)
 	}
-	expectedTimeout, _ := time.ParseDuration("10m")
-	if scaleDownIdleTimeout != expectedTimeout {
-		t.Errorf("Expected scaleDownIdleTimeout to be %v, got %v", expectedTimeout, scaleDownIdleTimeout)
+	if cfg.target.idleTimeout != 10*time.Minute {
+		t.Errorf("Expected idle timeout to be %v, got %v", 10*time.Minute, cfg.target.idleTimeout)
 	}
-	if kubeconfigPath != "/env/kubeconfig" {
-		t.Errorf("Expected kubeconfigPath to be /env/kubeconfig, got %s", kubeconfigPath)
+	if cfg.kubeconfigPath != "/env/kubeconfig" {
+		t.Errorf("Expected kubeconfigPath to be /env/kubeconfig, got %s", cfg.kubeconfigPath)
+	}
+	if cfg.podNamespace != "autoscaler-ns" {
+		t.Errorf("Expected podNamespace to be autoscaler-ns, got %s", cfg.podNamespace)
 	}
 }
 
 // TestConfigLoading_EnvVarOverridesFlag tests the precedence logic, specifically
 // that environment variables override values set by command-line flags.
 func TestConfigLoading_EnvVarOverridesFlag(t *testing.T) {
-	resetFlagsAndEnv(t)
-
-	// Set flags
 	testArgs := []string{
 		"-listen-addr=:9090",
 		"-sts-name=flag-buildkitd",
 		"-idle-timeout=5m",
 	}
+	env := map[string]string{
+		"PROXY_LISTEN_ADDR":          ":9999",
+		"BUILDKITD_STATEFULSET_NAME": "env-buildkitd",
+		"SCALE_DOWN_IDLE_TIMEOUT":    "10m",
+	}
 
-	// Set environment variables that should override flags
-	os.Setenv("PROXY_LISTEN_ADDR", ":9999")                  // Env overrides flag
-	os.Setenv("BUILDKITD_STATEFULSET_NAME", "env-buildkitd") // Env overrides flag
-	os.Setenv("SCALE_DOWN_IDLE_TIMEOUT", "10m")              // Env overrides flag
+	cfg, err := loadConfig(testArgs, envFrom(env))
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
 
-	// This flag is not overridden by env
-	os.Setenv("BUILDKITD_STATEFULSET_NAMESPACE", defaultBuildkitdNamespace) // To ensure it takes default if not set by flag/env
+	if cfg.listenAddr != ":9999" {
+		t.Errorf("Expected listenAddr to be :9999 (env override), got %s", cfg.listenAddr)
+	}
+	if cfg.target.name != "env-buildkitd" {
+		t.Errorf("Expected target name to be env-buildkitd (env override), got %s", cfg.target.name)
+	}
+	if cfg.target.idleTimeout != 10*time.Minute {
+		t.Errorf("Expected idle timeout to be %v (env override), got %v", 10*time.Minute, cfg.target.idleTimeout)
+	}
+	// A setting given neither as a flag nor in the environment keeps its default.
+	if cfg.target.namespace != defaultBuildkitdNamespace {
+		t.Errorf("Expected target namespace to be %s (default), got %s", defaultBuildkitdNamespace, cfg.target.namespace)
+	}
+}
 
-	if err := loadConfigForTest(testArgs); err != nil {
-		t.Fatalf("loadConfigForTest failed: %v", err)
+// TestConfigLoading_Options verifies the flags and environment variables added on top of the StatefulSet
+// settings, and the defaults loadConfig derives from them.
+func TestConfigLoading_Options(t *testing.T) {
+	tests := []struct {
+		name  string
+		args  []string
+		env   map[string]string
+		check func(t *testing.T, cfg config)
+	}{
+		{
+			name: "scaling policy",
+			args: []string{"-lb-strategy=least-connections", "-min-replicas=2", "-max-replicas=4", "-target-connections-per-replica=5"},
+			env:  map[string]string{"SCALE_DOWN_COOLDOWN": "1m", "DRAIN_TIMEOUT": "30s"},
+			check: func(t *testing.T, cfg config) {
+				want := scalePolicy{targetConnectionsPerReplica: 5, minReplicas: 2, maxReplicas: 4, scaleDownCooldown: time.Minute, drainTimeout: 30 * time.Second}
+				if cfg.lbStrategy != strategyLeastConnections || cfg.scalingPolicy != want {
+					t.Errorf("lbStrategy, scalingPolicy = %s, %+v; want %s, %+v", cfg.lbStrategy, cfg.scalingPolicy, strategyLeastConnections, want)
+				}
+			},
+		},
+		{
+			name: "cold start",
+			env:  map[string]string{"READY_WAIT_TIMEOUT": "90s", "MAX_PENDING_CONNECTIONS": "8"},
+			check: func(t *testing.T, cfg config) {
+				if cfg.target.readyWaitTimeout != 90*time.Second || cfg.maxPendingConnections != 8 {
+					t.Errorf("readyWaitTimeout, maxPendingConnections = %v, %d; want 1m30s, 8", cfg.target.readyWaitTimeout, cfg.maxPendingConnections)
+				}
+			},
+		},
+		{
+			name: "listener TLS",
+			args: []string{"-tls-cert-file=/tls/tls.crt", "-tls-key-file=/tls/tls.key", "-tls-client-ca-file=/tls/ca.crt"},
+			check: func(t *testing.T, cfg config) {
+				if cfg.tlsCertFile != "/tls/tls.crt" || cfg.tlsKeyFile != "/tls/tls.key" || cfg.tlsClientCAFile != "/tls/ca.crt" {
+					t.Errorf("TLS files = %q, %q, %q", cfg.tlsCertFile, cfg.tlsKeyFile, cfg.tlsClientCAFile)
+				}
+			},
+		},
+		{
+			name: "backend TLS from a Secret",
+			env:  map[string]string{"BACKEND_TLS_SECRET": "buildkitd-client", "BACKEND_TLS_SERVER_NAME": "buildkitd"},
+			check: func(t *testing.T, cfg config) {
+				if cfg.backendTLSFiles() || cfg.backendTLSSecret != "buildkitd-client" || cfg.backendTLSServerName != "buildkitd" {
+					t.Errorf("backend TLS = files %v, Secret %q, server name %q", cfg.backendTLSFiles(), cfg.backendTLSSecret, cfg.backendTLSServerName)
+				}
+			},
+		},
+		{
+			name: "leader election derives the Lease and advertise address",
+			args: []string{"-leader-elect=true", "-health-addr=:8081", "-peer-token-file=/peer/token"},
+			env:  map[string]string{"POD_IP": "10.0.0.7"},
+			check: func(t *testing.T, cfg config) {
+				if !cfg.leaderElect || cfg.leaderElectionLeaseName != defaultBuildkitdStatefulSetName+"-autoscaler" || cfg.advertiseAddr != "10.0.0.7:8081" {
+					t.Errorf("leader election = %v, Lease %q, advertise address %q", cfg.leaderElect, cfg.leaderElectionLeaseName, cfg.advertiseAddr)
+				}
+			},
+		},
+		{
+			name: "SNI routes",
+			env:  map[string]string{"SNI_ROUTES": "arm.example.com=arm/buildkitd-arm64"},
+			check: func(t *testing.T, cfg config) {
+				route, ok := cfg.listeners[0].sniRoutes["arm.example.com"]
+				if !ok || route.key() != "arm/buildkitd-arm64" || route.idleTimeout != cfg.target.idleTimeout {
+					t.Errorf("SNI routes = %+v, want arm.example.com routed to arm/buildkitd-arm64 with the listener's timeouts", cfg.listeners[0].sniRoutes)
+				}
+			},
+		},
+		{
+			name: "PROXY protocol",
+			env:  map[string]string{"PROXY_PROTOCOL_TRUSTED_CIDRS": "10.0.0.0/8", "BACKEND_PROXY_PROTOCOL": "true"},
+			check: func(t *testing.T, cfg config) {
+				if len(cfg.proxyProtocolTrustedCIDRs) != 1 || !cfg.backendProxyProtocol {
+					t.Errorf("PROXY protocol = trusted %v, backend %v", cfg.proxyProtocolTrustedCIDRs, cfg.backendProxyProtocol)
+				}
+			},
+		},
+		{
+			name: "TCP keep-alive and inactivity timeout",
+			env:  map[string]string{"TCP_KEEPALIVE_IDLE": "1m", "TCP_KEEPALIVE_INTERVAL": "10s", "TCP_KEEPALIVE_COUNT": "3", "INACTIVITY_TIMEOUT": "1h"},
+			check: func(t *testing.T, cfg config) {
+				want := net.KeepAliveConfig{Enable: true, Idle: time.Minute, Interval: 10 * time.Second, Count: 3}
+				if cfg.tcpKeepAlive != want || cfg.inactivityTimeout != time.Hour {
+					t.Errorf("tcpKeepAlive, inactivityTimeout = %+v, %v; want %+v, 1h0m0s", cfg.tcpKeepAlive, cfg.inactivityTimeout, want)
+				}
+			},
+		},
+		{
+			name: "TCP keep-alive disabled",
+			args: []string{"-tcp-keepalive-idle=0"},
+			check: func(t *testing.T, cfg config) {
+				if cfg.tcpKeepAlive.Enable {
+					t.Errorf("tcpKeepAlive = %+v, want it disabled", cfg.tcpKeepAlive)
+				}
+			},
+		},
+		{
+			name: "admin API",
+			args: []string{"-admin-addr=:8082"},
+			env:  map[string]string{"ADMIN_TOKEN_FILE": "/admin/token"},
+			check: func(t *testing.T, cfg config) {
+				if cfg.adminAddr != ":8082" || cfg.adminTokenFile != "/admin/token" {
+					t.Errorf("adminAddr, adminTokenFile = %q, %q; want :8082, /admin/token", cfg.adminAddr, cfg.adminTokenFile)
+				}
+			},
+		},
+		{
+			name: "pipeline endpoints",
+			args: []string{"-pipeline-addr=:8083"},
+			env:  map[string]string{"PIPELINE_TOKEN_FILE": "/pipeline/token"},
+			check: func(t *testing.T, cfg config) {
+				if cfg.pipelineAddr != ":8083" || cfg.pipelineTokenFile != "/pipeline/token" {
+					t.Errorf("pipelineAddr, pipelineTokenFile = %q, %q; want :8083, /pipeline/token", cfg.pipelineAddr, cfg.pipelineTokenFile)
+				}
+			},
+		},
+		{
+			name: "keep-alive lease TTL",
+			env:  map[string]string{"MAX_KEEPALIVE_TTL": "30m"},
+			check: func(t *testing.T, cfg config) {
+				if cfg.maxKeepAliveTTL != 30*time.Minute {
+					t.Errorf("maxKeepAliveTTL = %v, want 30m", cfg.maxKeepAliveTTL)
+				}
+			},
+		},
+		{
+			name: "OTLP endpoint",
+			env:  map[string]string{"OTLP_ENDPOINT": "http://otel-collector:4318"},
+			check: func(t *testing.T, cfg config) {
+				if cfg.otlpEndpoint != "http://otel-collector:4318" {
+					t.Errorf("otlpEndpoint = %q, want http://otel-collector:4318", cfg.otlpEndpoint)
+				}
+			},
+		},
+		{
+			name: "probe CIDRs",
+			args: []string{"-probe-cidrs=10.0.0.0/8,192.168.1.10"},
+			check: func(t *testing.T, cfg config) {
+				if len(cfg.probeCIDRs) != 2 {
+					t.Errorf("probeCIDRs = %v, want 2 networks", cfg.probeCIDRs)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := loadConfig(tt.args, envFrom(tt.env))
+			if err != nil {
+				t.Fatalf("loadConfig() error = %v", err)
+			}
+			tt.check(t, cfg)
+		})
 	}
+}
 
-	if proxyListenAddr != ":9999" { // Env should win
-		t.Errorf("Expected proxyListenAddr to be :9999 (env override), got %s", proxyListenAddr)
+// TestConfigLoading_Rejects verifies that invalid and contradictory settings are rejected, whether they come
+// from flags or environment variables.
+func TestConfigLoading_Rejects(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configFile, []byte("listeners:\n- address: :8372\n  target:\n    statefulSet: buildkitd\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	leader := []string{"-leader-elect=true", "-health-addr=:8081"}
+	tests := []struct {
+		name    string
+		args    []string
+		env     map[string]string
+		wantErr string
+	}{
+		{"invalid idle timeout flag", []string{"-idle-timeout=invalid"}, nil, "time: invalid duration"},
+		{"invalid idle timeout env", nil, map[string]string{"SCALE_DOWN_IDLE_TIMEOUT": "alsoinvalid"}, "time: invalid duration"},
+		{"unknown strategy", nil, map[string]string{"LB_STRATEGY": "fastest"}, "LB_STRATEGY"},
+		{"min above max", []string{"-min-replicas=3", "-max-replicas=2"}, nil, "scaling policy"},
+		{"invalid max pending", nil, map[string]string{"MAX_PENDING_CONNECTIONS": "many"}, "MAX_PENDING_CONNECTIONS"},
+		{"TLS cert without key", []string{"-tls-cert-file=/tls/tls.crt"}, nil, "TLS_CERT_FILE and TLS_KEY_FILE"},
+		{"TLS key without cert", nil, map[string]string{"TLS_KEY_FILE": "/tls/tls.key"}, "TLS_CERT_FILE and TLS_KEY_FILE"},
+		{"client CA without cert", []string{"-tls-client-ca-file=/tls/ca.crt"}, nil, "TLS_CLIENT_CA_FILE requires them"},
+		{"backend cert without key", []string{"-backend-tls-cert-file=/tls/client.crt"}, nil, "BACKEND_TLS_CERT_FILE and BACKEND_TLS_KEY_FILE"},
+		{"backend files and Secret", []string{"-backend-tls-ca-file=/tls/ca.crt"}, map[string]string{"BACKEND_TLS_SECRET": "buildkitd-client"}, "cannot be combined with BACKEND_TLS_SECRET"},
+		{"SNI routes and config file", []string{"-config=" + configFile}, map[string]string{"SNI_ROUTES": "arm.example.com=arm/buildkitd-arm64"}, "SNI_ROUTES cannot be combined with CONFIG_FILE"},
+		{"missing config file", nil, map[string]string{"CONFIG_FILE": filepath.Join(t.TempDir(), "missing.yaml")}, "CONFIG_FILE"},
+		{"invalid SNI routes", nil, map[string]string{"SNI_ROUTES": "arm.example.com"}, "SNI_ROUTES"},
+		{"SNI routes and listener TLS", []string{"-tls-cert-file=/tls/tls.crt", "-tls-key-file=/tls/tls.key", "-sni-routes=arm.example.com=arm/buildkitd-arm64"}, nil, "SNI routes pass TLS through"},
+		{"SNI routes and backend TLS", []string{"-sni-routes=arm.example.com=arm/buildkitd-arm64"}, map[string]string{"BACKEND_TLS_SECRET": "buildkitd-client"}, "SNI routes pass TLS through"},
+		{"invalid trusted CIDR", nil, map[string]string{"PROXY_PROTOCOL_TRUSTED_CIDRS": "10.0.0.0/33"}, "PROXY_PROTOCOL_TRUSTED_CIDRS"},
+		{"negative keep-alive idle", []string{"-tcp-keepalive-idle=-1s"}, nil, "TCP_KEEPALIVE_IDLE"},
+		{"zero keep-alive interval", nil, map[string]string{"TCP_KEEPALIVE_INTERVAL": "0s"}, "TCP_KEEPALIVE_INTERVAL"},
+		{"zero keep-alive count", []string{"-tcp-keepalive-count=0"}, nil, "TCP_KEEPALIVE_COUNT"},
+		{"invalid keep-alive count", nil, map[string]string{"TCP_KEEPALIVE_COUNT": "few"}, "TCP_KEEPALIVE_COUNT"},
+		{"negative inactivity timeout", nil, map[string]string{"INACTIVITY_TIMEOUT": "-1m"}, "INACTIVITY_TIMEOUT"},
+		{"admin API without token", nil, map[string]string{"ADMIN_LISTEN_ADDR": ":8082"}, "ADMIN_TOKEN_FILE"},
+		{"zero keep-alive lease TTL", []string{"-max-keepalive-ttl=0s"}, nil, "MAX_KEEPALIVE_TTL"},
+		{"negative keep-alive lease TTL", nil, map[string]string{"MAX_KEEPALIVE_TTL": "-1h"}, "MAX_KEEPALIVE_TTL"},
+		{"invalid keep-alive lease TTL", nil, map[string]string{"MAX_KEEPALIVE_TTL": "an hour"}, "MAX_KEEPALIVE_TTL"},
+		{"pipeline endpoints without token", []string{"-pipeline-addr=:8083"}, nil, "PIPELINE_TOKEN_FILE"},
+		{"OTLP endpoint without scheme", []string{"-otlp-endpoint=otel-collector:4318"}, nil, "OTLP_ENDPOINT"},
+		{"invalid probe CIDR", []string{"-probe-cidrs=probes"}, nil, "PROBE_CIDRS"},
+		{"invalid backend PROXY protocol", []string{"-backend-proxy-protocol=maybe"}, nil, "BACKEND_PROXY_PROTOCOL"},
+		{"invalid leader elect", nil, map[string]string{"LEADER_ELECT": "maybe"}, "LEADER_ELECT"},
+		{"leader election without health listener", []string{"-leader-elect=true", "-health-addr="}, nil, "HEALTH_LISTEN_ADDR"},
+		{"leader election without peer token", leader, map[string]string{"POD_IP": "10.0.0.7"}, "PEER_TOKEN_FILE"},
+		{"leader election without POD_IP", leader, map[string]string{"PEER_TOKEN_FILE": "/peer/token"}, "POD_IP"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadConfig(tt.args, envFrom(tt.env))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("loadConfig() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
 	}
-	if buildkitdStatefulSetName != "env-buildkitd" { // Env should win
-		t.Errorf("Expected buildkitdStatefulSetName to be env-buildkitd (env override), got %s", buildkitdStatefulSetName)
+}
+
+// startEchoBackend starts a TCP server standing in for buildkitd, which echoes back whatever it reads, and
+// returns its address.
+func startEchoBackend(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// setupProxyTest returns a listener whose target is clientset's StatefulSet, read through a StatefulSet cache,
+// with every ordinal routed to backendAddr, and points the globals at it until the test ends. The lifecycle
+// runs on a fake clock, so the idle scale-down never fires. With warm set, it starts out routing to the
+// existing replicas.
+func setupProxyTest(t *testing.T, clientset *fake.Clientset, backendAddr string, warm bool) *proxyListener {
+	t.Helper()
+	prevClientset, prevTargets := kubeClientset, targets
+	kubeClientset = clientset
+	spec := targetSpec{namespace: testNamespace, name: testStsName, readyWaitTimeout: 30 * time.Second}
+	cache := startTestCache(t, clientset)
+	pool := newBackendPool(strategyRoundRobin, func(int32) string { return backendAddr })
+	kube := kubeScaleTarget{clientset: clientset, cache: cache, namespace: spec.namespace, name: spec.name, timeout: spec.readyWaitTimeout}
+	policy := scalePolicy{targetConnectionsPerReplica: 10, minReplicas: 1, maxReplicas: 1}
+	scaler := newLifecycle(kube, pool, policy, time.Hour, newFakeClock())
+	scaler.handle(func() {
+		scaler.leading = true
+		if warm {
+			scaler.replicas = 1
+			scaler.setState(stateReady, "replicas already running")
+		}
+	})
+	target := &buildkitdTarget{
+		targetSpec: spec,
+		cache:      cache,
+		backends:   pool,
+		coldStarts: newScaleUpGroup(0),
+		scaler:     scaler,
+	}
+	targets = []*buildkitdTarget{target}
+	t.Cleanup(func() {
+		kubeClientset, targets = prevClientset, prevTargets
+	})
+	return &proxyListener{name: "default", target: target}
+}
+
+// proxyConnection runs handleConnection on l for a new client connection and returns the client's end. The
+// test waits for handleConnection to return once the client's end is closed.
+func proxyConnection(t *testing.T, l *proxyListener) net.Conn {
+	t.Helper()
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	shutdownWg.Add(1)
+	go func() {
+		handleConnection(server, l)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+	client.SetDeadline(time.Now().Add(30 * time.Second))
+	return client
+}
+
+// assertEcho sends a message through the proxied connection and checks the backend's echo.
+func assertEcho(t *testing.T, client net.Conn) {
+	t.Helper()
+	const msg = "buildkit session"
+	if _, err := client.Write([]byte(msg)); err != nil {
+		t.Fatalf("writing to the proxy: %v", err)
 	}
-	expectedTimeout, _ := time.ParseDuration("10m") // Env should win
-	if scaleDownIdleTimeout != expectedTimeout {
-		t.Errorf("Expected scaleDownIdleTimeout to be %v (env override), got %v", expectedTimeout, scaleDownIdleTimeout)
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(client, got); err != nil {
+		t.Fatalf("reading from the proxy: %v", err)
 	}
-	// Check a flag that wasn't overridden by env (should take its default or flag value)
-	if buildkitdNamespace != defaultBuildkitdNamespace { // Should be default as not set by flag in this test case and env set to default
-		t.Errorf("Expected buildkitdNamespace to be %s (default), got %s", defaultBuildkitdNamespace, buildkitdNamespace)
+	if string(got) != msg {
+		t.Errorf("proxied echo = %q, want %q", got, msg)
 	}
 }
 
-// TestConfigLoading_InvalidIdleTimeout checks that an error is returned
-// when an invalid duration string is provided for the idle timeout,
-// both via command-line flag and environment variable.
-func TestConfigLoading_InvalidIdleTimeout(t *testing.T) {
-	resetFlagsAndEnv(t)
-	testArgs := []string{"-idle-timeout=invalid"}
-	err := loadConfigForTest(testArgs)
-	if err == nil {
-		t.Errorf("Expected error for invalid idle-timeout, got nil")
-	} else {
-		if !strings.Contains(err.Error(), "time: invalid duration") {
-			t.Errorf("Expected error message to contain 'time: invalid duration', got '%v'", err)
+// TestHandleConnection_WarmPassThrough verifies that a connection arriving with a ready pod is proxied to it
+// without scaling the StatefulSet.
+func TestHandleConnection_WarmPassThrough(t *testing.T) {
+	sts := newTestStatefulSet(testStsName, testNamespace, 1)
+	sts.Spec.Selector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": testStsName}}
+	clientset := fake.NewSimpleClientset(sts, newTestPod(testStsName+"-0", true))
+	l := setupProxyTest(t, clientset, startEchoBackend(t), true)
+
+	assertEcho(t, proxyConnection(t, l))
+
+	for _, action := range clientset.Actions() {
+		if action.GetVerb() == "patch" {
+			t.Errorf("connection to a ready StatefulSet scaled it: %v", action)
 		}
 	}
+}
 
-	resetFlagsAndEnv(t)
-	os.Setenv("SCALE_DOWN_IDLE_TIMEOUT", "alsoinvalid")
-	err = loadConfigForTest([]string{})
-	if err == nil {
-		t.Errorf("Expected error for invalid SCALE_DOWN_IDLE_TIMEOUT env var, got nil")
-	} else {
-		if !strings.Contains(err.Error(), "time: invalid duration") { // Corrected .Rrror() to .Error()
-			t.Errorf("Expected error message for env to contain 'time: invalid duration', got '%v'", err)
+// TestHandleConnection_ColdStart verifies that the first connection to a StatefulSet scaled to zero scales it
+// to one replica, is held until the pod is ready and is then proxied to it.
+func TestHandleConnection_ColdStart(t *testing.T) {
+	sts := newTestStatefulSet(testStsName, testNamespace, 0)
+	sts.Spec.Selector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": testStsName}}
+	clientset := fake.NewSimpleClientset(sts)
+	scaled := make(chan struct{})
+	clientset.PrependReactor("patch", "statefulsets", func(k8stesting.Action) (bool, runtime.Object, error) {
+		close(scaled)
+		return false, nil, nil
+	})
+	l := setupProxyTest(t, clientset, startEchoBackend(t), false)
+
+	// Stand in for the StatefulSet controller and the kubelet: once scaled up, the pod becomes ready.
+	go func() {
+		<-scaled
+		ctx := context.Background()
+		sts, err := clientset.AppsV1().StatefulSets(testNamespace).Get(ctx, testStsName, metav1.GetOptions{})
+		if err != nil {
+			return
 		}
+		sts.Status.Replicas, sts.Status.ReadyReplicas = 1, 1
+		clientset.AppsV1().StatefulSets(testNamespace).UpdateStatus(ctx, sts, metav1.UpdateOptions{})
+		clientset.CoreV1().Pods(testNamespace).Create(ctx, newTestPod(testStsName+"-0", true), metav1.CreateOptions{})
+	}()
+
+	assertEcho(t, proxyConnection(t, l))
+
+	sts, err := clientset.AppsV1().StatefulSets(testNamespace).Get(context.Background(), testStsName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *sts.Spec.Replicas != 1 {
+		t.Errorf("desired replicas after a cold start = %d, want 1", *sts.Spec.Replicas)
 	}
 }
-
-// Note: Testing the homeDir() function itself, especially its cross-platform behavior
-// and interaction with os.Getenv("HOME") / os.Getenv("USERPROFILE"), would require
-// more complex mocking of os.Getenv. For these config tests, we assume homeDir()
-// works as intended or rely on the actual environment.
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsNamespace prefixes every metric exported by the autoscaler.
+const metricsNamespace = "buildkitd_proxy"
+
+// Directions of proxied traffic, used as the "direction" label of proxiedBytes.
+const (
+	directionClientToBackend = "client_to_backend"
+	directionBackendToClient = "backend_to_client"
+)
+
+// Directions of scaling events, used as the "direction" label of the scale metrics.
+const (
+	scaleDirectionUp   = "up"
+	scaleDirectionDown = "down"
+)
+
+// Prometheus metrics, registered with the default registry and served on /metrics.
+var (
+	// activeConnectionsGauge is the number of client connections currently being handled.
+	activeConnectionsGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "active_connections",
+		Help:      "Number of client connections currently being handled.",
+	})
+	// connectionsTotal counts accepted client connections.
+	connectionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "connections_total",
+		Help:      "Total number of accepted client connections.",
+	})
+	// ignoredConnections counts connections closed without being proxied: health probes, and connections
+	// that never sent data.
+	ignoredConnections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "ignored_connections_total",
+		Help:      "Total number of connections closed without waking buildkitd, by reason (probe, no_data).",
+	}, []string{"reason"})
+	// reapedConnections counts proxied connections closed by the inactivity timeout.
+	reapedConnections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "reaped_connections_total",
+		Help:      "Total number of proxied connections closed after no bytes flowed for the inactivity timeout.",
+	}, []string{"statefulset", "namespace"})
+	// proxiedBytes counts bytes proxied in each direction, as they are read, so long-lived connections show up
+	// while they are still open.
+	proxiedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "proxied_bytes_total",
+		Help:      "Total number of bytes proxied, by direction (client_to_backend, backend_to_client).",
+	}, []string{"direction"})
+	// scaleEvents counts successful changes of the StatefulSet replica count.
+	scaleEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "scale_events_total",
+		Help:      "Total number of StatefulSet replica changes, by direction (up, down).",
+	}, []string{"statefulset", "namespace", "direction"})
+	// scaleFailures counts failed scaling operations, including replicas that did not become ready.
+	scaleFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "scale_failures_total",
+		Help:      "Total number of failed scaling operations, by direction (up, down) and cause (api, timeout, scheduling, image_pull, crash).",
+	}, []string{"statefulset", "namespace", "direction", "cause"})
+	// coldStartDuration observes how long connections were held waiting for buildkitd to become ready.
+	coldStartDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "cold_start_duration_seconds",
+		Help:      "Time connections were held until buildkitd became ready.",
+		Buckets:   []float64{1, 2.5, 5, 10, 20, 30, 45, 60, 90, 120, 180, 300},
+	})
+	// connectionDuration observes the lifetime of client connections.
+	connectionDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "connection_duration_seconds",
+		Help:      "Lifetime of client connections, from accept to close.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 4, 10), // 0.1s to ~7h
+	})
+	// desiredReplicasGauge is the StatefulSet's desired replica count.
+	desiredReplicasGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "desired_replicas",
+		Help:      "Desired replicas of the buildkitd StatefulSet.",
+	}, []string{"statefulset", "namespace"})
+	// readyReplicasGauge is the StatefulSet's ready replica count.
+	readyReplicasGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "ready_replicas",
+		Help:      "Ready replicas of the buildkitd StatefulSet.",
+	}, []string{"statefulset", "namespace"})
+	// pinnedGauge is 1 while the StatefulSet is pinned through the admin API.
+	pinnedGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "pinned",
+		Help:      "1 while the buildkitd StatefulSet is pinned awake through the admin API, 0 otherwise.",
+	}, []string{"statefulset", "namespace"})
+	// pinnedReplicasGauge is the replica count the StatefulSet is pinned to, or 0 without a fixed count.
+	pinnedReplicasGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "pinned_replicas",
+		Help:      "Replica count the buildkitd StatefulSet is pinned to, 0 if it is not pinned to a fixed count.",
+	}, []string{"statefulset", "namespace"})
+	// keepAliveLeasesGauge is the number of keep-alive leases held on the StatefulSet.
+	keepAliveLeasesGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "keepalive_leases",
+		Help:      "Number of keep-alive leases held on the buildkitd StatefulSet; reported by the leader only.",
+	}, []string{"statefulset", "namespace"})
+	// leaderGauge is 1 while this replica holds the leader election Lease and scales the StatefulSet.
+	leaderGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "leader",
+		Help:      "1 if this autoscaler replica is the leader that scales the StatefulSet, 0 otherwise.",
+	})
+)
+
+// recordReplicas updates the replica gauges from a StatefulSet status.
+func recordReplicas(namespace, statefulSetName string, status *StatefulSetStatus) {
+	desiredReplicasGauge.WithLabelValues(statefulSetName, namespace).Set(float64(status.DesiredReplicas))
+	readyReplicasGauge.WithLabelValues(statefulSetName, namespace).Set(float64(status.ReadyReplicas))
+}
+
+// recordPin updates the pin gauges; pin is nil once the StatefulSet is unpinned.
+func recordPin(namespace, statefulSetName string, pin *pinState) {
+	pinned, replicas := 0.0, 0.0
+	if pin != nil {
+		pinned, replicas = 1, float64(pin.replicas)
+	}
+	pinnedGauge.WithLabelValues(statefulSetName, namespace).Set(pinned)
+	pinnedReplicasGauge.WithLabelValues(statefulSetName, namespace).Set(replicas)
+}
+
+// recordScaleFailure counts a failed scaling operation. The cause is taken from classified pod
+// failures; otherwise it is "timeout" for waits and "api" for everything else.
+func recordScaleFailure(namespace, statefulSetName, direction string, err error, waiting bool) {
+	cause := failureCause(err)
+	switch {
+	case cause != "":
+	case waiting:
+		cause = "timeout"
+	default:
+		cause = "api"
+	}
+	scaleFailures.WithLabelValues(statefulSetName, namespace, direction, cause).Inc()
+}
+
+// startMetricsServer serves /metrics on addr in the background.
+func startMetricsServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		logger.Info("Metrics server listening", "address", addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Metrics server failed", "address", addr, "error", err)
+		}
+	}()
+	return srv
+}
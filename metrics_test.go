@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// TestRecordScaleFailure checks the cause label chosen for failed scaling operations.
+func TestRecordScaleFailure(t *testing.T) {
+	tests := []struct {
+		err     error
+		waiting bool
+		cause   string
+	}{
+		{errors.New("patch rejected"), false, "api"},
+		{errors.New("timed out"), true, "timeout"},
+		{&podFailureError{cause: errImagePull, pod: "p", reason: "ImagePullBackOff"}, true, "image_pull"},
+	}
+	for _, tt := range tests {
+		counter := scaleFailures.WithLabelValues("metrics-sts", testNamespace, scaleDirectionUp, tt.cause)
+		before := testutil.ToFloat64(counter)
+		recordScaleFailure(testNamespace, "metrics-sts", scaleDirectionUp, tt.err, tt.waiting)
+		if got := testutil.ToFloat64(counter) - before; got != 1 {
+			t.Errorf("recordScaleFailure(%v, waiting=%v) incremented cause %q by %v, want 1", tt.err, tt.waiting, tt.cause, got)
+		}
+	}
+}
+
+// TestKubeScaleTarget_Metrics verifies that scaling through kubeScaleTarget records the direction of
+// each scale event and that the replica gauges follow the StatefulSet.
+func TestKubeScaleTarget_Metrics(t *testing.T) {
+	clientset := fake.NewSimpleClientset(newTestStatefulSet(testStsName, testNamespace, 1))
+	c := startTestCache(t, clientset)
+	target := kubeScaleTarget{clientset: clientset, cache: c, namespace: testNamespace, name: testStsName, timeout: time.Second}
+
+	up := scaleEvents.WithLabelValues(testStsName, testNamespace, scaleDirectionUp)
+	down := scaleEvents.WithLabelValues(testStsName, testNamespace, scaleDirectionDown)
+	upBefore, downBefore := testutil.ToFloat64(up), testutil.ToFloat64(down)
+
+	if err := target.Scale(context.Background(), 3); err != nil {
+		t.Fatalf("Scale(3) error = %v", err)
+	}
+	if got := testutil.ToFloat64(up) - upBefore; got != 1 {
+		t.Errorf("scale ups recorded = %v, want 1", got)
+	}
+	if err := c.waitFor(context.Background(), time.Second, "observe the scale up", func(s *StatefulSetStatus) bool { return s.DesiredReplicas == 3 }, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(desiredReplicasGauge.WithLabelValues(testStsName, testNamespace)); got != 3 {
+		t.Errorf("desired replicas gauge = %v, want 3", got)
+	}
+
+	if err := target.Scale(context.Background(), 0); err != nil {
+		t.Fatalf("Scale(0) error = %v", err)
+	}
+	if got := testutil.ToFloat64(down) - downBefore; got != 1 {
+		t.Errorf("scale downs recorded = %v, want 1", got)
+	}
+}
+
+// TestMetricsHandler verifies that the registered metrics are exposed in the Prometheus text format.
+func TestMetricsHandler(t *testing.T) {
+	connectionsTotal.Inc()
+	rec := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(rec, httptest.NewRequestWithContext(context.Background(), http.MethodGet, "/metrics", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /metrics status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	for _, name := range []string{"buildkitd_proxy_connections_total", "buildkitd_proxy_active_connections", "buildkitd_proxy_connection_duration_seconds"} {
+		if !strings.Contains(rec.Body.String(), name) {
+			t.Errorf("GET /metrics does not expose %s", name)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// pinAnnotation is the StatefulSet annotation holding the pin set through the admin API, so it survives
+// autoscaler restarts and leader changes.
+const pinAnnotation = "buildkitd-proxy/pin"
+
+// Errors of the manual overrides, reported to the admin API.
+var (
+	errInvalidPin           = errors.New("invalid pin")
+	errActiveConnections    = errors.New("connections are active; force the sleep to close them")
+	errTransitionInProgress = errors.New("a scale transition is in progress; retry once it has finished")
+)
+
+// pinState is a manual override of the load-based scaling. While pinned the StatefulSet is never scaled to
+// zero for being idle.
+type pinState struct {
+	// replicas fixes the replica count regardless of load. Zero keeps load-based scaling between
+	// minReplicas and maxReplicas.
+	replicas int32
+	// until is when the pin expires. Zero pins until the pin is removed.
+	until time.Time
+}
+
+// expired reports whether the pin has expired at now.
+func (p pinState) expired(now time.Time) bool {
+	return !p.until.IsZero() && !now.Before(p.until)
+}
+
+// pinRecord is the JSON form of a pinState, in pinAnnotation and in admin API responses.
+type pinRecord struct {
+	Replicas int32      `json:"replicas,omitempty"`
+	Until    *time.Time `json:"until,omitempty"`
+}
+
+// record returns the JSON form of p.
+func (p pinState) record() pinRecord {
+	record := pinRecord{Replicas: p.replicas}
+	if !p.until.IsZero() {
+		until := p.until.UTC()
+		record.Until = &until
+	}
+	return record
+}
+
+// pinStore persists the pin, so a restarted or newly elected autoscaler keeps it.
+type pinStore interface {
+	// LoadPin returns the persisted pin; ok is false if there is none.
+	LoadPin() (pin pinState, ok bool, err error)
+	// SavePin persists pin, or removes the persisted pin if it is nil.
+	SavePin(ctx context.Context, pin *pinState) error
+}
+
+// LoadPin reads the pin annotation from the cached StatefulSet.
+func (t kubeScaleTarget) LoadPin() (pinState, bool, error) {
+	sts, err := t.cache.statefulSet()
+	if err != nil {
+		return pinState{}, false, err
+	}
+	return pinOf(sts.Annotations)
+}
+
+// pinOf parses the pin annotation. A missing annotation is not an error.
+func pinOf(annotations map[string]string) (pinState, bool, error) {
+	value, ok := annotations[pinAnnotation]
+	if !ok {
+		return pinState{}, false, nil
+	}
+	var record pinRecord
+	if err := json.Unmarshal([]byte(value), &record); err != nil {
+		return pinState{}, false, fmt.Errorf("invalid %s annotation %q: %w", pinAnnotation, value, err)
+	}
+	pin := pinState{replicas: record.Replicas}
+	if record.Until != nil {
+		pin.until = *record.Until
+	}
+	return pin, true, nil
+}
+
+// SavePin writes or removes the pin annotation with a merge patch, leaving other annotations untouched.
+func (t kubeScaleTarget) SavePin(ctx context.Context, pin *pinState) error {
+	var value *string
+	if pin != nil {
+		data, err := json.Marshal(pin.record())
+		if err != nil {
+			return err
+		}
+		s := string(data)
+		value = &s
+	}
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]*string{pinAnnotation: value},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = t.clientset.AppsV1().StatefulSets(t.namespace).Patch(ctx, t.name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return fmt.Errorf("error saving pin on StatefulSet %s in namespace %s: %w", t.name, t.namespace, err)
+	}
+	return nil
+}
+
+// setPin replaces any pin with pin and brings the replicas in line with it: an idle StatefulSet is woken,
+// and with a fixed replica count it is scaled straight to that count. While another replica is the leader,
+// the pin is passed on through forwardPin.
+func (lc *lifecycle) setPin(ctx context.Context, pin pinState) error {
+	if pin.replicas < 0 || pin.replicas > lc.policy.maxReplicas {
+		return fmt.Errorf("%w: replicas must be between 0 and the maximum of %d, got %d", errInvalidPin, lc.policy.maxReplicas, pin.replicas)
+	}
+	if pin.expired(lc.clock.Now()) {
+		return fmt.Errorf("%w: already expired at %s", errInvalidPin, pin.until)
+	}
+	forward := false
+	lc.handle(func() {
+		if !lc.leading {
+			forward = true
+			return
+		}
+		lc.applyPin(&pin, "set by admin")
+		lc.queuePinSave()
+		lc.reconcilePin()
+	})
+	if forward {
+		if lc.forwardPin == nil {
+			return errNotLeader
+		}
+		return lc.forwardPin(ctx, &pin)
+	}
+	return nil
+}
+
+// clearPin removes the pin and resumes load-based scaling, starting the idle timer if nothing is connected.
+// While another replica is the leader, the removal is passed on through forwardPin.
+func (lc *lifecycle) clearPin(ctx context.Context) error {
+	forward := false
+	lc.handle(func() {
+		if !lc.leading {
+			forward = true
+			return
+		}
+		if lc.pin == nil {
+			return
+		}
+		lc.applyPin(nil, "removed by admin")
+		lc.queuePinSave()
+		lc.resumeAfterPin()
+	})
+	if forward {
+		if lc.forwardPin == nil {
+			return errNotLeader
+		}
+		return lc.forwardPin(ctx, nil)
+	}
+	return nil
+}
+
+// currentPin returns the pin in effect, if any.
+func (lc *lifecycle) currentPin() (pinState, bool) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if lc.pin == nil {
+		return pinState{}, false
+	}
+	return *lc.pin, true
+}
+
+// sleep scales to zero now, removing any pin. With connections active it refuses unless force is set, in
+// which case the connections end as their pods terminate. It returns once the scale-down has started, and
+// refuses while another transition is in flight. While another replica is the leader, the request is passed
+// on through forwardSleep.
+func (lc *lifecycle) sleep(ctx context.Context, force bool) error {
+	var err error
+	forward := false
+	lc.handle(func() {
+		switch {
+		case !lc.leading:
+			forward = true
+			return
+		case lc.totalConnections() > 0 && !force:
+			err = fmt.Errorf("%w (%d open)", errActiveConnections, lc.totalConnections())
+			return
+		case lc.state == stateScalingUp || lc.state == stateScalingDown:
+			err = errTransitionInProgress
+			return
+		}
+		if lc.pin != nil {
+			lc.applyPin(nil, "sleep requested by admin")
+			lc.queuePinSave()
+		}
+		if lc.idleTimer != nil {
+			lc.idleTimer.Stop()
+			lc.idleTimer = nil
+		}
+		switch lc.state {
+		case stateDraining:
+			lc.abortDrain("sleep requested by admin")
+			lc.startScaleDown(0, "sleep requested by admin")
+		case stateReady:
+			lc.startScaleDown(0, "sleep requested by admin")
+		}
+	})
+	if forward {
+		if lc.forwardSleep == nil {
+			return errNotLeader
+		}
+		return lc.forwardSleep(ctx, force)
+	}
+	return err
+}
+
+// applyPin makes pin the pin in effect, or removes it if nil, and arms its expiry. Must be called under mu.
+func (lc *lifecycle) applyPin(pin *pinState, reason string) {
+	if lc.pinTimer != nil {
+		lc.pinTimer.Stop()
+		lc.pinTimer = nil
+	}
+	lc.pin = pin
+	if pin == nil {
+		lc.log.Info("Unpinned StatefulSet. Resuming load-based scaling.", "reason", reason)
+	} else {
+		lc.log.Info("Pinned StatefulSet.", "reason", reason, "replicas", pin.replicas, "until", pin.until)
+	}
+	if lc.onPinChanged != nil {
+		lc.onPinChanged(pin)
+	}
+	if pin == nil || pin.until.IsZero() {
+		return
+	}
+
+	var t timer
+	t = lc.clock.AfterFunc(pin.until.Sub(lc.clock.Now()), func() {
+		lc.handle(func() {
+			if lc.pinTimer != t {
+				return // Replaced or removed after it fired.
+			}
+			lc.pinTimer = nil
+			lc.applyPin(nil, "pin expired")
+			lc.queuePinSave()
+			lc.resumeAfterPin()
+		})
+	})
+	lc.pinTimer = t
+}
+
+// queuePinSave queues persisting the pin in effect. Saves are serialized and each saves the latest pin, so
+// they cannot overwrite a newer pin with an older one. Must be called under mu.
+func (lc *lifecycle) queuePinSave() {
+	if lc.pins == nil {
+		return
+	}
+	lc.pending = append(lc.pending, func() {
+		lc.pinSaveMu.Lock()
+		defer lc.pinSaveMu.Unlock()
+		lc.mu.Lock()
+		pin, leading := lc.pin, lc.leading
+		lc.mu.Unlock()
+		if !leading {
+			return // The pin is no longer this replica's to save.
+		}
+		if err := lc.pins.SavePin(lc.ctx, pin); err != nil {
+			lc.log.Warn("Failed to persist pin", "error", err)
+		}
+	})
+}
+
+// reconcilePin scales towards the pin in effect: up from idle or to a higher pinned count, and straight
+// down to a lower pinned count. A transition in flight reconciles once it has finished. Must be called
+// under mu.
+func (lc *lifecycle) reconcilePin() {
+	if lc.idleTimer != nil {
+		lc.idleTimer.Stop()
+		lc.idleTimer = nil
+	}
+	want := lc.desiredReplicas(lc.totalConnections())
+	if lc.state == stateDraining && lc.pin.replicas > 0 {
+		lc.abortDrain("pinned to a fixed replica count")
+	}
+	switch lc.state {
+	case stateIdle:
+		lc.startScaleUp(lc.ctx, want, "pinned")
+	case stateReady:
+		switch {
+		case want > lc.replicas:
+			lc.startScaleUp(lc.ctx, want, "pinned")
+		case want < lc.replicas && lc.pin.replicas > 0:
+			lc.startScaleDown(want, "pinned to fewer replicas")
+		}
+	}
+}
+
+// resumeAfterPin returns to load-based scaling once the pin is gone. Must be called under mu.
+func (lc *lifecycle) resumeAfterPin() {
+	if lc.state != stateReady {
+		// Idle stays idle, and transitions in flight resume load-based scaling when they finish.
+		return
+	}
+	total := lc.totalConnections()
+	if total == 0 {
+		lc.startIdleTimer()
+	} else if desired := lc.desiredReplicas(total); desired > lc.replicas {
+		lc.startScaleUp(lc.ctx, desired, "pin removed")
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakePinStore is an in-memory pinStore.
+type fakePinStore struct {
+	mu  sync.Mutex
+	pin *pinState
+}
+
+func (f *fakePinStore) LoadPin() (pinState, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.pin == nil {
+		return pinState{}, false, nil
+	}
+	return *f.pin, true, nil
+}
+
+func (f *fakePinStore) SavePin(_ context.Context, pin *pinState) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pin = pin
+	return nil
+}
+
+// saved returns the persisted pin.
+func (f *fakePinStore) saved() *pinState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.pin
+}
+
+// newPinTest creates a started lifecycle over a StatefulSet scaled to zero that persists its pin in store.
+func newPinTest(t *testing.T, policy scalePolicy, store *fakePinStore, replicas int32) *lifecycleTest {
+	t.Helper()
+	lt := &lifecycleTest{target: &fakeScaleTarget{replicas: replicas}, clock: newFakeClock()}
+	lt.lc = newLifecycle(lt.target, newBackendPool(strategyRoundRobin, testBackendAddr), policy, time.Minute, lt.clock)
+	lt.lc.spawn = func(f func()) { f() }
+	lt.lc.pins = store
+	lt.lc.start()
+	return lt
+}
+
+// TestPinOf verifies parsing of the pin annotation.
+func TestPinOf(t *testing.T) {
+	until := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        pinState
+		wantOK      bool
+		wantErr     bool
+	}{
+		{"none", nil, pinState{}, false, false},
+		{"awake indefinitely", map[string]string{pinAnnotation: `{}`}, pinState{}, true, false},
+		{"replicas until", map[string]string{pinAnnotation: `{"replicas":2,"until":"2024-01-01T12:00:00Z"}`}, pinState{replicas: 2, until: until}, true, false},
+		{"invalid", map[string]string{pinAnnotation: `pinned`}, pinState{}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok, err := pinOf(tt.annotations)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("pinOf() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if ok != tt.wantOK || got.replicas != tt.want.replicas || !got.until.Equal(tt.want.until) {
+				t.Errorf("pinOf() = %+v, %v, want %+v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+// TestKubeScaleTarget_Pin verifies that a pin saved on the StatefulSet is read back from the cache and can be removed.
+func TestKubeScaleTarget_Pin(t *testing.T) {
+	clientset := fake.NewSimpleClientset(newTestStatefulSet(testStsName, testNamespace, 1))
+	c := startTestCache(t, clientset)
+	target := kubeScaleTarget{clientset: clientset, cache: c, namespace: testNamespace, name: testStsName, timeout: time.Second}
+
+	want := pinState{replicas: 2, until: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	if err := target.SavePin(context.Background(), &want); err != nil {
+		t.Fatalf("SavePin() error = %v", err)
+	}
+	waitFor(t, "the saved pin in the cache", func() bool {
+		got, ok, err := target.LoadPin()
+		return err == nil && ok && got.replicas == want.replicas && got.until.Equal(want.until)
+	})
+
+	if err := target.SavePin(context.Background(), nil); err != nil {
+		t.Fatalf("SavePin(nil) error = %v", err)
+	}
+	waitFor(t, "the pin to be removed from the cache", func() bool {
+		_, ok, err := target.LoadPin()
+		return err == nil && !ok
+	})
+}
+
+// TestLifecycle_PinAwake verifies that a pinned StatefulSet is woken and not scaled to zero until the pin
+// expires, after which the idle timer runs as usual.
+func TestLifecycle_PinAwake(t *testing.T) {
+	store := &fakePinStore{}
+	lt := newPinTest(t, testLifecyclePolicy, store, 0)
+
+	if err := lt.lc.setPin(context.Background(), pinState{until: lt.clock.Now().Add(time.Hour)}); err != nil {
+		t.Fatalf("setPin() error = %v", err)
+	}
+	lt.assertState(t, stateReady)
+	lt.assertScales(t, 1)
+	if store.saved() == nil {
+		t.Error("pin was not persisted")
+	}
+
+	lt.open(1)
+	lt.close(1)
+	lt.clock.Advance(59 * time.Minute)
+	lt.assertState(t, stateReady)
+	lt.assertScales(t, 1)
+
+	lt.clock.Advance(time.Minute)
+	if _, ok := lt.lc.currentPin(); ok || store.saved() != nil {
+		t.Errorf("pin still in effect or persisted after it expired")
+	}
+	lt.clock.Advance(time.Minute)
+	lt.assertState(t, stateIdle)
+	lt.assertScales(t, 1, 0)
+}
+
+// TestLifecycle_PinReplicas verifies that a fixed replica count is scaled to directly and holds regardless of
+// load until the pin is removed.
+func TestLifecycle_PinReplicas(t *testing.T) {
+	policy := scalePolicy{targetConnectionsPerReplica: 1, minReplicas: 1, maxReplicas: 3}
+	lt := newPinTest(t, policy, &fakePinStore{}, 0)
+
+	if err := lt.lc.setPin(context.Background(), pinState{replicas: 4}); !errors.Is(err, errInvalidPin) {
+		t.Errorf("setPin() above maxReplicas error = %v, want %v", err, errInvalidPin)
+	}
+	if err := lt.lc.setPin(context.Background(), pinState{replicas: 3}); err != nil {
+		t.Fatalf("setPin() error = %v", err)
+	}
+	lt.assertScales(t, 3)
+
+	if err := lt.lc.setPin(context.Background(), pinState{replicas: 2}); err != nil {
+		t.Fatalf("setPin() error = %v", err)
+	}
+	lt.assertState(t, stateReady)
+	lt.assertScales(t, 3, 2)
+
+	lt.open(3)
+	lt.clock.Advance(time.Hour)
+	lt.assertScales(t, 3, 2)
+
+	if err := lt.lc.clearPin(context.Background()); err != nil {
+		t.Fatalf("clearPin() error = %v", err)
+	}
+	lt.assertScales(t, 3, 2, 3)
+	lt.close(3)
+	lt.clock.Advance(time.Minute)
+	lt.assertState(t, stateIdle)
+}
+
+// TestLifecycle_PinRestoredAtStartup verifies that a new leader restores a persisted pin and ignores an
+// expired one.
+func TestLifecycle_PinRestoredAtStartup(t *testing.T) {
+	now := newFakeClock().Now()
+	lt := newPinTest(t, testLifecyclePolicy, &fakePinStore{pin: &pinState{until: now.Add(time.Hour)}}, 1)
+	lt.clock.Advance(30 * time.Minute)
+	lt.assertState(t, stateReady)
+	lt.assertScales(t)
+
+	store := &fakePinStore{pin: &pinState{until: now.Add(-time.Minute)}}
+	lt = newPinTest(t, testLifecyclePolicy, store, 1)
+	lt.assertState(t, stateIdle)
+	lt.assertScales(t, 0)
+	if store.saved() != nil {
+		t.Error("expired pin was not removed")
+	}
+}
+
+// TestLifecycle_Sleep verifies that a sleep scales to zero and removes the pin, refusing with connections
+// active unless forced.
+func TestLifecycle_Sleep(t *testing.T) {
+	store := &fakePinStore{}
+	lt := newPinTest(t, testLifecyclePolicy, store, 0)
+	if err := lt.lc.setPin(context.Background(), pinState{}); err != nil {
+		t.Fatalf("setPin() error = %v", err)
+	}
+	lt.open(1)
+
+	if err := lt.lc.sleep(context.Background(), false); !errors.Is(err, errActiveConnections) {
+		t.Fatalf("sleep() with an active connection error = %v, want %v", err, errActiveConnections)
+	}
+	lt.assertState(t, stateReady)
+	if err := lt.lc.sleep(context.Background(), true); err != nil {
+		t.Fatalf("sleep(force) error = %v", err)
+	}
+	lt.assertState(t, stateIdle)
+	lt.assertScales(t, 1, 0)
+	if _, ok := lt.lc.currentPin(); ok || store.saved() != nil {
+		t.Error("pin still in effect or persisted after sleeping")
+	}
+
+	lt.close(1)
+	if err := lt.lc.wake(context.Background()); err != nil {
+		t.Fatalf("wake() after sleeping error = %v", err)
+	}
+	lt.assertScales(t, 1, 0, 1)
+}
+
+// TestLifecycle_OverridesForwarded verifies that followers pass manual overrides on to the leader, and
+// refuse them without a way to reach it.
+func TestLifecycle_OverridesForwarded(t *testing.T) {
+	lt := newPinTest(t, testLifecyclePolicy, &fakePinStore{}, 0)
+	lt.lc.stopLeading()
+	if err := lt.lc.setPin(context.Background(), pinState{}); !errors.Is(err, errNotLeader) {
+		t.Errorf("setPin() on a follower without forwardPin error = %v, want %v", err, errNotLeader)
+	}
+	if err := lt.lc.sleep(context.Background(), true); !errors.Is(err, errNotLeader) {
+		t.Errorf("sleep() on a follower without forwardSleep error = %v, want %v", err, errNotLeader)
+	}
+
+	var pins []*pinState
+	var sleeps []bool
+	lt.lc.forwardPin = func(_ context.Context, pin *pinState) error { pins = append(pins, pin); return nil }
+	lt.lc.forwardSleep = func(_ context.Context, force bool) error { sleeps = append(sleeps, force); return errActiveConnections }
+	if err := lt.lc.setPin(context.Background(), pinState{replicas: 1}); err != nil {
+		t.Errorf("setPin() on a follower error = %v", err)
+	}
+	if err := lt.lc.clearPin(context.Background()); err != nil {
+		t.Errorf("clearPin() on a follower error = %v", err)
+	}
+	if err := lt.lc.sleep(context.Background(), false); !errors.Is(err, errActiveConnections) {
+		t.Errorf("sleep() on a follower error = %v, want the leader's %v", err, errActiveConnections)
+	}
+	if len(pins) != 2 || pins[0] == nil || pins[0].replicas != 1 || pins[1] != nil || !slices.Equal(sleeps, []bool{false}) {
+		t.Errorf("forwarded pins = %v and sleeps = %v, want the pin, its removal and one sleep", pins, sleeps)
+	}
+	if _, ok := lt.lc.currentPin(); ok {
+		t.Error("follower applied a forwarded pin itself")
+	}
+	lt.assertScales(t)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Classified causes of a cold start that cannot succeed without intervention. A podFailureError wraps one
+// of these, so callers can tell them apart with errors.Is.
+var (
+	// errPodUnschedulable means the scheduler cannot place the pod and no node is being added for it.
+	errPodUnschedulable = errors.New("buildkitd pod cannot be scheduled")
+	// errImagePull means the buildkitd image cannot be pulled.
+	errImagePull = errors.New("buildkitd image cannot be pulled")
+	// errContainerCrash means a buildkitd container keeps crashing.
+	errContainerCrash = errors.New("buildkitd container is crash looping")
+)
+
+// unschedulableGracePeriod is how long a pod may stay unschedulable before the cold start is failed.
+// It leaves the cluster autoscaler time to react; once it reports a scale-up for the pod, the wait continues.
+const unschedulableGracePeriod = 30 * time.Second
+
+// failureRecheckInterval is how often a readiness wait re-evaluates time-based failure checks
+// (the unschedulable grace period) in the absence of watch events.
+const failureRecheckInterval = 5 * time.Second
+
+// podEventsRefreshInterval is how long the events listed for a failing pod are reused by failure checks,
+// which bounds the Events LISTs a pod waiting on a new node causes.
+const podEventsRefreshInterval = 15 * time.Second
+
+// Event reasons recorded by the cluster autoscaler on pending pods.
+const (
+	eventReasonTriggeredScaleUp  = "TriggeredScaleUp"
+	eventReasonNotTriggerScaleUp = "NotTriggerScaleUp"
+)
+
+// podFailureError reports a terminal failure of a buildkitd pod during a cold start.
+type podFailureError struct {
+	// cause is one of errPodUnschedulable, errImagePull or errContainerCrash.
+	cause error
+	// pod is the name of the failing pod.
+	pod string
+	// reason is the Kubernetes reason, e.g. ImagePullBackOff.
+	reason string
+	// message is the most specific message available, from the pod status or its latest warning event.
+	message string
+}
+
+// Error describes the failure including the pod and the Kubernetes reason.
+func (e *podFailureError) Error() string {
+	if e.message == "" {
+		return fmt.Sprintf("%v: pod %s: %s", e.cause, e.pod, e.reason)
+	}
+	return fmt.Sprintf("%v: pod %s: %s: %s", e.cause, e.pod, e.reason, e.message)
+}
+
+// Unwrap returns the classified cause.
+func (e *podFailureError) Unwrap() error {
+	return e.cause
+}
+
+// failureCause returns a short label for the classified cause of err, for logs and metrics:
+// "scheduling", "image_pull", "crash", or "" if err is not a classified pod failure.
+func failureCause(err error) string {
+	switch {
+	case errors.Is(err, errPodUnschedulable):
+		return "scheduling"
+	case errors.Is(err, errImagePull):
+		return "image_pull"
+	case errors.Is(err, errContainerCrash):
+		return "crash"
+	}
+	return ""
+}
+
+// classifyPodFailure inspects a pod's status for a failure that will not resolve on its own, or returns nil.
+// An unschedulable pod only counts once it has been unschedulable for unschedulableGracePeriod.
+func classifyPodFailure(pod *corev1.Pod, now time.Time) *podFailureError {
+	for _, statuses := range [][]corev1.ContainerStatus{pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses} {
+		for _, cs := range statuses {
+			if cs.State.Waiting == nil {
+				continue
+			}
+			switch cs.State.Waiting.Reason {
+			case "ImagePullBackOff", "ErrImageNeverPull", "InvalidImageName":
+				return &podFailureError{cause: errImagePull, pod: pod.Name, reason: cs.State.Waiting.Reason, message: cs.State.Waiting.Message}
+			case "CrashLoopBackOff":
+				return &podFailureError{cause: errContainerCrash, pod: pod.Name, reason: cs.State.Waiting.Reason, message: cs.State.Waiting.Message}
+			}
+		}
+	}
+
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodScheduled && cond.Status == corev1.ConditionFalse && cond.Reason == corev1.PodReasonUnschedulable &&
+			now.Sub(cond.LastTransitionTime.Time) >= unschedulableGracePeriod {
+			return &podFailureError{cause: errPodUnschedulable, pod: pod.Name, reason: cond.Reason, message: cond.Message}
+		}
+	}
+	return nil
+}
+
+// listPodEvents returns the events recorded for the pod.
+func listPodEvents(ctx context.Context, clientset kubernetes.Interface, pod *corev1.Pod) ([]corev1.Event, error) {
+	events, err := clientset.CoreV1().Events(pod.Namespace).List(ctx, metav1.ListOptions{
+		FieldSelector: fields.Set{"involvedObject.kind": "Pod", "involvedObject.name": pod.Name}.String(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing events for pod %s in namespace %s: %w", pod.Name, pod.Namespace, err)
+	}
+	// Field selectors are not honoured everywhere (e.g. by the fake clientset), so filter again.
+	var podEvents []corev1.Event
+	for _, event := range events.Items {
+		if event.InvolvedObject.Name == pod.Name {
+			podEvents = append(podEvents, event)
+		}
+	}
+	return podEvents, nil
+}
+
+// summarizePodEvents returns whether the cluster autoscaler's latest verdict on the pod is that it
+// triggered a scale-up, and the most recent Warning event.
+func summarizePodEvents(events []corev1.Event) (scaleUpTriggered bool, latestWarning *corev1.Event) {
+	var latestScaleUp *corev1.Event
+	for i := range events {
+		event := &events[i]
+		switch {
+		case event.Reason == eventReasonTriggeredScaleUp || event.Reason == eventReasonNotTriggerScaleUp:
+			if latestScaleUp == nil || eventTime(event).After(eventTime(latestScaleUp)) {
+				latestScaleUp = event
+			}
+		case event.Type == corev1.EventTypeWarning:
+			if latestWarning == nil || eventTime(event).After(eventTime(latestWarning)) {
+				latestWarning = event
+			}
+		}
+	}
+	return latestScaleUp != nil && latestScaleUp.Reason == eventReasonTriggeredScaleUp, latestWarning
+}
+
+// eventTime returns when the event last occurred.
+func eventTime(event *corev1.Event) time.Time {
+	if !event.LastTimestamp.IsZero() {
+		return event.LastTimestamp.Time
+	}
+	if !event.EventTime.IsZero() {
+		return event.EventTime.Time
+	}
+	return event.CreationTimestamp.Time
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// waitingPod returns a test pod whose container is waiting with the given reason.
+func waitingPod(reason string) *corev1.Pod {
+	pod := newTestPod(testStsName+"-0", false)
+	pod.Status.ContainerStatuses = []corev1.ContainerStatus{{
+		Name:  "buildkitd",
+		State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: reason, Message: reason + " message"}},
+	}}
+	return pod
+}
+
+// unschedulablePod returns a test pod that has been unschedulable since the given time.
+func unschedulablePod(since time.Time) *corev1.Pod {
+	pod := newTestPod(testStsName+"-0", false)
+	pod.Status.Conditions = append(pod.Status.Conditions, corev1.PodCondition{
+		Type:               corev1.PodScheduled,
+		Status:             corev1.ConditionFalse,
+		Reason:             corev1.PodReasonUnschedulable,
+		Message:            "0/3 nodes are available: 3 Insufficient cpu.",
+		LastTransitionTime: metav1.NewTime(since),
+	})
+	return pod
+}
+
+// TestClassifyPodFailure checks which pod states are treated as terminal cold-start failures.
+func TestClassifyPodFailure(t *testing.T) {
+	now := time.Now()
+	initCrash := newTestPod(testStsName+"-0", false)
+	initCrash.Status.InitContainerStatuses = []corev1.ContainerStatus{{
+		State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}},
+	}}
+
+	tests := []struct {
+		name  string
+		pod   *corev1.Pod
+		want  error
+		cause string
+	}{
+		{"healthy", newTestPod(testStsName+"-0", true), nil, ""},
+		{"container creating", waitingPod("ContainerCreating"), nil, ""},
+		{"transient image pull error", waitingPod("ErrImagePull"), nil, ""},
+		{"image pull backoff", waitingPod("ImagePullBackOff"), errImagePull, "image_pull"},
+		{"invalid image name", waitingPod("InvalidImageName"), errImagePull, "image_pull"},
+		{"crash loop", waitingPod("CrashLoopBackOff"), errContainerCrash, "crash"},
+		{"init container crash loop", initCrash, errContainerCrash, "crash"},
+		{"unschedulable within grace period", unschedulablePod(now.Add(-time.Second)), nil, ""},
+		{"unschedulable after grace period", unschedulablePod(now.Add(-unschedulableGracePeriod)), errPodUnschedulable, "scheduling"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			failure := classifyPodFailure(tt.pod, now)
+			if tt.want == nil {
+				if failure != nil {
+					t.Fatalf("classifyPodFailure() = %v, want nil", failure)
+				}
+				return
+			}
+			if failure == nil {
+				t.Fatalf("classifyPodFailure() = nil, want %v", tt.want)
+			}
+			if !errors.Is(failure, tt.want) {
+				t.Errorf("classifyPodFailure() = %v, want it to wrap %v", failure, tt.want)
+			}
+			if got := failureCause(failure); got != tt.cause {
+				t.Errorf("failureCause() = %q, want %q", got, tt.cause)
+			}
+		})
+	}
+}
+
+// TestSummarizePodEvents checks that the latest cluster autoscaler verdict and warning are picked.
+func TestSummarizePodEvents(t *testing.T) {
+	base := time.Now()
+	event := func(reason, eventType string, at time.Duration) corev1.Event {
+		return corev1.Event{Reason: reason, Type: eventType, Message: reason, LastTimestamp: metav1.NewTime(base.Add(at))}
+	}
+
+	triggered, warning := summarizePodEvents([]corev1.Event{
+		event("FailedScheduling", corev1.EventTypeWarning, 0),
+		event(eventReasonNotTriggerScaleUp, corev1.EventTypeNormal, time.Second),
+		event(eventReasonTriggeredScaleUp, corev1.EventTypeNormal, 2*time.Second),
+		event("FailedScheduling", corev1.EventTypeWarning, 3*time.Second),
+	})
+	if !triggered {
+		t.Error("summarizePodEvents() scaleUpTriggered = false, want true")
+	}
+	if warning == nil || !warning.LastTimestamp.Time.Equal(base.Add(3*time.Second)) {
+		t.Errorf("summarizePodEvents() latestWarning = %v, want the FailedScheduling event at +3s", warning)
+	}
+
+	triggered, _ = summarizePodEvents([]corev1.Event{
+		event(eventReasonTriggeredScaleUp, corev1.EventTypeNormal, 0),
+		event(eventReasonNotTriggerScaleUp, corev1.EventTypeNormal, time.Second),
+	})
+	if triggered {
+		t.Error("summarizePodEvents() scaleUpTriggered = true after NotTriggerScaleUp, want false")
+	}
+
+	if failureCause(errors.New("timeout")) != "" {
+		t.Error("failureCause() of an unclassified error should be empty")
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// prewarmPath is the pipeline listener endpoint that scales buildkitd up ahead of a build.
+const prewarmPath = "/prewarm"
+
+// pipelineHandler returns the endpoints pipelines call over targets, /prewarm and /keepalive, each requiring the
+// bearer token. They are served on their own listener so exposing them does not expose the health listener's
+// peer endpoints.
+func pipelineHandler(ctx context.Context, token string, targets []*buildkitdTarget) http.Handler {
+	pipelineTargets := newTargetSet(targets)
+	mux := http.NewServeMux()
+	newPrewarmer(ctx, pipelineTargets).register(mux)
+	newKeepAliveAPI(pipelineTargets).register(mux)
+	return requireBearerToken(token, "buildkitd-proxy pipelines", mux)
+}
+
+// startPipelineServer serves the pipeline endpoints in handler on addr in the background.
+func startPipelineServer(addr string, handler http.Handler) *http.Server {
+	srv := &http.Server{Addr: addr, Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		logger.Info("Pipeline server listening", "address", addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Pipeline server failed", "address", addr, "error", err)
+		}
+	}()
+	return srv
+}
+
+// prewarmer serves the pre-warm endpoint, which lets a pipeline warm buildkitd while it checks out code so the
+// cold start is off the critical path of its first build.
+type prewarmer struct {
+	// targets are the StatefulSets that can be warmed.
+	targets *targetSet
+	// ctx bounds pre-warms the request does not wait for.
+	ctx context.Context
+}
+
+// newPrewarmer creates the pre-warm endpoint over targets.
+func newPrewarmer(ctx context.Context, targets *targetSet) *prewarmer {
+	return &prewarmer{targets: targets, ctx: ctx}
+}
+
+// targetSet looks up the target named in a request to the endpoints pipelines call.
+type targetSet struct {
+	byKey map[string]*buildkitdTarget
+	// fallback is used when a request names no target.
+	fallback *buildkitdTarget
+}
+
+// newTargetSet creates a targetSet over targets, the first of which is the default.
+func newTargetSet(targets []*buildkitdTarget) *targetSet {
+	s := &targetSet{byKey: make(map[string]*buildkitdTarget, len(targets)), fallback: targets[0]}
+	for _, t := range targets {
+		s.byKey[t.key()] = t
+	}
+	return s
+}
+
+// fromQuery returns the target named by the "target" query parameter, or the default target without one.
+// For an unknown target it responds 404 and returns nil.
+func (s *targetSet) fromQuery(w http.ResponseWriter, r *http.Request) *buildkitdTarget {
+	key := r.URL.Query().Get("target")
+	if key == "" {
+		return s.fallback
+	}
+	t, ok := s.byKey[key]
+	if !ok {
+		http.Error(w, "unknown target", http.StatusNotFound)
+		return nil
+	}
+	return t
+}
+
+// register adds the pre-warm endpoint to mux.
+func (p *prewarmer) register(mux *http.ServeMux) {
+	mux.HandleFunc("POST "+prewarmPath, p.servePrewarm)
+}
+
+// servePrewarm scales the target named by the "target" query parameter up through the same shared scale-up
+// as a connection arriving at zero replicas, which restarts the scale-down timer once buildkitd is ready.
+// With "wait=true" it responds once buildkitd is ready; otherwise it responds right away and the scale-up
+// carries on in the background.
+func (p *prewarmer) servePrewarm(w http.ResponseWriter, r *http.Request) {
+	t := p.targets.fromQuery(w, r)
+	if t == nil {
+		return
+	}
+	wait, err := strconv.ParseBool(cmp.Or(r.URL.Query().Get("wait"), "false"))
+	if err != nil {
+		http.Error(w, "invalid wait parameter", http.StatusBadRequest)
+		return
+	}
+	logger.Info("Pre-warming StatefulSet.", "target", t.key(), "wait", wait, "remoteAddr", r.RemoteAddr)
+
+	if !wait {
+		go p.warm(p.ctx, t)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	if err := p.warm(r.Context(), t); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// warm scales t up and waits until it is ready, traced in a proxy.prewarm span.
+func (p *prewarmer) warm(ctx context.Context, t *buildkitdTarget) error {
+	ctx, span := tracer.Start(ctx, "proxy.prewarm", targetAttributes(t.namespace, t.name), trace.WithSpanKind(trace.SpanKindServer))
+	err := t.coldStarts.do(ctx, t.readyWaitTimeout, t.scaler.wake)
+	endSpan(span, err)
+	if err != nil {
+		logger.Error("Pre-warm failed", "error", err, "cause", failureCause(err), "target", t.key())
+	}
+	return err
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestPrewarmer creates a prewarmer over a target with a started lifecycle scaled to zero.
+func newTestPrewarmer(t *testing.T) (*prewarmer, *lifecycleTest) {
+	t.Helper()
+	lt := newLifecycleTest(t, testLifecyclePolicy, time.Minute)
+	target := &buildkitdTarget{
+		targetSpec: targetSpec{namespace: testNamespace, name: testStsName, readyWaitTimeout: time.Second},
+		coldStarts: newScaleUpGroup(defaultMaxPendingConnections),
+		scaler:     lt.lc,
+	}
+	return newPrewarmer(context.Background(), newTargetSet([]*buildkitdTarget{target})), lt
+}
+
+// postPrewarm performs a POST against the pre-warm endpoint and returns the status code.
+func postPrewarm(t *testing.T, p *prewarmer, query string) int {
+	t.Helper()
+	mux := http.NewServeMux()
+	p.register(mux)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequestWithContext(context.Background(), http.MethodPost, prewarmPath+query, nil))
+	return rec.Code
+}
+
+// TestPrewarm_Wait verifies that a waiting pre-warm scales buildkitd up and responds once it is ready.
+func TestPrewarm_Wait(t *testing.T) {
+	p, lt := newTestPrewarmer(t)
+	if code := postPrewarm(t, p, "?target="+testNamespace+"/"+testStsName+"&wait=true"); code != http.StatusNoContent {
+		t.Fatalf("pre-warm = %d, want %d", code, http.StatusNoContent)
+	}
+	lt.assertState(t, stateReady)
+	lt.assertScales(t, 1)
+
+	lt.clock.Advance(time.Minute)
+	lt.assertState(t, stateIdle)
+	lt.assertScales(t, 1, 0)
+}
+
+// TestPrewarm_Background verifies that a pre-warm without wait responds right away and scales up in the
+// background.
+func TestPrewarm_Background(t *testing.T) {
+	p, lt := newTestPrewarmer(t)
+	if code := postPrewarm(t, p, ""); code != http.StatusAccepted {
+		t.Fatalf("pre-warm = %d, want %d", code, http.StatusAccepted)
+	}
+	waitFor(t, "the pre-warm scale-up", func() bool { return lt.lc.currentState() == stateReady })
+	lt.assertScales(t, 1)
+}
+
+// TestPrewarm_RestartsIdleTimer verifies that a pre-warm of a ready StatefulSet counts as activity and
+// restarts the scale-down timer.
+func TestPrewarm_RestartsIdleTimer(t *testing.T) {
+	p, lt := newTestPrewarmer(t)
+	lt.open(1)
+	lt.close(1)
+	lt.clock.Advance(50 * time.Second)
+
+	if code := postPrewarm(t, p, "?wait=true"); code != http.StatusNoContent {
+		t.Fatalf("pre-warm = %d, want %d", code, http.StatusNoContent)
+	}
+	lt.clock.Advance(50 * time.Second)
+	lt.assertState(t, stateReady)
+	if got := lt.lc.activity().lastActivity; !got.Equal(lt.clock.Now().Add(-50 * time.Second)) {
+		t.Errorf("last activity = %v, want the time of the pre-warm", got)
+	}
+	lt.clock.Advance(10 * time.Second)
+	lt.assertState(t, stateIdle)
+}
+
+// TestPrewarm_InvalidRequest verifies that unknown targets and invalid parameters are rejected.
+func TestPrewarm_InvalidRequest(t *testing.T) {
+	p, lt := newTestPrewarmer(t)
+	if code := postPrewarm(t, p, "?target="+testNamespace+"/unknown"); code != http.StatusNotFound {
+		t.Errorf("pre-warm of an unknown target = %d, want %d", code, http.StatusNotFound)
+	}
+	if code := postPrewarm(t, p, "?wait=soon"); code != http.StatusBadRequest {
+		t.Errorf("pre-warm with an invalid wait = %d, want %d", code, http.StatusBadRequest)
+	}
+	lt.assertScales(t)
+}
+
+// testPipelineToken is the bearer token of the pipeline handler in TestPipelineHandler.
+const testPipelineToken = "p1pel1ne"
+
+// TestPipelineHandler verifies that the pipeline listener serves the pre-warm and keep-alive endpoints with the
+// bearer token and none of the health listener's endpoints.
+func TestPipelineHandler(t *testing.T) {
+	lt := newLifecycleTest(t, testLifecyclePolicy, time.Minute)
+	target := &buildkitdTarget{
+		targetSpec: targetSpec{namespace: testNamespace, name: testStsName, readyWaitTimeout: time.Second},
+		coldStarts: newScaleUpGroup(defaultMaxPendingConnections),
+		scaler:     lt.lc,
+	}
+	handler := pipelineHandler(context.Background(), testPipelineToken, []*buildkitdTarget{target})
+
+	tests := []struct {
+		method, path, token string
+		want                int
+	}{
+		{http.MethodPost, prewarmPath + "?wait=true", "", http.StatusUnauthorized},
+		{http.MethodPost, prewarmPath + "?wait=true", "wrong", http.StatusUnauthorized},
+		{http.MethodPost, prewarmPath + "?wait=true", testPipelineToken, http.StatusNoContent},
+		{http.MethodDelete, keepAlivePath + "/pipeline", "", http.StatusUnauthorized},
+		{http.MethodDelete, keepAlivePath + "/pipeline", testPipelineToken, http.StatusNoContent},
+		{http.MethodPost, leaderActivityPath, testPipelineToken, http.StatusNotFound},
+		{http.MethodPost, leaderWakePath, testPipelineToken, http.StatusNotFound},
+		{http.MethodGet, "/readyz", testPipelineToken, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequestWithContext(context.Background(), tt.method, tt.path, nil)
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s %s with token %q = %d, want %d", tt.method, tt.path, tt.token, rec.Code, tt.want)
+		}
+	}
+	lt.assertScales(t, 1)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"time"
+)
+
+// clientDataTimeout bounds how long an accepted connection may stay silent before it is closed. Until the
+// client sends its first bytes the connection is not counted, so it neither wakes buildkitd nor keeps it up.
+const clientDataTimeout = 30 * time.Second
+
+// isProbe reports whether a connection is a load balancer health probe that must never be proxied: either
+// its source is in probeCIDRs or its PROXY protocol header says the load balancer opened it itself (v2 LOCAL,
+// v1 UNKNOWN).
+func isProbe(conn net.Conn, header *proxyHeader, probeCIDRs []*net.IPNet) bool {
+	if header != nil && header.local {
+		return true
+	}
+	return cidrsContain(probeCIDRs, conn.RemoteAddr())
+}
+
+// awaitClientData blocks until the client sends its first bytes, or until timeout passes, and returns a
+// connection that replays them. Load balancers open and close connections without ever sending data; such
+// connections fail here instead of being treated as demand for buildkitd.
+func awaitClientData(conn net.Conn, timeout time.Duration) (net.Conn, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if n == 0 {
+		if err == nil {
+			err = io.ErrNoProgress
+		}
+		return nil, err
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	return &peekedConn{Conn: conn, reader: io.MultiReader(bytes.NewReader(buf[:n]), conn)}, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestAwaitClientData verifies that the first bytes are replayed and that connections closed or left silent
+// by the client fail.
+func TestAwaitClientData(t *testing.T) {
+	client, server := net.Pipe()
+	go func(client net.Conn) {
+		client.Write([]byte("PRI * HTTP/2.0"))
+		client.Close()
+	}(client)
+	conn, err := awaitClientData(server, time.Second)
+	if err != nil {
+		t.Fatalf("awaitClientData() error = %v", err)
+	}
+	if got, _ := io.ReadAll(conn); string(got) != "PRI * HTTP/2.0" {
+		t.Errorf("replayed %q, want the client's first bytes", got)
+	}
+	conn.Close()
+
+	client, server = net.Pipe()
+	client.Close()
+	if _, err := awaitClientData(server, time.Second); err == nil {
+		t.Error("awaitClientData() on a closed connection succeeded, want an error")
+	}
+
+	client, server = net.Pipe()
+	defer client.Close()
+	if _, err := awaitClientData(server, 10*time.Millisecond); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("awaitClientData() on a silent connection error = %v, want a deadline error", err)
+	}
+}
+
+// TestIsProbe verifies that connections from probe CIDRs and LOCAL PROXY protocol headers are probes.
+func TestIsProbe(t *testing.T) {
+	probeCIDRs, err := parseCIDRs("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	probe := fakeAddrConn{remote: &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 40000}}
+	client := fakeAddrConn{remote: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}}
+
+	tests := []struct {
+		name   string
+		conn   net.Conn
+		header *proxyHeader
+		cidrs  []*net.IPNet
+		want   bool
+	}{
+		{"probe source", probe, nil, probeCIDRs, true},
+		{"client source", client, nil, probeCIDRs, false},
+		{"no probe CIDRs", probe, nil, nil, false},
+		{"LOCAL header", client, &proxyHeader{version: 2, local: true}, nil, true},
+		{"PROXY header", client, &proxyHeader{version: 2, source: client.remote}, probeCIDRs, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isProbe(tt.conn, tt.header, tt.cidrs); got != tt.want {
+				t.Errorf("isProbe() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
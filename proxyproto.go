@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyHeaderTimeout bounds how long a load balancer may take to send the PROXY protocol header.
+const proxyHeaderTimeout = 10 * time.Second
+
+// proxyV2Signature starts every PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyV1MaxLength is the longest valid PROXY protocol v1 line, including the CRLF.
+const proxyV1MaxLength = 107
+
+// PROXY protocol v2 commands, address families and the TLV types this proxy understands.
+const (
+	proxyV2CmdLocal = 0x0
+	proxyV2CmdProxy = 0x1
+
+	proxyV2FamilyUnspec = 0x0
+	proxyV2FamilyInet   = 0x1
+	proxyV2FamilyInet6  = 0x2
+	proxyV2FamilyUnix   = 0x3
+
+	proxyTLVAuthority = 0x02
+	proxyTLVCRC32C    = 0x03
+	// proxyTLVTarget and proxyTLVClientIdentity are custom TLVs (0xE0-0xEF are reserved for applications)
+	// sent to buildkitd: the "<namespace>/<statefulset>" the connection was routed to, and the subject of
+	// the client's verified certificate.
+	proxyTLVTarget         = 0xE0
+	proxyTLVClientIdentity = 0xE1
+	// proxyTLVAWS carries AWS-specific values; its first byte is a subtype.
+	proxyTLVAWS = 0xEA
+	// proxyTLVAWSVPCEndpointID is the AWS subtype holding the VPC endpoint ID of a PrivateLink connection.
+	proxyTLVAWSVPCEndpointID = 0x01
+)
+
+// proxyTLV is a type-length-value extension of a PROXY protocol v2 header.
+type proxyTLV struct {
+	typ   byte
+	value []byte
+}
+
+// proxyHeader is a parsed PROXY protocol header.
+type proxyHeader struct {
+	version int
+	// local is set for v2 LOCAL commands and v1 UNKNOWN connections, which the load balancer opened itself
+	// (e.g. health checks). They carry no client address.
+	local bool
+	// source and destination are the client's address and the address it connected to; nil when local.
+	source, destination net.Addr
+	tlvs                []proxyTLV
+}
+
+// tlv returns the value of the first TLV of type typ.
+func (h *proxyHeader) tlv(typ byte) ([]byte, bool) {
+	for _, t := range h.tlvs {
+		if t.typ == typ {
+			return t.value, true
+		}
+	}
+	return nil, false
+}
+
+// logAttrs returns the header's TLVs worth logging with a connection.
+func (h *proxyHeader) logAttrs() []any {
+	var attrs []any
+	if v, ok := h.tlv(proxyTLVAuthority); ok {
+		attrs = append(attrs, "proxyAuthority", string(v))
+	}
+	if v, ok := h.tlv(proxyTLVAWS); ok && len(v) > 1 && v[0] == proxyTLVAWSVPCEndpointID {
+		attrs = append(attrs, "vpcEndpointID", string(v[1:]))
+	}
+	return attrs
+}
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header from r.
+func readProxyHeader(r *bufio.Reader) (*proxyHeader, error) {
+	// Peek only as far as the signature the first byte announces, so a short header followed by no payload
+	// is not stuck waiting for bytes the client will only send once the server speaks.
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, fmt.Errorf("reading PROXY protocol header: %w", err)
+	}
+	switch first[0] {
+	case proxyV2Signature[0]:
+		sig, err := r.Peek(len(proxyV2Signature))
+		if err == nil && bytes.Equal(sig, proxyV2Signature) {
+			return readProxyHeaderV2(r)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading PROXY protocol header: %w", err)
+		}
+	case 'P':
+		sig, err := r.Peek(len("PROXY "))
+		if err == nil && string(sig) == "PROXY " {
+			return readProxyHeaderV1(r)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading PROXY protocol header: %w", err)
+		}
+	}
+	return nil, errors.New("connection does not start with a PROXY protocol header")
+}
+
+// readProxyHeaderV1 parses a "PROXY TCP4|TCP6|UNKNOWN <src> <dst> <sport> <dport>\r\n" line.
+func readProxyHeaderV1(r *bufio.Reader) (*proxyHeader, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("reading PROXY protocol v1 header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	text, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, errors.New("PROXY protocol v1 header is too long or not terminated by CRLF")
+	}
+
+	fields := strings.Split(text, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return &proxyHeader{version: 1, local: true}, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY protocol v1 header %q", text)
+	}
+	src, err := parseProxyV1Addr(fields[1], fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+	dst, err := parseProxyV1Addr(fields[1], fields[3], fields[5])
+	if err != nil {
+		return nil, err
+	}
+	return &proxyHeader{version: 1, source: src, destination: dst}, nil
+}
+
+// parseProxyV1Addr parses an address and port of a v1 header of the given protocol.
+func parseProxyV1Addr(proto, ip, port string) (*net.TCPAddr, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil || (proto == "TCP4") != (addr.To4() != nil) {
+		return nil, fmt.Errorf("invalid %s address %q in PROXY protocol v1 header", proto, ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (len(port) > 1 && port[0] == '0') {
+		return nil, fmt.Errorf("invalid port %q in PROXY protocol v1 header", port)
+	}
+	return &net.TCPAddr{IP: addr, Port: int(p)}, nil
+}
+
+// readProxyHeaderV2 parses a binary v2 header, including its TLVs. A CRC32C TLV is verified.
+func readProxyHeaderV2(r *bufio.Reader) (*proxyHeader, error) {
+	raw := make([]byte, 16)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, fmt.Errorf("reading PROXY protocol v2 header: %w", err)
+	}
+	if raw[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", raw[12]>>4)
+	}
+	command, family, transport := raw[12]&0x0f, raw[13]>>4, raw[13]&0x0f
+	raw = append(raw, make([]byte, binary.BigEndian.Uint16(raw[14:16]))...)
+	if _, err := io.ReadFull(r, raw[16:]); err != nil {
+		return nil, fmt.Errorf("reading PROXY protocol v2 header: %w", err)
+	}
+	payload := raw[16:]
+
+	h := &proxyHeader{version: 2}
+	var addrLen int
+	switch family {
+	case proxyV2FamilyUnspec:
+	case proxyV2FamilyInet:
+		addrLen = 12
+	case proxyV2FamilyInet6:
+		addrLen = 36
+	case proxyV2FamilyUnix:
+		addrLen = 216
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol v2 address family %#x", family)
+	}
+	if len(payload) < addrLen {
+		return nil, fmt.Errorf("PROXY protocol v2 header too short for address family %#x", family)
+	}
+	addrs := payload[:addrLen]
+	switch command {
+	case proxyV2CmdLocal:
+		h.local = true
+	case proxyV2CmdProxy:
+		if family == proxyV2FamilyUnspec {
+			h.local = true
+			break
+		}
+		h.source, h.destination = proxyV2Addrs(family, transport, addrs)
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol v2 command %#x", command)
+	}
+
+	tlvs, err := parseProxyTLVs(payload[addrLen:])
+	if err != nil {
+		return nil, err
+	}
+	h.tlvs = tlvs
+	offset := 16 + addrLen
+	for _, t := range tlvs {
+		if t.typ == proxyTLVCRC32C {
+			if err := verifyProxyCRC32C(raw, offset+3, len(t.value)); err != nil {
+				return nil, err
+			}
+			break
+		}
+		offset += 3 + len(t.value)
+	}
+	return h, nil
+}
+
+// proxyV2Addrs decodes the source and destination addresses of a v2 header.
+func proxyV2Addrs(family, transport byte, b []byte) (net.Addr, net.Addr) {
+	switch family {
+	case proxyV2FamilyInet, proxyV2FamilyInet6:
+		n := 4
+		if family == proxyV2FamilyInet6 {
+			n = 16
+		}
+		srcIP, dstIP := net.IP(bytes.Clone(b[:n])), net.IP(bytes.Clone(b[n:2*n]))
+		srcPort, dstPort := int(binary.BigEndian.Uint16(b[2*n:])), int(binary.BigEndian.Uint16(b[2*n+2:]))
+		if transport == 0x2 {
+			return &net.UDPAddr{IP: srcIP, Port: srcPort}, &net.UDPAddr{IP: dstIP, Port: dstPort}
+		}
+		return &net.TCPAddr{IP: srcIP, Port: srcPort}, &net.TCPAddr{IP: dstIP, Port: dstPort}
+	default:
+		unixPath := func(p []byte) string { return string(bytes.TrimRight(p, "\x00")) }
+		return &net.UnixAddr{Name: unixPath(b[:108]), Net: "unix"}, &net.UnixAddr{Name: unixPath(b[108:]), Net: "unix"}
+	}
+}
+
+// parseProxyTLVs splits the TLV section of a v2 header.
+func parseProxyTLVs(b []byte) ([]proxyTLV, error) {
+	var tlvs []proxyTLV
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return nil, errors.New("truncated TLV in PROXY protocol v2 header")
+		}
+		n := int(binary.BigEndian.Uint16(b[1:3]))
+		if len(b) < 3+n {
+			return nil, fmt.Errorf("TLV %#x overruns the PROXY protocol v2 header", b[0])
+		}
+		tlvs = append(tlvs, proxyTLV{typ: b[0], value: b[3 : 3+n]})
+		b = b[3+n:]
+	}
+	return tlvs, nil
+}
+
+// verifyProxyCRC32C checks the CRC32C TLV value at offset in raw, computed over the whole header with
+// the checksum field zeroed.
+func verifyProxyCRC32C(raw []byte, offset, length int) error {
+	if length != 4 {
+		return errors.New("invalid CRC32C TLV in PROXY protocol v2 header")
+	}
+	want := binary.BigEndian.Uint32(raw[offset:])
+	zeroed := bytes.Clone(raw)
+	clear(zeroed[offset : offset+4])
+	if got := crc32.Checksum(zeroed, crc32.MakeTable(crc32.Castagnoli)); got != want {
+		return fmt.Errorf("PROXY protocol v2 header checksum mismatch: got %#08x, want %#08x", got, want)
+	}
+	return nil
+}
+
+// encodeProxyHeaderV2 builds a v2 PROXY header for a TCP connection from src to dst with the given TLVs.
+// If either address is not TCP, or they are of different IP families, the header carries no addresses
+// (UNSPEC), and the receiver keeps the connection's own addresses.
+func encodeProxyHeaderV2(src, dst net.Addr, tlvs []proxyTLV) ([]byte, error) {
+	var addrs []byte
+	family := byte(proxyV2FamilyUnspec)
+	srcTCP, srcOK := src.(*net.TCPAddr)
+	dstTCP, dstOK := dst.(*net.TCPAddr)
+	if srcOK && dstOK {
+		switch srcIP4, dstIP4 := srcTCP.IP.To4(), dstTCP.IP.To4(); {
+		case srcIP4 != nil && dstIP4 != nil:
+			family = proxyV2FamilyInet
+			addrs = append(append(addrs, srcIP4...), dstIP4...)
+		case srcIP4 == nil && dstIP4 == nil && srcTCP.IP.To16() != nil && dstTCP.IP.To16() != nil:
+			family = proxyV2FamilyInet6
+			addrs = append(append(addrs, srcTCP.IP.To16()...), dstTCP.IP.To16()...)
+		}
+		if family != proxyV2FamilyUnspec {
+			addrs = binary.BigEndian.AppendUint16(addrs, uint16(srcTCP.Port))
+			addrs = binary.BigEndian.AppendUint16(addrs, uint16(dstTCP.Port))
+		}
+	}
+
+	payload := addrs
+	for _, t := range tlvs {
+		if len(t.value) > 0xffff {
+			return nil, fmt.Errorf("TLV %#x is too long for a PROXY protocol v2 header", t.typ)
+		}
+		payload = append(payload, t.typ)
+		payload = binary.BigEndian.AppendUint16(payload, uint16(len(t.value)))
+		payload = append(payload, t.value...)
+	}
+	if len(payload) > 0xffff {
+		return nil, errors.New("PROXY protocol v2 header is too long")
+	}
+
+	h := append(bytes.Clone(proxyV2Signature), 0x20|proxyV2CmdProxy, family<<4)
+	if family != proxyV2FamilyUnspec {
+		h[len(h)-1] |= 0x1 // STREAM
+	}
+	h = binary.BigEndian.AppendUint16(h, uint16(len(payload)))
+	return append(h, payload...), nil
+}
+
+// backendProxyHeader builds the PROXY header sent to buildkitd for a client connection. It carries the
+// client's address and the address it connected to, as seen through any PROXY header from a load balancer,
+// plus the target, server name and client identity as TLVs.
+func backendProxyHeader(clientConn net.Conn, inbound *proxyHeader, target, serverName, clientIdentity string) ([]byte, error) {
+	dst := clientConn.LocalAddr()
+	if inbound != nil && !inbound.local {
+		dst = inbound.destination
+	}
+	tlvs := []proxyTLV{{typ: proxyTLVTarget, value: []byte(target)}}
+	if serverName != "" {
+		tlvs = append(tlvs, proxyTLV{typ: proxyTLVAuthority, value: []byte(serverName)})
+	}
+	if clientIdentity != "" {
+		tlvs = append(tlvs, proxyTLV{typ: proxyTLVClientIdentity, value: []byte(clientIdentity)})
+	}
+	return encodeProxyHeaderV2(clientConn.RemoteAddr(), dst, tlvs)
+}
+
+// proxyProtocolListener reads a PROXY protocol header from every connection accepted from a trusted
+// load balancer. Connections from other sources are passed through untouched, so clients cannot spoof
+// their address by sending a header themselves.
+type proxyProtocolListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+// Accept wraps connections from trusted sources in a proxyConn.
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// isTrusted reports whether addr is in one of the trusted CIDRs.
+func (l *proxyProtocolListener) isTrusted(addr net.Addr) bool {
+	return cidrsContain(l.trusted, addr)
+}
+
+// cidrsContain reports whether addr is a TCP address in one of cidrs.
+func cidrsContain(cidrs []*net.IPNet, addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, cidr := range cidrs {
+		if cidr.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCIDRs parses a comma-separated list of CIDRs. A bare IP address is taken as a single host.
+func parseCIDRs(s string) ([]*net.IPNet, error) {
+	var cidrs []*net.IPNet
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid CIDR %q", entry)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			cidrs = append(cidrs, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, cidr, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	if len(cidrs) == 0 {
+		return nil, errors.New("no CIDRs")
+	}
+	return cidrs, nil
+}
+
+// proxyConn is a connection from a trusted load balancer. Its PROXY protocol header is read on first use,
+// in the connection's own goroutine rather than the accept loop, and RemoteAddr then returns the client's
+// address from the header.
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	once   sync.Once
+	parsed *proxyHeader
+	err    error
+}
+
+// header reads the PROXY protocol header once and returns it.
+func (c *proxyConn) header() (*proxyHeader, error) {
+	c.once.Do(func() {
+		if c.err = c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout)); c.err != nil {
+			return
+		}
+		c.parsed, c.err = readProxyHeader(c.reader)
+		if c.err == nil {
+			c.err = c.Conn.SetReadDeadline(time.Time{})
+		}
+	})
+	return c.parsed, c.err
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	if _, err := c.header(); err != nil {
+		return 0, err
+	}
+	return c.reader.Read(p)
+}
+
+// RemoteAddr returns the client's address from the PROXY header, or the load balancer's address for
+// connections it opened itself or whose header could not be read.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if h, err := c.header(); err == nil && !h.local {
+		return h.source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// CloseWrite half-closes the underlying connection, if it supports that.
+func (c *proxyConn) CloseWrite() error {
+	if hc, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return hc.CloseWrite()
+	}
+	return nil
+}
+
+// acceptProxyHeader reads the PROXY protocol header of a connection accepted by a proxyProtocolListener,
+// looking through a TLS listener's wrapping. It returns nil for connections without one.
+func acceptProxyHeader(conn net.Conn) (*proxyHeader, error) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	pc, ok := conn.(*proxyConn)
+	if !ok {
+		return nil, nil
+	}
+	h, err := pc.header()
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY protocol header from %s: %w", pc.Conn.RemoteAddr(), err)
+	}
+	return h, nil
+}
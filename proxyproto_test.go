@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyV2Header builds a v2 PROXY header for a TCP over IPv4 connection with the given TLVs. With
+// withCRC a CRC32C TLV is appended and filled in.
+func proxyV2Header(command byte, src, dst *net.TCPAddr, tlvs []proxyTLV, withCRC bool) []byte {
+	payload := make([]byte, 12)
+	copy(payload[0:4], src.IP.To4())
+	copy(payload[4:8], dst.IP.To4())
+	binary.BigEndian.PutUint16(payload[8:], uint16(src.Port))
+	binary.BigEndian.PutUint16(payload[10:], uint16(dst.Port))
+	if withCRC {
+		tlvs = append(tlvs, proxyTLV{typ: proxyTLVCRC32C, value: make([]byte, 4)})
+	}
+	for _, t := range tlvs {
+		payload = append(payload, t.typ, byte(len(t.value)>>8), byte(len(t.value)))
+		payload = append(payload, t.value...)
+	}
+	h := append([]byte{}, proxyV2Signature...)
+	h = append(h, 0x20|command, proxyV2FamilyInet<<4|0x1, byte(len(payload)>>8), byte(len(payload)))
+	h = append(h, payload...)
+	if withCRC {
+		binary.BigEndian.PutUint32(h[len(h)-4:], crc32.Checksum(h, crc32.MakeTable(crc32.Castagnoli)))
+	}
+	return h
+}
+
+// TestReadProxyHeader_V1 verifies parsing of the v1 text header.
+func TestReadProxyHeader_V1(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		want    string
+		local   bool
+		wantErr bool
+	}{
+		{name: "tcp4", header: "PROXY TCP4 203.0.113.7 10.0.0.1 51234 8372\r\n", want: "203.0.113.7:51234"},
+		{name: "tcp6", header: "PROXY TCP6 2001:db8::7 2001:db8::1 51234 8372\r\n", want: "[2001:db8::7]:51234"},
+		{name: "unknown", header: "PROXY UNKNOWN\r\n", local: true},
+		{name: "family mismatch", header: "PROXY TCP4 2001:db8::7 10.0.0.1 51234 8372\r\n", wantErr: true},
+		{name: "bad port", header: "PROXY TCP4 203.0.113.7 10.0.0.1 051234 8372\r\n", wantErr: true},
+		{name: "missing CRLF", header: "PROXY TCP4 203.0.113.7 10.0.0.1 51234 8372\n", wantErr: true},
+		{name: "too long", header: "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", wantErr: true},
+		{name: "no header", header: "GET / HTTP/1.1\r\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.header + "payload"))
+			h, err := readProxyHeader(r)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("readProxyHeader() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readProxyHeader() error = %v", err)
+			}
+			if h.local != tt.local || (!tt.local && h.source.String() != tt.want) {
+				t.Errorf("readProxyHeader() = local %v source %v, want local %v source %s", h.local, h.source, tt.local, tt.want)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != "payload" {
+				t.Errorf("bytes after the header = %q, want %q", rest, "payload")
+			}
+		})
+	}
+}
+
+// TestReadProxyHeader_ShortHeaderWithoutPayload verifies that the shortest v1 header is read without waiting for
+// bytes the client only sends once the server speaks.
+func TestReadProxyHeader_ShortHeaderWithoutPayload(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go client.Write([]byte("PROXY UNKNOWN\r\n"))
+
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	h, err := readProxyHeader(bufio.NewReader(server))
+	if err != nil || !h.local {
+		t.Errorf("readProxyHeader() = %+v, %v; want a local header", h, err)
+	}
+}
+
+// TestReadProxyHeader_V2 verifies parsing of the v2 binary header, its TLVs and its checksum.
+func TestReadProxyHeader_V2(t *testing.T) {
+	src := &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 51234}
+	dst := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 8372}
+	tlvs := []proxyTLV{
+		{typ: proxyTLVAuthority, value: []byte("buildkit.example.com")},
+		{typ: proxyTLVAWS, value: append([]byte{proxyTLVAWSVPCEndpointID}, "vpce-0123"...)},
+	}
+
+	raw := proxyV2Header(proxyV2CmdProxy, src, dst, tlvs, true)
+	r := bufio.NewReader(strings.NewReader(string(raw) + "payload"))
+	h, err := readProxyHeader(r)
+	if err != nil {
+		t.Fatalf("readProxyHeader() error = %v", err)
+	}
+	if h.version != 2 || h.local || h.source.String() != src.String() || h.destination.String() != dst.String() {
+		t.Errorf("readProxyHeader() = %+v, want a v2 header from %s to %s", h, src, dst)
+	}
+	attrs := h.logAttrs()
+	want := []any{"proxyAuthority", "buildkit.example.com", "vpcEndpointID", "vpce-0123"}
+	if len(attrs) != len(want) {
+		t.Fatalf("logAttrs() = %v, want %v", attrs, want)
+	}
+	for i := range want {
+		if attrs[i] != want[i] {
+			t.Errorf("logAttrs() = %v, want %v", attrs, want)
+		}
+	}
+	if rest, _ := io.ReadAll(r); string(rest) != "payload" {
+		t.Errorf("bytes after the header = %q, want %q", rest, "payload")
+	}
+
+	local, err := readProxyHeader(bufio.NewReader(strings.NewReader(string(proxyV2Header(proxyV2CmdLocal, src, dst, nil, false)))))
+	if err != nil || !local.local || local.source != nil {
+		t.Errorf("readProxyHeader(LOCAL) = %+v, %v; want a local header without a source", local, err)
+	}
+
+	corrupt := proxyV2Header(proxyV2CmdProxy, src, dst, tlvs, true)
+	corrupt[20]++
+	if _, err := readProxyHeader(bufio.NewReader(strings.NewReader(string(corrupt)))); err == nil {
+		t.Error("readProxyHeader() with a bad checksum succeeded, want an error")
+	}
+
+	truncated := proxyV2Header(proxyV2CmdProxy, src, dst, tlvs, false)
+	truncated[15] -= 2 // Cut the last TLV short.
+	if _, err := readProxyHeader(bufio.NewReader(strings.NewReader(string(truncated)))); err == nil {
+		t.Error("readProxyHeader() with a truncated TLV succeeded, want an error")
+	}
+}
+
+// TestParseCIDRs verifies CIDR list parsing, including bare addresses.
+func TestParseCIDRs(t *testing.T) {
+	cidrs, err := parseCIDRs("10.0.0.0/8, 192.0.2.10 ,2001:db8::/32")
+	if err != nil {
+		t.Fatalf("parseCIDRs() error = %v", err)
+	}
+	l := &proxyProtocolListener{trusted: cidrs}
+	for addr, want := range map[string]bool{
+		"10.1.2.3":    true,
+		"192.0.2.10":  true,
+		"192.0.2.11":  false,
+		"2001:db8::5": true,
+		"2001:db9::5": false,
+	} {
+		if got := l.isTrusted(&net.TCPAddr{IP: net.ParseIP(addr)}); got != want {
+			t.Errorf("isTrusted(%s) = %v, want %v", addr, got, want)
+		}
+	}
+	for _, invalid := range []string{"", "10.0.0.0/33", "not-an-ip"} {
+		if _, err := parseCIDRs(invalid); err == nil {
+			t.Errorf("parseCIDRs(%q) succeeded, want an error", invalid)
+		}
+	}
+}
+
+// TestProxyProtocolListener verifies that trusted connections report the client address from their header
+// and that untrusted connections are passed through untouched.
+func TestProxyProtocolListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer inner.Close()
+
+	for _, tc := range []struct {
+		name    string
+		trusted string
+		want    string
+	}{
+		{name: "trusted", trusted: "127.0.0.0/8", want: "203.0.113.7:51234"},
+		{name: "untrusted", trusted: "10.0.0.0/8", want: "127.0.0.1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cidrs, _ := parseCIDRs(tc.trusted)
+			l := &proxyProtocolListener{Listener: inner, trusted: cidrs}
+			go func() {
+				c, err := net.Dial("tcp", inner.Addr().String())
+				if err != nil {
+					return
+				}
+				defer c.Close()
+				io.WriteString(c, "PROXY TCP4 203.0.113.7 10.0.0.1 51234 8372\r\npayload")
+			}()
+
+			conn, err := l.Accept()
+			if err != nil {
+				t.Fatalf("Accept() error = %v", err)
+			}
+			defer conn.Close()
+			h, err := acceptProxyHeader(conn)
+			if err != nil {
+				t.Fatalf("acceptProxyHeader() error = %v", err)
+			}
+			if got := conn.RemoteAddr().String(); !strings.HasPrefix(got, tc.want) {
+				t.Errorf("RemoteAddr() = %s, want %s", got, tc.want)
+			}
+			data, _ := io.ReadAll(conn)
+			if h != nil && string(data) != "payload" {
+				t.Errorf("read %q after the header, want %q", data, "payload")
+			}
+			if h == nil && !strings.HasPrefix(string(data), "PROXY ") {
+				t.Errorf("untrusted connection read %q, want the header passed through", data)
+			}
+		})
+	}
+}
+
+// TestEncodeProxyHeaderV2 verifies that encoded headers read back with their addresses and TLVs.
+func TestEncodeProxyHeaderV2(t *testing.T) {
+	tlvs := []proxyTLV{{typ: proxyTLVTarget, value: []byte("buildkit/buildkitd")}, {typ: proxyTLVClientIdentity, value: []byte("CN=ci")}}
+	tests := []struct {
+		name     string
+		src, dst net.Addr
+		local    bool
+	}{
+		{name: "ipv4", src: &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51234}, dst: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 8372}},
+		{name: "ipv6", src: &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 51234}, dst: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 8372}},
+		{name: "mixed families", src: &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51234}, dst: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 8372}, local: true},
+		{name: "unix", src: &net.UnixAddr{Name: "@", Net: "unix"}, dst: &net.UnixAddr{Name: "/run/proxy.sock", Net: "unix"}, local: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := encodeProxyHeaderV2(tt.src, tt.dst, tlvs)
+			if err != nil {
+				t.Fatalf("encodeProxyHeaderV2() error = %v", err)
+			}
+			h, err := readProxyHeader(bufio.NewReader(strings.NewReader(string(raw))))
+			if err != nil {
+				t.Fatalf("readProxyHeader() error = %v", err)
+			}
+			if h.local != tt.local {
+				t.Errorf("local = %v, want %v", h.local, tt.local)
+			}
+			if !tt.local && (h.source.String() != tt.src.String() || h.destination.String() != tt.dst.String()) {
+				t.Errorf("addresses = %s -> %s, want %s -> %s", h.source, h.destination, tt.src, tt.dst)
+			}
+			if v, _ := h.tlv(proxyTLVClientIdentity); string(v) != "CN=ci" {
+				t.Errorf("client identity TLV = %q, want %q", v, "CN=ci")
+			}
+		})
+	}
+}
+
+// TestDialBackend_ProxyHeader verifies that the PROXY header reaches buildkitd ahead of the TLS handshake.
+func TestDialBackend_ProxyHeader(t *testing.T) {
+	ca := newTestCA(t)
+	serverCertPEM, serverKeyPEM := ca.issue(t, 50, "buildkitd", "localhost")
+	serverCert, err := tls.X509KeyPair(serverCertPEM, serverKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inner.Close()
+	trusted, _ := parseCIDRs("127.0.0.0/8")
+	listener := tls.NewListener(&proxyProtocolListener{Listener: inner, trusted: trusted}, &tls.Config{Certificates: []tls.Certificate{serverCert}})
+	received := make(chan *proxyHeader, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		h, _ := acceptProxyHeader(conn)
+		received <- h
+		conn.Write([]byte("ok"))
+	}()
+	certs, err := newCertReloader(context.Background(), fileCertSource{caFile: writeTestFile(t, t.TempDir(), "ca.crt", ca.pem, time.Now())})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51234}
+	inbound := &proxyHeader{version: 2, source: client, destination: &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 8372}}
+	preamble, err := backendProxyHeader(fakeAddrConn{remote: client}, inbound, "buildkit/buildkitd", "arm.example.com", "CN=ci")
+	if err != nil {
+		t.Fatalf("backendProxyHeader() error = %v", err)
+	}
+	_, port, _ := net.SplitHostPort(inner.Addr().String())
+	conn, err := dialBackend(context.Background(), net.JoinHostPort("localhost", port), certs, "", preamble)
+	if err != nil {
+		t.Fatalf("dialBackend() error = %v", err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ok" {
+		t.Errorf("read from backend = %q, %v, want \"ok\"", buf, err)
+	}
+
+	h := <-received
+	if h == nil || h.source.String() != client.String() || h.destination.String() != "198.51.100.1:8372" {
+		t.Fatalf("buildkitd received header %+v, want the client address and the load balancer's destination", h)
+	}
+	for typ, want := range map[byte]string{proxyTLVTarget: "buildkit/buildkitd", proxyTLVAuthority: "arm.example.com", proxyTLVClientIdentity: "CN=ci"} {
+		if v, _ := h.tlv(typ); string(v) != want {
+			t.Errorf("TLV %#x = %q, want %q", typ, v, want)
+		}
+	}
+}
+
+// fakeAddrConn is a net.Conn that only reports addresses.
+type fakeAddrConn struct {
+	net.Conn
+	remote, local net.Addr
+}
+
+func (c fakeAddrConn) RemoteAddr() net.Addr { return c.remote }
+func (c fakeAddrConn) LocalAddr() net.Addr  { return c.local }
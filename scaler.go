@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// scaleDownCheckInterval is how often the lifecycle re-evaluates the replica count under load.
+const scaleDownCheckInterval = 15 * time.Second
+
+// scalePolicy describes how many buildkitd replicas to run for a given number of concurrent connections.
+type scalePolicy struct {
+	// targetConnectionsPerReplica is the number of concurrent connections a single replica should serve.
+	targetConnectionsPerReplica int64
+	// minReplicas is the lowest replica count while there is any demand. Scale to zero is
+	// still handled by the idle timer once all connections are gone.
+	minReplicas int32
+	// maxReplicas is the upper bound on the replica count.
+	maxReplicas int32
+	// scaleDownCooldown is the minimum time between any scaling event and the next scale-down step.
+	scaleDownCooldown time.Duration
+	// drainTimeout is how long to wait for the highest-ordinal pod's connections to finish before
+	// removing it anyway.
+	drainTimeout time.Duration
+}
+
+// validate checks that the policy bounds are consistent.
+func (p scalePolicy) validate() error {
+	if p.targetConnectionsPerReplica < 1 {
+		return fmt.Errorf("target connections per replica must be at least 1, got %d", p.targetConnectionsPerReplica)
+	}
+	if p.minReplicas < 1 {
+		return fmt.Errorf("min replicas must be at least 1, got %d", p.minReplicas)
+	}
+	if p.maxReplicas < p.minReplicas {
+		return fmt.Errorf("max replicas (%d) must not be lower than min replicas (%d)", p.maxReplicas, p.minReplicas)
+	}
+	if p.scaleDownCooldown < 0 {
+		return fmt.Errorf("scale-down cooldown must not be negative, got %s", p.scaleDownCooldown)
+	}
+	if p.drainTimeout < 0 {
+		return fmt.Errorf("drain timeout must not be negative, got %s", p.drainTimeout)
+	}
+	return nil
+}
+
+// desiredReplicas returns the replica count needed to serve activeConnections at the target
+// connections per replica, clamped to [minReplicas, maxReplicas].
+func (p scalePolicy) desiredReplicas(activeConnections int64) int32 {
+	needed := (activeConnections + p.targetConnectionsPerReplica - 1) / p.targetConnectionsPerReplica
+	if needed < int64(p.minReplicas) {
+		return p.minReplicas
+	}
+	if needed > int64(p.maxReplicas) {
+		return p.maxReplicas
+	}
+	return int32(needed)
+}
+
+// nextScaleDown returns the replica count for a single scale-down step from currentReplicas,
+// or currentReplicas if the load does not allow scaling down.
+func (p scalePolicy) nextScaleDown(currentReplicas int32, activeConnections int64) int32 {
+	if currentReplicas > p.desiredReplicas(activeConnections) {
+		return currentReplicas - 1
+	}
+	return currentReplicas
+}
+
+// scalingPolicy is the active load-based scaling policy.
+var scalingPolicy scalePolicy
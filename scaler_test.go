@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestScalePolicy_DesiredReplicas checks the replica count computed for various connection loads.
+func TestScalePolicy_DesiredReplicas(t *testing.T) {
+	policy := scalePolicy{targetConnectionsPerReplica: 5, minReplicas: 2, maxReplicas: 4}
+	tests := []struct {
+		active int64
+		want   int32
+	}{
+		{0, 2},
+		{1, 2},
+		{10, 2},
+		{11, 3},
+		{15, 3},
+		{16, 4},
+		{100, 4},
+	}
+	for _, tt := range tests {
+		if got := policy.desiredReplicas(tt.active); got != tt.want {
+			t.Errorf("desiredReplicas(%d) = %d, want %d", tt.active, got, tt.want)
+		}
+	}
+}
+
+// TestScalePolicy_NextScaleDown checks that scale-down only ever removes one replica at a time.
+func TestScalePolicy_NextScaleDown(t *testing.T) {
+	policy := scalePolicy{targetConnectionsPerReplica: 5, minReplicas: 1, maxReplicas: 10}
+	if got := policy.nextScaleDown(5, 1); got != 4 {
+		t.Errorf("nextScaleDown(5, 1) = %d, want 4", got)
+	}
+	if got := policy.nextScaleDown(2, 10); got != 2 {
+		t.Errorf("nextScaleDown(2, 10) = %d, want 2", got)
+	}
+	if got := policy.nextScaleDown(1, 1); got != 1 {
+		t.Errorf("nextScaleDown(1, 1) = %d, want 1", got)
+	}
+}
+
+// TestScalePolicy_Validate checks that inconsistent policies are rejected.
+func TestScalePolicy_Validate(t *testing.T) {
+	valid := scalePolicy{targetConnectionsPerReplica: 1, minReplicas: 1, maxReplicas: 1}
+	if err := valid.validate(); err != nil {
+		t.Errorf("validate() unexpected error: %v", err)
+	}
+	invalid := []scalePolicy{
+		{targetConnectionsPerReplica: 0, minReplicas: 1, maxReplicas: 1},
+		{targetConnectionsPerReplica: 1, minReplicas: 0, maxReplicas: 1},
+		{targetConnectionsPerReplica: 1, minReplicas: 3, maxReplicas: 2},
+		{targetConnectionsPerReplica: 1, minReplicas: 1, maxReplicas: 1, scaleDownCooldown: -time.Second},
+	}
+	for _, p := range invalid {
+		if err := p.validate(); err == nil {
+			t.Errorf("validate(%+v) expected an error, got nil", p)
+		}
+	}
+}
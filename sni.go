@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// clientHelloTimeout bounds how long a client may take to send its TLS ClientHello.
+const clientHelloTimeout = 10 * time.Second
+
+// errClientHelloRead stops the TLS handshake used to parse a ClientHello once the hello has been seen.
+var errClientHelloRead = errors.New("client hello read")
+
+// sniRoute sends connections whose server name matches pattern to target. A pattern is either an
+// exact host name or "*." followed by a domain, matching exactly one extra label.
+type sniRoute struct {
+	pattern string
+	target  *buildkitdTarget
+}
+
+// sniRouter picks the target for a connection from the server name in its TLS ClientHello.
+type sniRouter struct {
+	routes []sniRoute
+	// fallback receives connections without a server name or without a matching route.
+	fallback *buildkitdTarget
+}
+
+// route returns the target for serverName. Exact patterns take precedence over wildcards.
+func (r *sniRouter) route(serverName string) *buildkitdTarget {
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+	var wildcard *buildkitdTarget
+	for _, route := range r.routes {
+		switch {
+		case route.pattern == serverName:
+			return route.target
+		case wildcard == nil && matchWildcard(route.pattern, serverName):
+			wildcard = route.target
+		}
+	}
+	if wildcard != nil {
+		return wildcard
+	}
+	return r.fallback
+}
+
+// matchWildcard reports whether a "*.domain" pattern matches serverName.
+func matchWildcard(pattern, serverName string) bool {
+	domain, ok := strings.CutPrefix(pattern, "*.")
+	if !ok {
+		return false
+	}
+	label, rest, ok := strings.Cut(serverName, ".")
+	return ok && label != "" && rest == domain
+}
+
+// parseSNIRoutes parses a comma-separated routing table of
+// "<server name>=<namespace>/<statefulset>[/<headless service>[:<port>]]" entries. The headless service
+// defaults to "<statefulset>-headless" and the port to defaultPort.
+func parseSNIRoutes(s, defaultPort string) (map[string]targetSpec, error) {
+	routes := make(map[string]targetSpec)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		pattern, target, ok := strings.Cut(entry, "=")
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("invalid route %q: want <server name>=<namespace>/<statefulset>", entry)
+		}
+		if strings.Contains(strings.TrimPrefix(pattern, "*."), "*") {
+			return nil, fmt.Errorf("invalid route %q: only a leading \"*.\" wildcard is supported", entry)
+		}
+		if _, dup := routes[pattern]; dup {
+			return nil, fmt.Errorf("duplicate route for %q", pattern)
+		}
+
+		parts := strings.Split(strings.TrimSpace(target), "/")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid route %q: want <namespace>/<statefulset>[/<headless service>[:<port>]]", entry)
+		}
+		spec := targetSpec{namespace: parts[0], name: parts[1], headlessService: parts[1] + "-headless", port: defaultPort}
+		if len(parts) == 3 {
+			svc, port, hasPort := strings.Cut(parts[2], ":")
+			if svc != "" {
+				spec.headlessService = svc
+			}
+			if hasPort {
+				spec.port = port
+			}
+		}
+		routes[pattern] = spec
+	}
+	if len(routes) == 0 {
+		return nil, errors.New("no routes")
+	}
+	return routes, nil
+}
+
+// peekServerName reads the TLS ClientHello from conn and returns the server name it asks for, or "" if
+// it has none. The returned connection replays the bytes read, so the encrypted stream is passed on unchanged.
+func peekServerName(conn net.Conn) (net.Conn, string, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(clientHelloTimeout)); err != nil {
+		return nil, "", err
+	}
+	var peeked bytes.Buffer
+	var serverName string
+	// Run a server handshake over a read-only view of the connection just far enough to parse the hello.
+	err := tls.Server(readOnlyConn{io.TeeReader(conn, &peeked)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+	if !errors.Is(err, errClientHelloRead) {
+		return nil, "", fmt.Errorf("reading TLS ClientHello: %w", err)
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, "", err
+	}
+	return &peekedConn{Conn: conn, reader: io.MultiReader(&peeked, conn)}, serverName, nil
+}
+
+// readOnlyConn is a net.Conn that reads from r and refuses writes, so a handshake run over it
+// cannot answer the client.
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)     { return c.r.Read(p) }
+func (readOnlyConn) Write([]byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (readOnlyConn) Close() error                     { return nil }
+func (readOnlyConn) LocalAddr() net.Addr              { return nil }
+func (readOnlyConn) RemoteAddr() net.Addr             { return nil }
+func (readOnlyConn) SetDeadline(time.Time) error      { return nil }
+func (readOnlyConn) SetReadDeadline(time.Time) error  { return nil }
+func (readOnlyConn) SetWriteDeadline(time.Time) error { return nil }
+
+// peekedConn replays the bytes read while peeking before reading from the connection again.
+type peekedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) { return c.reader.Read(p) }
+
+// CloseWrite half-closes the underlying connection, if it supports that.
+func (c *peekedConn) CloseWrite() error {
+	if hc, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return hc.CloseWrite()
+	}
+	return nil
+}
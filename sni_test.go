@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+)
+
+// TestSNIRouter_Route verifies that exact server names win over wildcards and that anything else falls back.
+func TestSNIRouter_Route(t *testing.T) {
+	fallback := &buildkitdTarget{targetSpec: targetSpec{namespace: "buildkit", name: "default"}}
+	exact := &buildkitdTarget{targetSpec: targetSpec{namespace: "team-a", name: "exact"}}
+	wildcard := &buildkitdTarget{targetSpec: targetSpec{namespace: "team-a", name: "wildcard"}}
+	r := &sniRouter{
+		routes: []sniRoute{
+			{pattern: "*.a.example.com", target: wildcard},
+			{pattern: "arm.a.example.com", target: exact},
+		},
+		fallback: fallback,
+	}
+
+	tests := []struct {
+		serverName string
+		want       *buildkitdTarget
+	}{
+		{"arm.a.example.com", exact},
+		{"ARM.a.example.com.", exact},
+		{"amd.a.example.com", wildcard},
+		{"a.example.com", fallback},
+		{"x.amd.a.example.com", fallback},
+		{"b.example.com", fallback},
+		{"", fallback},
+	}
+	for _, tt := range tests {
+		if got := r.route(tt.serverName); got != tt.want {
+			t.Errorf("route(%q) = %s, want %s", tt.serverName, got.key(), tt.want.key())
+		}
+	}
+}
+
+// TestParseSNIRoutes verifies the routing table format, its defaults and its errors.
+func TestParseSNIRoutes(t *testing.T) {
+	routes, err := parseSNIRoutes(" arm.example.com=team-a/buildkitd-arm , *.amd.example.com=team-b/buildkitd/bk:1234,x.example.com=team-c/bk/:9000", "8372")
+	if err != nil {
+		t.Fatalf("parseSNIRoutes() error = %v", err)
+	}
+	want := map[string]targetSpec{
+		"arm.example.com":   {namespace: "team-a", name: "buildkitd-arm", headlessService: "buildkitd-arm-headless", port: "8372"},
+		"*.amd.example.com": {namespace: "team-b", name: "buildkitd", headlessService: "bk", port: "1234"},
+		"x.example.com":     {namespace: "team-c", name: "bk", headlessService: "bk-headless", port: "9000"},
+	}
+	if len(routes) != len(want) {
+		t.Fatalf("parseSNIRoutes() = %v, want %v", routes, want)
+	}
+	for pattern, spec := range want {
+		if routes[pattern] != spec {
+			t.Errorf("route %q = %+v, want %+v", pattern, routes[pattern], spec)
+		}
+	}
+
+	for _, invalid := range []string{
+		"",
+		"arm.example.com",
+		"=team-a/bk",
+		"arm.example.com=team-a",
+		"arm.example.com=/bk",
+		"arm.example.com=a/b/c/d",
+		"*.*.example.com=team-a/bk",
+		"arm.example.com=team-a/bk,ARM.example.com=team-b/bk",
+	} {
+		if _, err := parseSNIRoutes(invalid, "8372"); err == nil {
+			t.Errorf("parseSNIRoutes(%q) succeeded, want an error", invalid)
+		}
+	}
+}
+
+// TestPeekServerName verifies that the server name is read from the ClientHello and that the peeked
+// connection replays the client's bytes unchanged.
+func TestPeekServerName(t *testing.T) {
+	for _, serverName := range []string{"arm.example.com", ""} {
+		client, server := net.Pipe()
+		sent := make(chan []byte, 1)
+		go func() {
+			// Record the raw ClientHello; the handshake itself never completes.
+			var raw bytes.Buffer
+			tlsClient := tls.Client(recordingConn{Conn: client, w: &raw}, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+			tlsClient.Handshake()
+			sent <- raw.Bytes()
+		}()
+
+		conn, got, err := peekServerName(server)
+		if err != nil {
+			t.Fatalf("peekServerName() error = %v", err)
+		}
+		if got != serverName {
+			t.Errorf("peekServerName() server name = %q, want %q", got, serverName)
+		}
+		client.Close()
+		replayed, _ := io.ReadAll(conn)
+		if hello := <-sent; !bytes.Equal(replayed, hello) {
+			t.Errorf("replayed %d bytes, want the %d-byte ClientHello", len(replayed), len(hello))
+		}
+		conn.Close()
+	}
+}
+
+// TestPeekServerName_NotTLS verifies that a client not speaking TLS is rejected.
+func TestPeekServerName_NotTLS(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		client.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+		client.Close()
+	}()
+	if _, _, err := peekServerName(server); err == nil {
+		t.Error("peekServerName() on plain text succeeded, want an error")
+	}
+}
+
+// recordingConn copies everything written to the connection into w.
+type recordingConn struct {
+	net.Conn
+	w io.Writer
+}
+
+func (c recordingConn) Write(p []byte) (int, error) {
+	c.w.Write(p)
+	return c.Conn.Write(p)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// cacheSyncTimeout bounds how long start waits for the initial list of the StatefulSet and its pods.
+const cacheSyncTimeout = time.Minute
+
+// statefulSetCache serves the buildkitd StatefulSet and its pods from shared informers, so status lookups
+// on every connection do not hit the API server and readiness waits complete as soon as the watch
+// delivers the change instead of on the next poll.
+type statefulSetCache struct {
+	clientset kubernetes.Interface
+	namespace string
+	name      string
+
+	stsLister appslisters.StatefulSetLister
+	podLister corelisters.PodLister
+
+	mu sync.Mutex
+	// changed is closed and replaced whenever the StatefulSet or one of its pods changes.
+	changed chan struct{}
+	// podEvents holds the latest events lookup per failing pod UID, so repeated failure checks during a
+	// wait do not list events on every watch event.
+	podEvents map[types.UID]podEventsLookup
+}
+
+// podEventsLookup is the summary of a failing pod's events and when they were listed.
+type podEventsLookup struct {
+	at               time.Time
+	scaleUpTriggered bool
+	warning          *corev1.Event
+}
+
+// newStatefulSetCache creates a cache for the named StatefulSet. Call start before using it.
+func newStatefulSetCache(clientset kubernetes.Interface, namespace, name string) *statefulSetCache {
+	return &statefulSetCache{
+		clientset: clientset,
+		namespace: namespace,
+		name:      name,
+		changed:   make(chan struct{}),
+		podEvents: make(map[types.UID]podEventsLookup),
+	}
+}
+
+// start runs the informers and blocks until their caches have synced, for at most cacheSyncTimeout.
+// The informers stop when ctx is cancelled.
+//
+// The StatefulSet informer watches only the named StatefulSet. Pods are watched by the StatefulSet's
+// label selector, which is immutable; if the StatefulSet cannot be read at startup, all pods in the
+// namespace are watched and filtered by name instead.
+func (c *statefulSetCache) start(ctx context.Context) error {
+	podListOptions := func(*metav1.ListOptions) {}
+	sts, err := c.clientset.AppsV1().StatefulSets(c.namespace).Get(ctx, c.name, metav1.GetOptions{})
+	switch {
+	case err != nil:
+		logger.Warn("Could not get StatefulSet to scope the pod watch. Watching all pods in the namespace.", "error", err, "statefulSet", c.name, "namespace", c.namespace)
+	case sts.Spec.Selector != nil:
+		selector, err := metav1.LabelSelectorAsSelector(sts.Spec.Selector)
+		if err != nil {
+			return fmt.Errorf("invalid selector on StatefulSet %s in namespace %s: %w", c.name, c.namespace, err)
+		}
+		podListOptions = func(opts *metav1.ListOptions) { opts.LabelSelector = selector.String() }
+	}
+
+	stsFactory := informers.NewSharedInformerFactoryWithOptions(c.clientset, 0,
+		informers.WithNamespace(c.namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", c.name).String()
+		}))
+	podFactory := informers.NewSharedInformerFactoryWithOptions(c.clientset, 0,
+		informers.WithNamespace(c.namespace),
+		informers.WithTweakListOptions(podListOptions))
+
+	stsInformer := stsFactory.Apps().V1().StatefulSets()
+	podInformer := podFactory.Core().V1().Pods()
+	stsHandler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj any) { c.onStatefulSetChange(obj) },
+		UpdateFunc: func(_, obj any) { c.onStatefulSetChange(obj) },
+		DeleteFunc: func(any) { c.notify() },
+	}
+	podHandler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(any) { c.notify() },
+		UpdateFunc: func(any, any) { c.notify() },
+		DeleteFunc: func(any) { c.notify() },
+	}
+	if _, err := stsInformer.Informer().AddEventHandler(stsHandler); err != nil {
+		return fmt.Errorf("error watching StatefulSet %s in namespace %s: %w", c.name, c.namespace, err)
+	}
+	if _, err := podInformer.Informer().AddEventHandler(podHandler); err != nil {
+		return fmt.Errorf("error watching pods for StatefulSet %s in namespace %s: %w", c.name, c.namespace, err)
+	}
+	c.stsLister = stsInformer.Lister()
+	c.podLister = podInformer.Lister()
+
+	stsFactory.Start(ctx.Done())
+	podFactory.Start(ctx.Done())
+	syncCtx, cancel := context.WithTimeout(ctx, cacheSyncTimeout)
+	defer cancel()
+	if !cache.WaitForCacheSync(syncCtx.Done(), stsInformer.Informer().HasSynced, podInformer.Informer().HasSynced) {
+		return fmt.Errorf("timed out syncing cache for StatefulSet %s in namespace %s", c.name, c.namespace)
+	}
+	return nil
+}
+
+// onStatefulSetChange updates the replica gauges and wakes everyone waiting for a change.
+func (c *statefulSetCache) onStatefulSetChange(obj any) {
+	if sts, ok := obj.(*appsv1.StatefulSet); ok && sts.Name == c.name {
+		recordReplicas(c.namespace, c.name, statefulSetStatusOf(sts))
+	}
+	c.notify()
+}
+
+// notify wakes everyone waiting for a change.
+func (c *statefulSetCache) notify() {
+	c.mu.Lock()
+	close(c.changed)
+	c.changed = make(chan struct{})
+	c.mu.Unlock()
+}
+
+// status returns the cached replica counts of the StatefulSet.
+func (c *statefulSetCache) status() (*StatefulSetStatus, error) {
+	sts, err := c.statefulSet()
+	if err != nil {
+		return nil, err
+	}
+	return statefulSetStatusOf(sts), nil
+}
+
+// statefulSet returns the cached StatefulSet. The object is shared with the cache and must not be modified.
+func (c *statefulSetCache) statefulSet() (*appsv1.StatefulSet, error) {
+	sts, err := c.stsLister.StatefulSets(c.namespace).Get(c.name)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, fmt.Errorf("StatefulSet %s in namespace %s not found: %w", c.name, c.namespace, err)
+		}
+		return nil, fmt.Errorf("error getting StatefulSet %s in namespace %s: %w", c.name, c.namespace, err)
+	}
+	return sts, nil
+}
+
+// readyOrdinals returns the ordinals of the cached pods that are Ready and not terminating, in ascending order.
+func (c *statefulSetCache) readyOrdinals() ([]int32, error) {
+	pods, err := c.podLister.Pods(c.namespace).List(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("error listing pods for StatefulSet %s in namespace %s: %w", c.name, c.namespace, err)
+	}
+	return readyOrdinalsOf(c.name, pods), nil
+}
+
+// podFailure returns a podFailureError for the first of the StatefulSet's pods that is stuck in a state
+// it will not recover from on its own, or nil. The events of a pod whose status suggests a failure are
+// consulted to keep waiting for an unschedulable pod the cluster autoscaler is adding a node for, and to
+// report the most specific message; they are listed at most once per podEventsRefreshInterval.
+func (c *statefulSetCache) podFailure() error {
+	pods, err := c.podLister.Pods(c.namespace).List(labels.Everything())
+	if err != nil {
+		return nil // Nothing to inspect; the readiness wait carries on.
+	}
+	now := time.Now()
+	for _, pod := range pods {
+		if _, ok := podOrdinal(c.name, pod.Name); !ok || pod.DeletionTimestamp != nil {
+			continue
+		}
+		failure := classifyPodFailure(pod, now)
+		if failure == nil {
+			continue
+		}
+
+		lookup, err := c.lookupPodEvents(context.TODO(), pod, now)
+		if err != nil {
+			logger.Debug("Could not list events for failing pod.", "pod", pod.Name, "namespace", c.namespace, "error", err)
+			return failure
+		}
+		if errors.Is(failure, errPodUnschedulable) && lookup.scaleUpTriggered {
+			logger.Debug("Pod is unschedulable, but the cluster autoscaler is adding a node for it. Waiting.", "pod", pod.Name, "namespace", c.namespace)
+			continue
+		}
+		if lookup.warning != nil && lookup.warning.Message != "" {
+			failure.message = lookup.warning.Message
+		}
+		return failure
+	}
+	return nil
+}
+
+// lookupPodEvents returns the summary of the pod's events, listing them only if the last lookup is older
+// than podEventsRefreshInterval.
+func (c *statefulSetCache) lookupPodEvents(ctx context.Context, pod *corev1.Pod, now time.Time) (podEventsLookup, error) {
+	c.mu.Lock()
+	lookup, ok := c.podEvents[pod.UID]
+	c.mu.Unlock()
+	if ok && now.Sub(lookup.at) < podEventsRefreshInterval {
+		return lookup, nil
+	}
+
+	events, err := listPodEvents(ctx, c.clientset, pod)
+	if err != nil {
+		return podEventsLookup{}, err
+	}
+	lookup = podEventsLookup{at: now}
+	lookup.scaleUpTriggered, lookup.warning = summarizePodEvents(events)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for uid, l := range c.podEvents {
+		if now.Sub(l.at) >= podEventsRefreshInterval {
+			delete(c.podEvents, uid)
+		}
+	}
+	c.podEvents[pod.UID] = lookup
+	return lookup, nil
+}
+
+// waitFor blocks until cond holds for the cached StatefulSet status, re-checking on every watch event,
+// or until timeout elapses or ctx is cancelled. A missing StatefulSet is treated as not yet matching, e.g. while
+// it is being created. If failed is set, it is checked alongside cond, and the wait aborts with its error as soon
+// as it returns one.
+func (c *statefulSetCache) waitFor(ctx context.Context, timeout time.Duration, what string, cond func(*StatefulSetStatus) bool, failed func() error) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	// Failure checks can depend on elapsed time, so they are also re-run without watch events.
+	recheck := time.NewTicker(failureRecheckInterval)
+	defer recheck.Stop()
+
+	for {
+		// Grab the notification channel before checking so no event is missed in between.
+		c.mu.Lock()
+		changed := c.changed
+		c.mu.Unlock()
+
+		status, err := c.status()
+		if err != nil {
+			logger.Debug("Waiting: StatefulSet not in cache yet.", "statefulSet", c.name, "namespace", c.namespace, "error", err)
+		} else {
+			logger.Debug("Cached StatefulSet status",
+				"statefulSet", c.name, "namespace", c.namespace,
+				"desiredReplicas", status.DesiredReplicas, "currentReplicas", status.CurrentReplicas, "readyReplicas", status.ReadyReplicas)
+			if cond(status) {
+				return nil
+			}
+		}
+		if failed != nil {
+			if err := failed(); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-changed:
+		case <-recheck.C:
+		case <-deadline.C:
+			return fmt.Errorf("timed out after %s waiting for StatefulSet %s in namespace %s to %s", timeout, c.name, c.namespace, what)
+		case <-ctx.Done():
+			return fmt.Errorf("stopped waiting for StatefulSet %s in namespace %s to %s: %w", c.name, c.namespace, what, context.Cause(ctx))
+		}
+	}
+}
+
+// waitReady blocks until at least expectedReadyReplicas are ready and the StatefulSet is stable.
+// It fails fast with a podFailureError if a pod is unschedulable, cannot pull its image or is crash looping.
+func (c *statefulSetCache) waitReady(ctx context.Context, expectedReadyReplicas int32, timeout time.Duration) error {
+	err := c.waitFor(ctx, timeout, fmt.Sprintf("have %d ready replicas", expectedReadyReplicas), func(status *StatefulSetStatus) bool {
+		return isStatefulSetReady(status, expectedReadyReplicas)
+	}, c.podFailure)
+	switch {
+	case err == nil:
+		logger.Info("StatefulSet is ready.", "statefulSet", c.name, "namespace", c.namespace, "readyReplicas", expectedReadyReplicas)
+	case failureCause(err) != "":
+		logger.Error("buildkitd pod failed to start. Aborting wait for ready replicas.", "cause", failureCause(err), "error", err, "statefulSet", c.name, "namespace", c.namespace)
+	}
+	return err
+}
+
+// waitScaledDown blocks until the StatefulSet is scaled to zero and has no pods left, including terminating ones.
+func (c *statefulSetCache) waitScaledDown(ctx context.Context, timeout time.Duration) error {
+	err := c.waitFor(ctx, timeout, "have no pods left", isStatefulSetScaledDown, nil)
+	if err == nil {
+		logger.Info("StatefulSet has no pods left.", "statefulSet", c.name, "namespace", c.namespace)
+	}
+	return err
+}
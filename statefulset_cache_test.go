@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// startTestCache starts a statefulSetCache over the given fake clientset and stops it when the test ends.
+func startTestCache(t *testing.T, clientset *fake.Clientset) *statefulSetCache {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	c := newStatefulSetCache(clientset, testNamespace, testStsName)
+	if err := c.start(ctx); err != nil {
+		t.Fatalf("start() error = %v", err)
+	}
+	return c
+}
+
+// TestStatefulSetCache_Lookups verifies that status and ready ordinals are served from the cache.
+func TestStatefulSetCache_Lookups(t *testing.T) {
+	sts := newTestStatefulSet(testStsName, testNamespace, 3)
+	sts.Spec.Selector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": testStsName}}
+	clientset := fake.NewSimpleClientset(sts,
+		newTestPod(testStsName+"-2", true),
+		newTestPod(testStsName+"-0", true),
+		newTestPod(testStsName+"-1", false),
+	)
+	c := startTestCache(t, clientset)
+
+	status, err := c.status()
+	if err != nil {
+		t.Fatalf("status() error = %v", err)
+	}
+	if status.DesiredReplicas != 3 || status.ReadyReplicas != 3 {
+		t.Errorf("status() = %+v, want 3 desired and ready replicas", status)
+	}
+
+	ordinals, err := c.readyOrdinals()
+	if err != nil {
+		t.Fatalf("readyOrdinals() error = %v", err)
+	}
+	if want := []int32{0, 2}; !slices.Equal(ordinals, want) {
+		t.Errorf("readyOrdinals() = %v, want %v", ordinals, want)
+	}
+}
+
+// TestStatefulSetCache_NotFound verifies that a missing StatefulSet is reported as an error.
+func TestStatefulSetCache_NotFound(t *testing.T) {
+	c := startTestCache(t, fake.NewSimpleClientset())
+	if _, err := c.status(); err == nil {
+		t.Error("status() expected an error for a missing StatefulSet, got nil")
+	}
+}
+
+// TestStatefulSetCache_WaitReadyOnWatchEvent verifies that a readiness wait completes as soon as the
+// watch delivers the ready StatefulSet, well before the old 5 second poll interval.
+func TestStatefulSetCache_WaitReadyOnWatchEvent(t *testing.T) {
+	sts := newTestStatefulSet(testStsName, testNamespace, 0)
+	clientset := fake.NewSimpleClientset(sts)
+	c := startTestCache(t, clientset)
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		ready := newTestStatefulSet(testStsName, testNamespace, 1)
+		if _, err := clientset.AppsV1().StatefulSets(testNamespace).Update(context.Background(), ready, metav1.UpdateOptions{}); err != nil {
+			t.Errorf("Update() error = %v", err)
+		}
+	}()
+
+	start := time.Now()
+	if err := c.waitReady(context.Background(), 1, 5*time.Second); err != nil {
+		t.Fatalf("waitReady() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("waitReady() took %s, want it to complete on the watch event", elapsed)
+	}
+}
+
+// TestStatefulSetCache_WaitTimeout verifies that waits give up after the timeout.
+func TestStatefulSetCache_WaitTimeout(t *testing.T) {
+	c := startTestCache(t, fake.NewSimpleClientset(newTestStatefulSet(testStsName, testNamespace, 1)))
+
+	if err := c.waitReady(context.Background(), 2, 20*time.Millisecond); err == nil {
+		t.Error("waitReady() expected a timeout error, got nil")
+	}
+	if err := c.waitScaledDown(context.Background(), 20*time.Millisecond); err == nil {
+		t.Error("waitScaledDown() expected a timeout error, got nil")
+	}
+}
+
+// TestStatefulSetCache_WaitCancelled verifies that waits end with the cancellation cause when their context is cancelled.
+func TestStatefulSetCache_WaitCancelled(t *testing.T) {
+	c := startTestCache(t, fake.NewSimpleClientset(newTestStatefulSet(testStsName, testNamespace, 1)))
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(errClientDisconnected)
+
+	start := time.Now()
+	if err := c.waitReady(ctx, 2, 5*time.Second); !errors.Is(err, errClientDisconnected) {
+		t.Errorf("waitReady() error = %v, want %v", err, errClientDisconnected)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("waitReady() took %s after cancellation", elapsed)
+	}
+}
+
+// TestStatefulSetCache_WaitReadyFailsFast verifies that a readiness wait aborts with a classified error
+// as soon as a pod reports a terminal failure, reporting the message of its latest warning event.
+func TestStatefulSetCache_WaitReadyFailsFast(t *testing.T) {
+	sts := newTestStatefulSet(testStsName, testNamespace, 0)
+	sts.Spec.Replicas = int32Ptr(1)
+	pod := waitingPod("ImagePullBackOff")
+	warning := &corev1.Event{
+		ObjectMeta:     metav1.ObjectMeta{Name: "pull-failed", Namespace: testNamespace},
+		InvolvedObject: corev1.ObjectReference{Kind: "Pod", Name: pod.Name},
+		Type:           corev1.EventTypeWarning,
+		Reason:         "Failed",
+		Message:        "manifest unknown",
+	}
+	c := startTestCache(t, fake.NewSimpleClientset(sts, pod, warning))
+
+	start := time.Now()
+	err := c.waitReady(context.Background(), 1, 5*time.Second)
+	if !errors.Is(err, errImagePull) {
+		t.Fatalf("waitReady() error = %v, want %v", err, errImagePull)
+	}
+	if !strings.Contains(err.Error(), "manifest unknown") {
+		t.Errorf("waitReady() error = %q, want it to include the warning event message", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("waitReady() took %s, want it to fail fast", elapsed)
+	}
+}
+
+// TestStatefulSetCache_WaitReadyUnschedulableWithNodeScaleUp verifies that an unschedulable pod does not
+// fail the wait while the cluster autoscaler reports that it is adding a node for it.
+func TestStatefulSetCache_WaitReadyUnschedulableWithNodeScaleUp(t *testing.T) {
+	sts := newTestStatefulSet(testStsName, testNamespace, 0)
+	sts.Spec.Replicas = int32Ptr(1)
+	pod := unschedulablePod(time.Now().Add(-time.Hour))
+	scaleUp := &corev1.Event{
+		ObjectMeta:     metav1.ObjectMeta{Name: "scale-up", Namespace: testNamespace},
+		InvolvedObject: corev1.ObjectReference{Kind: "Pod", Name: pod.Name},
+		Type:           corev1.EventTypeNormal,
+		Reason:         eventReasonTriggeredScaleUp,
+	}
+	c := startTestCache(t, fake.NewSimpleClientset(sts, pod, scaleUp))
+
+	err := c.waitReady(context.Background(), 1, 50*time.Millisecond)
+	if err == nil || failureCause(err) != "" {
+		t.Errorf("waitReady() error = %v, want a plain timeout", err)
+	}
+}
+
+// TestStatefulSetCache_PodFailureReusesEvents verifies that repeated failure checks list a failing pod's
+// events only once per refresh interval.
+func TestStatefulSetCache_PodFailureReusesEvents(t *testing.T) {
+	sts := newTestStatefulSet(testStsName, testNamespace, 0)
+	sts.Spec.Replicas = int32Ptr(1)
+	clientset := fake.NewSimpleClientset(sts, unschedulablePod(time.Now().Add(-time.Hour)))
+	c := startTestCache(t, clientset)
+
+	for range 3 {
+		if err := c.podFailure(); !errors.Is(err, errPodUnschedulable) {
+			t.Fatalf("podFailure() error = %v, want %v", err, errPodUnschedulable)
+		}
+	}
+	var lists int
+	for _, action := range clientset.Actions() {
+		if action.Matches("list", "events") {
+			lists++
+		}
+	}
+	if lists != 1 {
+		t.Errorf("events listed %d times, want once", lists)
+	}
+}
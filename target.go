@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// targetSpec names a buildkitd StatefulSet and how its pods are reached.
+type targetSpec struct {
+	namespace string
+	name      string
+	// headlessService resolves the per-pod DNS names.
+	headlessService string
+	// port is the buildkitd port on each pod.
+	port string
+	// idleTimeout is how long the target stays up after its last connection closes.
+	idleTimeout time.Duration
+	// readyWaitTimeout bounds how long a connection is held while the target scales up from zero.
+	readyWaitTimeout time.Duration
+}
+
+// key identifies the target as "<namespace>/<name>".
+func (s targetSpec) key() string {
+	return s.namespace + "/" + s.name
+}
+
+// backendAddress returns the dial address of the pod with the given ordinal, resolved through the
+// headless service (<sts>-<ordinal>.<headless>.<ns>.svc.cluster.local:<port>).
+func (s targetSpec) backendAddress(ordinal int32) string {
+	return fmt.Sprintf("%s-%d.%s.%s.svc.cluster.local:%s", s.name, ordinal, s.headlessService, s.namespace, s.port)
+}
+
+// buildkitdTarget is a buildkitd StatefulSet the proxy routes connections to. Each target has its own
+// cache, backend pool, cold-start group and lifecycle, so connection counts, scaling and idle timers
+// are kept per target.
+type buildkitdTarget struct {
+	targetSpec
+	// cache serves the StatefulSet and its pods from a shared informer cache.
+	cache *statefulSetCache
+	// backends tracks the ready pods and balances connections across them.
+	backends *backendPool
+	// coldStarts lets all connections arriving at zero ready replicas share one scale-up.
+	coldStarts *scaleUpGroup
+	// scaler is the lifecycle state machine that owns every scale transition and tracks active connections.
+	scaler *lifecycle
+	// store persists the lifecycle's activity on the StatefulSet.
+	store activityStore
+}
+
+// newBuildkitdTarget creates the runtime state for spec using the global scaling policy and strategy.
+// Call startCache before routing connections to it.
+func newBuildkitdTarget(clientset kubernetes.Interface, spec targetSpec) *buildkitdTarget {
+	t := &buildkitdTarget{targetSpec: spec}
+	t.cache = newStatefulSetCache(clientset, spec.namespace, spec.name)
+	t.backends = newBackendPool(lbStrategy, spec.backendAddress)
+	t.coldStarts = newScaleUpGroup(maxPendingConnections)
+	kube := kubeScaleTarget{clientset: clientset, cache: t.cache, namespace: spec.namespace, name: spec.name, timeout: spec.readyWaitTimeout}
+	t.scaler = newLifecycle(kube, t.backends, scalingPolicy, spec.idleTimeout, realClock{})
+	t.scaler.log = logger.With("statefulSet", spec.name, "namespace", spec.namespace)
+	t.scaler.ctx = processCtx
+	t.scaler.store = kube
+	t.scaler.pins = kube
+	t.scaler.onPinChanged = func(pin *pinState) { recordPin(spec.namespace, spec.name, pin) }
+	t.scaler.maxKeepAliveTTL = maxKeepAliveTTL
+	t.scaler.onKeepAlivesChanged = func(leases int) {
+		keepAliveLeasesGauge.WithLabelValues(spec.name, spec.namespace).Set(float64(leases))
+	}
+	t.store = kube
+	return t
+}
+
+// startCache starts the target's StatefulSet cache and waits for it to sync.
+func (t *buildkitdTarget) startCache(ctx context.Context) error {
+	if err := t.cache.start(ctx); err != nil {
+		return fmt.Errorf("StatefulSet cache for %s: %w", t.key(), err)
+	}
+	return nil
+}
+
+// waitLocalReady blocks until this replica's cache sees a ready pod, after another replica scaled the target up.
+func (t *buildkitdTarget) waitLocalReady(ctx context.Context) error {
+	return t.cache.waitReady(ctx, 1, t.readyWaitTimeout)
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// certReloadInterval is how often the TLS certificate files are checked for changes.
+const certReloadInterval = 30 * time.Second
+
+// tlsHandshakeTimeout bounds the TLS handshake with a client.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// tlsMaterial is a certificate with its key and a CA pool, as loaded from a certSource.
+type tlsMaterial struct {
+	// cert is the certificate presented to the peer; nil if none is configured.
+	cert *tls.Certificate
+	// ca verifies the peer's certificate; nil if none is configured.
+	ca *x509.CertPool
+}
+
+// certSource loads TLS material. version identifies the loaded contents and changes whenever they do.
+type certSource interface {
+	fmt.Stringer
+	load(ctx context.Context) (material *tlsMaterial, version string, err error)
+}
+
+// certReloader serves TLS material from a certSource, reloading it whenever the source changes. Mounted
+// Kubernetes Secrets are updated in place, so a renewed certificate is picked up without restarting the
+// autoscaler.
+type certReloader struct {
+	source certSource
+
+	mu       sync.RWMutex
+	material *tlsMaterial
+	version  string
+}
+
+// newCertReloader loads the initial material from source. It fails if it cannot be loaded.
+func newCertReloader(ctx context.Context, source certSource) (*certReloader, error) {
+	r := &certReloader{source: source}
+	if _, err := r.reload(ctx); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload loads the material from the source and swaps it in if it changed. On error the previously
+// loaded material stays in use.
+func (r *certReloader) reload(ctx context.Context) (changed bool, err error) {
+	material, version, err := r.source.load(ctx)
+	if err != nil {
+		return false, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if version == r.version {
+		return false, nil
+	}
+	r.material, r.version = material, version
+	return true, nil
+}
+
+// current returns the most recently loaded material.
+func (r *certReloader) current() *tlsMaterial {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.material
+}
+
+// fileCertSource loads a certificate, key and CA bundle from files. Either the certificate and key or the
+// CA may be left empty.
+type fileCertSource struct {
+	certFile, keyFile, caFile string
+}
+
+func (s fileCertSource) String() string {
+	return "files " + strings.Join(slices.DeleteFunc([]string{s.certFile, s.keyFile, s.caFile}, func(f string) bool { return f == "" }), ", ")
+}
+
+// load reads the files. The version is made of their modification times.
+func (s fileCertSource) load(context.Context) (*tlsMaterial, string, error) {
+	var version strings.Builder
+	for _, f := range []string{s.certFile, s.keyFile, s.caFile} {
+		if f == "" {
+			continue
+		}
+		info, err := os.Stat(f)
+		if err != nil {
+			return nil, "", fmt.Errorf("error reading TLS file: %w", err)
+		}
+		fmt.Fprintf(&version, "%s@%d;", f, info.ModTime().UnixNano())
+	}
+
+	material := &tlsMaterial{}
+	if s.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+		if err != nil {
+			return nil, "", fmt.Errorf("error loading TLS certificate %s and key %s: %w", s.certFile, s.keyFile, err)
+		}
+		material.cert = &cert
+	}
+	if s.caFile != "" {
+		pem, err := os.ReadFile(s.caFile)
+		if err != nil {
+			return nil, "", fmt.Errorf("error reading CA file %s: %w", s.caFile, err)
+		}
+		material.ca, err = certPoolOf(pem, s.caFile)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	return material, version.String(), nil
+}
+
+// Keys of a Secret holding TLS material, as used by kubernetes.io/tls Secrets and cert-manager.
+const (
+	secretCertKey = corev1.TLSCertKey
+	secretKeyKey  = corev1.TLSPrivateKeyKey
+	secretCAKey   = "ca.crt"
+)
+
+// secretCertSource loads a certificate, key and CA from a Secret through the Kubernetes API. Either the
+// certificate and key or the CA may be missing from the Secret.
+type secretCertSource struct {
+	clientset kubernetes.Interface
+	namespace string
+	name      string
+}
+
+func (s secretCertSource) String() string {
+	return "secret " + s.namespace + "/" + s.name
+}
+
+// load reads the Secret. The version is its resourceVersion.
+func (s secretCertSource) load(ctx context.Context) (*tlsMaterial, string, error) {
+	secret, err := s.clientset.CoreV1().Secrets(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+	if err != nil {
+		return nil, "", fmt.Errorf("error getting Secret %s in namespace %s: %w", s.name, s.namespace, err)
+	}
+
+	material := &tlsMaterial{}
+	if certPEM, ok := secret.Data[secretCertKey]; ok {
+		cert, err := tls.X509KeyPair(certPEM, secret.Data[secretKeyKey])
+		if err != nil {
+			return nil, "", fmt.Errorf("error loading TLS certificate from %s: %w", s, err)
+		}
+		material.cert = &cert
+	}
+	if caPEM, ok := secret.Data[secretCAKey]; ok {
+		material.ca, err = certPoolOf(caPEM, s.String())
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	if material.cert == nil && material.ca == nil {
+		return nil, "", fmt.Errorf("%s has neither %s nor %s", s, secretCertKey, secretCAKey)
+	}
+	return material, secret.ResourceVersion, nil
+}
+
+// certPoolOf parses a PEM bundle of CA certificates read from source.
+func certPoolOf(pem []byte, source string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA %s", source)
+	}
+	return pool, nil
+}
+
+// watch checks the source every interval and reloads it when it changed, until ctx is cancelled.
+func (r *certReloader) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		changed, err := r.reload(ctx)
+		if err != nil {
+			logger.Error("Failed to reload TLS certificate. Keeping the previous one.", "source", r.source, "error", err)
+			continue
+		}
+		if changed {
+			logger.Info("Reloaded TLS certificate", "source", r.source)
+		}
+	}
+}
+
+// serverConfig returns the TLS configuration for the proxy listener. Every handshake uses the most
+// recently loaded certificate and client CA; with a client CA, clients must present a certificate it signed.
+func (r *certReloader) serverConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			m := r.current()
+			cfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*m.cert},
+			}
+			if m.ca != nil {
+				cfg.ClientCAs = m.ca
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return cfg, nil
+		},
+	}
+}
+
+// clientConfig returns the TLS configuration for dialling a server named serverName, presenting the
+// current certificate, if any, and verifying the server against the current CA (or the system roots).
+func (r *certReloader) clientConfig(serverName string) *tls.Config {
+	m := r.current()
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: serverName, RootCAs: m.ca}
+	if m.cert != nil {
+		cfg.Certificates = []tls.Certificate{*m.cert}
+	}
+	return cfg
+}
+
+// handshakeClient completes the TLS handshake on a client connection accepted by a TLS listener, so
+// failed handshakes are rejected before they count as connections. It returns the verified client
+// certificate's subject, or "" without client authentication. Plain connections are left untouched. The
+// handshake is abandoned when ctx is cancelled.
+func handshakeClient(ctx context.Context, conn net.Conn) (string, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, tlsHandshakeTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return "", fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return "", nil
+	}
+	return state.PeerCertificates[0].Subject.String(), nil
+}
+
+// backendDialTimeout bounds connecting to a buildkitd pod, including the TLS handshake.
+const backendDialTimeout = 10 * time.Second
+
+// dialBackend connects to the buildkitd pod at addr and writes preamble (e.g. a PROXY protocol header), if
+// any, ahead of everything else. With backend TLS configured it then originates TLS, verifying the pod
+// against serverName, or against the pod's FQDN from addr when serverName is empty. The dial is abandoned
+// when ctx is cancelled.
+func dialBackend(ctx context.Context, addr string, certs *certReloader, serverName string, preamble []byte) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, backendDialTimeout)
+	defer cancel()
+	conn, err := (&net.Dialer{KeepAlive: keepAlivePeriod(), KeepAliveConfig: tcpKeepAlive}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if len(preamble) > 0 {
+		conn.SetWriteDeadline(time.Now().Add(backendDialTimeout))
+		if _, err := conn.Write(preamble); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetWriteDeadline(time.Time{})
+	}
+	if certs == nil {
+		return conn, nil
+	}
+
+	if serverName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		serverName = host
+	}
+	tlsConn := tls.Client(conn, certs.clientConfig(serverName))
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// testCA is a throwaway certificate authority for TLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+// newTestCA creates a self-signed CA.
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue creates a certificate for commonName, valid for the given DNS names, and returns it as PEM.
+func (ca *testCA) issue(t *testing.T, serial int64, commonName string, dnsNames ...string) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeTestFile writes data to name in dir and sets its modification time, returning the path.
+func writeTestFile(t *testing.T, dir, name string, data []byte, modTime time.Time) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// tlsHandshake connects a client with the given configuration to a server using the reloader and
+// returns the server certificate's serial number and the client identity seen by the server.
+func tlsHandshake(t *testing.T, r *certReloader, client *tls.Config) (serial int64, identity string, err error) {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	type result struct {
+		identity string
+		err      error
+	}
+	done := make(chan result, 1)
+	go func() {
+		id, err := handshakeClient(context.Background(), tls.Server(serverConn, r.serverConfig()))
+		if err != nil {
+			serverConn.Close()
+		}
+		done <- result{id, err}
+	}()
+
+	tlsClient := tls.Client(clientConn, client)
+	clientErr := tlsClient.Handshake()
+	if clientErr == nil {
+		// TLS 1.3 clients finish before the server has verified their certificate; wait for its verdict.
+		tlsClient.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		tlsClient.Read(make([]byte, 1))
+	}
+	res := <-done
+	if res.err != nil {
+		return 0, "", res.err
+	}
+	if clientErr != nil {
+		return 0, "", clientErr
+	}
+	return tlsClient.ConnectionState().PeerCertificates[0].SerialNumber.Int64(), res.identity, nil
+}
+
+// TestCertReloader_Reload verifies that a changed certificate is served without restarting.
+func TestCertReloader_Reload(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	modTime := time.Now().Add(-time.Minute)
+	certPEM, keyPEM := ca.issue(t, 10, "proxy", "proxy.example.com")
+	certFile := writeTestFile(t, dir, "tls.crt", certPEM, modTime)
+	keyFile := writeTestFile(t, dir, "tls.key", keyPEM, modTime)
+
+	r, err := newCertReloader(context.Background(), fileCertSource{certFile: certFile, keyFile: keyFile})
+	if err != nil {
+		t.Fatalf("newCertReloader(context.Background(), ) error = %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	client := &tls.Config{RootCAs: roots, ServerName: "proxy.example.com"}
+
+	if serial, _, err := tlsHandshake(t, r, client); err != nil || serial != 10 {
+		t.Fatalf("handshake = serial %d, %v, want serial 10", serial, err)
+	}
+	if changed, err := r.reload(context.Background()); changed || err != nil {
+		t.Errorf("reload() before the files changed = %v, %v, want false, nil", changed, err)
+	}
+
+	certPEM, keyPEM = ca.issue(t, 11, "proxy", "proxy.example.com")
+	writeTestFile(t, dir, "tls.crt", certPEM, modTime.Add(time.Second))
+	writeTestFile(t, dir, "tls.key", keyPEM, modTime.Add(time.Second))
+	if changed, err := r.reload(context.Background()); !changed || err != nil {
+		t.Fatalf("reload() after the files changed = %v, %v, want true, nil", changed, err)
+	}
+	if serial, _, err := tlsHandshake(t, r, client); err != nil || serial != 11 {
+		t.Errorf("handshake after reload = serial %d, %v, want serial 11", serial, err)
+	}
+
+	writeTestFile(t, dir, "tls.key", []byte("not a key"), modTime.Add(2*time.Second))
+	if _, err := r.reload(context.Background()); err == nil {
+		t.Error("reload() with an invalid key succeeded, want an error")
+	}
+	if serial, _, err := tlsHandshake(t, r, client); err != nil || serial != 11 {
+		t.Errorf("handshake after a failed reload = serial %d, %v, want the previous serial 11", serial, err)
+	}
+}
+
+// TestCertReloader_ClientAuth verifies that a client CA makes client certificates mandatory.
+func TestCertReloader_ClientAuth(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	modTime := time.Now()
+	certPEM, keyPEM := ca.issue(t, 10, "proxy", "proxy.example.com")
+	r, err := newCertReloader(context.Background(), fileCertSource{
+		certFile: writeTestFile(t, dir, "tls.crt", certPEM, modTime),
+		keyFile:  writeTestFile(t, dir, "tls.key", keyPEM, modTime),
+		caFile:   writeTestFile(t, dir, "ca.crt", ca.pem, modTime),
+	})
+	if err != nil {
+		t.Fatalf("newCertReloader(context.Background(), ) error = %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	if _, _, err := tlsHandshake(t, r, &tls.Config{RootCAs: roots, ServerName: "proxy.example.com"}); err == nil {
+		t.Error("handshake without a client certificate succeeded, want an error")
+	}
+
+	clientCertPEM, clientKeyPEM := ca.issue(t, 20, "developer")
+	clientCert, err := tls.X509KeyPair(clientCertPEM, clientKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, identity, err := tlsHandshake(t, r, &tls.Config{RootCAs: roots, ServerName: "proxy.example.com", Certificates: []tls.Certificate{clientCert}})
+	if err != nil {
+		t.Fatalf("handshake with a client certificate error = %v", err)
+	}
+	if identity != "CN=developer" {
+		t.Errorf("client identity = %q, want %q", identity, "CN=developer")
+	}
+}
+
+// TestSecretCertSource verifies loading TLS material from a Secret and reloading it when the Secret changes.
+func TestSecretCertSource(t *testing.T) {
+	ca := newTestCA(t)
+	certPEM, keyPEM := ca.issue(t, 30, "buildkitd-proxy")
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "buildkitd-client", Namespace: testNamespace, ResourceVersion: "1"},
+		Data:       map[string][]byte{secretCertKey: certPEM, secretKeyKey: keyPEM, secretCAKey: ca.pem},
+	}
+	clientset := fake.NewSimpleClientset(secret)
+	r, err := newCertReloader(context.Background(), secretCertSource{clientset: clientset, namespace: testNamespace, name: "buildkitd-client"})
+	if err != nil {
+		t.Fatalf("newCertReloader(context.Background(), ) error = %v", err)
+	}
+	if m := r.current(); m.cert == nil || m.ca == nil {
+		t.Fatalf("loaded material = %+v, want a certificate and a CA", m)
+	}
+
+	secret = secret.DeepCopy()
+	secret.ResourceVersion = "2"
+	delete(secret.Data, secretCAKey)
+	if _, err := clientset.CoreV1().Secrets(testNamespace).Update(context.Background(), secret, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := r.reload(context.Background()); !changed || err != nil {
+		t.Fatalf("reload() after the Secret changed = %v, %v, want true, nil", changed, err)
+	}
+	if m := r.current(); m.ca != nil {
+		t.Error("reloaded material still has the removed CA")
+	}
+
+	if _, err := newCertReloader(context.Background(), secretCertSource{clientset: clientset, namespace: testNamespace, name: "missing"}); err == nil {
+		t.Error("newCertReloader(context.Background(), ) for a missing Secret succeeded, want an error")
+	}
+}
+
+// TestDialBackend verifies that TLS to buildkitd presents the client certificate and verifies the server
+// name taken from the pod address or the override.
+func TestDialBackend(t *testing.T) {
+	ca := newTestCA(t)
+	serverCertPEM, serverKeyPEM := ca.issue(t, 40, "buildkitd", "localhost", "buildkitd.example.com")
+	serverCert, err := tls.X509KeyPair(serverCertPEM, serverKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCA := x509.NewCertPool()
+	serverCA.AddCert(ca.cert)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    serverCA,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+				conn.Write([]byte("ok"))
+			}()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	dir := t.TempDir()
+	clientCertPEM, clientKeyPEM := ca.issue(t, 41, "buildkitd-proxy")
+	certs, err := newCertReloader(context.Background(), fileCertSource{
+		certFile: writeTestFile(t, dir, "tls.crt", clientCertPEM, time.Now()),
+		keyFile:  writeTestFile(t, dir, "tls.key", clientKeyPEM, time.Now()),
+		caFile:   writeTestFile(t, dir, "ca.crt", ca.pem, time.Now()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		addr       string
+		serverName string
+		wantErr    bool
+	}{
+		{"pod name", net.JoinHostPort("localhost", port), "", false},
+		{"override", listener.Addr().String(), "buildkitd.example.com", false},
+		{"mismatch", listener.Addr().String(), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := dialBackend(context.Background(), tt.addr, certs, tt.serverName, nil)
+			if tt.wantErr {
+				if err == nil {
+					conn.Close()
+					t.Fatal("dialBackend() succeeded, want a verification error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("dialBackend() error = %v", err)
+			}
+			defer conn.Close()
+			buf := make([]byte, 2)
+			if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ok" {
+				t.Errorf("read from backend = %q, %v, want \"ok\"", buf, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracingServiceName is the service.name of the exported traces.
+const tracingServiceName = "buildkitd-proxy"
+
+// tracer creates the spans of the connection lifecycle. It is a no-op until initTracing installs a tracer
+// provider, so spans cost next to nothing with tracing disabled.
+var tracer = otel.Tracer("go-buildkitd-proxy")
+
+// Span attributes that have no semantic convention.
+const (
+	attrListener         = attribute.Key("buildkitd_proxy.listener")
+	attrBytesToBackend   = attribute.Key("buildkitd_proxy.bytes.client_to_backend")
+	attrBytesToClient    = attribute.Key("buildkitd_proxy.bytes.backend_to_client")
+	attrReplicas         = attribute.Key("buildkitd_proxy.replicas")
+	attrReadyReplicas    = attribute.Key("buildkitd_proxy.ready_replicas")
+	attrColdStart        = attribute.Key("buildkitd_proxy.cold_start")
+	attrInactivityReaped = attribute.Key("buildkitd_proxy.inactivity_reaped")
+)
+
+// initTracing exports spans over OTLP/HTTP to endpoint, a URL such as "http://otel-collector:4318". The
+// standard OTEL_EXPORTER_OTLP_* variables configure headers, TLS and timeouts. Trace context is propagated
+// to and from the leader when wake requests are forwarded. The returned function flushes and stops the
+// exporter.
+func initTracing(ctx context.Context, endpoint string) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("error creating OTLP trace exporter: %w", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(tracingServiceName)))
+	if err != nil {
+		return nil, fmt.Errorf("error creating trace resource: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown, nil
+}
+
+// targetAttributes identifies the StatefulSet a span is about.
+func targetAttributes(namespace, statefulSetName string) trace.SpanStartEventOption {
+	return trace.WithAttributes(semconv.K8SNamespaceName(namespace), semconv.K8SStatefulSetName(statefulSetName))
+}
+
+// endSpan records err, if any, on span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// withTraceOf returns ctx carrying the span of from, so work bound to ctx's lifetime shows up in from's trace.
+func withTraceOf(ctx, from context.Context) context.Context {
+	return trace.ContextWithSpanContext(ctx, trace.SpanContextFromContext(from))
+}
+
+// clientAttributes identifies the client of a connection.
+func clientAttributes(addr net.Addr) []attribute.KeyValue {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return []attribute.KeyValue{semconv.ClientAddress(tcpAddr.IP.String()), semconv.ClientPort(tcpAddr.Port)}
+	}
+	return []attribute.KeyValue{semconv.ClientAddress(addr.String())}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var (
+	spanRecorderOnce sync.Once
+	spanRecorder     *tracetest.SpanRecorder
+)
+
+// recordSpans installs a tracer provider that records ended spans. The global provider can only be set once,
+// so tests share the recorder and tell their spans apart by trace ID.
+func recordSpans() *tracetest.SpanRecorder {
+	spanRecorderOnce.Do(func() {
+		spanRecorder = tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder)))
+	})
+	return spanRecorder
+}
+
+// spanNamesInTrace returns the names of the ended spans of the trace.
+func spanNamesInTrace(recorder *tracetest.SpanRecorder, traceID trace.TraceID) map[string]bool {
+	names := make(map[string]bool)
+	for _, s := range recorder.Ended() {
+		if s.SpanContext().TraceID() == traceID {
+			names[s.Name()] = true
+		}
+	}
+	return names
+}
+
+// TestTracing_ScaleUpInConnectionTrace verifies that a cold start's Kubernetes calls are recorded in the trace
+// of the connection that started it.
+func TestTracing_ScaleUpInConnectionTrace(t *testing.T) {
+	recorder := recordSpans()
+	clientset := fake.NewSimpleClientset(newTestStatefulSet(testStsName, testNamespace, 0))
+	c := startTestCache(t, clientset)
+	target := kubeScaleTarget{clientset: clientset, cache: c, namespace: testNamespace, name: testStsName, timeout: 50 * time.Millisecond}
+
+	ctx, span := tracer.Start(context.Background(), "proxy.connection")
+	g := newScaleUpGroup(0)
+	err := g.do(ctx, time.Second, func(ctx context.Context) error {
+		if err := target.Scale(ctx, 1); err != nil {
+			return err
+		}
+		target.WaitReady(ctx, 1) // Times out, as nothing makes the fake StatefulSet ready.
+		return nil
+	})
+	span.End()
+	if err != nil {
+		t.Fatalf("do() error = %v", err)
+	}
+
+	names := spanNamesInTrace(recorder, span.SpanContext().TraceID())
+	for _, name := range []string{"proxy.connection", "ScaleStatefulSet", "WaitForStatefulSetReady"} {
+		if !names[name] {
+			t.Errorf("span %q missing from the connection's trace, got %v", name, names)
+		}
+	}
+}